@@ -0,0 +1,362 @@
+package gq
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/mattbonnell/gq/internal"
+)
+
+// QueueStats summarises the state of a queue. Its JSON encoding is stable, so that it can be exported to dashboards
+type QueueStats struct {
+	// Queue is the name of the queue
+	Queue string `json:"queue"`
+	// Ready is the number of messages which are ready to be pulled
+	Ready int64 `json:"ready"`
+	// Delayed is the number of messages which won't be ready until later, such as those waiting to be retried
+	Delayed int64 `json:"delayed"`
+	// InFlight is the number of messages leased by Consumer.Receive which have not yet been acked or nacked
+	InFlight int64 `json:"in_flight"`
+	// Retrying is the number of messages, ready or delayed, which have failed processing at least once
+	Retrying int64 `json:"retrying"`
+	// MaxRetries is the highest number of times any message on the queue has been retried
+	MaxRetries int64 `json:"max_retries"`
+	// Dead is the number of messages in the dead-letter table
+	Dead int64 `json:"dead"`
+	// OldestCreatedAt is the time the oldest message on the queue was pushed, or the zero time if the queue is empty
+	OldestCreatedAt time.Time `json:"oldest_created_at"`
+	// OldestAge is the age of the oldest message on the queue when the stats were read
+	OldestAge time.Duration `json:"oldest_age_ns"`
+}
+
+// MessageInfo describes a message on a queue, or in the dead-letter table
+type MessageInfo struct {
+	ID        int64             `json:"id"`
+	Queue     string            `json:"queue"`
+	Payload   []byte            `json:"payload"`
+	Headers   map[string]string `json:"headers,omitempty"`
+	Retries   int               `json:"retries"`
+	CreatedAt time.Time         `json:"created_at"`
+	// ReadyAt is the time the message is ready to be pulled. It is zero for dead messages
+	ReadyAt time.Time `json:"ready_at,omitempty"`
+	// Dead reports whether the message is in the dead-letter table
+	Dead bool `json:"dead"`
+	// FailedAt is the time a dead message last failed processing
+	FailedAt time.Time `json:"failed_at,omitempty"`
+	// LastError is the error a dead message last failed processing with
+	LastError string `json:"last_error,omitempty"`
+}
+
+// RequeueFilter selects the dead messages which Requeue moves back onto their queues. Empty fields match every message
+type RequeueFilter struct {
+	// Queue restricts requeueing to the named queue
+	Queue string
+	// IDs restricts requeueing to the messages with the given IDs
+	IDs []int64
+	// FailedAfter restricts requeueing to messages which failed after the given time
+	FailedAfter time.Time
+	// FailedBefore restricts requeueing to messages which failed before the given time
+	FailedBefore time.Time
+}
+
+func (f RequeueFilter) where() (string, []interface{}) {
+	conditions := []string{"1 = 1"}
+	args := []interface{}{}
+	if f.Queue != "" {
+		conditions = append(conditions, "queue = ?")
+		args = append(args, f.Queue)
+	}
+	if len(f.IDs) > 0 {
+		conditions = append(conditions, "id IN (?)")
+		args = append(args, f.IDs)
+	}
+	if !f.FailedAfter.IsZero() {
+		conditions = append(conditions, "failed_at > ?")
+		args = append(args, f.FailedAfter.UTC())
+	}
+	if !f.FailedBefore.IsZero() {
+		conditions = append(conditions, "failed_at < ?")
+		args = append(args, f.FailedBefore.UTC())
+	}
+	return strings.Join(conditions, " AND "), args
+}
+
+// Stats returns statistics for every queue with messages on it or in the dead-letter table, ordered by queue name
+func (c *Client) Stats(ctx context.Context) ([]QueueStats, error) {
+	now := c.now()
+	query := c.db.Rebind(fmt.Sprintf(`SELECT queue,
+	SUM(CASE WHEN ready_at <= ? THEN 1 ELSE 0 END),
+	SUM(CASE WHEN ready_at > ? AND lease_token IS NULL THEN 1 ELSE 0 END),
+	SUM(CASE WHEN ready_at > ? AND lease_token IS NOT NULL THEN 1 ELSE 0 END),
+	SUM(CASE WHEN retries > 0 THEN 1 ELSE 0 END),
+	MAX(retries),
+	MIN(created_at)
+FROM %s GROUP BY queue`, c.tables.Message))
+	rows, err := c.db.QueryxContext(ctx, query, now, now, now)
+	if err != nil {
+		return nil, fmt.Errorf("error reading queue stats: %s", err)
+	}
+	defer rows.Close()
+	stats := make(map[string]*QueueStats)
+	for rows.Next() {
+		s := QueueStats{}
+		var oldest internal.Time
+		if err := rows.Scan(&s.Queue, &s.Ready, &s.Delayed, &s.InFlight, &s.Retrying, &s.MaxRetries, &oldest); err != nil {
+			return nil, fmt.Errorf("error scanning queue stats: %s", err)
+		}
+		s.OldestCreatedAt = oldest.Time
+		if !oldest.IsZero() {
+			s.OldestAge = now.Sub(oldest.Time)
+		}
+		stats[s.Queue] = &s
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading queue stats: %s", err)
+	}
+	rows.Close()
+
+	rows, err = c.db.QueryxContext(ctx, fmt.Sprintf("SELECT queue, COUNT(*) FROM %s GROUP BY queue", c.tables.DeadMessage))
+	if err != nil {
+		return nil, fmt.Errorf("error reading dead message stats: %s", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var queue string
+		var dead int64
+		if err := rows.Scan(&queue, &dead); err != nil {
+			return nil, fmt.Errorf("error scanning dead message stats: %s", err)
+		}
+		if _, ok := stats[queue]; !ok {
+			stats[queue] = &QueueStats{Queue: queue}
+		}
+		stats[queue].Dead = dead
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading dead message stats: %s", err)
+	}
+
+	result := make([]QueueStats, 0, len(stats))
+	for _, s := range stats {
+		result = append(result, *s)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Queue < result[j].Queue })
+	return result, nil
+}
+
+const messageInfoColumns = "id, queue, payload, headers, retries, created_at"
+
+type messageInfoRow struct {
+	ID        int64            `db:"id"`
+	Queue     string           `db:"queue"`
+	Payload   []byte           `db:"payload"`
+	Headers   internal.Headers `db:"headers"`
+	Retries   int              `db:"retries"`
+	CreatedAt internal.Time    `db:"created_at"`
+	ReadyAt   internal.Time    `db:"ready_at"`
+	FailedAt  internal.Time    `db:"failed_at"`
+	LastError sql.NullString   `db:"last_error"`
+}
+
+func (r messageInfoRow) info(dead bool) MessageInfo {
+	return MessageInfo{
+		ID:        r.ID,
+		Queue:     r.Queue,
+		Payload:   r.Payload,
+		Headers:   r.Headers,
+		Retries:   r.Retries,
+		CreatedAt: r.CreatedAt.Time,
+		ReadyAt:   r.ReadyAt.Time,
+		Dead:      dead,
+		FailedAt:  r.FailedAt.Time,
+		LastError: r.LastError.String,
+	}
+}
+
+// Peek returns up to n of the messages on queue, in the order they will become ready, without pulling them
+func (c *Client) Peek(ctx context.Context, queue string, n int) ([]MessageInfo, error) {
+	query := c.db.Rebind(fmt.Sprintf("SELECT %s, ready_at FROM %s WHERE queue = ? ORDER BY ready_at ASC LIMIT ?", messageInfoColumns, c.tables.Message))
+	rows := []messageInfoRow{}
+	if err := c.db.SelectContext(ctx, &rows, query, queue, n); err != nil {
+		return nil, fmt.Errorf("error peeking messages: %s", err)
+	}
+	messages := make([]MessageInfo, len(rows))
+	for i, r := range rows {
+		messages[i] = r.info(false)
+	}
+	return messages, nil
+}
+
+// PeekDead returns up to n of the messages from queue in the dead-letter table, most recently failed first
+func (c *Client) PeekDead(ctx context.Context, queue string, n int) ([]MessageInfo, error) {
+	query := c.db.Rebind(fmt.Sprintf("SELECT %s, failed_at, last_error FROM %s WHERE queue = ? ORDER BY failed_at DESC LIMIT ?", messageInfoColumns, c.tables.DeadMessage))
+	rows := []messageInfoRow{}
+	if err := c.db.SelectContext(ctx, &rows, query, queue, n); err != nil {
+		return nil, fmt.Errorf("error peeking dead messages: %s", err)
+	}
+	messages := make([]MessageInfo, len(rows))
+	for i, r := range rows {
+		messages[i] = r.info(true)
+	}
+	return messages, nil
+}
+
+// Browse returns up to n of the messages on queue with IDs greater than afterID, in ID order, without pulling them.
+// Passing the ID of the last message returned as afterID pages through the queue, and picks up messages as they are pushed
+func (c *Client) Browse(ctx context.Context, queue string, afterID int64, n int) ([]MessageInfo, error) {
+	query := c.db.Rebind(fmt.Sprintf("SELECT %s, ready_at FROM %s WHERE queue = ? AND id > ? ORDER BY id ASC LIMIT ?", messageInfoColumns, c.tables.Message))
+	rows := []messageInfoRow{}
+	if err := c.db.SelectContext(ctx, &rows, query, queue, afterID, n); err != nil {
+		return nil, fmt.Errorf("error browsing messages: %s", err)
+	}
+	messages := make([]MessageInfo, len(rows))
+	for i, r := range rows {
+		messages[i] = r.info(false)
+	}
+	return messages, nil
+}
+
+// BrowseDead is like Browse, but returns messages from queue in the dead-letter table
+func (c *Client) BrowseDead(ctx context.Context, queue string, afterID int64, n int) ([]MessageInfo, error) {
+	query := c.db.Rebind(fmt.Sprintf("SELECT %s, failed_at, last_error FROM %s WHERE queue = ? AND id > ? ORDER BY id ASC LIMIT ?", messageInfoColumns, c.tables.DeadMessage))
+	rows := []messageInfoRow{}
+	if err := c.db.SelectContext(ctx, &rows, query, queue, afterID, n); err != nil {
+		return nil, fmt.Errorf("error browsing dead messages: %s", err)
+	}
+	messages := make([]MessageInfo, len(rows))
+	for i, r := range rows {
+		messages[i] = r.info(true)
+	}
+	return messages, nil
+}
+
+// Get returns the message with the given ID, whether it is on a queue or in the dead-letter table.
+// It returns ErrNotFound if there is no such message, which is the case once a message has been processed successfully
+func (c *Client) Get(ctx context.Context, id int64) (*MessageInfo, error) {
+	r := messageInfoRow{}
+	query := c.db.Rebind(fmt.Sprintf("SELECT %s, ready_at FROM %s WHERE id = ?", messageInfoColumns, c.tables.Message))
+	err := c.db.GetContext(ctx, &r, query, id)
+	if err == nil {
+		info := r.info(false)
+		return &info, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("error getting message: %s", err)
+	}
+	query = c.db.Rebind(fmt.Sprintf("SELECT %s, failed_at, last_error FROM %s WHERE id = ?", messageInfoColumns, c.tables.DeadMessage))
+	err = c.db.GetContext(ctx, &r, query, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error getting dead message: %s", err)
+	}
+	info := r.info(true)
+	return &info, nil
+}
+
+// Delete deletes the message with the given ID, whether it is on a queue or in the dead-letter table.
+// It returns ErrNotFound if there is no such message. A message which is being processed is deleted once processing completes,
+// if processing fails
+func (c *Client) Delete(ctx context.Context, id int64) error {
+	var deleted int64
+	for _, table := range []string{c.tables.Message, c.tables.DeadMessage} {
+		res, err := c.db.ExecContext(ctx, c.db.Rebind(fmt.Sprintf("DELETE FROM %s WHERE id = ?", table)), id)
+		if err != nil {
+			return fmt.Errorf("error deleting message: %s", err)
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("error deleting message: %s", err)
+		}
+		deleted += n
+	}
+	if deleted == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// DeleteDead deletes the message with the given ID from queue's messages in the dead-letter table.
+// It returns ErrNotFound if there is no such dead message, leaving any message with that ID on a queue untouched
+func (c *Client) DeleteDead(ctx context.Context, queue string, id int64) error {
+	n, err := c.exec(ctx, fmt.Sprintf("DELETE FROM %s WHERE id = ? AND queue = ?", c.tables.DeadMessage), id, queue)
+	if err != nil {
+		return fmt.Errorf("error deleting dead message: %s", err)
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Purge deletes every message on queue, returning the number deleted. Messages in the dead-letter table are kept
+func (c *Client) Purge(ctx context.Context, queue string) (int64, error) {
+	return c.exec(ctx, fmt.Sprintf("DELETE FROM %s WHERE queue = ?", c.tables.Message), queue)
+}
+
+// PurgeDead deletes every message from queue in the dead-letter table, returning the number deleted
+func (c *Client) PurgeDead(ctx context.Context, queue string) (int64, error) {
+	return c.exec(ctx, fmt.Sprintf("DELETE FROM %s WHERE queue = ?", c.tables.DeadMessage), queue)
+}
+
+// RescheduleAll sets the time at which every message on queue is ready to be pulled, returning the number of messages rescheduled
+func (c *Client) RescheduleAll(ctx context.Context, queue string, readyAt time.Time) (int64, error) {
+	return c.exec(ctx, fmt.Sprintf("UPDATE %s SET ready_at = ? WHERE queue = ?", c.tables.Message), readyAt.UTC(), queue)
+}
+
+// Requeue moves the dead messages selected by filter back onto their queues, ready to be pulled immediately with their retries reset.
+// It returns the number of messages requeued
+func (c *Client) Requeue(ctx context.Context, filter RequeueFilter) (int64, error) {
+	tx, err := c.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("error beginning requeue transaction: %s", err)
+	}
+	defer tx.Rollback()
+	where, args := filter.where()
+	query, args, err := sqlx.In(fmt.Sprintf("SELECT id FROM %s WHERE %s FOR UPDATE", c.tables.DeadMessage, where), args...)
+	if err != nil {
+		return 0, fmt.Errorf("error formulating requeue query: %s", err)
+	}
+	ids := []int64{}
+	if err := tx.SelectContext(ctx, &ids, tx.Rebind(query), args...); err != nil {
+		return 0, fmt.Errorf("error selecting dead messages: %s", err)
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	query, args, err = sqlx.In(fmt.Sprintf(
+		"INSERT INTO %s (id, queue, payload, headers, created_at, ready_at, retries) SELECT id, queue, payload, headers, created_at, ?, 0 FROM %s WHERE id IN (?)",
+		c.tables.Message, c.tables.DeadMessage,
+	), c.now(), ids)
+	if err != nil {
+		return 0, fmt.Errorf("error formulating requeue query: %s", err)
+	}
+	if _, err := tx.ExecContext(ctx, tx.Rebind(query), args...); err != nil {
+		return 0, fmt.Errorf("error requeueing dead messages: %s", err)
+	}
+	query, args, err = sqlx.In(fmt.Sprintf("DELETE FROM %s WHERE id IN (?)", c.tables.DeadMessage), ids)
+	if err != nil {
+		return 0, fmt.Errorf("error formulating requeue query: %s", err)
+	}
+	if _, err := tx.ExecContext(ctx, tx.Rebind(query), args...); err != nil {
+		return 0, fmt.Errorf("error deleting requeued dead messages: %s", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("error committing requeue transaction: %s", err)
+	}
+	return int64(len(ids)), nil
+}
+
+func (c *Client) exec(ctx context.Context, query string, args ...interface{}) (int64, error) {
+	res, err := c.db.ExecContext(ctx, c.db.Rebind(query), args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
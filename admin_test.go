@@ -0,0 +1,199 @@
+package gq
+
+import (
+	"context"
+	"database/sql"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/require"
+)
+
+func newAdminTestClient(t *testing.T, driverName ...string) (*Client, sqlmock.Sqlmock, time.Time) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err, "failed to open stub database connection")
+	t.Cleanup(func() { db.Close() })
+	now := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+	c := newTestClient(db)
+	if len(driverName) > 0 {
+		c.db = sqlx.NewDb(db, driverName[0])
+	}
+	c.opts.Clock = func() time.Time { return now }
+	return c, mock, now
+}
+
+func TestStats(t *testing.T) {
+	c, mock, now := newAdminTestClient(t)
+
+	mock.ExpectQuery(regexp.QuoteMeta("SUM(CASE WHEN ready_at <= ? THEN 1 ELSE 0 END)")).
+		WithArgs(now, now, now).
+		WillReturnRows(sqlmock.NewRows([]string{"queue", "ready", "delayed", "in_flight", "retrying", "max_retries", "oldest"}).
+			AddRow("emails", []byte("3"), []byte("1"), []byte("2"), []byte("1"), 2, []byte("2021-03-04 05:05:07")).
+			AddRow("default", 1, 0, 0, 0, 0, now))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT queue, COUNT(*) FROM dead_message GROUP BY queue")).
+		WillReturnRows(sqlmock.NewRows([]string{"queue", "count"}).AddRow("emails", 4).AddRow("reports", 1))
+
+	stats, err := c.Stats(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, []QueueStats{
+		{Queue: "default", Ready: 1, OldestCreatedAt: now},
+		{Queue: "emails", Ready: 3, Delayed: 1, InFlight: 2, Retrying: 1, MaxRetries: 2, Dead: 4, OldestCreatedAt: now.Add(-time.Minute), OldestAge: time.Minute},
+		{Queue: "reports", Dead: 1},
+	}, stats)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestPeek(t *testing.T) {
+	c, mock, now := newAdminTestClient(t)
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT id, queue, payload, headers, retries, created_at, ready_at FROM message WHERE queue = ? ORDER BY ready_at ASC LIMIT ?")).
+		WithArgs("emails", 10).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "queue", "payload", "headers", "retries", "created_at", "ready_at"}).
+			AddRow(1, "emails", []byte("a"), `{"k":"v"}`, 0, now, now).
+			AddRow(2, "emails", []byte("b"), nil, 1, now, now.Add(time.Second)))
+
+	messages, err := c.Peek(context.Background(), "emails", 10)
+	require.NoError(t, err)
+	require.Equal(t, []MessageInfo{
+		{ID: 1, Queue: "emails", Payload: []byte("a"), Headers: map[string]string{"k": "v"}, CreatedAt: now, ReadyAt: now},
+		{ID: 2, Queue: "emails", Payload: []byte("b"), Retries: 1, CreatedAt: now, ReadyAt: now.Add(time.Second)},
+	}, messages)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestBrowse(t *testing.T) {
+	c, mock, now := newAdminTestClient(t, "postgres")
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT id, queue, payload, headers, retries, created_at, ready_at FROM message WHERE queue = $1 AND id > $2 ORDER BY id ASC LIMIT $3")).
+		WithArgs("emails", 4, 2).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "queue", "payload", "headers", "retries", "created_at", "ready_at"}).
+			AddRow(5, "emails", []byte("a"), nil, 0, now, now))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT id, queue, payload, headers, retries, created_at, failed_at, last_error FROM dead_message WHERE queue = $1 AND id > $2 ORDER BY id ASC LIMIT $3")).
+		WithArgs("emails", 0, 2).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "queue", "payload", "headers", "retries", "created_at", "failed_at", "last_error"}))
+
+	messages, err := c.Browse(context.Background(), "emails", 4, 2)
+	require.NoError(t, err)
+	require.Equal(t, []MessageInfo{{ID: 5, Queue: "emails", Payload: []byte("a"), CreatedAt: now, ReadyAt: now}}, messages)
+	messages, err = c.BrowseDead(context.Background(), "emails", 0, 2)
+	require.NoError(t, err)
+	require.Empty(t, messages)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestGet(t *testing.T) {
+	t.Run("message on queue", func(t *testing.T) {
+		c, mock, now := newAdminTestClient(t)
+		mock.ExpectQuery(regexp.QuoteMeta("FROM message WHERE id = ?")).
+			WithArgs(7).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "queue", "payload", "headers", "retries", "created_at", "ready_at"}).
+				AddRow(7, "default", []byte("a"), nil, 0, now, now))
+
+		m, err := c.Get(context.Background(), 7)
+		require.NoError(t, err)
+		require.Equal(t, &MessageInfo{ID: 7, Queue: "default", Payload: []byte("a"), CreatedAt: now, ReadyAt: now}, m)
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+	t.Run("dead message", func(t *testing.T) {
+		c, mock, now := newAdminTestClient(t)
+		mock.ExpectQuery(regexp.QuoteMeta("FROM message WHERE id = ?")).WithArgs(7).WillReturnError(sql.ErrNoRows)
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT id, queue, payload, headers, retries, created_at, failed_at, last_error FROM dead_message WHERE id = ?")).
+			WithArgs(7).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "queue", "payload", "headers", "retries", "created_at", "failed_at", "last_error"}).
+				AddRow(7, "default", []byte("a"), nil, 3, now, now, "boom"))
+
+		m, err := c.Get(context.Background(), 7)
+		require.NoError(t, err)
+		require.Equal(t, &MessageInfo{ID: 7, Queue: "default", Payload: []byte("a"), Retries: 3, CreatedAt: now, Dead: true, FailedAt: now, LastError: "boom"}, m)
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+	t.Run("not found", func(t *testing.T) {
+		c, mock, _ := newAdminTestClient(t)
+		mock.ExpectQuery(regexp.QuoteMeta("FROM message WHERE id = ?")).WithArgs(7).WillReturnError(sql.ErrNoRows)
+		mock.ExpectQuery(regexp.QuoteMeta("FROM dead_message WHERE id = ?")).WithArgs(7).WillReturnError(sql.ErrNoRows)
+
+		_, err := c.Get(context.Background(), 7)
+		require.ErrorIs(t, err, ErrNotFound)
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func TestDelete(t *testing.T) {
+	c, mock, _ := newAdminTestClient(t)
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM message WHERE id = ?")).WithArgs(7).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM dead_message WHERE id = ?")).WithArgs(7).WillReturnResult(sqlmock.NewResult(0, 1))
+	require.NoError(t, c.Delete(context.Background(), 7))
+
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM message WHERE id = ?")).WithArgs(8).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM dead_message WHERE id = ?")).WithArgs(8).WillReturnResult(sqlmock.NewResult(0, 0))
+	require.ErrorIs(t, c.Delete(context.Background(), 8), ErrNotFound)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestDeleteDead(t *testing.T) {
+	c, mock, _ := newAdminTestClient(t)
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM dead_message WHERE id = ? AND queue = ?")).WithArgs(7, "emails").WillReturnResult(sqlmock.NewResult(0, 1))
+	require.NoError(t, c.DeleteDead(context.Background(), "emails", 7))
+
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM dead_message WHERE id = ? AND queue = ?")).WithArgs(8, "emails").WillReturnResult(sqlmock.NewResult(0, 0))
+	require.ErrorIs(t, c.DeleteDead(context.Background(), "emails", 8), ErrNotFound, "a dead message on another queue isn't deleted")
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestPurgeAndReschedule(t *testing.T) {
+	c, mock, now := newAdminTestClient(t)
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM message WHERE queue = ?")).WithArgs("emails").WillReturnResult(sqlmock.NewResult(0, 5))
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM dead_message WHERE queue = ?")).WithArgs("emails").WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE message SET ready_at = ? WHERE queue = ?")).WithArgs(now, "emails").WillReturnResult(sqlmock.NewResult(0, 3))
+
+	n, err := c.Purge(context.Background(), "emails")
+	require.NoError(t, err)
+	require.EqualValues(t, 5, n)
+	n, err = c.PurgeDead(context.Background(), "emails")
+	require.NoError(t, err)
+	require.EqualValues(t, 2, n)
+	n, err = c.RescheduleAll(context.Background(), "emails", now)
+	require.NoError(t, err)
+	require.EqualValues(t, 3, n)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRequeue(t *testing.T) {
+	c, mock, now := newAdminTestClient(t)
+	failedBefore := now.Add(-time.Hour)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT id FROM dead_message WHERE 1 = 1 AND queue = ? AND id IN (?, ?) AND failed_at < ? FOR UPDATE")).
+		WithArgs("emails", 1, 2, failedBefore).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1).AddRow(2))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO message (id, queue, payload, headers, created_at, ready_at, retries) SELECT id, queue, payload, headers, created_at, ?, 0 FROM dead_message WHERE id IN (?, ?)")).
+		WithArgs(now, 1, 2).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM dead_message WHERE id IN (?, ?)")).
+		WithArgs(1, 2).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectCommit()
+
+	n, err := c.Requeue(context.Background(), RequeueFilter{Queue: "emails", IDs: []int64{1, 2}, FailedBefore: failedBefore})
+	require.NoError(t, err)
+	require.EqualValues(t, 2, n)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRequeue_Postgres(t *testing.T) {
+	c, mock, _ := newAdminTestClient(t, "postgres")
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT id FROM dead_message WHERE 1 = 1 AND queue = $1 FOR UPDATE")).
+		WithArgs("emails").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	mock.ExpectRollback()
+
+	n, err := c.Requeue(context.Background(), RequeueFilter{Queue: "emails"})
+	require.NoError(t, err)
+	require.Zero(t, n)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,208 @@
+package gq
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	defaultAutoscaleInterval = 5 * time.Second
+	defaultTargetLatency     = time.Second
+	defaultMaxErrorRate      = 0.5
+)
+
+// Autoscale configures a Consumer to adjust its number of goroutines to the load on its queue
+type Autoscale struct {
+	// MinConcurrency is the fewest goroutines the consumer pulls messages from (default: 1)
+	MinConcurrency int
+	// MaxConcurrency is the most goroutines the consumer pulls messages from. Autoscaling is disabled unless it is positive
+	MaxConcurrency int
+	// Interval is the period at which the number of goroutines is adjusted (default: 5s)
+	Interval time.Duration
+	// TargetLatency is how long a ready message should wait to be processed (default: 1s). The consumer scales up while the
+	// oldest ready message has waited longer, or while the backlog would take longer to process at the handler's latency
+	TargetLatency time.Duration
+	// MaxErrorRate is the fraction of messages failing processing above which the consumer scales down, rather than adding
+	// load to a failing downstream (default: 0.5)
+	MaxErrorRate float64
+}
+
+func (a Autoscale) enabled() bool {
+	return a.MaxConcurrency > 0
+}
+
+func (a Autoscale) withDefaults() Autoscale {
+	if a.MinConcurrency <= 0 {
+		a.MinConcurrency = 1
+	}
+	if a.MinConcurrency > a.MaxConcurrency {
+		a.MinConcurrency = a.MaxConcurrency
+	}
+	if a.Interval <= 0 {
+		a.Interval = defaultAutoscaleInterval
+	}
+	if a.TargetLatency <= 0 {
+		a.TargetLatency = defaultTargetLatency
+	}
+	if a.MaxErrorRate <= 0 {
+		a.MaxErrorRate = defaultMaxErrorRate
+	}
+	return a
+}
+
+// ScaleReason labels a change in the number of a consumer's goroutines in ScalingMetrics
+type ScaleReason string
+
+const (
+	// ScaleStarted means the consumer started its goroutines
+	ScaleStarted ScaleReason = "started"
+	// ScaleStopped means the consumer was closed, stopping its goroutines
+	ScaleStopped ScaleReason = "stopped"
+	// ScaleBacklog means the autoscaler added goroutines to keep up with the queue's backlog
+	ScaleBacklog ScaleReason = "backlog"
+	// ScaleIdle means the autoscaler removed a goroutine because the queue's backlog needed fewer
+	ScaleIdle ScaleReason = "idle"
+	// ScaleErrors means the autoscaler removed a goroutine because too many messages were failing processing
+	ScaleErrors ScaleReason = "errors"
+)
+
+// backlog is the autoscaler's observation of a queue's ready messages
+type backlog struct {
+	ready     int
+	oldestAge time.Duration
+}
+
+// processingStats accumulates the results of processing messages between autoscaling decisions
+type processingStats struct {
+	mu          sync.Mutex
+	processed   int
+	failed      int
+	handlerTime time.Duration
+}
+
+func (s *processingStats) record(failed bool, handlerDuration time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.processed++
+	if failed {
+		s.failed++
+	}
+	s.handlerTime += handlerDuration
+}
+
+// take returns the stats accumulated since it was last called, resetting them
+func (s *processingStats) take() (processed int, failed int, handlerTime time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	processed, failed, handlerTime = s.processed, s.failed, s.handlerTime
+	s.processed, s.failed, s.handlerTime = 0, 0, 0
+	return processed, failed, handlerTime
+}
+
+// decide returns the number of goroutines a consumer running current of them should scale to, and why
+func (a Autoscale) decide(current int, b backlog, processed int, failed int, handlerTime time.Duration) (int, ScaleReason) {
+	desired, reason := a.desired(current, b, processed, failed, handlerTime)
+	if desired > a.MaxConcurrency {
+		desired = a.MaxConcurrency
+	}
+	if desired < a.MinConcurrency {
+		desired = a.MinConcurrency
+	}
+	return desired, reason
+}
+
+func (a Autoscale) desired(current int, b backlog, processed int, failed int, handlerTime time.Duration) (int, ScaleReason) {
+	if processed > 0 && float64(failed)/float64(processed) > a.MaxErrorRate {
+		return current - 1, ScaleErrors
+	}
+	if b.ready == 0 {
+		return current - 1, ScaleIdle
+	}
+	desired := current
+	if processed > 0 {
+		// each goroutine processes one message at a time, so this many process the backlog within the target latency
+		meanLatency := handlerTime / time.Duration(processed)
+		desired = int(math.Ceil(float64(b.ready) * float64(meanLatency) / float64(a.TargetLatency)))
+	}
+	if b.oldestAge > a.TargetLatency && desired <= current {
+		desired = current + 1
+	}
+	// grow quickly to catch up with a backlog, but shrink gradually so that a lull doesn't let one build up again
+	switch {
+	case desired > 2*current:
+		return 2 * current, ScaleBacklog
+	case desired > current:
+		return desired, ScaleBacklog
+	case desired < current:
+		return current - 1, ScaleIdle
+	}
+	return current, ScaleBacklog
+}
+
+// backlog returns the number of messages ready in the consumer's queue, and how long the oldest has been ready
+func (c *Consumer) backlog(ctx context.Context, now time.Time) (backlog, error) {
+	var row struct {
+		Ready  int          `db:"ready"`
+		Oldest sql.NullTime `db:"oldest"`
+	}
+	query := c.db.Rebind(fmt.Sprintf("SELECT COUNT(*) AS ready, MIN(ready_at) AS oldest FROM %s WHERE queue = ? AND ready_at <= ?", c.tables.Message))
+	if err := c.db.GetContext(ctx, &row, query, c.opts.Queue, now); err != nil {
+		return backlog{}, fmt.Errorf("error reading queue backlog: %s", err)
+	}
+	b := backlog{ready: row.Ready}
+	if row.Oldest.Valid {
+		b.oldestAge = now.Sub(row.Oldest.Time)
+	}
+	return b, nil
+}
+
+// autoscale adjusts the number of the consumer's goroutines every autoscaling interval until it is closed
+func (c *Consumer) autoscale(ctx context.Context) {
+	defer c.wg.Done()
+	ticker := time.NewTicker(c.opts.Autoscale.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.stop:
+			return
+		case <-ticker.C:
+			c.scale(ctx, c.now())
+		}
+	}
+}
+
+// scale observes the queue's backlog and the consumer's processing since it last scaled, and adds or removes goroutines
+func (c *Consumer) scale(ctx context.Context, now time.Time) {
+	b, err := c.backlog(ctx, now)
+	if err != nil {
+		c.log.Error("error autoscaling consumer", "queue", c.opts.Queue, "error", err)
+		return
+	}
+	processed, failed, handlerTime := c.stats.take()
+	current := len(c.workers)
+	desired, reason := c.opts.Autoscale.decide(current, b, processed, failed, handlerTime)
+	if desired == current {
+		return
+	}
+	c.log.Info("scaling consumer", "queue", c.opts.Queue, "from", current, "to", desired, "reason", reason)
+	for len(c.workers) < desired {
+		c.addWorker(ctx)
+	}
+	for len(c.workers) > desired {
+		c.removeWorker()
+	}
+	c.scaled(desired-current, reason)
+}
+
+// scaled reports a change in the number of the consumer's goroutines, if the client's Metrics implement ScalingMetrics
+func (c *Consumer) scaled(delta int, reason ScaleReason) {
+	if m, ok := c.metrics.(ScalingMetrics); ok {
+		m.ConsumerScaled(c.opts.Queue, delta, reason)
+	}
+}
@@ -0,0 +1,92 @@
+package gq
+
+import (
+	"context"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAutoscale_Decide(t *testing.T) {
+	a := Autoscale{MinConcurrency: 2, MaxConcurrency: 10}.withDefaults()
+	tests := []struct {
+		name        string
+		current     int
+		backlog     backlog
+		processed   int
+		failed      int
+		handlerTime time.Duration
+		want        int
+		reason      ScaleReason
+	}{
+		{"backlog needs more goroutines", 3, backlog{ready: 20}, 10, 0, 2 * time.Second, 4, ScaleBacklog},
+		{"growth is limited to doubling", 3, backlog{ready: 1000}, 10, 0, 2 * time.Second, 6, ScaleBacklog},
+		{"growth is limited to the maximum", 8, backlog{ready: 1000}, 10, 0, 2 * time.Second, 10, ScaleBacklog},
+		{"old messages add a goroutine", 3, backlog{ready: 1, oldestAge: time.Minute}, 0, 0, 0, 4, ScaleBacklog},
+		{"small backlog shrinks by one", 5, backlog{ready: 1}, 10, 0, time.Second, 4, ScaleIdle},
+		{"empty queue shrinks by one", 5, backlog{}, 0, 0, 0, 4, ScaleIdle},
+		{"shrinking is limited to the minimum", 2, backlog{}, 0, 0, 0, 2, ScaleIdle},
+		{"errors shrink despite a backlog", 5, backlog{ready: 1000, oldestAge: time.Minute}, 10, 6, time.Second, 4, ScaleErrors},
+		{"steady load holds", 4, backlog{ready: 40}, 10, 1, time.Second, 4, ScaleBacklog},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, reason := a.decide(tt.current, tt.backlog, tt.processed, tt.failed, tt.handlerTime)
+			require.Equal(t, tt.want, got)
+			require.Equal(t, tt.reason, reason)
+		})
+	}
+}
+
+func TestAutoscale_WithDefaults(t *testing.T) {
+	a := Autoscale{MinConcurrency: 5, MaxConcurrency: 3}.withDefaults()
+	require.Equal(t, 3, a.MinConcurrency)
+	require.Equal(t, defaultAutoscaleInterval, a.Interval)
+	require.Equal(t, defaultTargetLatency, a.TargetLatency)
+	require.Equal(t, defaultMaxErrorRate, a.MaxErrorRate)
+}
+
+// scalingMetrics records the scaling decisions reported to it
+type scalingMetrics struct {
+	nopMetrics
+	goroutines int
+	reasons    []ScaleReason
+}
+
+func (s *scalingMetrics) ConsumerScaled(queue string, delta int, reason ScaleReason) {
+	s.goroutines += delta
+	s.reasons = append(s.reasons, reason)
+}
+
+func TestConsumer_Scale(t *testing.T) {
+	c, mock, now := newAdminTestClient(t)
+	metrics := &scalingMetrics{}
+	c.opts.Metrics = metrics
+	opts := idleConsumerOpts()
+	opts.Autoscale = Autoscale{MaxConcurrency: 4, Interval: time.Hour, TargetLatency: time.Second}
+	consumer, err := newConsumer(context.Background(), c, func(ctx context.Context, m *Message) error { return nil }, opts)
+	require.NoError(t, err)
+	require.Len(t, consumer.workers, 1)
+
+	selectBacklog := regexp.QuoteMeta("SELECT COUNT(*) AS ready, MIN(ready_at) AS oldest FROM message WHERE queue = ? AND ready_at <= ?")
+	mock.ExpectQuery(selectBacklog).
+		WithArgs(DefaultQueue, now).
+		WillReturnRows(sqlmock.NewRows([]string{"ready", "oldest"}).AddRow(50, now.Add(-time.Minute)))
+	consumer.stats.record(false, 100*time.Millisecond)
+	consumer.scale(context.Background(), now)
+	require.Len(t, consumer.workers, 2)
+
+	mock.ExpectQuery(selectBacklog).
+		WithArgs(DefaultQueue, now).
+		WillReturnRows(sqlmock.NewRows([]string{"ready", "oldest"}).AddRow(0, nil))
+	consumer.scale(context.Background(), now)
+	require.Len(t, consumer.workers, 1)
+	require.NoError(t, mock.ExpectationsWereMet())
+
+	consumer.Close()
+	require.Equal(t, 0, metrics.goroutines)
+	require.Equal(t, []ScaleReason{ScaleStarted, ScaleBacklog, ScaleIdle, ScaleStopped}, metrics.reasons)
+}
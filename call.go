@@ -0,0 +1,127 @@
+package gq
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/mattbonnell/gq/internal"
+)
+
+const (
+	defaultCallTimeout = 30 * time.Second
+	// callReplyGracePeriod is how long after its caller's deadline an unclaimed reply is kept, allowing for skew between clocks
+	callReplyGracePeriod = time.Minute
+	// callCleanupTimeout bounds deleting a reply once its caller has claimed it, or given up on it
+	callCleanupTimeout = 5 * time.Second
+	// replySweepPeriod is how often consumers delete the replies which expired unclaimed
+	replySweepPeriod = time.Minute
+	// CallDeadlineHeader is the header which carries the time, in RFC 3339 format, after which the caller of Client.Call has
+	// given up waiting for the reply to a request
+	CallDeadlineHeader = "gq-call-deadline"
+)
+
+// CallOptions represents the options which can be used to tailor a call
+type CallOptions struct {
+	// Headers are the request's headers
+	Headers map[string]string
+	// Timeout is how long to wait for the reply (default: 30s)
+	Timeout time.Duration
+}
+
+// CallError is returned by Call when the request failed to be processed, having exhausted its retries, or was cancelled
+type CallError struct {
+	// ID is the ID of the request message
+	ID int64
+	// Err is the error from the request's last failed attempt, or "cancelled"
+	Err string
+}
+
+func (e *CallError) Error() string {
+	return fmt.Sprintf("gq: call %d failed: %s", e.ID, e.Err)
+}
+
+// Call pushes a request onto queue and waits for the reply, which is the result the request's handler sets with
+// Message.SetResult. The request is processed with the same durability and retries as any other message
+func (c *Client) Call(ctx context.Context, queue string, payload []byte) ([]byte, error) {
+	return c.CallWithOptions(ctx, queue, payload, CallOptions{})
+}
+
+// CallWithOptions is like Call, with the supplied options. If the reply isn't received within the timeout, or ctx is done first,
+// CallWithOptions returns ctx's error. The request may still be processed, but its reply is discarded
+func (c *Client) CallWithOptions(ctx context.Context, queue string, payload []byte, opts CallOptions) ([]byte, error) {
+	if opts.Timeout <= 0 {
+		opts.Timeout = defaultCallTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, opts.Timeout)
+	defer cancel()
+	now := c.now()
+	deadline, _ := ctx.Deadline()
+	h := internal.Headers{}
+	for k, v := range opts.Headers {
+		h[k] = v
+	}
+	h[CallDeadlineHeader] = deadline.UTC().Format(time.RFC3339)
+	c.opts.Tracer.Inject(ctx, h)
+	queue = queueOrDefault(queue)
+	expiresAt := sql.NullTime{Time: now.Add(time.Until(deadline) + callReplyGracePeriod), Valid: true}
+	start := time.Now()
+	id, err := pushTracked(ctx, c.db, c.dialect, c.tables, queue, payload, h, expiresAt, now)
+	if err != nil {
+		c.opts.Metrics.MessagesPushed(queue, 1, OutcomeError, time.Since(start))
+		return nil, err
+	}
+	c.opts.Metrics.MessagesPushed(queue, 1, OutcomeSuccess, time.Since(start))
+	status, err := c.Wait(ctx, id)
+	c.deleteReply(id)
+	if err != nil {
+		return nil, err
+	}
+	switch status.State {
+	case JobFailed:
+		return nil, &CallError{ID: id, Err: status.LastError}
+	case JobCancelled:
+		return nil, &CallError{ID: id, Err: "cancelled"}
+	}
+	return status.Result, nil
+}
+
+// deleteReply deletes the reply to a call once its caller has claimed it or given up on it
+func (c *Client) deleteReply(id int64) {
+	ctx, cancel := context.WithTimeout(context.Background(), callCleanupTimeout)
+	defer cancel()
+	if _, err := c.exec(ctx, fmt.Sprintf("DELETE FROM %s WHERE id = ?", c.tables.JobStatus), id); err != nil {
+		c.opts.Logger.Error("error deleting call reply", "id", id, "error", err)
+	}
+}
+
+// startSweepingReplies deletes the replies which expired unclaimed, because their callers exited before they could delete them,
+// every replySweepPeriod. Consumers sweep, rather than callers, since they run wherever requests are served
+func (c *Consumer) startSweepingReplies(ctx context.Context) {
+	defer c.wg.Done()
+	ticker := time.NewTicker(replySweepPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.stop:
+			return
+		case <-ticker.C:
+			c.sweepReplies(ctx)
+		}
+	}
+}
+
+func (c *Consumer) sweepReplies(ctx context.Context) {
+	query := c.db.Rebind(fmt.Sprintf("DELETE FROM %s WHERE expires_at < ?", c.tables.JobStatus))
+	res, err := c.db.ExecContext(ctx, query, c.now())
+	if err != nil {
+		c.log.Error("error deleting expired call replies", "error", err)
+		return
+	}
+	if n, err := res.RowsAffected(); err == nil && n > 0 {
+		c.log.Debug("deleted expired call replies", "count", n)
+	}
+}
@@ -0,0 +1,83 @@
+package gq
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/require"
+)
+
+func expectCall(mock sqlmock.Sqlmock, now time.Time) {
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO message (queue, payload, headers, unique_key, tracked, created_at, ready_at) VALUES (?, ?, ?, ?, ?, ?, ?)")).
+		WithArgs("pdfs", []byte("render"), sqlmock.AnyArg(), nil, true, now, now).
+		WillReturnResult(sqlmock.NewResult(4, 1))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO job_status (id, queue, state, attempts, created_at, expires_at, workflow_id) VALUES (?, ?, ?, 0, ?, ?, ?)")).
+		WithArgs(4, "pdfs", JobQueued, now, sqlmock.AnyArg(), nil).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+}
+
+func expectReplyDeleted(mock sqlmock.Sqlmock, now time.Time) {
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM job_status WHERE id = ?")).
+		WithArgs(4).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+}
+
+func TestCall(t *testing.T) {
+	query := regexp.QuoteMeta("FROM job_status WHERE id = ?")
+	t.Run("replied", func(t *testing.T) {
+		c, mock, now := newAdminTestClient(t)
+		expectCall(mock, now)
+		mock.ExpectQuery(query).WithArgs(4).
+			WillReturnRows(sqlmock.NewRows(statusColumns).AddRow(4, "pdfs", JobSucceeded, 1, nil, []byte("https://example.com/a.pdf"), now, now, now))
+		expectReplyDeleted(mock, now)
+		reply, err := c.Call(context.Background(), "pdfs", []byte("render"))
+		require.NoError(t, err)
+		require.Equal(t, []byte("https://example.com/a.pdf"), reply)
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+	t.Run("failed", func(t *testing.T) {
+		c, mock, now := newAdminTestClient(t)
+		expectCall(mock, now)
+		mock.ExpectQuery(query).WithArgs(4).
+			WillReturnRows(sqlmock.NewRows(statusColumns).AddRow(4, "pdfs", JobFailed, 4, "boom", nil, now, now, now))
+		expectReplyDeleted(mock, now)
+		_, err := c.Call(context.Background(), "pdfs", []byte("render"))
+		var callErr *CallError
+		require.True(t, errors.As(err, &callErr))
+		require.Equal(t, &CallError{ID: 4, Err: "boom"}, callErr)
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+	t.Run("timed out", func(t *testing.T) {
+		c, mock, now := newAdminTestClient(t)
+		expectCall(mock, now)
+		mock.ExpectQuery(query).WithArgs(4).
+			WillReturnRows(sqlmock.NewRows(statusColumns).AddRow(4, "pdfs", JobRunning, 1, nil, nil, now, now, nil))
+		expectReplyDeleted(mock, now)
+		_, err := c.CallWithOptions(context.Background(), "pdfs", []byte("render"), CallOptions{Timeout: 5 * time.Millisecond})
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func TestConsumerSweepReplies(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err, "failed to open stub database connection")
+	defer db.Close()
+	now := time.Now().UTC()
+	cl := newTestClient(db)
+	cl.opts.Clock = func() time.Time { return now }
+	c, err := cl.NewLeaseConsumer(context.Background(), ConsumerOptions{Queue: "pdfs"})
+	require.NoError(t, err)
+
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM job_status WHERE expires_at < ?")).
+		WithArgs(now).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	c.sweepReplies(context.Background())
+	require.NoError(t, mock.ExpectationsWereMet())
+}
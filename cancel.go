@@ -0,0 +1,166 @@
+package gq
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/mattbonnell/gq/internal"
+)
+
+// MessageUpdate represents the changes Client.Update makes to a message. Fields left unset are unchanged
+type MessageUpdate struct {
+	// Payload, if non-nil, replaces the message's payload
+	Payload []byte
+	// Headers, if non-nil, replace the message's headers
+	Headers map[string]string
+	// ReadyAt, if non-zero, is the time the message becomes ready to be pulled
+	ReadyAt time.Time
+	// Priority, if non-nil, replaces the message's priority. Consumers claim a queue's ready messages with the highest priority first,
+	// and those of equal priority in order of ready time. Messages are pushed with priority 0
+	Priority *int
+}
+
+// queuedMessage is a message locked while it waits to be processed
+type queuedMessage struct {
+	ID        int64          `db:"id"`
+	UniqueKey sql.NullString `db:"unique_key"`
+	Tracked   bool           `db:"tracked"`
+}
+
+// Cancel deletes the message with the given ID before it is processed. It returns ErrInFlight if the message is being processed,
+// and ErrNotFound if there is no such message on a queue, which is the case once it has been processed or dead-lettered.
+// Cancelling a unique message releases its key, and the status of a tracked message becomes JobCancelled
+func (c *Client) Cancel(ctx context.Context, id int64) error {
+	return c.cancel(ctx, "id = ?", id)
+}
+
+// CancelUnique cancels the message waiting on queue with the given unique key, as Cancel does. It returns ErrInFlight if the only
+// message with the key is being processed
+func (c *Client) CancelUnique(ctx context.Context, queue string, key string) error {
+	return c.cancel(ctx, "queue = ? AND unique_key = ?", queueOrDefault(queue), key)
+}
+
+func (c *Client) cancel(ctx context.Context, where string, args ...interface{}) error {
+	now := c.now()
+	tx, err := c.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error beginning cancel transaction: %s", err)
+	}
+	defer tx.Rollback()
+	messages, err := lockQueued(ctx, tx, c.tables, where, now, args...)
+	if err != nil {
+		return err
+	}
+	ids := make([]int64, len(messages))
+	unique := []int64{}
+	for i, m := range messages {
+		ids[i] = m.ID
+		if m.UniqueKey.Valid {
+			unique = append(unique, m.ID)
+		}
+	}
+	query, args, err := sqlx.In(fmt.Sprintf("DELETE FROM %s WHERE id IN (?)", c.tables.Message), ids)
+	if err != nil {
+		return fmt.Errorf("error formulating cancel query: %s", err)
+	}
+	if _, err := tx.ExecContext(ctx, tx.Rebind(query), args...); err != nil {
+		return fmt.Errorf("error deleting cancelled messages: %s", err)
+	}
+	if len(unique) > 0 {
+		query, args, err := sqlx.In(fmt.Sprintf("DELETE FROM %s WHERE message_id IN (?)", c.tables.UniqueLock), unique)
+		if err != nil {
+			return fmt.Errorf("error formulating cancel query: %s", err)
+		}
+		if _, err := tx.ExecContext(ctx, tx.Rebind(query), args...); err != nil {
+			return fmt.Errorf("error releasing unique keys: %s", err)
+		}
+	}
+	workflows := newWorkflowUpdates(ctx, c.opts.Tracer)
+	for _, m := range messages {
+		if m.Tracked {
+			if err := cancelJob(ctx, tx, c.tables, workflows, m.ID, now); err != nil {
+				return err
+			}
+		}
+	}
+	if err := workflows.advance(ctx, tx, c.dialect, c.tables, now); err != nil {
+		workflows.report(c.opts.Metrics, err)
+		return err
+	}
+	err = tx.Commit()
+	workflows.report(c.opts.Metrics, err)
+	if err != nil {
+		return fmt.Errorf("error committing cancel transaction: %s", err)
+	}
+	return nil
+}
+
+// Update changes the message with the given ID before it is processed. It returns ErrInFlight if the message is being processed,
+// and ErrNotFound if there is no such message on a queue. An expired lease on the message is revoked, so it can't be acked
+func (c *Client) Update(ctx context.Context, id int64, update MessageUpdate) error {
+	set := []string{"lease_token = NULL"}
+	args := []interface{}{}
+	if update.Payload != nil {
+		set = append(set, "payload = ?")
+		args = append(args, update.Payload)
+	}
+	if update.Headers != nil {
+		h := internal.Headers{}
+		for k, v := range update.Headers {
+			h[k] = v
+		}
+		set = append(set, "headers = ?")
+		args = append(args, h)
+	}
+	if !update.ReadyAt.IsZero() {
+		set = append(set, "ready_at = ?")
+		args = append(args, update.ReadyAt.UTC())
+	}
+	if update.Priority != nil {
+		set = append(set, "priority = ?")
+		args = append(args, *update.Priority)
+	}
+	tx, err := c.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error beginning update transaction: %s", err)
+	}
+	defer tx.Rollback()
+	if _, err := lockQueued(ctx, tx, c.tables, "id = ?", c.now(), id); err != nil {
+		return err
+	}
+	query := tx.Rebind(fmt.Sprintf("UPDATE %s SET %s WHERE id = ?", c.tables.Message, strings.Join(set, ", ")))
+	if _, err := tx.ExecContext(ctx, query, append(args, id)...); err != nil {
+		return fmt.Errorf("error updating message: %s", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing update transaction: %s", err)
+	}
+	return nil
+}
+
+// lockQueued locks the messages selected by where which are waiting to be processed, skipping those locked by a Consumer's
+// transaction or carrying an unexpired lease. If there are none, it returns ErrInFlight if some are being processed, and
+// ErrNotFound otherwise
+func lockQueued(ctx context.Context, tx *sqlx.Tx, tables internal.Tables, where string, now time.Time, args ...interface{}) ([]queuedMessage, error) {
+	messages := []queuedMessage{}
+	query := tx.Rebind(fmt.Sprintf("SELECT id, unique_key, tracked FROM %s WHERE %s AND (lease_token IS NULL OR ready_at <= ?) FOR UPDATE SKIP LOCKED", tables.Message, where))
+	if err := tx.SelectContext(ctx, &messages, query, append(args, now)...); err != nil {
+		return nil, fmt.Errorf("error selecting queued messages: %s", err)
+	}
+	if len(messages) > 0 {
+		return messages, nil
+	}
+	var count int
+	query = tx.Rebind(fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE %s", tables.Message, where))
+	if err := tx.GetContext(ctx, &count, query, args...); err != nil {
+		return nil, fmt.Errorf("error selecting messages: %s", err)
+	}
+	if count > 0 {
+		return nil, ErrInFlight
+	}
+	return nil, ErrNotFound
+}
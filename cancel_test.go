@@ -0,0 +1,103 @@
+package gq
+
+import (
+	"context"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/require"
+)
+
+var queuedColumns = []string{"id", "unique_key", "tracked"}
+
+func TestCancel(t *testing.T) {
+	ctx := context.Background()
+	lock := regexp.QuoteMeta("SELECT id, unique_key, tracked FROM message WHERE id = ? AND (lease_token IS NULL OR ready_at <= ?) FOR UPDATE SKIP LOCKED")
+	count := regexp.QuoteMeta("SELECT COUNT(*) FROM message WHERE id = ?")
+
+	t.Run("queued", func(t *testing.T) {
+		c, mock, now := newAdminTestClient(t)
+		mock.ExpectBegin()
+		mock.ExpectQuery(lock).WithArgs(3, now).WillReturnRows(sqlmock.NewRows(queuedColumns).AddRow(3, "order-7", true))
+		mock.ExpectExec(regexp.QuoteMeta("DELETE FROM message WHERE id IN (?)")).WithArgs(3).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(regexp.QuoteMeta("DELETE FROM unique_lock WHERE message_id IN (?)")).WithArgs(3).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(regexp.QuoteMeta("UPDATE job_status SET state = ?, finished_at = ? WHERE id = ?")).
+			WithArgs(JobCancelled, now, 3).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		expectNoWorkflow(mock, 3)
+		mock.ExpectCommit()
+		require.NoError(t, c.Cancel(ctx, 3))
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+	t.Run("in flight", func(t *testing.T) {
+		c, mock, now := newAdminTestClient(t)
+		mock.ExpectBegin()
+		mock.ExpectQuery(lock).WithArgs(3, now).WillReturnRows(sqlmock.NewRows(queuedColumns))
+		mock.ExpectQuery(count).WithArgs(3).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+		mock.ExpectRollback()
+		require.ErrorIs(t, c.Cancel(ctx, 3), ErrInFlight)
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+	t.Run("processed", func(t *testing.T) {
+		c, mock, now := newAdminTestClient(t)
+		mock.ExpectBegin()
+		mock.ExpectQuery(lock).WithArgs(3, now).WillReturnRows(sqlmock.NewRows(queuedColumns))
+		mock.ExpectQuery(count).WithArgs(3).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+		mock.ExpectRollback()
+		require.ErrorIs(t, c.Cancel(ctx, 3), ErrNotFound)
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func TestCancelUnique(t *testing.T) {
+	c, mock, now := newAdminTestClient(t)
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT id, unique_key, tracked FROM message WHERE queue = ? AND unique_key = ? AND (lease_token IS NULL OR ready_at <= ?) FOR UPDATE SKIP LOCKED")).
+		WithArgs("orders", "order-7", now).
+		WillReturnRows(sqlmock.NewRows(queuedColumns).AddRow(4, "order-7", false))
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM message WHERE id IN (?)")).WithArgs(4).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM unique_lock WHERE message_id IN (?)")).WithArgs(4).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	require.NoError(t, c.CancelUnique(context.Background(), "orders", "order-7"))
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestUpdate(t *testing.T) {
+	ctx := context.Background()
+	lock := regexp.QuoteMeta("SELECT id, unique_key, tracked FROM message WHERE id = ? AND (lease_token IS NULL OR ready_at <= ?) FOR UPDATE SKIP LOCKED")
+
+	t.Run("queued", func(t *testing.T) {
+		c, mock, now := newAdminTestClient(t)
+		mock.ExpectBegin()
+		mock.ExpectQuery(lock).WithArgs(3, now).WillReturnRows(sqlmock.NewRows(queuedColumns).AddRow(3, nil, false))
+		mock.ExpectExec(regexp.QuoteMeta("UPDATE message SET lease_token = NULL, payload = ?, headers = ?, ready_at = ? WHERE id = ?")).
+			WithArgs([]byte("go"), `{"k":"v"}`, now.Add(time.Hour), 3).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+		require.NoError(t, c.Update(ctx, 3, MessageUpdate{Payload: []byte("go"), Headers: map[string]string{"k": "v"}, ReadyAt: now.Add(time.Hour)}))
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+	t.Run("priority", func(t *testing.T) {
+		c, mock, now := newAdminTestClient(t)
+		mock.ExpectBegin()
+		mock.ExpectQuery(lock).WithArgs(3, now).WillReturnRows(sqlmock.NewRows(queuedColumns).AddRow(3, nil, false))
+		mock.ExpectExec(regexp.QuoteMeta("UPDATE message SET lease_token = NULL, priority = ? WHERE id = ?")).
+			WithArgs(0, 3).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+		priority := 0
+		require.NoError(t, c.Update(ctx, 3, MessageUpdate{Priority: &priority}))
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+	t.Run("in flight", func(t *testing.T) {
+		c, mock, now := newAdminTestClient(t)
+		mock.ExpectBegin()
+		mock.ExpectQuery(lock).WithArgs(3, now).WillReturnRows(sqlmock.NewRows(queuedColumns))
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(*) FROM message WHERE id = ?")).WithArgs(3).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+		mock.ExpectRollback()
+		require.ErrorIs(t, c.Update(ctx, 3, MessageUpdate{Payload: []byte("go")}), ErrInFlight)
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+}
@@ -4,51 +4,253 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"sync"
+	"time"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/mattbonnell/gq/internal"
-	"github.com/rs/zerolog"
-	"github.com/rs/zerolog/log"
 )
 
-func init() {
-	zerolog.SetGlobalLevel(zerolog.InfoLevel)
+// DefaultQueue is the queue which Producers and Consumers use when none is specified in their options
+const DefaultQueue = "default"
+
+func queueOrDefault(queue string) string {
+	if queue == "" {
+		return DefaultQueue
+	}
+	return queue
 }
 
-// Client represents a client of the message queue. It can be used to spawn any number of consumers or producers.
+// Client represents a client of the message queue. It can be used to spawn any number of consumers or producers,
+// each of which inherits the client's options.
 type Client struct {
-	db *sqlx.DB
+	db      *sqlx.DB
+	opts    ClientOptions
+	tables  internal.Tables
+	dialect *internal.Dialect
+
+	mu             sync.Mutex
+	closed         bool
+	producers      []*Producer
+	consumers      []*Consumer
+	groupConsumers []*GroupConsumer
+	schedulers     []*Scheduler
+}
+
+// ClientOptions represents the options which can be used to tailor client behaviour.
+// They apply to every Producer and Consumer spawned by the client
+type ClientOptions struct {
+	// DisableMigrations stops the client from migrating the database schema when it is created (default: false).
+	// The schema must then be migrated out-of-band, e.g. by applying the statements returned by MigrationSQL,
+	// and client creation fails if it is not at the version required by this version of gq
+	DisableMigrations bool
+	// Schema is the schema (on MySQL, the database) which gq's tables are created in (default: the connection's default schema).
+	// It is created if it doesn't exist
+	Schema string
+	// TablePrefix is prepended to the name of each of gq's tables and indexes (default: none).
+	// Distinct prefixes allow several gq instances to coexist in one schema
+	TablePrefix string
+	// Dialect is the SQL dialect to use, one of "mysql" or "postgres" (default: inferred from the driver name).
+	// It must be set when the driver is registered under a name gq doesn't recognise, such as a wrapped or instrumented driver
+	Dialect string
+	// Clock returns the current time, which is used to schedule messages (default: time.Now)
+	Clock func() time.Time
+	// Logger receives gq's logs (default: slog.Default(), so that the application's slog configuration applies).
+	// Use NewNopLogger to silence gq
+	Logger Logger
+	// Metrics receives measurements of the activity of every Producer and Consumer (default: none are recorded)
+	Metrics Metrics
+	// Tracer instruments pushing and processing messages (default: no tracing)
+	Tracer Tracer
+}
+
+func defaultClientOpts() ClientOptions {
+	return ClientOptions{Clock: time.Now, Logger: NewSlogLogger(nil), Metrics: nopMetrics{}, Tracer: nopTracer{}}
 }
 
-// NewClient creates a new Client, generating the database schema if it doesn't exist
+func (o ClientOptions) dialect(driverName string) string {
+	if o.Dialect != "" {
+		return o.Dialect
+	}
+	return driverName
+}
+
+// NewClient creates a new Client, migrating the database schema to the latest version
 func NewClient(db *sql.DB, driverName string) (*Client, error) {
-	log.Debug().Msg("creating new client")
-	c := Client{db: sqlx.NewDb(db, driverName)}
-	if err := internal.CreateSchema(c.db); err != nil {
-		err = fmt.Errorf("error creating schema: %s", err)
-		log.Debug().Msg(err.Error())
+	return newClient(db, driverName, nil)
+}
+
+// NewClientWithOptions creates a new Client with the supplied options
+func NewClientWithOptions(db *sql.DB, driverName string, opts ClientOptions) (*Client, error) {
+	return newClient(db, driverName, &opts)
+}
+
+func newClient(db *sql.DB, driverName string, opts *ClientOptions) (*Client, error) {
+	c := &Client{opts: defaultClientOpts()}
+	if opts != nil {
+		c.opts = *opts
+		if c.opts.Clock == nil {
+			c.opts.Clock = time.Now
+		}
+		if c.opts.Logger == nil {
+			c.opts.Logger = NewSlogLogger(nil)
+		}
+		if c.opts.Metrics == nil {
+			c.opts.Metrics = nopMetrics{}
+		}
+		if c.opts.Tracer == nil {
+			c.opts.Tracer = nopTracer{}
+		}
+	}
+	log := c.opts.Logger
+	log.Debug("creating new client")
+	// sqlx only uses the driver name to determine the bind style, so the dialect can stand in for it
+	c.db = sqlx.NewDb(db, c.opts.dialect(driverName))
+	tables, err := internal.NewTables(c.opts.Schema, c.opts.TablePrefix)
+	if err != nil {
+		return nil, err
+	}
+	c.tables = tables
+	if c.dialect, err = internal.GetDialect(c.db.DriverName(), tables); err != nil {
 		return nil, err
 	}
-	log.Debug().Msg("client created")
-	return &c, nil
+	ctx := context.Background()
+	if c.opts.DisableMigrations {
+		if err := internal.CheckSchemaVersion(ctx, c.db, c.tables); err != nil {
+			err = fmt.Errorf("error checking schema: %s", err)
+			log.Debug(err.Error())
+			return nil, err
+		}
+	} else if err := internal.Migrate(ctx, c.db, c.tables, log); err != nil {
+		err = fmt.Errorf("error migrating schema: %s", err)
+		log.Debug(err.Error())
+		return nil, err
+	}
+	log.Debug("client created")
+	return c, nil
+}
+
+// now returns the current time according to the client's clock, in UTC
+func (c *Client) now() time.Time {
+	return c.opts.Clock().UTC()
+}
+
+// Migrate applies any pending gq schema migrations to the database. It is safe to call concurrently from several processes.
+// Clients created without DisableMigrations do this automatically. Table naming and dialect are taken from opts
+func Migrate(ctx context.Context, db *sql.DB, driverName string, opts ClientOptions) error {
+	tables, err := internal.NewTables(opts.Schema, opts.TablePrefix)
+	if err != nil {
+		return err
+	}
+	log := opts.Logger
+	if log == nil {
+		log = NewSlogLogger(nil)
+	}
+	return internal.Migrate(ctx, sqlx.NewDb(db, opts.dialect(driverName)), tables, log)
+}
+
+// MigrationSQL returns the statements which bring an empty database up to the schema version required by this version of gq,
+// for use by DBAs who wish to apply the schema themselves. Table naming and dialect are taken from opts
+func MigrationSQL(driverName string, opts ClientOptions) ([]string, error) {
+	tables, err := internal.NewTables(opts.Schema, opts.TablePrefix)
+	if err != nil {
+		return nil, err
+	}
+	d, err := internal.GetDialect(opts.dialect(driverName), tables)
+	if err != nil {
+		return nil, err
+	}
+	return d.MigrationSQL(), nil
 }
 
 // NewConsumer creates a new gq Consumer. It begins pulling messages immediately, and passes each one to the supplied process function
-func (c Client) NewConsumer(ctx context.Context, p ProcessFunc) (*Consumer, error) {
-	return newConsumer(ctx, c.db, p, nil)
+func (c *Client) NewConsumer(ctx context.Context, p ProcessFunc) (*Consumer, error) {
+	return c.addConsumer(newConsumer(ctx, c, p.handlerFunc(), nil))
 }
 
 // NewConsumerWithOptions creates a new gq Consumer with the supplied options.
-func (c Client) NewConsumerWithOptions(ctx context.Context, p ProcessFunc, opts ConsumerOptions) (*Consumer, error) {
-	return newConsumer(ctx, c.db, p, &opts)
+func (c *Client) NewConsumerWithOptions(ctx context.Context, p ProcessFunc, opts ConsumerOptions) (*Consumer, error) {
+	return c.addConsumer(newConsumer(ctx, c, p.handlerFunc(), &opts))
+}
+
+// NewConsumerWithHandler creates a new gq Consumer with the supplied options, which passes each message, along with its metadata
+// and a context carrying any propagated trace context, to the supplied handler
+func (c *Client) NewConsumerWithHandler(ctx context.Context, h HandlerFunc, opts ConsumerOptions) (*Consumer, error) {
+	return c.addConsumer(newConsumer(ctx, c, h, &opts))
+}
+
+// NewLeaseConsumer creates a Consumer which does not process messages itself. Instead, messages are claimed by calling Receive,
+// and must then be acknowledged with Ack or rejected with Nack before their lease expires
+func (c *Client) NewLeaseConsumer(ctx context.Context, opts ConsumerOptions) (*Consumer, error) {
+	return c.addConsumer(newConsumer(ctx, c, nil, &opts))
 }
 
 // NewProducer creates a new gq Producer
-func (c Client) NewProducer(ctx context.Context) (*Producer, error) {
-	return newProducer(ctx, c.db, nil)
+func (c *Client) NewProducer(ctx context.Context) (*Producer, error) {
+	return c.addProducer(newProducer(ctx, c, nil))
 }
 
 // NewProducerWithOptions creates a new gq Producer with the supplied options
-func (c Client) NewProducerWithOptions(ctx context.Context, opts ProducerOptions) (*Producer, error) {
-	return newProducer(ctx, c.db, &opts)
+func (c *Client) NewProducerWithOptions(ctx context.Context, opts ProducerOptions) (*Producer, error) {
+	return c.addProducer(newProducer(ctx, c, &opts))
+}
+
+func (c *Client) addProducer(p *Producer, err error) (*Producer, error) {
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		p.Close()
+		return nil, ErrClientClosed
+	}
+	c.producers = append(c.producers, p)
+	return p, nil
+}
+
+func (c *Client) addConsumer(cs *Consumer, err error) (*Consumer, error) {
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		cs.Close()
+		return nil, ErrClientClosed
+	}
+	c.consumers = append(c.consumers, cs)
+	return cs, nil
+}
+
+// Close stops every Producer and Consumer spawned by the client. Producers are closed first, in the order they were created,
+// so that their buffered messages are pushed; then consumers are closed, waiting for the messages they are processing.
+// It doesn't close the underlying database. It returns the first error encountered while flushing producers
+func (c *Client) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	producers, consumers, groupConsumers, schedulers := c.producers, c.consumers, c.groupConsumers, c.schedulers
+	c.producers, c.consumers, c.groupConsumers, c.schedulers = nil, nil, nil, nil
+	c.mu.Unlock()
+
+	var firstErr error
+	for _, p := range producers {
+		if err := p.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	for _, cs := range consumers {
+		cs.Close()
+	}
+	for _, gc := range groupConsumers {
+		gc.Close()
+	}
+	for _, s := range schedulers {
+		s.Close()
+	}
+	return firstErr
 }
@@ -1,15 +1,42 @@
 package gq
 
 import (
+	"context"
+	"database/sql"
 	"fmt"
+	"regexp"
 	"testing"
+	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jmoiron/sqlx"
 	"github.com/mattbonnell/gq/internal"
 	"github.com/mattbonnell/gq/test"
 	"github.com/stretchr/testify/require"
 )
 
+// newTestClient returns a client for the mock db which skips schema migration
+func newTestClient(db *sql.DB) *Client {
+	d, err := internal.GetDialect(arbitraryDriverName, internal.DefaultTables)
+	if err != nil {
+		panic(err)
+	}
+	return &Client{db: sqlx.NewDb(db, arbitraryDriverName), opts: defaultClientOpts(), tables: internal.DefaultTables, dialect: d}
+}
+
+func expectMigrations(t *testing.T, mock sqlmock.Sqlmock, driverName string, tables internal.Tables) {
+	d, err := internal.GetDialect(driverName, tables)
+	require.NoError(t, err, "failed to get dialect")
+	test.ExpectMigrations(t, mock, test.Migrations{
+		AcquireLock:      d.AcquireLock,
+		ReleaseLock:      d.ReleaseLock,
+		CreateSchema:     d.CreateSchema,
+		VersionTable:     d.VersionTable,
+		VersionTableName: tables.SchemaVersion,
+		Statements:       d.Migrations,
+	})
+}
+
 func TestNewClient(t *testing.T) {
 	for _, d := range internal.SupportedDrivers {
 		t.Run(fmt.Sprintf("driver=%s", d), func(t *testing.T) {
@@ -17,12 +44,31 @@ func TestNewClient(t *testing.T) {
 				db, mock, err := sqlmock.New()
 				require.NoError(t, err)
 
-				schema, err := internal.GetSchema(d)
-				require.NoError(t, err, "failed to get schema")
-				test.ExpectSchema(t, mock, schema)
+				expectMigrations(t, mock, d, internal.DefaultTables)
 
 				_, err = NewClient(db, d)
 				require.NoError(t, err)
+				require.NoError(t, mock.ExpectationsWereMet())
+			})
+			t.Run("new client with schema and table prefix should succeed", func(t *testing.T) {
+				db, mock, err := sqlmock.New()
+				require.NoError(t, err)
+
+				tables, err := internal.NewTables("gq", "app_")
+				require.NoError(t, err)
+				expectMigrations(t, mock, d, tables)
+
+				c, err := NewClientWithOptions(db, d, ClientOptions{Schema: "gq", TablePrefix: "app_"})
+				require.NoError(t, err)
+				require.Equal(t, "gq.app_message", c.tables.Message)
+				require.NoError(t, mock.ExpectationsWereMet())
+			})
+			t.Run("new client should fail, invalid table prefix", func(t *testing.T) {
+				db, _, err := sqlmock.New()
+				require.NoError(t, err)
+
+				_, err = NewClientWithOptions(db, d, ClientOptions{TablePrefix: "app-"})
+				require.Error(t, err)
 			})
 			t.Run("new client should fail, closed db", func(t *testing.T) {
 
@@ -37,7 +83,70 @@ func TestNewClient(t *testing.T) {
 				_, err = NewClient(db, d)
 				require.Error(t, err)
 			})
+			t.Run("new client with migrations disabled should fail, schema out of date", func(t *testing.T) {
+				db, mock, err := sqlmock.New()
+				require.NoError(t, err)
+
+				mock.ExpectQuery(test.Query("SELECT MAX(version) FROM gq_schema_version")).
+					WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow(nil))
+
+				_, err = NewClientWithOptions(db, d, ClientOptions{DisableMigrations: true})
+				require.Error(t, err)
+				require.NoError(t, mock.ExpectationsWereMet())
+			})
 		})
 
 	}
 }
+
+func TestMigrationSQL(t *testing.T) {
+	for _, d := range internal.SupportedDrivers {
+		t.Run(fmt.Sprintf("driver=%s", d), func(t *testing.T) {
+			stmts, err := MigrationSQL(d, ClientOptions{})
+			require.NoError(t, err)
+			require.Contains(t, stmts[len(stmts)-1], "INSERT INTO gq_schema_version")
+		})
+	}
+	_, err := MigrationSQL("sqlite3", ClientOptions{})
+	require.Error(t, err)
+}
+
+func TestNewClientWithOptions_Dialect(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+
+	expectMigrations(t, mock, "postgres", internal.DefaultTables)
+
+	c, err := NewClientWithOptions(db, "instrumented-postgres", ClientOptions{Dialect: "postgres"})
+	require.NoError(t, err)
+	require.Equal(t, "SELECT $1", c.db.Rebind("SELECT ?"))
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestClientClose(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+
+	payload := []byte("buffered payload")
+	mock.
+		ExpectExec(
+			regexp.QuoteMeta(`INSERT INTO message (queue, payload, headers, created_at, ready_at) VALUES (?, ?, ?, ?, ?)`),
+		).
+		WithArgs(DefaultQueue, payload, nil, sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	c := newTestClient(db)
+	ctx := context.Background()
+	// a push period longer than the test ensures the message is still buffered when the client is closed
+	p, err := c.NewProducerWithOptions(ctx, ProducerOptions{PushPeriod: time.Hour, MaxRetryPeriods: 1, Concurrency: 1})
+	require.NoError(t, err)
+	_, err = c.NewConsumerWithOptions(ctx, func(message []byte) error { return nil }, ConsumerOptions{PullPeriod: time.Hour, Concurrency: 1})
+	require.NoError(t, err)
+
+	p.Push(payload)
+	require.NoError(t, c.Close())
+	require.NoError(t, mock.ExpectationsWereMet())
+
+	_, err = c.NewProducer(ctx)
+	require.ErrorIs(t, err, ErrClientClosed)
+}
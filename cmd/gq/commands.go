@@ -0,0 +1,474 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mattbonnell/gq"
+)
+
+// browseBatchSize is the number of messages read per query by tail and export
+const browseBatchSize = 500
+
+// maxLineSize is the largest message push and import will read
+const maxLineSize = 16 << 20
+
+func runMigrate(ctx context.Context, cfg config, args []string) error {
+	flags := newFlagSet("migrate")
+	printSQL := flags.Bool("print", false, "print the SQL which would be applied to an empty database instead of applying it")
+	flags.Parse(args)
+	if *printSQL {
+		stmts, err := gq.MigrationSQL(cfg.driver, cfg.clientOptions())
+		if err != nil {
+			return err
+		}
+		for _, stmt := range stmts {
+			fmt.Println(strings.TrimSpace(stmt))
+		}
+		return nil
+	}
+	db, err := cfg.open()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return gq.Migrate(ctx, db, cfg.driver, cfg.clientOptions())
+}
+
+func runStats(ctx context.Context, cfg config, args []string) error {
+	flags := newFlagSet("stats")
+	asJSON := flags.Bool("json", false, "print the stats as JSON")
+	flags.Parse(args)
+	cl, closeClient, err := cfg.client()
+	if err != nil {
+		return err
+	}
+	defer closeClient()
+	stats, err := cl.Stats(ctx)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(stats)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "QUEUE\tREADY\tDELAYED\tIN FLIGHT\tRETRYING\tMAX RETRIES\tDEAD\tOLDEST")
+	for _, s := range stats {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%d\t%d\t%s\n", s.Queue, s.Ready, s.Delayed, s.InFlight, s.Retrying, s.MaxRetries, s.Dead, s.OldestAge.Round(time.Second))
+	}
+	return w.Flush()
+}
+
+// printer writes messages to stdout, either as JSONL or as their raw payloads
+type printer struct {
+	enc     *json.Encoder
+	payload bool
+}
+
+func newPrinter(payload bool) printer {
+	return printer{enc: json.NewEncoder(os.Stdout), payload: payload}
+}
+
+func (p printer) print(messages []gq.MessageInfo) error {
+	for _, m := range messages {
+		if p.payload {
+			if _, err := fmt.Printf("%s\n", m.Payload); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := p.enc.Encode(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runPeek(ctx context.Context, cfg config, args []string) error {
+	flags := newFlagSet("peek")
+	queue := flags.String("queue", gq.DefaultQueue, "queue to peek at")
+	n := flags.Int("n", 10, "number of messages to print")
+	dead := flags.Bool("dead", false, "print the most recently dead-lettered messages instead")
+	payload := flags.Bool("payload", false, "print only the payloads, one per line, instead of JSONL")
+	flags.Parse(args)
+	cl, closeClient, err := cfg.client()
+	if err != nil {
+		return err
+	}
+	defer closeClient()
+	var messages []gq.MessageInfo
+	if *dead {
+		messages, err = cl.PeekDead(ctx, *queue, *n)
+	} else {
+		messages, err = cl.Peek(ctx, *queue, *n)
+	}
+	if err != nil {
+		return err
+	}
+	return newPrinter(*payload).print(messages)
+}
+
+func runTail(ctx context.Context, cfg config, args []string) error {
+	flags := newFlagSet("tail")
+	queue := flags.String("queue", gq.DefaultQueue, "queue to tail")
+	afterID := flags.Int64("after", -1, "print messages with IDs greater than this; by default only messages pushed after tail starts are printed")
+	interval := flags.Duration("interval", time.Second, "how often to poll for new messages")
+	payload := flags.Bool("payload", false, "print only the payloads, one per line, instead of JSONL")
+	flags.Parse(args)
+	cl, closeClient, err := cfg.client()
+	if err != nil {
+		return err
+	}
+	defer closeClient()
+	last := *afterID
+	if last < 0 {
+		// skip past the messages already on the queue
+		last = 0
+		for {
+			messages, err := cl.Browse(ctx, *queue, last, browseBatchSize)
+			if err != nil {
+				return err
+			}
+			if len(messages) == 0 {
+				break
+			}
+			last = messages[len(messages)-1].ID
+		}
+	}
+	p := newPrinter(*payload)
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for {
+		messages, err := cl.Browse(ctx, *queue, last, browseBatchSize)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		if err := p.print(messages); err != nil {
+			return err
+		}
+		if len(messages) > 0 {
+			last = messages[len(messages)-1].ID
+		}
+		if len(messages) == browseBatchSize {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// lines calls f with each line read from the file at path, or from stdin if path is "-"
+func lines(path string, f func(line []byte) error) error {
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		r = file
+	}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxLineSize)
+	for scanner.Scan() {
+		if err := f(scanner.Bytes()); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// newProducer returns a producer for queue which retries failed pushes for longer than the default, since the CLI has nothing else to do
+func newProducer(ctx context.Context, cl *gq.Client, queue string) (*gq.Producer, error) {
+	return cl.NewProducerWithOptions(ctx, gq.ProducerOptions{PushPeriod: 100 * time.Millisecond, MaxRetryPeriods: 50, Concurrency: 1, Queue: queue})
+}
+
+func runPush(ctx context.Context, cfg config, args []string) error {
+	flags := newFlagSet("push")
+	queue := flags.String("queue", gq.DefaultQueue, "queue to push onto")
+	file := flags.String("file", "-", "file to read messages from, one per line (default: stdin)")
+	flags.Parse(args)
+	cl, closeClient, err := cfg.client()
+	if err != nil {
+		return err
+	}
+	defer closeClient()
+	p, err := newProducer(ctx, cl, *queue)
+	if err != nil {
+		return err
+	}
+	count := 0
+	err = lines(*file, func(line []byte) error {
+		// the scanner reuses its buffer, and the producer pushes asynchronously
+		if err := p.Push(append([]byte(nil), line...)); err != nil {
+			return err
+		}
+		count++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := p.Close(); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "pushed %d messages onto %s\n", count, *queue)
+	return nil
+}
+
+func runRequeueDead(ctx context.Context, cfg config, args []string) error {
+	flags := newFlagSet("requeue-dead")
+	queue := flags.String("queue", "", "queue to requeue dead messages onto (required)")
+	ids := flags.String("ids", "", "comma-separated IDs of the dead messages to requeue (default: all)")
+	failedAfter := flags.String("failed-after", "", "only requeue messages which failed after this RFC 3339 time")
+	failedBefore := flags.String("failed-before", "", "only requeue messages which failed before this RFC 3339 time")
+	flags.Parse(args)
+	if err := requireQueue(*queue); err != nil {
+		return err
+	}
+	filter := gq.RequeueFilter{Queue: *queue}
+	if *ids != "" {
+		for _, s := range strings.Split(*ids, ",") {
+			id, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid ID %q: %s", s, err)
+			}
+			filter.IDs = append(filter.IDs, id)
+		}
+	}
+	var err error
+	if filter.FailedAfter, err = parseTime(*failedAfter); err != nil {
+		return err
+	}
+	if filter.FailedBefore, err = parseTime(*failedBefore); err != nil {
+		return err
+	}
+	cl, closeClient, err := cfg.client()
+	if err != nil {
+		return err
+	}
+	defer closeClient()
+	n, err := cl.Requeue(ctx, filter)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "requeued %d dead messages onto %s\n", n, *queue)
+	return nil
+}
+
+func parseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q: %s", s, err)
+	}
+	return t, nil
+}
+
+func runPurge(ctx context.Context, cfg config, args []string) error {
+	flags := newFlagSet("purge")
+	queue := flags.String("queue", "", "queue to purge (required)")
+	dead := flags.Bool("dead", false, "purge the queue's dead-letter table instead")
+	flags.Parse(args)
+	if err := requireQueue(*queue); err != nil {
+		return err
+	}
+	cl, closeClient, err := cfg.client()
+	if err != nil {
+		return err
+	}
+	defer closeClient()
+	purge, what := cl.Purge, "messages"
+	if *dead {
+		purge, what = cl.PurgeDead, "dead messages"
+	}
+	n, err := purge(ctx, *queue)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "purged %d %s from %s\n", n, what, *queue)
+	return nil
+}
+
+func runPause(ctx context.Context, cfg config, args []string) error {
+	flags := newFlagSet("pause")
+	queue := flags.String("queue", "", "queue to pause (required unless -list)")
+	list := flags.Bool("list", false, "print the paused queues instead")
+	flags.Parse(args)
+	if !*list {
+		if err := requireQueue(*queue); err != nil {
+			return err
+		}
+	}
+	cl, closeClient, err := cfg.client()
+	if err != nil {
+		return err
+	}
+	defer closeClient()
+	if *list {
+		queues, err := cl.PausedQueues(ctx)
+		if err != nil {
+			return err
+		}
+		for _, q := range queues {
+			fmt.Println(q)
+		}
+		return nil
+	}
+	if err := cl.Pause(ctx, *queue); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "paused %s\n", *queue)
+	return nil
+}
+
+func runResume(ctx context.Context, cfg config, args []string) error {
+	flags := newFlagSet("resume")
+	queue := flags.String("queue", "", "queue to resume (required)")
+	flags.Parse(args)
+	if err := requireQueue(*queue); err != nil {
+		return err
+	}
+	cl, closeClient, err := cfg.client()
+	if err != nil {
+		return err
+	}
+	defer closeClient()
+	if err := cl.Resume(ctx, *queue); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "resumed %s\n", *queue)
+	return nil
+}
+
+func runExport(ctx context.Context, cfg config, args []string) error {
+	flags := newFlagSet("export")
+	queue := flags.String("queue", "", "queue to export (default: every queue)")
+	dead := flags.Bool("dead", false, "export dead messages instead")
+	file := flags.String("file", "-", "file to write to (default: stdout)")
+	flags.Parse(args)
+	cl, closeClient, err := cfg.client()
+	if err != nil {
+		return err
+	}
+	defer closeClient()
+	queues := []string{*queue}
+	if *queue == "" {
+		stats, err := cl.Stats(ctx)
+		if err != nil {
+			return err
+		}
+		queues = queues[:0]
+		for _, s := range stats {
+			queues = append(queues, s.Queue)
+		}
+	}
+	var w io.Writer = os.Stdout
+	if *file != "-" {
+		f, err := os.Create(*file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	browse := cl.Browse
+	if *dead {
+		browse = cl.BrowseDead
+	}
+	count := 0
+	for _, q := range queues {
+		var last int64
+		for {
+			messages, err := browse(ctx, q, last, browseBatchSize)
+			if err != nil {
+				return err
+			}
+			if len(messages) == 0 {
+				break
+			}
+			for _, m := range messages {
+				if err := enc.Encode(m); err != nil {
+					return err
+				}
+			}
+			count += len(messages)
+			last = messages[len(messages)-1].ID
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "exported %d messages\n", count)
+	return nil
+}
+
+func runImport(ctx context.Context, cfg config, args []string) error {
+	flags := newFlagSet("import")
+	queue := flags.String("queue", "", "queue to push the messages onto (default: the queue each message was exported from)")
+	file := flags.String("file", "-", "file to read from (default: stdin)")
+	flags.Parse(args)
+	cl, closeClient, err := cfg.client()
+	if err != nil {
+		return err
+	}
+	defer closeClient()
+	producers := map[string]*gq.Producer{}
+	count := 0
+	err = lines(*file, func(line []byte) error {
+		if len(strings.TrimSpace(string(line))) == 0 {
+			return nil
+		}
+		m := gq.MessageInfo{}
+		if err := json.Unmarshal(line, &m); err != nil {
+			return fmt.Errorf("invalid message on line %d: %s", count+1, err)
+		}
+		q := *queue
+		if q == "" {
+			q = m.Queue
+		}
+		p, ok := producers[q]
+		if !ok {
+			if p, err = newProducer(ctx, cl, q); err != nil {
+				return err
+			}
+			producers[q] = p
+		}
+		// messages are pushed afresh: they are assigned new IDs and are ready immediately, with their retries reset
+		if err := p.PushWithHeaders(ctx, m.Payload, m.Headers); err != nil {
+			return err
+		}
+		count++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, p := range producers {
+		if err := p.Close(); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(os.Stderr, "imported %d messages\n", count)
+	return nil
+}
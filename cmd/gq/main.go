@@ -0,0 +1,145 @@
+// Command gq inspects and repairs gq queues from the command line.
+//
+//	gq -driver postgres -dsn "$DATABASE_URL" <command> [flags]
+//
+// The driver and DSN default to the GQ_DRIVER and GQ_DSN environment variables. Run gq -h for the list of commands,
+// and gq <command> -h for their flags.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+	"github.com/mattbonnell/gq"
+)
+
+// config holds the global flags shared by every command
+type config struct {
+	driver  string
+	dsn     string
+	schema  string
+	prefix  string
+	verbose bool
+}
+
+func (c config) clientOptions() gq.ClientOptions {
+	level := slog.LevelWarn
+	if c.verbose {
+		level = slog.LevelDebug
+	}
+	return gq.ClientOptions{
+		Schema:      c.schema,
+		TablePrefix: c.prefix,
+		Logger:      gq.NewSlogLogger(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}))),
+	}
+}
+
+func (c config) open() (*sql.DB, error) {
+	if c.driver == "" || c.dsn == "" {
+		return nil, errors.New("a driver and DSN are required: set -driver and -dsn, or GQ_DRIVER and GQ_DSN")
+	}
+	return sql.Open(c.driver, c.dsn)
+}
+
+// client opens a client which requires the schema to already be migrated, so that inspecting a queue never changes its schema
+func (c config) client() (*gq.Client, func(), error) {
+	db, err := c.open()
+	if err != nil {
+		return nil, nil, err
+	}
+	opts := c.clientOptions()
+	opts.DisableMigrations = true
+	cl, err := gq.NewClientWithOptions(db, c.driver, opts)
+	if err != nil {
+		db.Close()
+		return nil, nil, fmt.Errorf("%s (has the schema been migrated with 'gq migrate'?)", err)
+	}
+	return cl, func() {
+		cl.Close()
+		db.Close()
+	}, nil
+}
+
+// command is a gq subcommand
+type command struct {
+	usage string
+	run   func(ctx context.Context, cfg config, args []string) error
+}
+
+var commands = map[string]command{
+	"migrate":      {"apply pending schema migrations, or print them with -print", runMigrate},
+	"stats":        {"print statistics for every queue", runStats},
+	"peek":         {"print the next messages on a queue without pulling them", runPeek},
+	"push":         {"push messages onto a queue, one per line, from stdin or a file", runPush},
+	"tail":         {"print messages as they are pushed onto a queue, without pulling them", runTail},
+	"requeue-dead": {"move dead messages back onto their queue", runRequeueDead},
+	"purge":        {"delete every message on a queue, or in its dead-letter table", runPurge},
+	"pause":        {"stop consumers claiming messages from a queue, or list paused queues with -list", runPause},
+	"resume":       {"let consumers claim messages from a paused queue again", runResume},
+	"export":       {"write the messages on a queue to JSONL", runExport},
+	"import":       {"push the messages in JSONL written by export", runImport},
+}
+
+func main() {
+	cfg := config{}
+	flags := flag.NewFlagSet("gq", flag.ExitOnError)
+	flags.StringVar(&cfg.driver, "driver", os.Getenv("GQ_DRIVER"), "database driver: mysql or postgres (env GQ_DRIVER)")
+	flags.StringVar(&cfg.dsn, "dsn", os.Getenv("GQ_DSN"), "database DSN (env GQ_DSN)")
+	flags.StringVar(&cfg.schema, "schema", os.Getenv("GQ_SCHEMA"), "schema containing gq's tables (env GQ_SCHEMA)")
+	flags.StringVar(&cfg.prefix, "prefix", os.Getenv("GQ_TABLE_PREFIX"), "prefix of gq's table names (env GQ_TABLE_PREFIX)")
+	flags.BoolVar(&cfg.verbose, "v", false, "log debug output to stderr")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: gq [flags] <command> [command flags]\n\ncommands:")
+		names := make([]string, 0, len(commands))
+		for name := range commands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(flags.Output(), "  %-13s %s\n", name, commands[name].usage)
+		}
+		fmt.Fprintln(flags.Output(), "\nflags:")
+		flags.PrintDefaults()
+	}
+	flags.Parse(os.Args[1:])
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	name := flags.Arg(0)
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "gq: unknown command %q\n", name)
+		flags.Usage()
+		os.Exit(2)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if err := cmd.run(ctx, cfg, flags.Args()[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "gq %s: %s\n", name, err)
+		os.Exit(1)
+	}
+}
+
+// newFlagSet returns the flag set for a command
+func newFlagSet(name string) *flag.FlagSet {
+	return flag.NewFlagSet("gq "+name, flag.ExitOnError)
+}
+
+// requireQueue returns an error if queue is empty, which for destructive commands is safer than defaulting it
+func requireQueue(queue string) error {
+	if strings.TrimSpace(queue) == "" {
+		return errors.New("-queue is required")
+	}
+	return nil
+}
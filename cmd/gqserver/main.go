@@ -0,0 +1,121 @@
+// Command gqserver serves the gqhttp API, so that services which aren't written in Go can push and receive gq messages.
+//
+//	gqserver -addr :8080 -driver postgres -dsn "$DATABASE_URL"
+//
+// The driver and DSN default to the GQ_DRIVER and GQ_DSN environment variables. The API is unauthenticated, so the server
+// should only be reachable by trusted services.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+	"github.com/mattbonnell/gq"
+	"github.com/mattbonnell/gq/gqhttp"
+)
+
+const shutdownTimeout = 30 * time.Second
+
+func main() {
+	addr := flag.String("addr", ":8080", "address to listen on")
+	driver := flag.String("driver", os.Getenv("GQ_DRIVER"), "database driver: mysql or postgres (env GQ_DRIVER)")
+	dsn := flag.String("dsn", os.Getenv("GQ_DSN"), "database DSN (env GQ_DSN)")
+	schema := flag.String("schema", os.Getenv("GQ_SCHEMA"), "schema containing gq's tables (env GQ_SCHEMA)")
+	prefix := flag.String("prefix", os.Getenv("GQ_TABLE_PREFIX"), "prefix of gq's table names (env GQ_TABLE_PREFIX)")
+	migrate := flag.Bool("migrate", false, "migrate the schema on startup, instead of requiring it to be migrated already")
+	maxWait := flag.Duration("max-wait", 0, "longest a receive request may long-poll for (default 20s)")
+	defaultLease := flag.Duration("default-lease", 0, "lease on received messages when the receiver doesn't specify one (default 30s)")
+	maxRetries := flag.Int("max-retries", 0, "number of times a nacked message is retried before it is dead-lettered (default 3)")
+	queues := flag.String("queues", os.Getenv("GQ_QUEUES"), "comma-separated queues to serve, rejecting others (env GQ_QUEUES; default: any, up to -max-queues)")
+	maxQueues := flag.Int("max-queues", 0, "most queues to serve if -queues isn't set (default 100)")
+	flag.Parse()
+
+	log := slog.New(slog.NewJSONHandler(os.Stderr, nil))
+	if err := run(log, *addr, *driver, *dsn, gq.ClientOptions{
+		DisableMigrations: !*migrate,
+		Schema:            *schema,
+		TablePrefix:       *prefix,
+		Logger:            gq.NewSlogLogger(log),
+	}, gqhttp.Options{
+		MaxWait:              *maxWait,
+		DefaultLease:         *defaultLease,
+		MaxProcessingRetries: *maxRetries,
+		Queues:               splitQueues(*queues),
+		MaxQueues:            *maxQueues,
+	}); err != nil {
+		log.Error("gqserver failed", "error", err)
+		os.Exit(1)
+	}
+}
+
+// splitQueues splits a comma-separated list of queue names, returning nil if it is empty
+func splitQueues(list string) []string {
+	var queues []string
+	for _, q := range strings.Split(list, ",") {
+		if q = strings.TrimSpace(q); q != "" {
+			queues = append(queues, q)
+		}
+	}
+	return queues
+}
+
+func run(log *slog.Logger, addr, driver, dsn string, clientOpts gq.ClientOptions, handlerOpts gqhttp.Options) error {
+	if driver == "" || dsn == "" {
+		return errors.New("a driver and DSN are required: set -driver and -dsn, or GQ_DRIVER and GQ_DSN")
+	}
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	client, err := gq.NewClientWithOptions(db, driver, clientOpts)
+	if err != nil {
+		return fmt.Errorf("could not create client: %s", err)
+	}
+
+	// cancelled when shutdown begins, so that long-polling receive requests return promptly
+	baseCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           gqhttp.NewHandler(client, handlerOpts),
+		ReadHeaderTimeout: 10 * time.Second,
+		BaseContext:       func(net.Listener) context.Context { return baseCtx },
+	}
+	errs := make(chan error, 1)
+	go func() {
+		log.Info("serving gq HTTP API", "addr", addr)
+		errs <- srv.ListenAndServe()
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	select {
+	case err := <-errs:
+		client.Close()
+		return err
+	case sig := <-signals:
+		log.Info("shutting down", "signal", sig.String())
+	}
+	cancel()
+	ctx, cancelShutdown := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancelShutdown()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Error("error shutting down HTTP server", "error", err)
+	}
+	// flushes any messages still buffered by producers
+	return client.Close()
+}
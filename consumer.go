@@ -3,11 +3,11 @@ package gq
 import (
 	"context"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/mattbonnell/gq/internal"
-	"github.com/rs/zerolog/log"
 )
 
 const (
@@ -23,21 +23,43 @@ const (
 // ConsumerOptions represents the options which can be used to tailor producer behaviour
 type ConsumerOptions struct {
 	// PullPeriod is the period messages should be pulled at (default: 50ms).
-	// This can be tuned to achieve the desired throughput/latency tradeoff
+	// This can be tuned to achieve the desired throughput/latency tradeoff. A consumer pulls again immediately after pulling a
+	// full batch, and backs off from the pull period while the queue is empty
 	PullPeriod time.Duration
+	// MaxIdlePullPeriod is the longest a consumer backs off between pulls while the queue is empty (default: 1s)
+	MaxIdlePullPeriod time.Duration
 	// MaxPullSize is the maximum number of messages to be pulled in one batch (default: 50)
 	MaxBatchSize int
-	// MaxProcessingRetries is the maximum number of times that a message will be requeued for re-processing after processing fails (default: 3)
+	// MaxProcessingRetries is the maximum number of times that a message will be requeued for re-processing after processing fails (default: 3).
+	// A message which fails once it has been retried this many times is moved to the dead-letter table
 	MaxProcessingRetries int
-	// Concurrency is the number of concurrent goroutines to pull messages from (default: 1)
+	// Concurrency is the number of concurrent goroutines to pull messages from (default: 1).
+	// It is ignored if Autoscale is enabled
 	Concurrency int
+	// Queue is the name of the queue to pull messages from (default: "default")
+	Queue string
+	// RateLimit limits the rate at which messages are claimed, across all of the consumer's goroutines (default: unlimited).
+	// Each pull claims no more messages than there are tokens, so that throttled messages aren't left locked
+	RateLimit RateLimit
+	// MaxInFlight, if positive, is the most messages which may be processed at once by every consumer of the queue together,
+	// across processes (default: unlimited). Every consumer of the queue should set the same limit
+	MaxInFlight int
+	// InFlightKey names the limit MaxInFlight sets (default: the queue's name). Consumers of different queues which set the same
+	// key share a limit, such as one on a downstream they all call
+	InFlightKey string
+	// Autoscale, if its MaxConcurrency is positive, adjusts the number of goroutines to pull messages from between its minimum
+	// and maximum, according to the queue's backlog and the handler's latency and error rate (default: disabled)
+	Autoscale Autoscale
 }
 
 func defaultConsumerOpts() ConsumerOptions {
 	return ConsumerOptions{
-		PullPeriod:   defaultPullPeriod,
-		MaxBatchSize: defaultMaxBatchSize,
-		Concurrency:  1,
+		PullPeriod:           defaultPullPeriod,
+		MaxIdlePullPeriod:    defaultMaxIdlePullPeriod,
+		MaxBatchSize:         defaultMaxBatchSize,
+		MaxProcessingRetries: processingMaxRetries,
+		Concurrency:          1,
+		Queue:                DefaultQueue,
 	}
 }
 
@@ -47,111 +69,351 @@ type ProcessFunc func(message []byte) error
 // Consumer represents a gq consumer
 type Consumer struct {
 	db      *sqlx.DB
-	process ProcessFunc
+	tables  internal.Tables
+	dialect *internal.Dialect
+	now     func() time.Time
+	log     Logger
+	metrics Metrics
+	tracer  Tracer
+	handle  HandlerFunc
 	opts    ConsumerOptions
+	pause   pauseCache
+	limiter rateLimiter
+	slots   *inFlightLimit
+	stats   *processingStats
+	// workers holds a stop channel for each goroutine pulling messages
+	workers []chan struct{}
+
+	stop      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
 }
 
-func newConsumer(ctx context.Context, db *sqlx.DB, process ProcessFunc, opts *ConsumerOptions) (*Consumer, error) {
-	c := &Consumer{db: db, process: process}
+func newConsumer(ctx context.Context, cl *Client, handle HandlerFunc, opts *ConsumerOptions) (*Consumer, error) {
+	c := &Consumer{db: cl.db, tables: cl.tables, dialect: cl.dialect, now: cl.now, log: cl.opts.Logger, metrics: cl.opts.Metrics, tracer: cl.opts.Tracer, handle: handle, stop: make(chan struct{})}
 	if opts != nil {
 		c.opts = *opts
+		c.opts.Queue = queueOrDefault(c.opts.Queue)
+		if c.opts.MaxBatchSize <= 0 {
+			// a batch size of zero would claim nothing, yet look like a full batch
+			c.opts.MaxBatchSize = defaultMaxBatchSize
+		}
 	} else {
 		c.opts = defaultConsumerOpts()
 	}
-	for i := 0; i < c.opts.Concurrency; i++ {
-		go c.startPullingMessages(ctx)
+	c.limiter = newRateLimiter(cl.db, cl.dialect, cl.tables, c.opts.Queue, c.opts.RateLimit)
+	inFlightKey := c.opts.InFlightKey
+	if inFlightKey == "" {
+		inFlightKey = c.opts.Queue
+	}
+	c.slots = newInFlightLimit(cl.db, cl.dialect, cl.tables, inFlightKey, c.opts.MaxInFlight)
+	if handle == nil {
+		// lease consumers only claim messages when Receive is called
+		return c, nil
+	}
+	c.wg.Add(1)
+	go c.startSweepingReplies(ctx)
+	if !c.opts.Autoscale.enabled() {
+		for i := 0; i < c.opts.Concurrency; i++ {
+			c.addWorker(ctx)
+		}
+		return c, nil
 	}
+	c.opts.Autoscale = c.opts.Autoscale.withDefaults()
+	c.stats = &processingStats{}
+	for i := 0; i < c.opts.Autoscale.MinConcurrency; i++ {
+		c.addWorker(ctx)
+	}
+	c.scaled(len(c.workers), ScaleStarted)
+	c.wg.Add(1)
+	go c.autoscale(ctx)
 	return c, nil
 }
 
-func (c *Consumer) startPullingMessages(ctx context.Context) {
-	ticker := time.NewTicker(c.opts.PullPeriod)
+// Close stops the consumer from pulling messages, waiting for any messages it is processing to be completed
+func (c *Consumer) Close() {
+	c.closeOnce.Do(func() {
+		close(c.stop)
+		c.wg.Wait()
+		if c.stats != nil {
+			c.scaled(-len(c.workers), ScaleStopped)
+		}
+	})
+}
+
+// addWorker starts another goroutine pulling messages
+func (c *Consumer) addWorker(ctx context.Context) {
+	stop := make(chan struct{})
+	c.workers = append(c.workers, stop)
+	c.wg.Add(1)
+	go c.startPullingMessages(ctx, stop)
+}
+
+// removeWorker stops the most recently started goroutine pulling messages, once it has finished any pull in progress
+func (c *Consumer) removeWorker() {
+	last := len(c.workers) - 1
+	close(c.workers[last])
+	c.workers = c.workers[:last]
+}
+
+func (c *Consumer) startPullingMessages(ctx context.Context, stop <-chan struct{}) {
+	defer c.wg.Done()
+	sched := newPullScheduler(c.opts.PullPeriod, c.opts.MaxIdlePullPeriod)
+	// the first pull is jittered too, so that consumers started together don't pull together
+	timer := time.NewTimer(jitter(sched.period))
+	defer timer.Stop()
 	for {
 		select {
 		case <-ctx.Done():
-			log.Debug().Msgf("stopping message pulling: %s", ctx.Err())
+			c.log.Debug("stopping message pulling", "reason", ctx.Err())
 			return
-		case <-ticker.C:
-			c.pullMessages(time.Now().UTC())
+		case <-c.stop:
+			c.log.Debug("consumer closed, stopping message pulling")
+			return
+		case <-stop:
+			c.log.Debug("consumer scaled down, stopping message pulling")
+			return
+		case <-timer.C:
+			outcome := pullThrottled
+			paused, err := c.paused(ctx)
+			if err != nil {
+				c.log.Error("error reading queue pause", "error", err)
+			}
+			if !paused {
+				outcome = c.pullMessages(ctx, c.now())
+			}
+			timer.Reset(sched.next(outcome))
 		}
 	}
 }
 
-func (c *Consumer) pullMessages(now time.Time) {
-	log.Debug().Msg("pulling new messages")
-	tx, err := c.db.Beginx()
+// takeTokens returns the number of messages, up to n, which the consumer's rate limit allows it to claim, and whether it's
+// more than none
+func (c *Consumer) takeTokens(ctx context.Context, n int, now time.Time) (int, bool) {
+	if c.limiter == nil {
+		return n, true
+	}
+	taken, err := c.limiter.take(ctx, n, now)
 	if err != nil {
-		e := fmt.Errorf("error beginning message pull transaction: %s", err)
-		log.Debug().Err(e)
+		c.log.Error("error taking rate limit tokens", "queue", c.opts.Queue, "error", err)
+		return 0, false
+	}
+	if taken == 0 {
+		c.log.Debug("rate limited", "queue", c.opts.Queue)
+	}
+	return taken, taken > 0
+}
+
+// refundTokens returns the tokens taken for messages which weren't claimed
+func (c *Consumer) refundTokens(ctx context.Context, n int) {
+	if c.limiter == nil || n <= 0 {
 		return
 	}
+	if err := c.limiter.refund(ctx, n); err != nil {
+		c.log.Error("error refunding rate limit tokens", "queue", c.opts.Queue, "error", err)
+	}
+}
+
+// result records the outcome of processing a pulled message
+type result struct {
+	message         internal.Message
+	err             error
+	handlerDuration time.Duration
+	outcome         Outcome
+	// value is the result the handler set, recorded in the status of a tracked message
+	value []byte
+}
+
+func (c *Consumer) pullMessages(ctx context.Context, now time.Time) pullOutcome {
+	taken, ok := c.takeTokens(ctx, c.opts.MaxBatchSize, now)
+	if !ok {
+		return pullThrottled
+	}
+	claimed := 0
+	defer func() { c.refundTokens(ctx, taken-claimed) }()
+	c.log.Debug("pulling new messages", "queue", c.opts.Queue)
+	tx, err := c.db.BeginTxx(ctx, nil)
+	if err != nil {
+		c.log.Error("error beginning message pull transaction", "error", err)
+		return pullEmpty
+	}
 	defer tx.Rollback()
-	query := tx.Rebind("SELECT id, payload, retries FROM message WHERE ready_at <= ? ORDER BY ready_at ASC LIMIT ? FOR UPDATE SKIP LOCKED")
+	limit := taken
+	if c.slots != nil {
+		// the slots stay locked until the transaction ends, once the claimed messages have been processed
+		slots, err := c.slots.lock(ctx, tx, limit, now)
+		if err != nil {
+			c.log.Error("error locking concurrency slots", "error", err)
+			return pullEmpty
+		}
+		if len(slots) == 0 {
+			c.log.Debug("in-flight limit reached", "queue", c.opts.Queue)
+			return pullThrottled
+		}
+		limit = len(slots)
+	}
+	query := tx.Rebind(fmt.Sprintf("SELECT id, payload, headers, retries, created_at, unique_key, tracked FROM %s WHERE queue = ? AND ready_at <= ? ORDER BY priority DESC, ready_at ASC LIMIT ? FOR UPDATE SKIP LOCKED", c.tables.Message))
 	// use Query instead of QueryRow so that we can close the Rows after processing the message, thus allowing us to scan the payload into an sql.RawBytes
 	// and avoid having to copy it
-	rows, err := tx.Queryx(query, now, c.opts.MaxBatchSize)
+	rows, err := tx.Queryx(query, c.opts.Queue, now, limit)
 	if err != nil {
-		log.Debug().Err(err).Msg("error pulling messages")
-		return
+		c.log.Error("error pulling messages", "error", err)
+		return pullEmpty
 	}
 	defer rows.Close()
 	var m internal.Message
-	errMsgs := make([]internal.Message, 0, c.opts.MaxBatchSize)
-	successMsgIds := make([]int64, 0, c.opts.MaxBatchSize)
+	results := make([]result, 0, limit)
 	for rows.Next() {
-		if err := rows.Scan(&m.ID, &m.Payload, &m.Retries); err != nil {
-			log.Debug().Err(err).Msg("error scanning messages")
-		}
-		log.Debug().Msgf("pulled message %d", m.ID)
-		log.Debug().Msgf("processing message %d", m.ID)
-		if err := c.process([]byte(m.Payload)); err != nil {
-			log.Debug().Err(err).Msgf("error processing message %d", m.ID)
-			errMsgs = append(errMsgs, m)
+		claimed++
+		if err := rows.Scan(&m.ID, &m.Payload, &m.Headers, &m.Retries, &m.CreatedAt, &m.UniqueKey, &m.Tracked); err != nil {
+			c.log.Error("error scanning messages", "error", err)
+			continue
+		}
+		c.log.Debug("processing message", "id", m.ID)
+		if m.Tracked {
+			// recorded outside the transaction, so that the message is seen to be running until it commits
+			if err := startJob(ctx, c.db, c.tables, []int64{m.ID}, c.now()); err != nil {
+				c.log.Error("error recording job start", "id", m.ID, "error", err)
+			}
+		}
+		start := time.Now()
+		value, err := c.process(ctx, m)
+		r := result{message: m, err: err, handlerDuration: time.Since(start), outcome: OutcomeAcked, value: value}
+		if err != nil {
+			c.log.Debug("error processing message", "id", m.ID, "error", err)
+			// the payload is only valid until the next call to rows.Next, and is needed if the message is dead-lettered
+			r.message.Payload = append([]byte(nil), m.Payload...)
+			r.outcome = OutcomeRetried
+			if int(m.Retries) >= c.opts.MaxProcessingRetries {
+				r.outcome = OutcomeDeadLettered
+			}
 		} else {
-			log.Debug().Msgf("successfully processed message %d", m.ID)
-			successMsgIds = append(successMsgIds, m.ID)
+			c.log.Debug("successfully processed message", "id", m.ID)
 		}
+		results = append(results, r)
 	}
 	if err := rows.Err(); err != nil {
-		log.Debug().Err(err).Msg("error from query result")
-		return
+		c.log.Error("error from query result", "error", err)
+		return pullEmpty
 	}
 	rows.Close()
-	for _, m := range errMsgs {
-		if int(m.Retries) < c.opts.MaxProcessingRetries {
-			query := c.db.Rebind("UPDATE message WHERE id = ? SET retries = ?, ready_at = ?")
-			numRetries := m.Retries + 1
-			backoffPeriodSeconds := retryInitialBackoffPeriodSeconds * numRetries
-			readyAt := time.Now().UTC().Add(time.Second * time.Duration(backoffPeriodSeconds))
-			res, err := tx.Exec(query, m.ID, numRetries, readyAt)
-			if err != nil {
-				e := fmt.Errorf("error setting next ready_at: %s", err)
-				log.Debug().Err(e).Msg("error")
+	c.metrics.MessagesPulled(c.opts.Queue, len(results))
+	deleteIds := make([]int64, 0, len(results))
+	var uniqueIds []int64
+	workflows := newWorkflowUpdates(ctx, c.tracer)
+	for _, r := range results {
+		if r.outcome != OutcomeRetried && r.message.UniqueKey.Valid {
+			uniqueIds = append(uniqueIds, r.message.ID)
+		}
+		switch r.outcome {
+		case OutcomeAcked:
+			deleteIds = append(deleteIds, r.message.ID)
+		case OutcomeRetried:
+			if err := c.retry(tx, r.message); err != nil {
+				c.log.Error("error requeueing message for retry", "id", r.message.ID, "error", err)
+				return pullEmpty
+			}
+		case OutcomeDeadLettered:
+			if err := c.deadLetter(tx, r.message, r.err); err != nil {
+				c.log.Error("error moving message to dead-letter table", "id", r.message.ID, "error", err)
+				return pullEmpty
 			}
-			n, err := res.RowsAffected()
-			if err != nil || n != 1 {
-				e := fmt.Errorf("error setting next ready_at: %s", err)
-				log.Debug().Err(e).Msg("error")
+			deleteIds = append(deleteIds, r.message.ID)
+		}
+		if r.message.Tracked {
+			if err := finishJob(ctx, tx, c.tables, workflows, r.message.ID, r.outcome, r.err, r.value, c.now()); err != nil {
+				c.log.Error("error recording job outcome", "id", r.message.ID, "error", err)
+				return pullEmpty
 			}
 		}
 	}
-	if len(successMsgIds) > 0 {
-		log.Debug().Msg("deleting successfully processed messages from the queue")
-		query, args, err := sqlx.In("DELETE FROM message WHERE id in (?)", successMsgIds)
+	if len(deleteIds) > 0 {
+		c.log.Debug("deleting processed messages from the queue", "count", len(deleteIds))
+		query, args, err := sqlx.In(fmt.Sprintf("DELETE FROM %s WHERE id in (?)", c.tables.Message), deleteIds)
 		if err != nil {
-			log.Debug().Err(err).Msg("error formulating delete query")
-			return
+			c.log.Error("error formulating delete query", "error", err)
+			return pullEmpty
 		}
 		query = tx.Rebind(query)
 		_, err = tx.Exec(query, args...)
 		if err != nil {
-			log.Debug().Err(err).Msg("error deleting messages from queue")
-			return
+			c.log.Error("error deleting messages from queue", "error", err)
+			return pullEmpty
 		}
 
 	}
-	if err := tx.Commit(); err != nil {
-		log.Debug().Msg("error committing tx")
-		return
+	if len(uniqueIds) > 0 {
+		if err := releaseUnique(ctx, tx, c.dialect, c.tables, uniqueIds, c.now()); err != nil {
+			c.log.Error("error releasing unique messages", "error", err)
+			return pullEmpty
+		}
+	}
+	if err := workflows.advance(ctx, tx, c.dialect, c.tables, c.now()); err != nil {
+		workflows.report(c.metrics, err)
+		c.log.Error("error advancing workflows", "error", err)
+		return pullEmpty
+	}
+	err = tx.Commit()
+	workflows.report(c.metrics, err)
+	if err != nil {
+		c.log.Error("error committing message pull transaction", "error", err)
+		return pullEmpty
+	}
+	committedAt := c.now()
+	for _, r := range results {
+		c.metrics.MessageProcessed(c.opts.Queue, r.outcome, r.handlerDuration, committedAt.Sub(r.message.CreatedAt.Time))
+		if c.stats != nil {
+			c.stats.record(r.err != nil, r.handlerDuration)
+		}
+	}
+	switch {
+	case claimed > 0 && claimed == limit:
+		return pullFull
+	case claimed > 0:
+		return pullPartial
+	}
+	return pullEmpty
+}
+
+// process passes a pulled message to the handler, within the span started by the tracer, returning any result it set
+func (c *Consumer) process(ctx context.Context, m internal.Message) ([]byte, error) {
+	msg := &Message{
+		ID:        m.ID,
+		Queue:     c.opts.Queue,
+		Payload:   []byte(m.Payload),
+		Headers:   m.Headers,
+		Attempt:   int(m.Retries) + 1,
+		CreatedAt: m.CreatedAt.Time,
+	}
+	ctx, end := c.tracer.StartProcess(ctx, msg)
+	err := c.handle(ctx, msg)
+	end(err)
+	// the result may alias the payload, which is only valid until the next row is scanned
+	return append([]byte(nil), msg.result...), err
+}
+
+// retry requeues a message which failed processing, backing off linearly with its number of retries.
+// Any lease on the message is released
+func (c *Consumer) retry(tx *sqlx.Tx, m internal.Message) error {
+	numRetries := m.Retries + 1
+	backoffPeriodSeconds := retryInitialBackoffPeriodSeconds * numRetries
+	readyAt := c.now().Add(time.Second * time.Duration(backoffPeriodSeconds))
+	query := tx.Rebind(fmt.Sprintf("UPDATE %s SET retries = ?, ready_at = ?, lease_token = NULL WHERE id = ?", c.tables.Message))
+	res, err := tx.Exec(query, numRetries, readyAt, m.ID)
+	if err != nil {
+		return fmt.Errorf("error setting next ready_at: %s", err)
+	}
+	if n, err := res.RowsAffected(); err != nil || n != 1 {
+		return fmt.Errorf("error setting next ready_at: %d rows affected: %v", n, err)
+	}
+	return nil
+}
+
+// deadLetter copies a message which has exhausted its retries to the dead-letter table. The caller deletes it from the queue
+func (c *Consumer) deadLetter(tx *sqlx.Tx, m internal.Message, processErr error) error {
+	query := tx.Rebind(fmt.Sprintf("INSERT INTO %s (id, queue, payload, headers, created_at, failed_at, retries, last_error) VALUES (?, ?, ?, ?, ?, ?, ?, ?)", c.tables.DeadMessage))
+	if _, err := tx.Exec(query, m.ID, c.opts.Queue, []byte(m.Payload), m.Headers, m.CreatedAt.Time, c.now(), m.Retries, processErr.Error()); err != nil {
+		return fmt.Errorf("error inserting dead message: %s", err)
 	}
+	return nil
 }
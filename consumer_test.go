@@ -2,18 +2,70 @@ package gq
 
 import (
 	"context"
+	"errors"
 	"regexp"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
-	"github.com/jmoiron/sqlx"
-	"github.com/mattbonnell/gq/internal"
 	"github.com/stretchr/testify/require"
 )
 
 const arbitraryDriverName = "mysql"
 
+// recordingMetrics records the outcomes reported to it
+type recordingMetrics struct {
+	nopMetrics
+	mu       sync.Mutex
+	pushed   map[Outcome]int
+	pulled   int
+	outcomes []Outcome
+}
+
+func newRecordingMetrics() *recordingMetrics {
+	return &recordingMetrics{pushed: make(map[Outcome]int)}
+}
+
+func (r *recordingMetrics) MessagesPushed(queue string, count int, outcome Outcome, duration time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.pushed[outcome] += count
+}
+
+func (r *recordingMetrics) MessagesPulled(queue string, count int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.pulled += count
+}
+
+func (r *recordingMetrics) MessageProcessed(queue string, outcome Outcome, handlerDuration time.Duration, endToEndLatency time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.outcomes = append(r.outcomes, outcome)
+}
+
+// idleConsumerOpts returns consumer options whose pull period is long enough that only explicit calls to pullMessages pull messages
+func idleConsumerOpts() *ConsumerOptions {
+	opts := defaultConsumerOpts()
+	opts.PullPeriod = time.Hour
+	return &opts
+}
+
+func expectPull(mock sqlmock.Sqlmock, now time.Time, rows *sqlmock.Rows) {
+	mock.ExpectBegin()
+	mock.
+		ExpectQuery(
+			regexp.QuoteMeta(`SELECT id, payload, headers, retries, created_at, unique_key, tracked FROM message WHERE queue = ? AND ready_at <= ? ORDER BY priority DESC, ready_at ASC LIMIT ? FOR UPDATE SKIP LOCKED`),
+		).
+		WithArgs(
+			DefaultQueue,
+			now,
+			defaultMaxBatchSize,
+		).
+		WillReturnRows(rows)
+}
+
 func TestPullMessageShouldSucceed_OneMessage(t *testing.T) {
 	db, mock, err := sqlmock.New()
 	if err != nil {
@@ -25,36 +77,28 @@ func TestPullMessageShouldSucceed_OneMessage(t *testing.T) {
 
 	now := time.Now().UTC()
 
-	expectedMessage := internal.Message{}
-	expectedMessage.ID = 1
+	var expectedID int64 = 1
 	expectedPayload := []byte("message payload")
 
-	c, err := newConsumer(ctx, sqlx.NewDb(db, arbitraryDriverName), func(message []byte) error {
+	cl := newTestClient(db)
+	metrics := newRecordingMetrics()
+	cl.opts.Metrics = metrics
+	c, err := newConsumer(ctx, cl, ProcessFunc(func(message []byte) error {
 		require.Equal(t, expectedPayload, message)
 		return nil
-	}, nil)
-
-	mock.ExpectBegin()
+	}).handlerFunc(), idleConsumerOpts())
+	require.NoError(t, err)
+	defer c.Close()
 
-	mock.
-		ExpectQuery(
-			regexp.QuoteMeta(`SELECT id, payload, retries FROM message WHERE ready_at <= ? ORDER BY ready_at ASC LIMIT ? FOR UPDATE SKIP LOCKED`),
-		).
-		WithArgs(
-			now,
-			c.opts.MaxBatchSize,
-		).
-		WillReturnRows(
-			sqlmock.NewRows([]string{"id", "payload", "retries"}).
-				AddRow(expectedMessage.ID, expectedPayload, expectedMessage.Retries),
-		)
+	expectPull(mock, now, sqlmock.NewRows([]string{"id", "payload", "headers", "retries", "created_at", "unique_key", "tracked"}).
+		AddRow(expectedID, expectedPayload, nil, 0, now, nil, false))
 
 	mock.
 		ExpectExec(
-			regexp.QuoteMeta(`DELETE FROM message WHERE id = ?`),
+			regexp.QuoteMeta(`DELETE FROM message WHERE id in (?)`),
 		).
 		WithArgs(
-			expectedMessage.ID,
+			expectedID,
 		).
 		WillReturnResult(
 			sqlmock.NewResult(0, 1),
@@ -63,4 +107,53 @@ func TestPullMessageShouldSucceed_OneMessage(t *testing.T) {
 	mock.ExpectCommit()
 
 	c.pullMessages(ctx, now)
+	require.NoError(t, mock.ExpectationsWereMet())
+	require.Equal(t, 1, metrics.pulled)
+	require.Equal(t, []Outcome{OutcomeAcked}, metrics.outcomes)
+}
+
+func TestPullMessageShouldRetryAndDeadLetter(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	ctx := context.Background()
+	now := time.Now().UTC()
+
+	cl := newTestClient(db)
+	cl.opts.Clock = func() time.Time { return now }
+	metrics := newRecordingMetrics()
+	cl.opts.Metrics = metrics
+	processErr := errors.New("processing failed")
+	c, err := newConsumer(ctx, cl, func(ctx context.Context, m *Message) error {
+		if m.ID == 2 {
+			require.Equal(t, map[string]string{"k": "v"}, m.Headers)
+			require.Equal(t, processingMaxRetries+1, m.Attempt)
+		}
+		return processErr
+	}, idleConsumerOpts())
+	require.NoError(t, err)
+	defer c.Close()
+
+	expectPull(mock, now, sqlmock.NewRows([]string{"id", "payload", "headers", "retries", "created_at", "unique_key", "tracked"}).
+		AddRow(1, []byte("retried"), nil, 0, now, nil, false).
+		AddRow(2, []byte("dead"), `{"k":"v"}`, processingMaxRetries, now, nil, false))
+
+	mock.
+		ExpectExec(regexp.QuoteMeta(`UPDATE message SET retries = ?, ready_at = ?, lease_token = NULL WHERE id = ?`)).
+		WithArgs(1, now.Add(retryInitialBackoffPeriodSeconds*time.Second), 1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.
+		ExpectExec(regexp.QuoteMeta(`INSERT INTO dead_message (id, queue, payload, headers, created_at, failed_at, retries, last_error) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`)).
+		WithArgs(2, DefaultQueue, []byte("dead"), `{"k":"v"}`, now, now, processingMaxRetries, processErr.Error()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.
+		ExpectExec(regexp.QuoteMeta(`DELETE FROM message WHERE id in (?)`)).
+		WithArgs(2).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	c.pullMessages(ctx, now)
+	require.NoError(t, mock.ExpectationsWereMet())
+	require.Equal(t, []Outcome{OutcomeRetried, OutcomeDeadLettered}, metrics.outcomes)
 }
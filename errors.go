@@ -0,0 +1,20 @@
+package gq
+
+import "errors"
+
+var (
+	// ErrClientClosed is returned when spawning a Producer or Consumer from a Client which has been closed
+	ErrClientClosed = errors.New("gq: client closed")
+	// ErrNotFound is returned when a message looked up by ID does not exist
+	ErrNotFound = errors.New("gq: message not found")
+	// ErrLeaseLost is returned when acking, nacking or extending the lease on a message whose lease has expired
+	// and which has since been delivered again, or removed
+	ErrLeaseLost = errors.New("gq: lease lost")
+	// ErrProducerClosed is returned by PushSync when the producer is closed before the message is pushed
+	ErrProducerClosed = errors.New("gq: producer closed")
+	// ErrInFlight is returned when cancelling or updating a message which is being processed
+	ErrInFlight = errors.New("gq: message in flight")
+	// ErrBufferFull is returned when pushing a message onto a producer whose buffer is full, under OverflowError, or once
+	// BufferTimeout passes under OverflowBlock
+	ErrBufferFull = errors.New("gq: producer buffer full")
+)
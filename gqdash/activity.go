@@ -0,0 +1,115 @@
+package gqdash
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mattbonnell/gq"
+)
+
+const (
+	defaultBucketWidth = 10 * time.Second
+	defaultBuckets     = 90
+)
+
+// ActivityBucket counts the messages pushed and processed on a queue during one bucket of time
+type ActivityBucket struct {
+	Start        time.Time `json:"start"`
+	Pushed       int64     `json:"pushed"`
+	Acked        int64     `json:"acked"`
+	Retried      int64     `json:"retried"`
+	DeadLettered int64     `json:"dead_lettered"`
+}
+
+// ActivitySnapshot is the recent activity on every queue, oldest bucket first
+type ActivitySnapshot struct {
+	BucketSeconds float64                     `json:"bucket_seconds"`
+	Queues        map[string][]ActivityBucket `json:"queues"`
+}
+
+// Activity implements gq.Metrics by counting the messages pushed and processed by the process in recent buckets of time,
+// from which the dashboard draws its throughput graphs. It only sees the activity of Producers and Consumers created
+// from clients it is passed to, so processes which don't serve the dashboard aren't included
+type Activity struct {
+	width   time.Duration
+	buckets int
+	now     func() time.Time
+
+	mu     sync.Mutex
+	queues map[string][]ActivityBucket
+}
+
+var _ gq.Metrics = (*Activity)(nil)
+
+// NewActivity creates an Activity which keeps 15 minutes of history in 10 second buckets
+func NewActivity() *Activity {
+	return &Activity{width: defaultBucketWidth, buckets: defaultBuckets, now: time.Now, queues: map[string][]ActivityBucket{}}
+}
+
+// bucket returns the current bucket for queue, discarding any which have aged out. The caller must hold a.mu
+func (a *Activity) bucket(queue string) *ActivityBucket {
+	start := a.now().Truncate(a.width)
+	buckets := a.queues[queue]
+	if len(buckets) == 0 || buckets[len(buckets)-1].Start.Before(start) {
+		buckets = append(buckets, ActivityBucket{Start: start})
+	}
+	cutoff := start.Add(-a.width * time.Duration(a.buckets-1))
+	i := sort.Search(len(buckets), func(i int) bool { return !buckets[i].Start.Before(cutoff) })
+	buckets = buckets[i:]
+	a.queues[queue] = buckets
+	return &buckets[len(buckets)-1]
+}
+
+// MessagesPushed implements gq.Metrics
+func (a *Activity) MessagesPushed(queue string, count int, outcome gq.Outcome, duration time.Duration) {
+	if outcome != gq.OutcomeSuccess {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.bucket(queue).Pushed += int64(count)
+}
+
+// MessagesPulled implements gq.Metrics
+func (a *Activity) MessagesPulled(queue string, count int) {}
+
+// MessageProcessed implements gq.Metrics
+func (a *Activity) MessageProcessed(queue string, outcome gq.Outcome, handlerDuration time.Duration, endToEndLatency time.Duration) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	b := a.bucket(queue)
+	switch outcome {
+	case gq.OutcomeAcked:
+		b.Acked++
+	case gq.OutcomeRetried:
+		b.Retried++
+	case gq.OutcomeDeadLettered:
+		b.DeadLettered++
+	}
+}
+
+// BufferedMessages implements gq.Metrics
+func (a *Activity) BufferedMessages(queue string, delta int) {}
+
+// Snapshot returns the recent activity on every queue. Buckets in which there was no activity are included with zero counts
+func (a *Activity) Snapshot() ActivitySnapshot {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	end := a.now().Truncate(a.width)
+	start := end.Add(-a.width * time.Duration(a.buckets-1))
+	s := ActivitySnapshot{BucketSeconds: a.width.Seconds(), Queues: make(map[string][]ActivityBucket, len(a.queues))}
+	for queue, buckets := range a.queues {
+		filled := make([]ActivityBucket, a.buckets)
+		for i := range filled {
+			filled[i].Start = start.Add(a.width * time.Duration(i))
+		}
+		for _, b := range buckets {
+			if i := int(b.Start.Sub(start) / a.width); i >= 0 && i < a.buckets {
+				filled[i] = b
+			}
+		}
+		s.Queues[queue] = filled
+	}
+	return s
+}
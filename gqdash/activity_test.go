@@ -0,0 +1,38 @@
+package gqdash
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mattbonnell/gq"
+	"github.com/stretchr/testify/require"
+)
+
+func TestActivity(t *testing.T) {
+	a := NewActivity()
+	now := time.Date(2021, 3, 4, 5, 6, 0, 0, time.UTC)
+	a.now = func() time.Time { return now }
+
+	a.MessagesPushed("emails", 5, gq.OutcomeSuccess, time.Millisecond)
+	a.MessagesPushed("emails", 3, gq.OutcomeError, time.Millisecond)
+	a.MessageProcessed("emails", gq.OutcomeAcked, time.Millisecond, time.Second)
+	now = now.Add(defaultBucketWidth)
+	a.MessageProcessed("emails", gq.OutcomeRetried, time.Millisecond, time.Second)
+	a.MessageProcessed("emails", gq.OutcomeDeadLettered, time.Millisecond, time.Second)
+
+	s := a.Snapshot()
+	require.Equal(t, defaultBucketWidth.Seconds(), s.BucketSeconds)
+	buckets := s.Queues["emails"]
+	require.Len(t, buckets, defaultBuckets)
+	require.Equal(t, ActivityBucket{Start: now.Add(-defaultBucketWidth), Pushed: 5, Acked: 1}, buckets[defaultBuckets-2])
+	require.Equal(t, ActivityBucket{Start: now, Retried: 1, DeadLettered: 1}, buckets[defaultBuckets-1])
+	require.Equal(t, now.Add(-defaultBucketWidth*(defaultBuckets-1)), buckets[0].Start)
+
+	// buckets older than the window are discarded
+	now = now.Add(defaultBucketWidth * defaultBuckets)
+	a.MessagesPushed("emails", 1, gq.OutcomeSuccess, time.Millisecond)
+	require.Len(t, a.queues["emails"], 1)
+	s = a.Snapshot()
+	require.EqualValues(t, 1, s.Queues["emails"][defaultBuckets-1].Pushed)
+	require.Zero(t, s.Queues["emails"][0].Pushed)
+}
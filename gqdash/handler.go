@@ -0,0 +1,240 @@
+// Package gqdash serves a web dashboard for gq queues. It shows the depth and age of each queue, throughput graphs
+// drawn from recent activity, and the dead-letter table, from which messages can be retried, deleted or purged.
+//
+// The dashboard does no authentication, so it should be given the application's auth middleware. It uses relative URLs,
+// so it can be mounted under any prefix ending in a slash:
+//
+//	activity := gqdash.NewActivity()
+//	client, err := gq.NewClientWithOptions(db, "postgres", gq.ClientOptions{Metrics: activity})
+//	http.Handle("/gq/", http.StripPrefix("/gq", gqdash.NewHandler(client, gqdash.Options{Activity: activity, Middleware: requireAdmin})))
+package gqdash
+
+import (
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/mattbonnell/gq"
+)
+
+//go:embed static
+var static embed.FS
+
+const (
+	defaultDeadLimit = 50
+	maxDeadLimit     = 500
+	// csrfHeader must be set on requests which modify queues. Browsers don't allow cross-site forms to set headers,
+	// so requiring it stops other sites from submitting actions on behalf of a signed-in user
+	csrfHeader = "X-Gq-Dashboard"
+)
+
+// Options represents the options which can be used to tailor the dashboard
+type Options struct {
+	// Middleware wraps every request to the dashboard, and is where authentication and authorization belong (default: none)
+	Middleware func(http.Handler) http.Handler
+	// ReadOnly hides the buttons which retry, delete or purge messages, and rejects requests to do so (default: false)
+	ReadOnly bool
+	// Activity records the activity the throughput graphs are drawn from. It must also be set as, or included in,
+	// the Metrics of the clients whose activity should be graphed (default: no graphs are drawn)
+	Activity *Activity
+}
+
+type handler struct {
+	client *gq.Client
+	opts   Options
+	static http.Handler
+}
+
+// NewHandler creates an http.Handler which serves the dashboard for client's queues
+func NewHandler(client *gq.Client, opts Options) http.Handler {
+	sub, err := fs.Sub(static, "static")
+	if err != nil {
+		panic(err) // the embedded directory always exists
+	}
+	var h http.Handler = &handler{client: client, opts: opts, static: http.FileServer(http.FS(sub))}
+	if opts.Middleware != nil {
+		h = opts.Middleware(h)
+	}
+	return h
+}
+
+// config is read by the dashboard's script to decide what to show
+type config struct {
+	ReadOnly bool `json:"read_only"`
+	Activity bool `json:"activity"`
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(r.URL.EscapedPath(), "/")
+	if !strings.HasPrefix(path, "api/") && path != "api" {
+		h.static.ServeHTTP(w, r)
+		return
+	}
+	parts := strings.Split(path, "/")[1:]
+	switch {
+	case len(parts) == 1 && parts[0] == "config":
+		if h.allow(w, r, http.MethodGet) {
+			writeJSON(w, http.StatusOK, config{ReadOnly: h.opts.ReadOnly, Activity: h.opts.Activity != nil})
+		}
+	case len(parts) == 1 && parts[0] == "stats":
+		if h.allow(w, r, http.MethodGet) {
+			h.stats(w, r)
+		}
+	case len(parts) == 1 && parts[0] == "activity":
+		if h.allow(w, r, http.MethodGet) {
+			h.activity(w)
+		}
+	case len(parts) >= 3 && parts[0] == "queues":
+		queue, err := url.PathUnescape(parts[1])
+		if err != nil || queue == "" {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid queue name %q", parts[1]))
+			return
+		}
+		h.queue(w, r, queue, parts[2:])
+	default:
+		writeError(w, http.StatusNotFound, errors.New("not found"))
+	}
+}
+
+// queue routes the requests under /api/queues/{queue}
+func (h *handler) queue(w http.ResponseWriter, r *http.Request, queue string, parts []string) {
+	switch {
+	case len(parts) == 1 && parts[0] == "dead":
+		if h.allow(w, r, http.MethodGet) {
+			h.dead(w, r, queue)
+		}
+	case len(parts) == 1 && parts[0] == "purge":
+		if h.mutation(w, r) {
+			h.count(w, r, func() (int64, error) { return h.client.Purge(r.Context(), queue) })
+		}
+	case len(parts) == 2 && parts[0] == "dead" && parts[1] == "purge":
+		if h.mutation(w, r) {
+			h.count(w, r, func() (int64, error) { return h.client.PurgeDead(r.Context(), queue) })
+		}
+	case len(parts) == 2 && parts[0] == "dead" && parts[1] == "retry":
+		if h.mutation(w, r) {
+			h.count(w, r, func() (int64, error) { return h.client.Requeue(r.Context(), gq.RequeueFilter{Queue: queue}) })
+		}
+	case len(parts) == 3 && parts[0] == "dead" && (parts[2] == "retry" || parts[2] == "delete"):
+		id, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid message ID %q", parts[1]))
+			return
+		}
+		if !h.mutation(w, r) {
+			return
+		}
+		if parts[2] == "retry" {
+			h.count(w, r, func() (int64, error) {
+				return h.client.Requeue(r.Context(), gq.RequeueFilter{Queue: queue, IDs: []int64{id}})
+			})
+			return
+		}
+		h.count(w, r, func() (int64, error) {
+			if err := h.client.DeleteDead(r.Context(), queue, id); err != nil {
+				return 0, err
+			}
+			return 1, nil
+		})
+	default:
+		writeError(w, http.StatusNotFound, errors.New("not found"))
+	}
+}
+
+// allow writes an error response and returns false if the request's method isn't method
+func (h *handler) allow(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return false
+	}
+	return true
+}
+
+// mutation writes an error response and returns false if the request may not modify a queue
+func (h *handler) mutation(w http.ResponseWriter, r *http.Request) bool {
+	if !h.allow(w, r, http.MethodPost) {
+		return false
+	}
+	if h.opts.ReadOnly {
+		writeError(w, http.StatusForbidden, errors.New("the dashboard is read-only"))
+		return false
+	}
+	if r.Header.Get(csrfHeader) == "" {
+		writeError(w, http.StatusForbidden, fmt.Errorf("the %s header is required", csrfHeader))
+		return false
+	}
+	return true
+}
+
+func (h *handler) stats(w http.ResponseWriter, r *http.Request) {
+	stats, err := h.client.Stats(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
+
+func (h *handler) activity(w http.ResponseWriter) {
+	if h.opts.Activity == nil {
+		writeJSON(w, http.StatusOK, ActivitySnapshot{Queues: map[string][]ActivityBucket{}})
+		return
+	}
+	writeJSON(w, http.StatusOK, h.opts.Activity.Snapshot())
+}
+
+func (h *handler) dead(w http.ResponseWriter, r *http.Request, queue string) {
+	limit := defaultDeadLimit
+	if s := r.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 || n > maxDeadLimit {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("limit must be between 1 and %d", maxDeadLimit))
+			return
+		}
+		limit = n
+	}
+	messages, err := h.client.PeekDead(r.Context(), queue, limit)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, messages)
+}
+
+// countResponse is the response to an action, with the number of messages it affected
+type countResponse struct {
+	Count int64 `json:"count"`
+}
+
+func (h *handler) count(w http.ResponseWriter, r *http.Request, action func() (int64, error)) {
+	n, err := action()
+	if errors.Is(err, gq.ErrNotFound) {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, countResponse{Count: n})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, struct {
+		Error string `json:"error"`
+	}{err.Error()})
+}
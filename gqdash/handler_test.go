@@ -0,0 +1,174 @@
+package gqdash
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/mattbonnell/gq"
+	"github.com/mattbonnell/gq/internal"
+	"github.com/mattbonnell/gq/test"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestServer(t *testing.T, opts Options) (*httptest.Server, sqlmock.Sqlmock, time.Time) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err, "failed to open stub database connection")
+	d, err := internal.GetDialect("mysql", internal.DefaultTables)
+	require.NoError(t, err)
+	test.ExpectSchemaVersion(mock, internal.DefaultTables.SchemaVersion, d.LatestVersion())
+
+	now := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+	client, err := gq.NewClientWithOptions(db, "mysql", gq.ClientOptions{
+		DisableMigrations: true,
+		Clock:             func() time.Time { return now },
+		Logger:            gq.NewNopLogger(),
+	})
+	require.NoError(t, err)
+	srv := httptest.NewServer(http.StripPrefix("/gq", NewHandler(client, opts)))
+	t.Cleanup(func() {
+		srv.Close()
+		client.Close()
+		db.Close()
+	})
+	return srv, mock, now
+}
+
+func request(t *testing.T, method, url string, csrf bool) (*http.Response, string) {
+	req, err := http.NewRequest(method, url, nil)
+	require.NoError(t, err)
+	if csrf {
+		req.Header.Set(csrfHeader, "1")
+	}
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	return res, string(body)
+}
+
+func TestStaticAssets(t *testing.T) {
+	srv, _, _ := newTestServer(t, Options{})
+	for path, contains := range map[string]string{
+		"/gq/":          "<title>gq</title>",
+		"/gq/app.js":    "X-Gq-Dashboard",
+		"/gq/style.css": "#graphs",
+	} {
+		res, body := request(t, http.MethodGet, srv.URL+path, false)
+		require.Equal(t, http.StatusOK, res.StatusCode, path)
+		require.Contains(t, body, contains, path)
+	}
+}
+
+func TestStats(t *testing.T) {
+	srv, mock, now := newTestServer(t, Options{})
+	mock.ExpectQuery("SELECT queue,").
+		WillReturnRows(sqlmock.NewRows([]string{"queue", "ready", "delayed", "in_flight", "retrying", "max_retries", "oldest"}).
+			AddRow("emails", 3, 1, 0, 1, 2, now.Add(-time.Minute)))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT queue, COUNT(*) FROM dead_message GROUP BY queue")).
+		WillReturnRows(sqlmock.NewRows([]string{"queue", "count"}).AddRow("emails", 4))
+
+	res, body := request(t, http.MethodGet, srv.URL+"/gq/api/stats", false)
+	require.Equal(t, http.StatusOK, res.StatusCode, body)
+	stats := []gq.QueueStats{}
+	require.NoError(t, json.Unmarshal([]byte(body), &stats))
+	require.Equal(t, []gq.QueueStats{{Queue: "emails", Ready: 3, Delayed: 1, Retrying: 1, MaxRetries: 2, Dead: 4, OldestCreatedAt: now.Add(-time.Minute), OldestAge: time.Minute}}, stats)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestDeadLetters(t *testing.T) {
+	srv, mock, now := newTestServer(t, Options{})
+	mock.ExpectQuery(regexp.QuoteMeta("FROM dead_message WHERE queue = ? ORDER BY failed_at DESC LIMIT ?")).
+		WithArgs("emails", 10).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "queue", "payload", "headers", "retries", "created_at", "failed_at", "last_error"}).
+			AddRow(7, "emails", []byte(`{"to":"a"}`), nil, 3, now, now, "boom"))
+
+	res, body := request(t, http.MethodGet, srv.URL+"/gq/api/queues/emails/dead?limit=10", false)
+	require.Equal(t, http.StatusOK, res.StatusCode, body)
+	require.Contains(t, body, `"last_error":"boom"`)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestActions(t *testing.T) {
+	srv, mock, _ := newTestServer(t, Options{})
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM message WHERE queue = ?")).WithArgs("emails").WillReturnResult(sqlmock.NewResult(0, 5))
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM dead_message WHERE queue = ?")).WithArgs("emails").WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM dead_message WHERE id = ? AND queue = ?")).WithArgs(7, "emails").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM dead_message WHERE id = ? AND queue = ?")).WithArgs(9, "emails").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT id FROM dead_message WHERE 1 = 1 AND queue = ? AND id IN (?) FOR UPDATE")).
+		WithArgs("emails", 8).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(8))
+	mock.ExpectExec("INSERT INTO message").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM dead_message").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	res, body := request(t, http.MethodPost, srv.URL+"/gq/api/queues/emails/purge", true)
+	require.Equal(t, http.StatusOK, res.StatusCode, body)
+	require.JSONEq(t, `{"count": 5}`, body)
+	res, body = request(t, http.MethodPost, srv.URL+"/gq/api/queues/emails/dead/purge", true)
+	require.JSONEq(t, `{"count": 2}`, body)
+	res, _ = request(t, http.MethodPost, srv.URL+"/gq/api/queues/emails/dead/7/delete", true)
+	require.Equal(t, http.StatusNotFound, res.StatusCode)
+	res, body = request(t, http.MethodPost, srv.URL+"/gq/api/queues/emails/dead/9/delete", true)
+	require.Equal(t, http.StatusOK, res.StatusCode, body)
+	require.JSONEq(t, `{"count": 1}`, body)
+	res, body = request(t, http.MethodPost, srv.URL+"/gq/api/queues/emails/dead/8/retry", true)
+	require.Equal(t, http.StatusOK, res.StatusCode, body)
+	require.JSONEq(t, `{"count": 1}`, body)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestActions_Forbidden(t *testing.T) {
+	srv, _, _ := newTestServer(t, Options{})
+	res, body := request(t, http.MethodPost, srv.URL+"/gq/api/queues/emails/purge", false)
+	require.Equal(t, http.StatusForbidden, res.StatusCode)
+	require.Contains(t, body, csrfHeader)
+	res, _ = request(t, http.MethodGet, srv.URL+"/gq/api/queues/emails/purge", true)
+	require.Equal(t, http.StatusMethodNotAllowed, res.StatusCode)
+
+	srv, _, _ = newTestServer(t, Options{ReadOnly: true})
+	res, body = request(t, http.MethodPost, srv.URL+"/gq/api/queues/emails/dead/retry", true)
+	require.Equal(t, http.StatusForbidden, res.StatusCode)
+	require.Contains(t, body, "read-only")
+	_, body = request(t, http.MethodGet, srv.URL+"/gq/api/config", false)
+	require.JSONEq(t, `{"read_only": true, "activity": false}`, body)
+}
+
+func TestMiddleware(t *testing.T) {
+	srv, _, _ := newTestServer(t, Options{Middleware: func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != "secret" {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}})
+	res, body := request(t, http.MethodGet, srv.URL+"/gq/", false)
+	require.Equal(t, http.StatusUnauthorized, res.StatusCode)
+	require.True(t, strings.HasPrefix(body, "unauthorized"))
+}
+
+func TestActivityEndpoint(t *testing.T) {
+	activity := NewActivity()
+	activity.MessagesPushed("emails", 2, gq.OutcomeSuccess, time.Millisecond)
+	srv, _, _ := newTestServer(t, Options{Activity: activity})
+	res, body := request(t, http.MethodGet, srv.URL+"/gq/api/activity", false)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	snapshot := ActivitySnapshot{}
+	require.NoError(t, json.Unmarshal([]byte(body), &snapshot))
+	require.Len(t, snapshot.Queues["emails"], defaultBuckets)
+	var pushed int64
+	for _, b := range snapshot.Queues["emails"] {
+		pushed += b.Pushed
+	}
+	require.EqualValues(t, 2, pushed)
+}
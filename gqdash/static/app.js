@@ -0,0 +1,229 @@
+"use strict";
+
+const refreshInterval = 5000;
+let config = { read_only: true, activity: false };
+let deadQueue = null;
+
+async function api(path, method) {
+  const init = { method: method || "GET", headers: {} };
+  if (init.method !== "GET") {
+    init.headers["X-Gq-Dashboard"] = "1";
+  }
+  const res = await fetch("api/" + path, init);
+  const body = await res.json();
+  if (!res.ok) {
+    throw new Error(body.error || res.statusText);
+  }
+  return body;
+}
+
+function el(tag, attrs, ...children) {
+  const e = document.createElement(tag);
+  for (const [k, v] of Object.entries(attrs || {})) {
+    if (k === "onclick") {
+      e.addEventListener("click", v);
+    } else {
+      e.setAttribute(k, v);
+    }
+  }
+  for (const c of children) {
+    e.append(c instanceof Node ? c : String(c));
+  }
+  return e;
+}
+
+function showError(err) {
+  const p = document.getElementById("error");
+  p.textContent = err ? String(err.message || err) : "";
+  p.hidden = !err;
+}
+
+function age(ns) {
+  let s = Math.round(ns / 1e9);
+  if (s < 60) return s + "s";
+  if (s < 3600) return Math.floor(s / 60) + "m" + (s % 60) + "s";
+  if (s < 86400) return Math.floor(s / 3600) + "h" + Math.floor((s % 3600) / 60) + "m";
+  return Math.floor(s / 86400) + "d" + Math.floor((s % 86400) / 3600) + "h";
+}
+
+async function act(path, confirmation) {
+  if (confirmation && !window.confirm(confirmation)) {
+    return;
+  }
+  try {
+    await api(path, "POST");
+    showError(null);
+  } catch (err) {
+    showError(err);
+  }
+  refresh();
+}
+
+function queuePath(queue) {
+  return "queues/" + encodeURIComponent(queue);
+}
+
+function renderStats(stats) {
+  const tbody = document.querySelector("#queues tbody");
+  tbody.replaceChildren();
+  document.getElementById("no-queues").hidden = stats.length > 0;
+  for (const s of stats) {
+    const actions = el("td", {},
+      el("button", { onclick: () => showDead(s.queue) }, "Dead letters"));
+    if (!config.read_only) {
+      actions.append(" ", el("button", {
+        class: "danger",
+        onclick: () => act(queuePath(s.queue) + "/purge", `Delete every message on ${s.queue}?`),
+      }, "Purge"));
+    }
+    tbody.append(el("tr", {},
+      el("td", {}, s.queue),
+      el("td", { class: "number" }, s.ready),
+      el("td", { class: "number" }, s.delayed),
+      el("td", { class: "number" }, s.in_flight),
+      el("td", { class: "number" }, s.retrying),
+      el("td", { class: "number" }, s.max_retries),
+      el("td", { class: "number" }, s.dead),
+      el("td", { class: "number" }, s.oldest_age_ns ? age(s.oldest_age_ns) : "-"),
+      actions));
+  }
+}
+
+function polyline(values, max, width, height, cls) {
+  const step = values.length > 1 ? width / (values.length - 1) : width;
+  const points = values.map((v, i) => `${(i * step).toFixed(1)},${(height - (v / max) * height).toFixed(1)}`);
+  const line = document.createElementNS("http://www.w3.org/2000/svg", "polyline");
+  line.setAttribute("points", points.join(" "));
+  line.setAttribute("fill", "none");
+  line.setAttribute("class", cls);
+  return line;
+}
+
+function renderActivity(activity) {
+  const section = document.getElementById("activity");
+  section.hidden = !config.activity;
+  if (!config.activity) {
+    return;
+  }
+  const seconds = activity.bucket_seconds;
+  const buckets = Object.values(activity.queues)[0] || [];
+  document.getElementById("window").textContent = age(buckets.length * seconds * 1e9);
+  const graphs = document.getElementById("graphs");
+  graphs.replaceChildren();
+  for (const queue of Object.keys(activity.queues).sort()) {
+    const b = activity.queues[queue];
+    const series = {
+      pushed: b.map((x) => x.pushed / seconds),
+      acked: b.map((x) => x.acked / seconds),
+      failed: b.map((x) => (x.retried + x.dead_lettered) / seconds),
+    };
+    const max = Math.max(1, ...series.pushed, ...series.acked, ...series.failed);
+    const svg = document.createElementNS("http://www.w3.org/2000/svg", "svg");
+    svg.setAttribute("viewBox", "0 0 300 100");
+    svg.setAttribute("preserveAspectRatio", "none");
+    for (const [cls, values] of Object.entries(series)) {
+      svg.append(polyline(values, max, 300, 100, cls));
+    }
+    graphs.append(el("div", { class: "graph" },
+      el("h3", {}, queue, " ", el("small", {}, `peak ${max.toFixed(1)}/s`)),
+      svg,
+      el("div", { class: "legend" },
+        el("span", { class: "pushed" }, "pushed"),
+        el("span", { class: "acked" }, "acked"),
+        el("span", { class: "failed" }, "retried or dead-lettered"))));
+  }
+}
+
+function decodeBase64(s) {
+  const binary = atob(s || "");
+  const bytes = new Uint8Array(binary.length);
+  for (let i = 0; i < binary.length; i++) {
+    bytes[i] = binary.charCodeAt(i);
+  }
+  return bytes;
+}
+
+function preview(bytes, mode) {
+  if (mode === "hex") {
+    const lines = [];
+    for (let i = 0; i < bytes.length; i += 16) {
+      const row = Array.from(bytes.slice(i, i + 16), (b) => b.toString(16).padStart(2, "0"));
+      lines.push(i.toString(16).padStart(8, "0") + "  " + row.join(" "));
+    }
+    return lines.join("\n");
+  }
+  const text = new TextDecoder().decode(bytes);
+  if (mode === "json") {
+    try {
+      return JSON.stringify(JSON.parse(text), null, 2);
+    } catch (err) {
+      return "(not valid JSON) " + text;
+    }
+  }
+  return text;
+}
+
+async function renderDead() {
+  const section = document.getElementById("dead");
+  section.hidden = deadQueue === null;
+  if (deadQueue === null) {
+    return;
+  }
+  document.getElementById("dead-queue").textContent = deadQueue;
+  document.querySelector("#dead .actions").hidden = config.read_only;
+  const messages = await api(queuePath(deadQueue) + "/dead");
+  const mode = document.getElementById("preview").value;
+  const tbody = document.querySelector("#dead tbody");
+  tbody.replaceChildren();
+  for (const m of messages) {
+    const actions = el("td", {});
+    if (!config.read_only) {
+      const path = queuePath(deadQueue) + "/dead/" + m.id;
+      actions.append(
+        el("button", { onclick: () => act(path + "/retry") }, "Retry"), " ",
+        el("button", { class: "danger", onclick: () => act(path + "/delete", `Delete message ${m.id}?`) }, "Delete"));
+    }
+    tbody.append(el("tr", {},
+      el("td", { class: "number" }, m.id),
+      el("td", {}, new Date(m.failed_at).toLocaleString()),
+      el("td", { class: "number" }, m.retries),
+      el("td", {}, el("pre", {}, m.last_error || "")),
+      el("td", {}, el("pre", {}, preview(decodeBase64(m.payload), mode))),
+      actions));
+  }
+}
+
+function showDead(queue) {
+  deadQueue = queue;
+  renderDead().catch(showError);
+}
+
+async function refresh() {
+  try {
+    const [stats, activity] = await Promise.all([api("stats"), api("activity")]);
+    renderStats(stats);
+    renderActivity(activity);
+    await renderDead();
+    document.getElementById("updated").textContent = "updated " + new Date().toLocaleTimeString();
+    showError(null);
+  } catch (err) {
+    showError(err);
+  }
+}
+
+async function main() {
+  try {
+    config = await api("config");
+  } catch (err) {
+    showError(err);
+  }
+  document.getElementById("preview").addEventListener("change", () => renderDead().catch(showError));
+  document.getElementById("retry-all").addEventListener("click",
+    () => act(queuePath(deadQueue) + "/dead/retry", `Retry every dead message on ${deadQueue}?`));
+  document.getElementById("purge-dead").addEventListener("click",
+    () => act(queuePath(deadQueue) + "/dead/purge", `Delete every dead message on ${deadQueue}?`));
+  await refresh();
+  setInterval(refresh, refreshInterval);
+}
+
+main();
@@ -0,0 +1,515 @@
+// Package gqhttp exposes gq queues over HTTP, so that services which aren't written in Go can push and receive messages.
+//
+//	POST /queues/{queue}/messages              push a message, or a batch of messages
+//	GET  /queues/{queue}/messages              receive messages, long-polling until some are ready
+//	POST /queues/{queue}/messages/{id}/ack     ack a received message
+//	POST /queues/{queue}/messages/{id}/nack    nack a received message, so that it is retried or dead-lettered
+//	POST /queues/{queue}/messages/{id}/extend  extend the lease on a received message
+//
+// Received messages are leased to the receiver, and are delivered again, or dead-lettered once they exhaust their retries,
+// if they are neither acked nor nacked before their lease expires. The handler does no authentication, so it should be wrapped in the application's auth middleware,
+// and mounted under a prefix with http.StripPrefix if need be:
+//
+//	http.Handle("/gq/", http.StripPrefix("/gq", gqhttp.NewHandler(client, gqhttp.Options{})))
+package gqhttp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/mattbonnell/gq"
+)
+
+const (
+	defaultLease                = 30 * time.Second
+	defaultMaxLease             = 12 * time.Hour
+	defaultMaxWait              = 20 * time.Second
+	defaultPollInterval         = 100 * time.Millisecond
+	defaultMaxReceive           = 100
+	defaultMaxBodyBytes         = 4 << 20
+	defaultMaxProcessingRetries = 3
+	defaultPushPeriod           = 10 * time.Millisecond
+	defaultMaxQueues            = 100
+	maxQueueNameLength          = 255
+)
+
+// Options represents the options which can be used to tailor the handler's behaviour
+type Options struct {
+	// DefaultLease is the lease on received messages when the receiver doesn't specify one (default: 30s)
+	DefaultLease time.Duration
+	// MaxLease is the longest lease a receiver may request (default: 12h)
+	MaxLease time.Duration
+	// MaxWait is the longest a receive request may wait for messages to become ready (default: 20s)
+	MaxWait time.Duration
+	// PollInterval is the period with which a waiting receive request polls for ready messages (default: 100ms)
+	PollInterval time.Duration
+	// MaxReceive is the largest number of messages a receive request may return (default: 100)
+	MaxReceive int
+	// MaxBodyBytes is the size limit on request bodies (default: 4MiB)
+	MaxBodyBytes int64
+	// MaxProcessingRetries is the number of times a nacked message is retried before it is dead-lettered (default: 3)
+	MaxProcessingRetries int
+	// PushPeriod is the push period of the handler's producers (default: 10ms).
+	//
+	// Deprecated: each push request's messages are inserted immediately, in one transaction, so they are no longer batched
+	// with those of other requests
+	PushPeriod time.Duration
+	// Queues, if set, are the only queues the handler serves. Requests for other queues are rejected with 404 Not Found
+	Queues []string
+	// MaxQueues is the most queues the handler serves if Queues isn't set (default: 100). The handler holds a producer and a
+	// consumer for each queue it has served until the client is closed, so requests for more are rejected with 503 Service Unavailable
+	MaxQueues int
+}
+
+func (o *Options) setDefaults() {
+	if o.DefaultLease <= 0 {
+		o.DefaultLease = defaultLease
+	}
+	if o.MaxLease <= 0 {
+		o.MaxLease = defaultMaxLease
+	}
+	if o.MaxWait <= 0 {
+		o.MaxWait = defaultMaxWait
+	}
+	if o.PollInterval <= 0 {
+		o.PollInterval = defaultPollInterval
+	}
+	if o.MaxReceive <= 0 {
+		o.MaxReceive = defaultMaxReceive
+	}
+	if o.MaxBodyBytes <= 0 {
+		o.MaxBodyBytes = defaultMaxBodyBytes
+	}
+	if o.MaxProcessingRetries <= 0 {
+		o.MaxProcessingRetries = defaultMaxProcessingRetries
+	}
+	if o.PushPeriod <= 0 {
+		o.PushPeriod = defaultPushPeriod
+	}
+	if o.MaxQueues <= 0 {
+		o.MaxQueues = defaultMaxQueues
+	}
+}
+
+var (
+	errQueueNotServed = errors.New("queue not found")
+	errTooManyQueues  = errors.New("too many queues")
+)
+
+// OutgoingMessage is a message to push. Binary payloads can be sent base64-encoded in PayloadBase64 instead of Payload
+type OutgoingMessage struct {
+	Payload       string            `json:"payload,omitempty"`
+	PayloadBase64 []byte            `json:"payload_base64,omitempty"`
+	Headers       map[string]string `json:"headers,omitempty"`
+}
+
+func (m OutgoingMessage) payload() []byte {
+	if m.PayloadBase64 != nil {
+		return m.PayloadBase64
+	}
+	return []byte(m.Payload)
+}
+
+// PushRequest is the body of a push request: either a single message, or a batch of messages in Messages
+type PushRequest struct {
+	OutgoingMessage
+	Messages []OutgoingMessage `json:"messages,omitempty"`
+}
+
+// PushResponse is the body of the response to a successful push request
+type PushResponse struct {
+	Pushed int `json:"pushed"`
+}
+
+// ReceivedMessage is a message leased to a receiver. Exactly one of Payload and PayloadBase64 is set,
+// depending on whether the payload is valid UTF-8
+type ReceivedMessage struct {
+	ID             int64             `json:"id"`
+	Queue          string            `json:"queue"`
+	Payload        *string           `json:"payload,omitempty"`
+	PayloadBase64  []byte            `json:"payload_base64,omitempty"`
+	Headers        map[string]string `json:"headers,omitempty"`
+	Attempt        int               `json:"attempt"`
+	CreatedAt      time.Time         `json:"created_at"`
+	LeaseToken     string            `json:"lease_token"`
+	LeaseExpiresAt time.Time         `json:"lease_expires_at"`
+}
+
+// ReceiveResponse is the body of the response to a receive request
+type ReceiveResponse struct {
+	Messages []ReceivedMessage `json:"messages"`
+}
+
+// LeaseRequest is the body of an ack, nack or extend request
+type LeaseRequest struct {
+	LeaseToken string `json:"lease_token"`
+	// Error is the reason a nacked message failed processing, which is recorded if it is dead-lettered
+	Error string `json:"error,omitempty"`
+	// Lease is the duration to extend a lease by, e.g. "30s" (default: Options.DefaultLease)
+	Lease string `json:"lease,omitempty"`
+}
+
+// ExtendResponse is the body of the response to a successful extend request
+type ExtendResponse struct {
+	LeaseExpiresAt time.Time `json:"lease_expires_at"`
+}
+
+// ErrorResponse is the body of an unsuccessful response
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
+
+// Handler serves the gq HTTP API. Producers and lease consumers are created from the client for each queue on first use,
+// and are closed with the client
+type Handler struct {
+	client *gq.Client
+	opts   Options
+	// allowed holds Options.Queues, or is nil if every queue may be served
+	allowed map[string]bool
+
+	mu        sync.Mutex
+	queues    map[string]bool
+	producers map[string]*gq.Producer
+	consumers map[string]*gq.Consumer
+}
+
+// NewHandler creates a Handler which serves the queues of client
+func NewHandler(client *gq.Client, opts Options) *Handler {
+	opts.setDefaults()
+	h := &Handler{client: client, opts: opts, queues: map[string]bool{}, producers: map[string]*gq.Producer{}, consumers: map[string]*gq.Consumer{}}
+	if len(opts.Queues) > 0 {
+		h.allowed = map[string]bool{}
+		for _, q := range opts.Queues {
+			h.allowed[q] = true
+		}
+	}
+	return h
+}
+
+// admit checks that the handler may serve queue, counting it towards MaxQueues the first time. The caller holds h.mu
+func (h *Handler) admit(queue string) error {
+	if h.queues[queue] {
+		return nil
+	}
+	if h.allowed != nil {
+		if !h.allowed[queue] {
+			return errQueueNotServed
+		}
+	} else if len(h.queues) >= h.opts.MaxQueues {
+		return errTooManyQueues
+	}
+	h.queues[queue] = true
+	return nil
+}
+
+func (h *Handler) producer(queue string) (*gq.Producer, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if p, ok := h.producers[queue]; ok {
+		return p, nil
+	}
+	if err := h.admit(queue); err != nil {
+		return nil, err
+	}
+	// retry failed pushes for about a second, or a single period if that's longer
+	retryPeriods := int(time.Second / h.opts.PushPeriod)
+	if retryPeriods < 1 {
+		retryPeriods = 1
+	}
+	// producers outlive the request which creates them, and are stopped by closing the client
+	p, err := h.client.NewProducerWithOptions(context.Background(), gq.ProducerOptions{
+		PushPeriod:      h.opts.PushPeriod,
+		MaxRetryPeriods: retryPeriods,
+		Concurrency:     1,
+		Queue:           queue,
+	})
+	if err != nil {
+		return nil, err
+	}
+	h.producers[queue] = p
+	return p, nil
+}
+
+func (h *Handler) consumer(queue string) (*gq.Consumer, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if c, ok := h.consumers[queue]; ok {
+		return c, nil
+	}
+	if err := h.admit(queue); err != nil {
+		return nil, err
+	}
+	c, err := h.client.NewLeaseConsumer(context.Background(), gq.ConsumerOptions{
+		MaxProcessingRetries: h.opts.MaxProcessingRetries,
+		Queue:                queue,
+	})
+	if err != nil {
+		return nil, err
+	}
+	h.consumers[queue] = c
+	return c, nil
+}
+
+// ServeHTTP implements http.Handler
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// split the escaped path, so that queue names may contain slashes
+	parts := strings.Split(strings.Trim(r.URL.EscapedPath(), "/"), "/")
+	if len(parts) < 3 || parts[0] != "queues" || parts[2] != "messages" {
+		writeError(w, http.StatusNotFound, errors.New("not found"))
+		return
+	}
+	queue, err := url.PathUnescape(parts[1])
+	if err != nil || queue == "" || len(queue) > maxQueueNameLength {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid queue name %q", parts[1]))
+		return
+	}
+	switch len(parts) {
+	case 3:
+		switch r.Method {
+		case http.MethodPost:
+			h.push(w, r, queue)
+		case http.MethodGet:
+			h.receive(w, r, queue)
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		}
+	case 5:
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+			return
+		}
+		id, err := strconv.ParseInt(parts[3], 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid message ID %q", parts[3]))
+			return
+		}
+		switch parts[4] {
+		case "ack", "nack", "extend":
+			h.settle(w, r, queue, id, parts[4])
+		default:
+			writeError(w, http.StatusNotFound, errors.New("not found"))
+		}
+	default:
+		writeError(w, http.StatusNotFound, errors.New("not found"))
+	}
+}
+
+func (h *Handler) push(w http.ResponseWriter, r *http.Request, queue string) {
+	req := PushRequest{}
+	if !h.decode(w, r, &req) {
+		return
+	}
+	messages := req.Messages
+	if messages == nil {
+		messages = []OutgoingMessage{req.OutgoingMessage}
+	}
+	p, err := h.producer(queue)
+	if err != nil {
+		writeClientError(w, err)
+		return
+	}
+	// the batch is pushed atomically, so that a client can retry a failed request without duplicating messages
+	batch := make([]gq.OutgoingMessage, len(messages))
+	for i := range messages {
+		batch[i] = gq.OutgoingMessage{Payload: messages[i].payload(), Headers: messages[i].Headers}
+	}
+	if err := p.PushBatch(r.Context(), batch); err != nil {
+		writeClientError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, PushResponse{Pushed: len(messages)})
+}
+
+func (h *Handler) receive(w http.ResponseWriter, r *http.Request, queue string) {
+	q := r.URL.Query()
+	limit := 1
+	if s := q.Get("max"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 || n > h.opts.MaxReceive {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("max must be between 1 and %d", h.opts.MaxReceive))
+			return
+		}
+		limit = n
+	}
+	lease, ok := h.lease(w, q.Get("lease"))
+	if !ok {
+		return
+	}
+	wait, ok := h.duration(w, q.Get("wait"), "wait", 0, h.opts.MaxWait)
+	if !ok {
+		return
+	}
+	c, err := h.consumer(queue)
+	if err != nil {
+		writeClientError(w, err)
+		return
+	}
+	deadline := time.Now().Add(wait)
+	ticker := time.NewTicker(h.opts.PollInterval)
+	defer ticker.Stop()
+	for {
+		deliveries, err := c.Receive(r.Context(), limit, lease)
+		if err != nil {
+			if r.Context().Err() != nil {
+				return
+			}
+			writeClientError(w, err)
+			return
+		}
+		if len(deliveries) > 0 || !time.Now().Before(deadline) {
+			res := ReceiveResponse{Messages: make([]ReceivedMessage, len(deliveries))}
+			for i, d := range deliveries {
+				res.Messages[i] = receivedMessage(d)
+			}
+			writeJSON(w, http.StatusOK, res)
+			return
+		}
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func receivedMessage(d *gq.Delivery) ReceivedMessage {
+	m := ReceivedMessage{
+		ID:             d.ID,
+		Queue:          d.Queue,
+		Headers:        d.Headers,
+		Attempt:        d.Attempt,
+		CreatedAt:      d.CreatedAt,
+		LeaseToken:     d.LeaseToken,
+		LeaseExpiresAt: d.LeaseExpiresAt,
+	}
+	if utf8.Valid(d.Payload) {
+		payload := string(d.Payload)
+		m.Payload = &payload
+	} else {
+		m.PayloadBase64 = d.Payload
+	}
+	return m
+}
+
+func (h *Handler) settle(w http.ResponseWriter, r *http.Request, queue string, id int64, action string) {
+	req := LeaseRequest{}
+	if !h.decode(w, r, &req) {
+		return
+	}
+	if req.LeaseToken == "" {
+		writeError(w, http.StatusBadRequest, errors.New("lease_token is required"))
+		return
+	}
+	c, err := h.consumer(queue)
+	if err != nil {
+		writeClientError(w, err)
+		return
+	}
+	switch action {
+	case "ack":
+		err = c.Ack(r.Context(), id, req.LeaseToken)
+	case "nack":
+		var reason error
+		if req.Error != "" {
+			reason = errors.New(req.Error)
+		}
+		err = c.Nack(r.Context(), id, req.LeaseToken, reason)
+	case "extend":
+		lease, ok := h.lease(w, req.Lease)
+		if !ok {
+			return
+		}
+		var expiresAt time.Time
+		if expiresAt, err = c.Extend(r.Context(), id, req.LeaseToken, lease); err == nil {
+			writeJSON(w, http.StatusOK, ExtendResponse{LeaseExpiresAt: expiresAt})
+			return
+		}
+	}
+	if err != nil {
+		writeClientError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// decode decodes the JSON request body into v, writing an error response and returning false if it can't
+func (h *Handler) decode(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, h.opts.MaxBodyBytes))
+	if err := dec.Decode(v); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeError(w, http.StatusRequestEntityTooLarge, err)
+			return false
+		}
+		if errors.Is(err, io.EOF) {
+			err = errors.New("request body is empty")
+		}
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %s", err))
+		return false
+	}
+	return true
+}
+
+// duration parses the duration s, writing an error response and returning false if it isn't between zero and limit
+func (h *Handler) duration(w http.ResponseWriter, s, name string, def, limit time.Duration) (time.Duration, bool) {
+	if s == "" {
+		return def, true
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 || d > limit {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("%s must be a duration between 0s and %s", name, limit))
+		return 0, false
+	}
+	return d, true
+}
+
+// lease parses the lease duration s like duration, but also rejects a zero lease, which would expire as soon as it was granted
+func (h *Handler) lease(w http.ResponseWriter, s string) (time.Duration, bool) {
+	if s == "" {
+		return h.opts.DefaultLease, true
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 || d > h.opts.MaxLease {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("lease must be a positive duration up to %s", h.opts.MaxLease))
+		return 0, false
+	}
+	return d, true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, ErrorResponse{Error: err.Error()})
+}
+
+// writeClientError writes the response for an error returned by gq
+func writeClientError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errQueueNotServed):
+		writeError(w, http.StatusNotFound, err)
+	case errors.Is(err, errTooManyQueues):
+		writeError(w, http.StatusServiceUnavailable, err)
+	case errors.Is(err, gq.ErrLeaseLost):
+		writeError(w, http.StatusConflict, err)
+	case errors.Is(err, gq.ErrClientClosed), errors.Is(err, gq.ErrProducerClosed), errors.Is(err, gq.ErrBufferFull):
+		writeError(w, http.StatusServiceUnavailable, err)
+	default:
+		writeError(w, http.StatusInternalServerError, err)
+	}
+}
@@ -0,0 +1,265 @@
+package gqhttp
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/mattbonnell/gq"
+	"github.com/mattbonnell/gq/internal"
+	"github.com/mattbonnell/gq/test"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestServer(t *testing.T) (*httptest.Server, sqlmock.Sqlmock, time.Time) {
+	return newTestServerWithOptions(t, Options{PushPeriod: time.Millisecond})
+}
+
+func newTestServerWithOptions(t *testing.T, opts Options) (*httptest.Server, sqlmock.Sqlmock, time.Time) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err, "failed to open stub database connection")
+	d, err := internal.GetDialect("mysql", internal.DefaultTables)
+	require.NoError(t, err)
+	test.ExpectSchemaVersion(mock, internal.DefaultTables.SchemaVersion, d.LatestVersion())
+
+	now := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+	client, err := gq.NewClientWithOptions(db, "mysql", gq.ClientOptions{
+		DisableMigrations: true,
+		Clock:             func() time.Time { return now },
+		Logger:            gq.NewNopLogger(),
+	})
+	require.NoError(t, err)
+	srv := httptest.NewServer(NewHandler(client, opts))
+	t.Cleanup(func() {
+		srv.Close()
+		client.Close()
+		db.Close()
+	})
+	return srv, mock, now
+}
+
+func expectNotPaused(mock sqlmock.Sqlmock) {
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(*) FROM queue_pause WHERE queue = ?")).
+		WithArgs("emails").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+}
+
+func do(t *testing.T, method, url, body string) (*http.Response, map[string]interface{}) {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	require.NoError(t, err)
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	decoded := map[string]interface{}{}
+	if res.StatusCode != http.StatusNoContent {
+		require.NoError(t, json.NewDecoder(res.Body).Decode(&decoded))
+	}
+	return res, decoded
+}
+
+func TestPush(t *testing.T) {
+	srv, mock, now := newTestServer(t)
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO message (queue, payload, headers, created_at, ready_at) VALUES (?, ?, ?, ?, ?)")).
+		WithArgs("emails", []byte("hello"), `{"k":"v"}`, now, now).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO message (queue, payload, headers, created_at, ready_at) VALUES (?, ?, ?, ?, ?), (?, ?, ?, ?, ?)")).
+		WithArgs("emails", []byte{0xff, 0x00}, nil, now, now, "emails", []byte("again"), nil, now, now).
+		WillReturnResult(sqlmock.NewResult(2, 2))
+
+	res, body := do(t, http.MethodPost, srv.URL+"/queues/emails/messages", `{"payload": "hello", "headers": {"k": "v"}}`)
+	require.Equal(t, http.StatusCreated, res.StatusCode, body)
+	require.Equal(t, float64(1), body["pushed"])
+
+	// a batch is inserted in one query
+	res, body = do(t, http.MethodPost, srv.URL+"/queues/emails/messages", `{"messages": [{"payload_base64": "/wA="}, {"payload": "again"}]}`)
+	require.Equal(t, http.StatusCreated, res.StatusCode, body)
+	require.Equal(t, float64(2), body["pushed"])
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestPush_Error(t *testing.T) {
+	srv, mock, _ := newTestServer(t)
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO message")).WillReturnError(errors.New("database unavailable"))
+
+	res, body := do(t, http.MethodPost, srv.URL+"/queues/emails/messages", `{"messages": [{"payload": "a"}, {"payload": "b"}]}`)
+	require.Equal(t, http.StatusInternalServerError, res.StatusCode)
+	require.Contains(t, body["error"], "database unavailable")
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestPush_InvalidBody(t *testing.T) {
+	srv, _, _ := newTestServer(t)
+	res, body := do(t, http.MethodPost, srv.URL+"/queues/emails/messages", `{"payload": `)
+	require.Equal(t, http.StatusBadRequest, res.StatusCode)
+	require.Contains(t, body["error"], "invalid request body")
+}
+
+func TestReceive(t *testing.T) {
+	srv, mock, now := newTestServer(t)
+	expectNotPaused(mock)
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("FROM message WHERE queue = ? AND ready_at <= ? ORDER BY priority DESC, ready_at ASC LIMIT ? FOR UPDATE SKIP LOCKED")).
+		WithArgs("emails", now, 2).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "payload", "headers", "retries", "created_at", "unique_key", "tracked", "lease_token"}).
+			AddRow(1, []byte("hello"), nil, 0, now, nil, false, nil).
+			AddRow(2, []byte{0xff}, nil, 1, now, nil, false, nil))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE message SET retries = CASE WHEN lease_token IS NULL THEN retries ELSE retries + 1 END, ready_at = ?, lease_token = ? WHERE id IN (?, ?)")).
+		WithArgs(now.Add(time.Minute), sqlmock.AnyArg(), 1, 2).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectCommit()
+
+	res, err := http.Get(srv.URL + "/queues/emails/messages?max=2&lease=1m")
+	require.NoError(t, err)
+	defer res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	body := ReceiveResponse{}
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&body))
+	require.Len(t, body.Messages, 2)
+	require.Equal(t, "hello", *body.Messages[0].Payload)
+	require.Nil(t, body.Messages[1].Payload)
+	require.Equal(t, []byte{0xff}, body.Messages[1].PayloadBase64)
+	require.Equal(t, 2, body.Messages[1].Attempt)
+	require.NotEmpty(t, body.Messages[0].LeaseToken)
+	require.Equal(t, now.Add(time.Minute), body.Messages[0].LeaseExpiresAt)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestReceive_LongPoll(t *testing.T) {
+	srv, mock, now := newTestServer(t)
+	empty := func() *sqlmock.Rows {
+		return sqlmock.NewRows([]string{"id", "payload", "headers", "retries", "created_at", "unique_key", "tracked", "lease_token"})
+	}
+	expectNotPaused(mock)
+	mock.ExpectBegin()
+	mock.ExpectQuery("FROM message").WillReturnRows(empty())
+	mock.ExpectRollback()
+	mock.ExpectBegin()
+	mock.ExpectQuery("FROM message").WillReturnRows(empty().AddRow(1, []byte("hello"), nil, 0, now, nil, false, nil))
+	mock.ExpectExec("UPDATE message SET retries").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	res, body := do(t, http.MethodGet, srv.URL+"/queues/emails/messages?wait=5s", "")
+	require.Equal(t, http.StatusOK, res.StatusCode, body)
+	require.Len(t, body["messages"], 1)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestReceive_NoneReady(t *testing.T) {
+	srv, mock, _ := newTestServer(t)
+	expectNotPaused(mock)
+	mock.ExpectBegin()
+	mock.ExpectQuery("FROM message").WillReturnRows(sqlmock.NewRows([]string{"id", "payload", "headers", "retries", "created_at"}))
+	mock.ExpectRollback()
+
+	res, body := do(t, http.MethodGet, srv.URL+"/queues/emails/messages", "")
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Equal(t, []interface{}{}, body["messages"])
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestAck(t *testing.T) {
+	srv, mock, now := newTestServer(t)
+	mock.ExpectQuery(regexp.QuoteMeta("FROM message WHERE id = ? AND lease_token = ?")).
+		WithArgs(7, "token").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "payload", "headers", "retries", "created_at", "unique_key", "tracked"}).AddRow(7, []byte("a"), nil, 0, now, nil, false))
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM message WHERE id = ? AND lease_token = ?")).
+		WithArgs(7, "token").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(regexp.QuoteMeta("FROM message WHERE id = ? AND lease_token = ?")).
+		WithArgs(7, "token").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "payload", "headers", "retries", "created_at"}))
+
+	res, _ := do(t, http.MethodPost, srv.URL+"/queues/emails/messages/7/ack", `{"lease_token": "token"}`)
+	require.Equal(t, http.StatusNoContent, res.StatusCode)
+	res, body := do(t, http.MethodPost, srv.URL+"/queues/emails/messages/7/ack", `{"lease_token": "token"}`)
+	require.Equal(t, http.StatusConflict, res.StatusCode)
+	require.Equal(t, gq.ErrLeaseLost.Error(), body["error"])
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestNack(t *testing.T) {
+	srv, mock, now := newTestServer(t)
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("FROM message WHERE id = ? AND lease_token = ? FOR UPDATE")).
+		WithArgs(7, "token").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "payload", "headers", "retries", "created_at", "unique_key", "tracked"}).AddRow(7, []byte("a"), nil, 0, now, nil, false))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE message SET retries = ?, ready_at = ?, lease_token = NULL WHERE id = ?")).
+		WithArgs(1, sqlmock.AnyArg(), 7).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	res, _ := do(t, http.MethodPost, srv.URL+"/queues/emails/messages/7/nack", `{"lease_token": "token", "error": "boom"}`)
+	require.Equal(t, http.StatusNoContent, res.StatusCode)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestExtend(t *testing.T) {
+	srv, mock, now := newTestServer(t)
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE message SET ready_at = ? WHERE id = ? AND lease_token = ?")).
+		WithArgs(now.Add(time.Minute), 7, "token").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	res, body := do(t, http.MethodPost, srv.URL+"/queues/emails/messages/7/extend", `{"lease_token": "token", "lease": "1m"}`)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Equal(t, now.Add(time.Minute).Format(time.RFC3339), body["lease_expires_at"])
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRouting(t *testing.T) {
+	srv, _, _ := newTestServer(t)
+	for _, tc := range []struct {
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{http.MethodGet, "/", "", http.StatusNotFound},
+		{http.MethodGet, "/queues/emails", "", http.StatusNotFound},
+		{http.MethodDelete, "/queues/emails/messages", "", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/queues/emails/messages/7/ack", "", http.StatusMethodNotAllowed},
+		{http.MethodPost, "/queues/emails/messages/x/ack", `{"lease_token": "t"}`, http.StatusBadRequest},
+		{http.MethodPost, "/queues/emails/messages/7/retry", `{"lease_token": "t"}`, http.StatusNotFound},
+		{http.MethodPost, "/queues/emails/messages/7/ack", `{}`, http.StatusBadRequest},
+		{http.MethodGet, "/queues/emails/messages?max=0", "", http.StatusBadRequest},
+		{http.MethodGet, "/queues/emails/messages?wait=1h", "", http.StatusBadRequest},
+		{http.MethodGet, "/queues/emails/messages?lease=0s", "", http.StatusBadRequest},
+		{http.MethodPost, "/queues/emails/messages/7/extend", `{"lease_token": "t", "lease": "0s"}`, http.StatusBadRequest},
+	} {
+		res, _ := do(t, tc.method, srv.URL+tc.path, tc.body)
+		require.Equal(t, tc.status, res.StatusCode, "%s %s", tc.method, tc.path)
+	}
+}
+
+func TestQueueLimits(t *testing.T) {
+	insert := regexp.QuoteMeta("INSERT INTO message (queue, payload, headers, created_at, ready_at) VALUES (?, ?, ?, ?, ?)")
+	t.Run("allowed queues", func(t *testing.T) {
+		srv, mock, _ := newTestServerWithOptions(t, Options{Queues: []string{"emails"}})
+		mock.ExpectExec(insert).WillReturnResult(sqlmock.NewResult(1, 1))
+		res, body := do(t, http.MethodPost, srv.URL+"/queues/emails/messages", `{"payload": "a"}`)
+		require.Equal(t, http.StatusCreated, res.StatusCode, body)
+		res, _ = do(t, http.MethodPost, srv.URL+"/queues/sms/messages", `{"payload": "a"}`)
+		require.Equal(t, http.StatusNotFound, res.StatusCode)
+		res, _ = do(t, http.MethodPost, srv.URL+"/queues/sms/messages/1/ack", `{"lease_token": "t"}`)
+		require.Equal(t, http.StatusNotFound, res.StatusCode)
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("max queues", func(t *testing.T) {
+		srv, mock, _ := newTestServerWithOptions(t, Options{MaxQueues: 1})
+		mock.ExpectExec(insert).WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec(insert).WillReturnResult(sqlmock.NewResult(2, 1))
+		res, body := do(t, http.MethodPost, srv.URL+"/queues/emails/messages", `{"payload": "a"}`)
+		require.Equal(t, http.StatusCreated, res.StatusCode, body)
+		res, _ = do(t, http.MethodPost, srv.URL+"/queues/sms/messages", `{"payload": "a"}`)
+		require.Equal(t, http.StatusServiceUnavailable, res.StatusCode, "a queue beyond the limit isn't served")
+		res, body = do(t, http.MethodPost, srv.URL+"/queues/emails/messages", `{"payload": "b"}`)
+		require.Equal(t, http.StatusCreated, res.StatusCode, body, "queues already served still are")
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+}
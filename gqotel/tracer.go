@@ -0,0 +1,131 @@
+// Package gqotel instruments gq with OpenTelemetry tracing.
+//
+// Producers inject the trace context of the ctx passed to PushContext into the message's headers, and record a span for each
+// batch insert which links to the trace context of every message in the batch. Consumers extract the trace context from the
+// headers and start a span around each handler invocation, so that processing a message appears within the trace which pushed it.
+//
+//	client, err := gq.NewClientWithOptions(db, "postgres", gq.ClientOptions{Tracer: gqotel.New()})
+package gqotel
+
+import (
+	"context"
+
+	"github.com/mattbonnell/gq"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "github.com/mattbonnell/gq/gqotel"
+
+// Attribute keys recorded on spans, following the OpenTelemetry messaging semantic conventions
+const (
+	MessagingSystemKey      = attribute.Key("messaging.system")
+	MessagingDestinationKey = attribute.Key("messaging.destination.name")
+	MessagingOperationKey   = attribute.Key("messaging.operation")
+	MessagingBatchCountKey  = attribute.Key("messaging.batch.message_count")
+	MessagingMessageIDKey   = attribute.Key("messaging.message.id")
+	MessagingAttemptKey     = attribute.Key("messaging.gq.attempt")
+)
+
+// Option configures a Tracer
+type Option func(*Tracer)
+
+// WithTracerProvider sets the provider spans are created from (default: otel.GetTracerProvider())
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return func(t *Tracer) {
+		t.provider = tp
+	}
+}
+
+// WithPropagator sets the propagator which injects and extracts trace context (default: otel.GetTextMapPropagator())
+func WithPropagator(p propagation.TextMapPropagator) Option {
+	return func(t *Tracer) {
+		t.propagator = p
+	}
+}
+
+// Tracer implements gq.Tracer using OpenTelemetry
+type Tracer struct {
+	provider   trace.TracerProvider
+	propagator propagation.TextMapPropagator
+	tracer     trace.Tracer
+}
+
+var _ gq.Tracer = (*Tracer)(nil)
+
+// New creates a Tracer with the supplied options
+func New(opts ...Option) *Tracer {
+	t := &Tracer{
+		provider:   otel.GetTracerProvider(),
+		propagator: otel.GetTextMapPropagator(),
+	}
+	for _, opt := range opts {
+		opt(t)
+	}
+	t.tracer = t.provider.Tracer(instrumentationName)
+	return t
+}
+
+// Inject implements gq.Tracer
+func (t *Tracer) Inject(ctx context.Context, headers map[string]string) {
+	t.propagator.Inject(ctx, propagation.MapCarrier(headers))
+}
+
+// StartPush implements gq.Tracer. The span links to the trace context of each message in the batch
+func (t *Tracer) StartPush(ctx context.Context, queue string, headers []map[string]string) func(err error) {
+	links := make([]trace.Link, 0, len(headers))
+	for _, h := range headers {
+		sc := trace.SpanContextFromContext(t.propagator.Extract(context.Background(), propagation.MapCarrier(h)))
+		if sc.IsValid() {
+			links = append(links, trace.Link{SpanContext: sc})
+		}
+	}
+	_, span := t.tracer.Start(ctx, queue+" publish",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithLinks(links...),
+		trace.WithAttributes(
+			MessagingSystemKey.String("gq"),
+			MessagingDestinationKey.String(queue),
+			MessagingOperationKey.String("publish"),
+			MessagingBatchCountKey.Int(len(headers)),
+		),
+	)
+	return func(err error) {
+		end(span, err)
+	}
+}
+
+// StartProcess implements gq.Tracer. The span is a child of the trace context extracted from the message's headers,
+// which it also links to, as recommended for messaging spans
+func (t *Tracer) StartProcess(ctx context.Context, m *gq.Message) (context.Context, func(err error)) {
+	carrier := propagation.MapCarrier(m.Headers)
+	ctx = t.propagator.Extract(ctx, carrier)
+	opts := []trace.SpanStartOption{
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			MessagingSystemKey.String("gq"),
+			MessagingDestinationKey.String(m.Queue),
+			MessagingOperationKey.String("process"),
+			MessagingMessageIDKey.Int64(m.ID),
+			MessagingAttemptKey.Int(m.Attempt),
+		),
+	}
+	if sc := trace.SpanContextFromContext(t.propagator.Extract(context.Background(), carrier)); sc.IsValid() {
+		opts = append(opts, trace.WithLinks(trace.Link{SpanContext: sc}))
+	}
+	ctx, span := t.tracer.Start(ctx, m.Queue+" process", opts...)
+	return ctx, func(err error) {
+		end(span, err)
+	}
+}
+
+func end(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,71 @@
+package gqotel
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/mattbonnell/gq"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestTracerPropagatesContextFromProducerToConsumer(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	tracer := New(WithTracerProvider(tp), WithPropagator(propagation.TraceContext{}))
+
+	// the request which pushes the message
+	ctx, request := tp.Tracer("test").Start(context.Background(), "signup")
+	headers := map[string]string{}
+	tracer.Inject(ctx, headers)
+	require.Contains(t, headers, "traceparent")
+	request.End()
+
+	endPush := tracer.StartPush(context.Background(), "emails", []map[string]string{headers, {}})
+	endPush(nil)
+
+	m := &gq.Message{ID: 42, Queue: "emails", Payload: []byte("hello"), Headers: headers, Attempt: 2}
+	handlerCtx, endProcess := tracer.StartProcess(context.Background(), m)
+	require.Equal(t, request.SpanContext().TraceID(), trace.SpanContextFromContext(handlerCtx).TraceID())
+	endProcess(errors.New("smtp unavailable"))
+
+	spans := exporter.GetSpans()
+	require.Len(t, spans, 3)
+
+	push := spans[1]
+	require.Equal(t, "emails publish", push.Name)
+	require.Equal(t, trace.SpanKindProducer, push.SpanKind)
+	require.Len(t, push.Links, 1, "messages without trace context shouldn't be linked")
+	require.Equal(t, request.SpanContext().SpanID(), push.Links[0].SpanContext.SpanID())
+	require.Contains(t, push.Attributes, MessagingBatchCountKey.Int(2))
+
+	process := spans[2]
+	require.Equal(t, "emails process", process.Name)
+	require.Equal(t, trace.SpanKindConsumer, process.SpanKind)
+	require.Equal(t, request.SpanContext().SpanID(), process.Parent.SpanID())
+	require.Len(t, process.Links, 1)
+	require.Contains(t, process.Attributes, MessagingMessageIDKey.Int64(42))
+	require.Contains(t, process.Attributes, MessagingAttemptKey.Int(2))
+	require.Contains(t, process.Attributes, MessagingDestinationKey.String("emails"))
+	require.Equal(t, codes.Error, process.Status.Code)
+}
+
+func TestTracerWithoutPropagatedContext(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	tracer := New(WithTracerProvider(tp), WithPropagator(propagation.TraceContext{}))
+
+	_, endProcess := tracer.StartProcess(context.Background(), &gq.Message{ID: 1, Queue: "emails", Attempt: 1})
+	endProcess(nil)
+
+	spans := exporter.GetSpans()
+	require.Len(t, spans, 1)
+	require.False(t, spans[0].Parent.IsValid())
+	require.Empty(t, spans[0].Links)
+	require.Equal(t, codes.Unset, spans[0].Status.Code)
+}
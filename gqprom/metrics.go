@@ -0,0 +1,137 @@
+// Package gqprom exports gq's metrics to Prometheus.
+//
+//	metrics, err := gqprom.New(prometheus.DefaultRegisterer)
+//	client, err := gq.NewClientWithOptions(db, "postgres", gq.ClientOptions{Metrics: metrics})
+package gqprom
+
+import (
+	"time"
+
+	"github.com/mattbonnell/gq"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const namespace = "gq"
+
+// Metrics implements gq.Metrics and gq.ScalingMetrics by recording to Prometheus collectors, labelled by queue and, where
+// applicable, outcome
+type Metrics struct {
+	messagesPushed    *prometheus.CounterVec
+	messagesPulled    *prometheus.CounterVec
+	messagesProcessed *prometheus.CounterVec
+	pushDuration      *prometheus.HistogramVec
+	handlerDuration   *prometheus.HistogramVec
+	endToEndLatency   *prometheus.HistogramVec
+	bufferedMessages  *prometheus.GaugeVec
+	consumerWorkers   *prometheus.GaugeVec
+	scalingDecisions  *prometheus.CounterVec
+}
+
+var (
+	_ gq.Metrics        = (*Metrics)(nil)
+	_ gq.ScalingMetrics = (*Metrics)(nil)
+)
+
+// New creates Metrics and registers its collectors with reg
+func New(reg prometheus.Registerer) (*Metrics, error) {
+	m := &Metrics{
+		messagesPushed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "messages_pushed_total",
+			Help:      "Number of messages pushed onto the queue, by outcome (success or error). Failed pushes are retried, so errors may be counted more than once.",
+		}, []string{"queue", "outcome"}),
+		messagesPulled: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "messages_pulled_total",
+			Help:      "Number of messages pulled from the queue for processing.",
+		}, []string{"queue"}),
+		messagesProcessed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "messages_processed_total",
+			Help:      "Number of messages processed, by outcome (acked, retried or dead_lettered).",
+		}, []string{"queue", "outcome"}),
+		pushDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "push_duration_seconds",
+			Help:      "Time taken to push a batch of messages onto the queue, by outcome.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"queue", "outcome"}),
+		handlerDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "handler_duration_seconds",
+			Help:      "Time taken by the process function to handle a message, by outcome.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"queue", "outcome"}),
+		endToEndLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "end_to_end_latency_seconds",
+			Help:      "Time from a message being created to the result of processing it being committed, by outcome.",
+			Buckets:   prometheus.ExponentialBuckets(0.01, 4, 10),
+		}, []string{"queue", "outcome"}),
+		bufferedMessages: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "producer_buffered_messages",
+			Help:      "Number of messages buffered by producers which have not yet been pushed onto the queue.",
+		}, []string{"queue"}),
+		consumerWorkers: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "consumer_goroutines",
+			Help:      "Number of goroutines autoscaling consumers are pulling messages from.",
+		}, []string{"queue"}),
+		scalingDecisions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "consumer_scaling_decisions_total",
+			Help:      "Number of changes in the goroutines of autoscaling consumers decided by the autoscaler, by reason (backlog, idle or errors).",
+		}, []string{"queue", "reason"}),
+	}
+	for _, c := range []prometheus.Collector{
+		m.messagesPushed,
+		m.messagesPulled,
+		m.messagesProcessed,
+		m.pushDuration,
+		m.handlerDuration,
+		m.endToEndLatency,
+		m.bufferedMessages,
+		m.consumerWorkers,
+		m.scalingDecisions,
+	} {
+		if err := reg.Register(c); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// MessagesPushed implements gq.Metrics
+func (m *Metrics) MessagesPushed(queue string, count int, outcome gq.Outcome, duration time.Duration) {
+	m.messagesPushed.WithLabelValues(queue, string(outcome)).Add(float64(count))
+	m.pushDuration.WithLabelValues(queue, string(outcome)).Observe(duration.Seconds())
+}
+
+// MessagesPulled implements gq.Metrics
+func (m *Metrics) MessagesPulled(queue string, count int) {
+	m.messagesPulled.WithLabelValues(queue).Add(float64(count))
+}
+
+// MessageProcessed implements gq.Metrics
+func (m *Metrics) MessageProcessed(queue string, outcome gq.Outcome, handlerDuration time.Duration, endToEndLatency time.Duration) {
+	m.messagesProcessed.WithLabelValues(queue, string(outcome)).Inc()
+	if handlerDuration >= 0 {
+		m.handlerDuration.WithLabelValues(queue, string(outcome)).Observe(handlerDuration.Seconds())
+	}
+	m.endToEndLatency.WithLabelValues(queue, string(outcome)).Observe(endToEndLatency.Seconds())
+}
+
+// BufferedMessages implements gq.Metrics
+func (m *Metrics) BufferedMessages(queue string, delta int) {
+	m.bufferedMessages.WithLabelValues(queue).Add(float64(delta))
+}
+
+// ConsumerScaled implements gq.ScalingMetrics
+func (m *Metrics) ConsumerScaled(queue string, delta int, reason gq.ScaleReason) {
+	m.consumerWorkers.WithLabelValues(queue).Add(float64(delta))
+	// consumers starting and stopping change the number of goroutines, but aren't decisions of the autoscaler
+	if reason != gq.ScaleStarted && reason != gq.ScaleStopped {
+		m.scalingDecisions.WithLabelValues(queue, string(reason)).Inc()
+	}
+}
@@ -0,0 +1,56 @@
+package gqprom
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mattbonnell/gq"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetrics(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m, err := New(reg)
+	require.NoError(t, err)
+
+	m.MessagesPushed("emails", 3, gq.OutcomeSuccess, time.Millisecond)
+	m.MessagesPulled("emails", 2)
+	m.MessageProcessed("emails", gq.OutcomeAcked, time.Millisecond, time.Second)
+	m.MessageProcessed("emails", gq.OutcomeDeadLettered, time.Millisecond, time.Second)
+	m.MessageProcessed("emails", gq.OutcomeRetried, -1, time.Second)
+	m.BufferedMessages("emails", 5)
+	m.BufferedMessages("emails", -3)
+	m.ConsumerScaled("emails", 1, gq.ScaleStarted)
+	m.ConsumerScaled("emails", 2, gq.ScaleBacklog)
+
+	require.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP gq_consumer_goroutines Number of goroutines autoscaling consumers are pulling messages from.
+# TYPE gq_consumer_goroutines gauge
+gq_consumer_goroutines{queue="emails"} 3
+# HELP gq_consumer_scaling_decisions_total Number of changes in the goroutines of autoscaling consumers decided by the autoscaler, by reason (backlog, idle or errors).
+# TYPE gq_consumer_scaling_decisions_total counter
+gq_consumer_scaling_decisions_total{queue="emails",reason="backlog"} 1
+# HELP gq_messages_processed_total Number of messages processed, by outcome (acked, retried or dead_lettered).
+# TYPE gq_messages_processed_total counter
+gq_messages_processed_total{outcome="acked",queue="emails"} 1
+gq_messages_processed_total{outcome="dead_lettered",queue="emails"} 1
+gq_messages_processed_total{outcome="retried",queue="emails"} 1
+# HELP gq_messages_pulled_total Number of messages pulled from the queue for processing.
+# TYPE gq_messages_pulled_total counter
+gq_messages_pulled_total{queue="emails"} 2
+# HELP gq_messages_pushed_total Number of messages pushed onto the queue, by outcome (success or error). Failed pushes are retried, so errors may be counted more than once.
+# TYPE gq_messages_pushed_total counter
+gq_messages_pushed_total{outcome="success",queue="emails"} 3
+# HELP gq_producer_buffered_messages Number of messages buffered by producers which have not yet been pushed onto the queue.
+# TYPE gq_producer_buffered_messages gauge
+gq_producer_buffered_messages{queue="emails"} 2
+`), "gq_consumer_goroutines", "gq_consumer_scaling_decisions_total", "gq_messages_processed_total", "gq_messages_pulled_total", "gq_messages_pushed_total", "gq_producer_buffered_messages"))
+	require.Equal(t, 3, testutil.CollectAndCount(m.endToEndLatency))
+	require.Equal(t, 2, testutil.CollectAndCount(m.handlerDuration), "an unknown handler duration isn't observed")
+
+	_, err = New(reg)
+	require.Error(t, err, "registering twice should fail")
+}
@@ -0,0 +1,93 @@
+package gq
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/mattbonnell/gq/internal"
+)
+
+// inFlightLimit is a cluster-wide limit on the number of messages processed at once, enforced with a fixed number of slots in
+// the database. A Consumer's pull transaction locks a free slot for each message it claims, holding them until it commits, so
+// a crashed consumer's slots are freed with its connection. A lease consumer assigns a slot to each message it leases, until
+// the message is acked or nacked, or its lease expires
+type inFlightLimit struct {
+	db      *sqlx.DB
+	dialect *internal.Dialect
+	tables  internal.Tables
+	name    string
+	max     int
+
+	mu      sync.Mutex
+	created bool
+}
+
+// newInFlightLimit returns the limit named name, or nil if max is unlimited
+func newInFlightLimit(db *sqlx.DB, d *internal.Dialect, tables internal.Tables, name string, max int) *inFlightLimit {
+	if max <= 0 {
+		return nil
+	}
+	return &inFlightLimit{db: db, dialect: d, tables: tables, name: name, max: max}
+}
+
+// create creates the limit's slots the first time it is used
+func (l *inFlightLimit) create(ctx context.Context) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.created {
+		return nil
+	}
+	query := l.db.Rebind(l.dialect.InsertConcurrencySlot)
+	for slot := 0; slot < l.max; slot++ {
+		if _, err := l.db.ExecContext(ctx, query, l.name, slot); err != nil {
+			return fmt.Errorf("error creating concurrency slots: %s", err)
+		}
+	}
+	l.created = true
+	return nil
+}
+
+// lock locks up to n free slots in tx, returning their numbers. Slots beyond the limit, created when it was higher, are ignored
+func (l *inFlightLimit) lock(ctx context.Context, tx *sqlx.Tx, n int, now time.Time) ([]int, error) {
+	if err := l.create(ctx); err != nil {
+		return nil, err
+	}
+	slots := []int{}
+	query := tx.Rebind(fmt.Sprintf("SELECT slot FROM %s WHERE name = ? AND slot < ? AND (message_id IS NULL OR expires_at <= ?) ORDER BY slot LIMIT ? FOR UPDATE SKIP LOCKED", l.tables.ConcurrencySlot))
+	if err := tx.SelectContext(ctx, &slots, query, l.name, l.max, now, n); err != nil {
+		return nil, fmt.Errorf("error locking concurrency slots: %s", err)
+	}
+	return slots, nil
+}
+
+// assign assigns locked slots to the leased messages with the given IDs, until their leases expire
+func (l *inFlightLimit) assign(ctx context.Context, tx *sqlx.Tx, slots []int, ids []int64, expiresAt time.Time) error {
+	query := tx.Rebind(fmt.Sprintf("UPDATE %s SET message_id = ?, expires_at = ? WHERE name = ? AND slot = ?", l.tables.ConcurrencySlot))
+	for i, id := range ids {
+		if _, err := tx.ExecContext(ctx, query, id, expiresAt, l.name, slots[i]); err != nil {
+			return fmt.Errorf("error assigning concurrency slot: %s", err)
+		}
+	}
+	return nil
+}
+
+// release frees the slot assigned to a leased message
+func (l *inFlightLimit) release(ctx context.Context, id int64) error {
+	query := l.db.Rebind(fmt.Sprintf("UPDATE %s SET message_id = NULL, expires_at = NULL WHERE name = ? AND message_id = ?", l.tables.ConcurrencySlot))
+	if _, err := l.db.ExecContext(ctx, query, l.name, id); err != nil {
+		return fmt.Errorf("error releasing concurrency slot: %s", err)
+	}
+	return nil
+}
+
+// extend keeps the slot assigned to a leased message until its extended lease expires
+func (l *inFlightLimit) extend(ctx context.Context, id int64, expiresAt time.Time) error {
+	query := l.db.Rebind(fmt.Sprintf("UPDATE %s SET expires_at = ? WHERE name = ? AND message_id = ?", l.tables.ConcurrencySlot))
+	if _, err := l.db.ExecContext(ctx, query, expiresAt, l.name, id); err != nil {
+		return fmt.Errorf("error extending concurrency slot: %s", err)
+	}
+	return nil
+}
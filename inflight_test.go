@@ -0,0 +1,95 @@
+package gq
+
+import (
+	"context"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/require"
+)
+
+var lockSlots = regexp.QuoteMeta("SELECT slot FROM concurrency_slot WHERE name = ? AND slot < ? AND (message_id IS NULL OR expires_at <= ?) ORDER BY slot LIMIT ? FOR UPDATE SKIP LOCKED")
+
+func expectCreateSlots(mock sqlmock.Sqlmock, name string, max int) {
+	for slot := 0; slot < max; slot++ {
+		mock.ExpectExec(regexp.QuoteMeta("INSERT IGNORE INTO concurrency_slot (name, slot) VALUES (?, ?)")).
+			WithArgs(name, slot).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+}
+
+func TestPullMessages_MaxInFlight(t *testing.T) {
+	c, mock, now := newAdminTestClient(t)
+	opts := idleConsumerOpts()
+	opts.MaxInFlight = 2
+	opts.InFlightKey = "legacy-api"
+	consumer, err := newConsumer(context.Background(), c, func(ctx context.Context, m *Message) error { return nil }, opts)
+	require.NoError(t, err)
+	defer consumer.Close()
+
+	mock.ExpectBegin()
+	expectCreateSlots(mock, "legacy-api", 2)
+	mock.ExpectQuery(lockSlots).
+		WithArgs("legacy-api", 2, now, defaultMaxBatchSize).
+		WillReturnRows(sqlmock.NewRows([]string{"slot"}).AddRow(1))
+	mock.ExpectQuery(regexp.QuoteMeta("FROM message WHERE queue = ? AND ready_at <= ? ORDER BY priority DESC, ready_at ASC LIMIT ? FOR UPDATE SKIP LOCKED")).
+		WithArgs(DefaultQueue, now, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "payload", "headers", "retries", "created_at", "unique_key", "tracked"}).
+			AddRow(1, []byte("a"), nil, 0, now, nil, false))
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM message WHERE id in (?)")).WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	require.Equal(t, pullFull, consumer.pullMessages(context.Background(), now))
+	require.NoError(t, mock.ExpectationsWereMet())
+
+	// with every slot held, no messages are claimed
+	mock.ExpectBegin()
+	mock.ExpectQuery(lockSlots).WillReturnRows(sqlmock.NewRows([]string{"slot"}))
+	mock.ExpectRollback()
+	require.Equal(t, pullThrottled, consumer.pullMessages(context.Background(), now))
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestReceive_MaxInFlight(t *testing.T) {
+	c, mock, now := newLeaseTestConsumer(t)
+	c.slots = newInFlightLimit(c.db, c.dialect, c.tables, "emails", 1)
+	lease := 30 * time.Second
+
+	expectPauseCheck(mock, "emails", false)
+	mock.ExpectBegin()
+	expectCreateSlots(mock, "emails", 1)
+	mock.ExpectQuery(lockSlots).
+		WithArgs("emails", 1, now, 10).
+		WillReturnRows(sqlmock.NewRows([]string{"slot"}).AddRow(0))
+	mock.ExpectQuery(regexp.QuoteMeta("FROM message WHERE queue = ? AND ready_at <= ? ORDER BY priority DESC, ready_at ASC LIMIT ?")).
+		WithArgs("emails", now, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "payload", "headers", "retries", "created_at", "unique_key", "tracked", "lease_token"}).AddRow(7, []byte("a"), nil, 0, now, nil, false, nil))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE message SET retries = CASE WHEN lease_token IS NULL THEN retries ELSE retries + 1 END, ready_at = ?, lease_token = ? WHERE id IN (?)")).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE concurrency_slot SET message_id = ?, expires_at = ? WHERE name = ? AND slot = ?")).
+		WithArgs(7, now.Add(lease), "emails", 0).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	deliveries, err := c.Receive(context.Background(), 10, lease)
+	require.NoError(t, err)
+	require.Len(t, deliveries, 1)
+
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE message SET ready_at = ? WHERE id = ? AND lease_token = ?")).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE concurrency_slot SET expires_at = ? WHERE name = ? AND message_id = ?")).
+		WithArgs(now.Add(time.Minute), "emails", 7).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	_, err = c.Extend(context.Background(), 7, deliveries[0].LeaseToken, time.Minute)
+	require.NoError(t, err)
+
+	mock.ExpectQuery(regexp.QuoteMeta("FROM message WHERE id = ? AND lease_token = ?")).
+		WillReturnRows(leasedRows(0, now))
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM message WHERE id = ? AND lease_token = ?")).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE concurrency_slot SET message_id = NULL, expires_at = NULL WHERE name = ? AND message_id = ?")).
+		WithArgs("emails", 7).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	require.NoError(t, c.Ack(context.Background(), 7, deliveries[0].LeaseToken))
+	require.NoError(t, mock.ExpectationsWereMet())
+}
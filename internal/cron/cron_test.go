@@ -0,0 +1,41 @@
+package cron
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNext(t *testing.T) {
+	from := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC) // a Thursday
+	for _, tc := range []struct {
+		spec string
+		next time.Time
+	}{
+		{"* * * * *", time.Date(2021, 3, 4, 5, 7, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2021, 3, 4, 5, 15, 0, 0, time.UTC)},
+		{"30 9 * * *", time.Date(2021, 3, 4, 9, 30, 0, 0, time.UTC)},
+		{"0 0 * * mon-fri", time.Date(2021, 3, 5, 0, 0, 0, 0, time.UTC)},
+		{"0 12 * * 7", time.Date(2021, 3, 7, 12, 0, 0, 0, time.UTC)},
+		{"0 0 1,15 * *", time.Date(2021, 3, 15, 0, 0, 0, 0, time.UTC)},
+		// both day fields restricted: either may match
+		{"0 0 13 * 6", time.Date(2021, 3, 6, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 feb *", time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2021, 3, 4, 6, 0, 0, 0, time.UTC)},
+		{"@monthly", time.Date(2021, 4, 1, 0, 0, 0, 0, time.UTC)},
+		{"@every 90s", time.Date(2021, 3, 4, 5, 7, 37, 0, time.UTC)},
+		{"0 0 30 2 *", time.Time{}},
+	} {
+		s, err := Parse(tc.spec)
+		require.NoError(t, err, tc.spec)
+		require.Equal(t, tc.next, s.Next(from), tc.spec)
+	}
+}
+
+func TestParse_Invalid(t *testing.T) {
+	for _, spec := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "5-1 * * * *", "*/0 * * * *", "* * * foo *", "@every 1ms", "@every soon"} {
+		_, err := Parse(spec)
+		require.Error(t, err, spec)
+	}
+}
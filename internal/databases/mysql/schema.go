@@ -1,14 +1,209 @@
 package mysql
 
+// The statements below are templates, rendered with the names of gq's tables
+
 const (
-	message = `CREATE TABLE IF NOT EXISTS message (
+	// VersionTable records the schema migrations which have been applied
+	VersionTable = `CREATE TABLE IF NOT EXISTS {{.SchemaVersion}} (
+	version INT PRIMARY KEY,
+	applied_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);`
+	// CreateSchema creates the database which gq's tables are qualified with, if any
+	CreateSchema = `CREATE SCHEMA IF NOT EXISTS {{.Schema}};`
+	// AcquireLock acquires the named lock used to serialize migrations, returning 1 on success
+	AcquireLock = `SELECT GET_LOCK(?, 60)`
+	// ReleaseLock releases the named lock used to serialize migrations
+	ReleaseLock = `SELECT RELEASE_LOCK(?)`
+	// InsertSubscription subscribes a queue to a topic, doing nothing if it is already subscribed
+	InsertSubscription = `INSERT IGNORE INTO {{.Subscription}} (topic, queue) VALUES (?, ?)`
+	// InsertGroupOffset creates a consumer group's offset for a stream partition, doing nothing if it already exists
+	InsertGroupOffset = `INSERT IGNORE INTO {{.ConsumerGroupOffset}} (stream, group_name, partition_id, partitions, committed_offset, retries, poll_after) VALUES (?, ?, ?, ?, ?, 0, ?)`
+	// UpsertSchedule creates or replaces a schedule, keeping its next run time unless its spec has changed
+	UpsertSchedule = `INSERT INTO {{.Schedule}} (name, spec, queue, payload, headers, catch_up, next_run_at) VALUES (?, ?, ?, ?, ?, ?, ?) ON DUPLICATE KEY UPDATE next_run_at = IF(spec = VALUES(spec), next_run_at, VALUES(next_run_at)), spec = VALUES(spec), queue = VALUES(queue), payload = VALUES(payload), headers = VALUES(headers), catch_up = VALUES(catch_up)`
+	// UpsertDeadStreamMessage dead-letters a stream message for a consumer group, replacing the failure recorded if the group has dead-lettered it before
+	UpsertDeadStreamMessage = `INSERT INTO {{.DeadStreamMessage}} (stream, group_name, message_id, payload, headers, created_at, failed_at, retries, last_error) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?) ON DUPLICATE KEY UPDATE failed_at = VALUES(failed_at), retries = VALUES(retries), last_error = VALUES(last_error)`
+	// InsertUniqueLock acquires a uniqueness key, or locks it exclusively if it is already held: INSERT IGNORE would take only a
+	// shared lock on the held key, and two pushes upgrading theirs to lock it for update would deadlock
+	InsertUniqueLock = `INSERT INTO {{.UniqueLock}} (queue, unique_key, message_id, scope, expires_at) VALUES (?, ?, ?, ?, ?) ON DUPLICATE KEY UPDATE unique_key = unique_key`
+	// InsertQueuePause pauses a queue, doing nothing if it is already paused
+	InsertQueuePause = `INSERT IGNORE INTO {{.QueuePause}} (queue, paused_at) VALUES (?, ?)`
+	// InsertRateLimit creates a cluster-wide rate limit's token bucket, doing nothing if it already exists
+	InsertRateLimit = `INSERT IGNORE INTO {{.RateLimit}} (name, tokens, updated_at) VALUES (?, ?, ?)`
+	// InsertConcurrencySlot creates a slot of a limit on messages in flight, doing nothing if it already exists
+	InsertConcurrencySlot = `INSERT IGNORE INTO {{.ConcurrencySlot}} (name, slot) VALUES (?, ?)`
+
+	message = `CREATE TABLE IF NOT EXISTS {{.Message}} (
 	id INT AUTO_INCREMENT PRIMARY KEY,
 	payload BLOB NOT NULL,
 	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
 	ready_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
 	retries INT DEFAULT 0,
-	INDEX ready_at (ready_at ASC)
+	INDEX {{.Prefix}}message_ready_at_idx (ready_at ASC)
+);`
+
+	messageQueue      = `ALTER TABLE {{.Message}} ADD COLUMN queue VARCHAR(255) NOT NULL DEFAULT 'default';`
+	messageQueueIndex = `CREATE INDEX {{.Prefix}}message_queue_ready_at_idx ON {{.Message}} (queue, ready_at ASC);`
+	deadMessage       = `CREATE TABLE IF NOT EXISTS {{.DeadMessage}} (
+	id INT PRIMARY KEY,
+	queue VARCHAR(255) NOT NULL,
+	payload BLOB NOT NULL,
+	created_at TIMESTAMP NULL,
+	failed_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	retries INT DEFAULT 0,
+	last_error TEXT,
+	INDEX {{.Prefix}}dead_message_queue_idx (queue, failed_at)
+);`
+
+	messageHeaders     = `ALTER TABLE {{.Message}} ADD COLUMN headers TEXT;`
+	deadMessageHeaders = `ALTER TABLE {{.DeadMessage}} ADD COLUMN headers TEXT;`
+
+	// messageLeaseToken identifies the lease on a message claimed by Consumer.Receive, so that a stale lease cannot ack it
+	messageLeaseToken = `ALTER TABLE {{.Message}} ADD COLUMN lease_token VARCHAR(64);`
+
+	subscription = `CREATE TABLE IF NOT EXISTS {{.Subscription}} (
+	topic VARCHAR(255) NOT NULL,
+	queue VARCHAR(255) NOT NULL,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (topic, queue)
+);`
+
+	consumerGroupOffset = `CREATE TABLE IF NOT EXISTS {{.ConsumerGroupOffset}} (
+	stream VARCHAR(255) NOT NULL,
+	group_name VARCHAR(255) NOT NULL,
+	partition_id INT NOT NULL,
+	partitions INT NOT NULL,
+	committed_offset BIGINT NOT NULL DEFAULT 0,
+	retries INT NOT NULL DEFAULT 0,
+	poll_after TIMESTAMP NULL,
+	PRIMARY KEY (stream, group_name, partition_id)
+);`
+	messageQueueIDIndex = `CREATE INDEX {{.Prefix}}message_queue_id_idx ON {{.Message}} (queue, id);`
+
+	schedule = `CREATE TABLE IF NOT EXISTS {{.Schedule}} (
+	name VARCHAR(255) PRIMARY KEY,
+	spec VARCHAR(255) NOT NULL,
+	queue VARCHAR(255) NOT NULL,
+	payload BLOB NOT NULL,
+	headers TEXT,
+	catch_up INT NOT NULL DEFAULT 0,
+	next_run_at TIMESTAMP NULL,
+	last_run_at TIMESTAMP NULL,
+	INDEX {{.Prefix}}schedule_next_run_at_idx (next_run_at)
+);`
+
+	messageUniqueKey = `ALTER TABLE {{.Message}} ADD COLUMN unique_key VARCHAR(255);`
+	uniqueLock       = `CREATE TABLE IF NOT EXISTS {{.UniqueLock}} (
+	queue VARCHAR(255) NOT NULL,
+	unique_key VARCHAR(255) NOT NULL,
+	message_id BIGINT NOT NULL,
+	scope INT NOT NULL,
+	expires_at TIMESTAMP NULL,
+	rerun_payload BLOB,
+	rerun_headers TEXT,
+	PRIMARY KEY (queue, unique_key),
+	INDEX {{.Prefix}}unique_lock_message_id_idx (message_id)
+);`
+
+	messageTracked = `ALTER TABLE {{.Message}} ADD COLUMN tracked BOOLEAN NOT NULL DEFAULT FALSE;`
+	jobStatus      = `CREATE TABLE IF NOT EXISTS {{.JobStatus}} (
+	id BIGINT PRIMARY KEY,
+	queue VARCHAR(255) NOT NULL,
+	state INT NOT NULL DEFAULT 0,
+	attempts INT NOT NULL DEFAULT 0,
+	last_error TEXT,
+	result BLOB,
+	created_at TIMESTAMP NULL,
+	started_at TIMESTAMP NULL,
+	finished_at TIMESTAMP NULL,
+	INDEX {{.Prefix}}job_status_finished_at_idx (finished_at)
+);`
+
+	// jobStatusExpiresAt is the time after which the reply to an abandoned call may be deleted
+	jobStatusExpiresAt      = `ALTER TABLE {{.JobStatus}} ADD COLUMN expires_at TIMESTAMP NULL;`
+	jobStatusExpiresAtIndex = `CREATE INDEX {{.Prefix}}job_status_expires_at_idx ON {{.JobStatus}} (expires_at);`
+
+	workflow = `CREATE TABLE IF NOT EXISTS {{.Workflow}} (
+	id VARCHAR(64) PRIMARY KEY,
+	state INT NOT NULL,
+	step INT NOT NULL DEFAULT 0,
+	steps INT NOT NULL,
+	total INT NOT NULL,
+	pending INT NOT NULL,
+	succeeded INT NOT NULL DEFAULT 0,
+	failed INT NOT NULL DEFAULT 0,
+	created_at TIMESTAMP NULL,
+	finished_at TIMESTAMP NULL,
+	INDEX {{.Prefix}}workflow_finished_at_idx (finished_at)
+);`
+	workflowTask = `CREATE TABLE IF NOT EXISTS {{.WorkflowTask}} (
+	workflow_id VARCHAR(64) NOT NULL,
+	step INT NOT NULL,
+	position INT NOT NULL,
+	queue VARCHAR(255) NOT NULL,
+	payload BLOB NOT NULL,
+	headers TEXT,
+	PRIMARY KEY (workflow_id, step, position)
+);`
+	jobStatusWorkflowID = `ALTER TABLE {{.JobStatus}} ADD COLUMN workflow_id VARCHAR(64);`
+
+	queuePause = `CREATE TABLE IF NOT EXISTS {{.QueuePause}} (
+	queue VARCHAR(255) PRIMARY KEY,
+	paused_at TIMESTAMP NULL
+);`
+
+	rateLimit = `CREATE TABLE IF NOT EXISTS {{.RateLimit}} (
+	name VARCHAR(255) PRIMARY KEY,
+	tokens DOUBLE NOT NULL,
+	updated_at TIMESTAMP NULL
+);`
+
+	concurrencySlot = `CREATE TABLE IF NOT EXISTS {{.ConcurrencySlot}} (
+	name VARCHAR(255) NOT NULL,
+	slot INT NOT NULL,
+	message_id BIGINT NULL,
+	expires_at TIMESTAMP NULL,
+	PRIMARY KEY (name, slot)
+);`
+	concurrencySlotMessageIDIndex = `CREATE INDEX {{.Prefix}}concurrency_slot_message_id_idx ON {{.ConcurrencySlot}} (message_id);`
+
+	// deadStreamMessage is kept apart from the dead message table, since every consumer group may dead-letter the same stream message,
+	// which stays in the stream
+	// messagePriority orders the claiming of ready messages, highest first
+	messagePriority      = `ALTER TABLE {{.Message}} ADD COLUMN priority INT NOT NULL DEFAULT 0;`
+	messagePriorityIndex = `CREATE INDEX {{.Prefix}}message_queue_priority_idx ON {{.Message}} (queue, priority DESC, ready_at ASC);`
+
+	deadStreamMessage = `CREATE TABLE IF NOT EXISTS {{.DeadStreamMessage}} (
+	stream VARCHAR(255) NOT NULL,
+	group_name VARCHAR(255) NOT NULL,
+	message_id BIGINT NOT NULL,
+	payload BLOB NOT NULL,
+	headers TEXT,
+	created_at TIMESTAMP NULL,
+	failed_at TIMESTAMP NULL,
+	retries INT NOT NULL DEFAULT 0,
+	last_error TEXT,
+	PRIMARY KEY (stream, group_name, message_id),
+	INDEX {{.Prefix}}dead_stream_message_created_at_idx (stream, created_at)
 );`
 )
 
-var Schema = []string{message}
+// Migrations are the ordered schema migrations. Migration n is recorded as version n+1.
+// MySQL implicitly commits DDL statements, so a migration which fails part-way may need to be completed by hand before it is retried.
+var Migrations = [][]string{
+	{message},
+	{messageQueue, messageQueueIndex, deadMessage},
+	{messageHeaders, deadMessageHeaders},
+	{messageLeaseToken},
+	{subscription},
+	{consumerGroupOffset, messageQueueIDIndex},
+	{schedule},
+	{messageUniqueKey, uniqueLock},
+	{messageTracked, jobStatus},
+	{jobStatusExpiresAt, jobStatusExpiresAtIndex},
+	{workflow, workflowTask, jobStatusWorkflowID},
+	{queuePause},
+	{rateLimit},
+	{concurrencySlot, concurrencySlotMessageIDIndex},
+	{deadStreamMessage},
+	{messagePriority, messagePriorityIndex},
+}
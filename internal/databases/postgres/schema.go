@@ -1,14 +1,220 @@
 package postgres
 
+// The statements below are templates, rendered with the names of gq's tables
+
 const (
-	messageTable = `CREATE TABLE IF NOT EXISTS message (
+	// VersionTable records the schema migrations which have been applied
+	VersionTable = `CREATE TABLE IF NOT EXISTS {{.SchemaVersion}} (
+	version INT PRIMARY KEY,
+	applied_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);`
+	// CreateSchema creates the schema which gq's tables are qualified with, if any
+	CreateSchema = `CREATE SCHEMA IF NOT EXISTS {{.Schema}};`
+	// AcquireLock acquires the advisory lock used to serialize migrations, returning 1 on success
+	AcquireLock = `SELECT 1 FROM pg_advisory_lock(?)`
+	// ReleaseLock releases the advisory lock used to serialize migrations
+	ReleaseLock = `SELECT pg_advisory_unlock(?)`
+	// InsertSubscription subscribes a queue to a topic, doing nothing if it is already subscribed
+	InsertSubscription = `INSERT INTO {{.Subscription}} (topic, queue) VALUES (?, ?) ON CONFLICT DO NOTHING`
+	// InsertGroupOffset creates a consumer group's offset for a stream partition, doing nothing if it already exists
+	InsertGroupOffset = `INSERT INTO {{.ConsumerGroupOffset}} (stream, group_name, partition_id, partitions, committed_offset, retries, poll_after) VALUES (?, ?, ?, ?, ?, 0, ?) ON CONFLICT DO NOTHING`
+	// UpsertSchedule creates or replaces a schedule, keeping its next run time unless its spec has changed
+	UpsertSchedule = `INSERT INTO {{.Schedule}} AS s (name, spec, queue, payload, headers, catch_up, next_run_at) VALUES (?, ?, ?, ?, ?, ?, ?) ON CONFLICT (name) DO UPDATE SET next_run_at = CASE WHEN s.spec = EXCLUDED.spec THEN s.next_run_at ELSE EXCLUDED.next_run_at END, spec = EXCLUDED.spec, queue = EXCLUDED.queue, payload = EXCLUDED.payload, headers = EXCLUDED.headers, catch_up = EXCLUDED.catch_up`
+	// UpsertDeadStreamMessage dead-letters a stream message for a consumer group, replacing the failure recorded if the group has dead-lettered it before
+	UpsertDeadStreamMessage = `INSERT INTO {{.DeadStreamMessage}} (stream, group_name, message_id, payload, headers, created_at, failed_at, retries, last_error) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?) ON CONFLICT (stream, group_name, message_id) DO UPDATE SET failed_at = EXCLUDED.failed_at, retries = EXCLUDED.retries, last_error = EXCLUDED.last_error`
+	// InsertUniqueLock acquires a uniqueness key, doing nothing if it is already held
+	InsertUniqueLock = `INSERT INTO {{.UniqueLock}} (queue, unique_key, message_id, scope, expires_at) VALUES (?, ?, ?, ?, ?) ON CONFLICT DO NOTHING`
+	// InsertQueuePause pauses a queue, doing nothing if it is already paused
+	InsertQueuePause = `INSERT INTO {{.QueuePause}} (queue, paused_at) VALUES (?, ?) ON CONFLICT DO NOTHING`
+	// InsertRateLimit creates a cluster-wide rate limit's token bucket, doing nothing if it already exists
+	InsertRateLimit = `INSERT INTO {{.RateLimit}} (name, tokens, updated_at) VALUES (?, ?, ?) ON CONFLICT DO NOTHING`
+	// InsertConcurrencySlot creates a slot of a limit on messages in flight, doing nothing if it already exists
+	InsertConcurrencySlot = `INSERT INTO {{.ConcurrencySlot}} (name, slot) VALUES (?, ?) ON CONFLICT DO NOTHING`
+	// ReturningID returns the ID of an inserted message, which lib/pq does not report as the last insert ID
+	ReturningID = " RETURNING id"
+
+	messageTable = `CREATE TABLE IF NOT EXISTS {{.Message}} (
 	id SERIAL PRIMARY KEY,
 	payload BYTEA NOT NULL,
 	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
 	ready_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
 	retries INT DEFAULT 0
 );`
-	messageReadyAtIndex = `CREATE INDEX IF NOT EXISTS ready_at ON message (ready_at ASC);`
+
+	// index names share a namespace within a schema, so they carry the table prefix to let several gq instances coexist
+	messageReadyAtIndex = `CREATE INDEX IF NOT EXISTS {{.Prefix}}message_ready_at_idx ON {{.Message}} (ready_at ASC);`
+	// databases created before migrations were versioned index the message table as ready_at, which the index above replaces
+	messageBaselineReadyAtIndex = `DO $$
+DECLARE
+	schema_name TEXT := COALESCE(NULLIF('{{.Schema}}', ''), current_schema());
+BEGIN
+	IF EXISTS (SELECT 1 FROM pg_indexes WHERE schemaname = schema_name AND tablename = '{{.Prefix}}message' AND indexname = 'ready_at') THEN
+		EXECUTE format('DROP INDEX %I.ready_at', schema_name);
+	END IF;
+END $$;`
+
+	messageQueue      = `ALTER TABLE {{.Message}} ADD COLUMN IF NOT EXISTS queue VARCHAR(255) NOT NULL DEFAULT 'default';`
+	messageQueueIndex = `CREATE INDEX IF NOT EXISTS {{.Prefix}}message_queue_ready_at_idx ON {{.Message}} (queue, ready_at ASC);`
+	deadMessageTable  = `CREATE TABLE IF NOT EXISTS {{.DeadMessage}} (
+	id INT PRIMARY KEY,
+	queue VARCHAR(255) NOT NULL,
+	payload BYTEA NOT NULL,
+	created_at TIMESTAMP,
+	failed_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	retries INT DEFAULT 0,
+	last_error TEXT
+);`
+	deadMessageQueueIndex = `CREATE INDEX IF NOT EXISTS {{.Prefix}}dead_message_queue_idx ON {{.DeadMessage}} (queue, failed_at);`
+
+	messageHeaders     = `ALTER TABLE {{.Message}} ADD COLUMN IF NOT EXISTS headers TEXT;`
+	deadMessageHeaders = `ALTER TABLE {{.DeadMessage}} ADD COLUMN IF NOT EXISTS headers TEXT;`
+
+	// messageLeaseToken identifies the lease on a message claimed by Consumer.Receive, so that a stale lease cannot ack it
+	messageLeaseToken = `ALTER TABLE {{.Message}} ADD COLUMN IF NOT EXISTS lease_token VARCHAR(64);`
+
+	subscriptionTable = `CREATE TABLE IF NOT EXISTS {{.Subscription}} (
+	topic VARCHAR(255) NOT NULL,
+	queue VARCHAR(255) NOT NULL,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (topic, queue)
+);`
+
+	consumerGroupOffsetTable = `CREATE TABLE IF NOT EXISTS {{.ConsumerGroupOffset}} (
+	stream VARCHAR(255) NOT NULL,
+	group_name VARCHAR(255) NOT NULL,
+	partition_id INT NOT NULL,
+	partitions INT NOT NULL,
+	committed_offset BIGINT NOT NULL DEFAULT 0,
+	retries INT NOT NULL DEFAULT 0,
+	poll_after TIMESTAMP NULL,
+	PRIMARY KEY (stream, group_name, partition_id)
+);`
+	messageQueueIDIndex = `CREATE INDEX IF NOT EXISTS {{.Prefix}}message_queue_id_idx ON {{.Message}} (queue, id);`
+
+	scheduleTable = `CREATE TABLE IF NOT EXISTS {{.Schedule}} (
+	name VARCHAR(255) PRIMARY KEY,
+	spec VARCHAR(255) NOT NULL,
+	queue VARCHAR(255) NOT NULL,
+	payload BYTEA NOT NULL,
+	headers TEXT,
+	catch_up INT NOT NULL DEFAULT 0,
+	next_run_at TIMESTAMP NULL,
+	last_run_at TIMESTAMP NULL
+);`
+	scheduleNextRunAtIndex = `CREATE INDEX IF NOT EXISTS {{.Prefix}}schedule_next_run_at_idx ON {{.Schedule}} (next_run_at);`
+
+	messageUniqueKey = `ALTER TABLE {{.Message}} ADD COLUMN IF NOT EXISTS unique_key VARCHAR(255);`
+	uniqueLockTable  = `CREATE TABLE IF NOT EXISTS {{.UniqueLock}} (
+	queue VARCHAR(255) NOT NULL,
+	unique_key VARCHAR(255) NOT NULL,
+	message_id BIGINT NOT NULL,
+	scope INT NOT NULL,
+	expires_at TIMESTAMP NULL,
+	rerun_payload BYTEA,
+	rerun_headers TEXT,
+	PRIMARY KEY (queue, unique_key)
+);`
+	uniqueLockMessageIDIndex = `CREATE INDEX IF NOT EXISTS {{.Prefix}}unique_lock_message_id_idx ON {{.UniqueLock}} (message_id);`
+
+	messageTracked = `ALTER TABLE {{.Message}} ADD COLUMN IF NOT EXISTS tracked BOOLEAN NOT NULL DEFAULT FALSE;`
+	jobStatusTable = `CREATE TABLE IF NOT EXISTS {{.JobStatus}} (
+	id BIGINT PRIMARY KEY,
+	queue VARCHAR(255) NOT NULL,
+	state INT NOT NULL DEFAULT 0,
+	attempts INT NOT NULL DEFAULT 0,
+	last_error TEXT,
+	result BYTEA,
+	created_at TIMESTAMP NULL,
+	started_at TIMESTAMP NULL,
+	finished_at TIMESTAMP NULL
+);`
+	jobStatusFinishedAtIndex = `CREATE INDEX IF NOT EXISTS {{.Prefix}}job_status_finished_at_idx ON {{.JobStatus}} (finished_at);`
+
+	// jobStatusExpiresAt is the time after which the reply to an abandoned call may be deleted
+	jobStatusExpiresAt      = `ALTER TABLE {{.JobStatus}} ADD COLUMN IF NOT EXISTS expires_at TIMESTAMP NULL;`
+	jobStatusExpiresAtIndex = `CREATE INDEX IF NOT EXISTS {{.Prefix}}job_status_expires_at_idx ON {{.JobStatus}} (expires_at);`
+
+	workflowTable = `CREATE TABLE IF NOT EXISTS {{.Workflow}} (
+	id VARCHAR(64) PRIMARY KEY,
+	state INT NOT NULL,
+	step INT NOT NULL DEFAULT 0,
+	steps INT NOT NULL,
+	total INT NOT NULL,
+	pending INT NOT NULL,
+	succeeded INT NOT NULL DEFAULT 0,
+	failed INT NOT NULL DEFAULT 0,
+	created_at TIMESTAMP NULL,
+	finished_at TIMESTAMP NULL
+);`
+	workflowFinishedAtIndex = `CREATE INDEX IF NOT EXISTS {{.Prefix}}workflow_finished_at_idx ON {{.Workflow}} (finished_at);`
+	workflowTaskTable       = `CREATE TABLE IF NOT EXISTS {{.WorkflowTask}} (
+	workflow_id VARCHAR(64) NOT NULL,
+	step INT NOT NULL,
+	position INT NOT NULL,
+	queue VARCHAR(255) NOT NULL,
+	payload BYTEA NOT NULL,
+	headers TEXT,
+	PRIMARY KEY (workflow_id, step, position)
+);`
+	jobStatusWorkflowID = `ALTER TABLE {{.JobStatus}} ADD COLUMN IF NOT EXISTS workflow_id VARCHAR(64);`
+
+	queuePauseTable = `CREATE TABLE IF NOT EXISTS {{.QueuePause}} (
+	queue VARCHAR(255) PRIMARY KEY,
+	paused_at TIMESTAMP NULL
+);`
+
+	rateLimitTable = `CREATE TABLE IF NOT EXISTS {{.RateLimit}} (
+	name VARCHAR(255) PRIMARY KEY,
+	tokens DOUBLE PRECISION NOT NULL,
+	updated_at TIMESTAMP NULL
+);`
+
+	concurrencySlotTable = `CREATE TABLE IF NOT EXISTS {{.ConcurrencySlot}} (
+	name VARCHAR(255) NOT NULL,
+	slot INT NOT NULL,
+	message_id BIGINT NULL,
+	expires_at TIMESTAMP NULL,
+	PRIMARY KEY (name, slot)
+);`
+	concurrencySlotMessageIDIndex = `CREATE INDEX IF NOT EXISTS {{.Prefix}}concurrency_slot_message_id_idx ON {{.ConcurrencySlot}} (message_id);`
+
+	// deadStreamMessageTable is kept apart from the dead message table, since every consumer group may dead-letter the same stream message,
+	// which stays in the stream
+	// messagePriority orders the claiming of ready messages, highest first
+	messagePriority      = `ALTER TABLE {{.Message}} ADD COLUMN IF NOT EXISTS priority INT NOT NULL DEFAULT 0;`
+	messagePriorityIndex = `CREATE INDEX IF NOT EXISTS {{.Prefix}}message_queue_priority_idx ON {{.Message}} (queue, priority DESC, ready_at ASC);`
+
+	deadStreamMessageTable = `CREATE TABLE IF NOT EXISTS {{.DeadStreamMessage}} (
+	stream VARCHAR(255) NOT NULL,
+	group_name VARCHAR(255) NOT NULL,
+	message_id BIGINT NOT NULL,
+	payload BYTEA NOT NULL,
+	headers TEXT,
+	created_at TIMESTAMP NULL,
+	failed_at TIMESTAMP NULL,
+	retries INT NOT NULL DEFAULT 0,
+	last_error TEXT,
+	PRIMARY KEY (stream, group_name, message_id)
+);`
+	deadStreamMessageCreatedAtIndex = `CREATE INDEX IF NOT EXISTS {{.Prefix}}dead_stream_message_created_at_idx ON {{.DeadStreamMessage}} (stream, created_at);`
 )
 
-var Schema = []string{messageTable, messageReadyAtIndex}
+// Migrations are the ordered schema migrations. Migration n is recorded as version n+1.
+var Migrations = [][]string{
+	{messageTable, messageReadyAtIndex, messageBaselineReadyAtIndex},
+	{messageQueue, messageQueueIndex, deadMessageTable, deadMessageQueueIndex},
+	{messageHeaders, deadMessageHeaders},
+	{messageLeaseToken},
+	{subscriptionTable},
+	{consumerGroupOffsetTable, messageQueueIDIndex},
+	{scheduleTable, scheduleNextRunAtIndex},
+	{messageUniqueKey, uniqueLockTable, uniqueLockMessageIDIndex},
+	{messageTracked, jobStatusTable, jobStatusFinishedAtIndex},
+	{jobStatusExpiresAt, jobStatusExpiresAtIndex},
+	{workflowTable, workflowFinishedAtIndex, workflowTaskTable, jobStatusWorkflowID},
+	{queuePauseTable},
+	{rateLimitTable},
+	{concurrencySlotTable, concurrencySlotMessageIDIndex},
+	{deadStreamMessageTable, deadStreamMessageCreatedAtIndex},
+	{messagePriority, messagePriorityIndex},
+}
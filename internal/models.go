@@ -2,13 +2,89 @@ package internal
 
 import (
 	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
 	"time"
 )
 
 type Message struct {
 	ID        int64
-	CreatedAt time.Time    `db:"created_at"`
+	Queue     string       `db:"queue"`
+	CreatedAt Time         `db:"created_at"`
 	Payload   sql.RawBytes `db:"payload"`
+	Headers   Headers      `db:"headers"`
 	Retries   int32        `db:"retries"`
 	ReadyAt   time.Time    `db:"ready_at"`
+	// UniqueKey is the key of a message pushed with Producer.PushUnique
+	UniqueKey sql.NullString `db:"unique_key"`
+	// Tracked is whether the message's status is recorded, having been pushed with Producer.PushTracked
+	Tracked bool `db:"tracked"`
+}
+
+// Headers are a message's headers, stored as a JSON object, or NULL if there are none
+type Headers map[string]string
+
+// Value implements driver.Valuer
+func (h Headers) Value() (driver.Value, error) {
+	if len(h) == 0 {
+		return nil, nil
+	}
+	b, err := json.Marshal(h)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+// Scan implements sql.Scanner
+func (h *Headers) Scan(src interface{}) error {
+	var b []byte
+	switch v := src.(type) {
+	case nil:
+		*h = nil
+		return nil
+	case []byte:
+		b = v
+	case string:
+		b = []byte(v)
+	default:
+		return fmt.Errorf("cannot scan %T into Headers", src)
+	}
+	*h = nil
+	return json.Unmarshal(b, h)
+}
+
+// timestampLayout is the layout MySQL returns TIMESTAMP columns in when the driver isn't configured with parseTime=true
+const timestampLayout = "2006-01-02 15:04:05.999999"
+
+// Time is a timestamp which can be scanned whether or not the driver parses timestamps itself
+type Time struct {
+	time.Time
+}
+
+// Scan implements sql.Scanner
+func (t *Time) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		t.Time = time.Time{}
+	case time.Time:
+		t.Time = v.UTC()
+	case []byte:
+		return t.parse(string(v))
+	case string:
+		return t.parse(v)
+	default:
+		return fmt.Errorf("cannot scan %T into Time", src)
+	}
+	return nil
+}
+
+func (t *Time) parse(s string) error {
+	parsed, err := time.Parse(timestampLayout, s)
+	if err != nil {
+		return err
+	}
+	t.Time = parsed
+	return nil
 }
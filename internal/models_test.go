@@ -0,0 +1,42 @@
+package internal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTimeScan(t *testing.T) {
+	expected := time.Date(2021, 2, 27, 20, 46, 43, 0, time.UTC)
+	var ts Time
+
+	require.NoError(t, ts.Scan(expected.In(time.FixedZone("EST", -5*60*60))))
+	require.True(t, expected.Equal(ts.Time))
+	require.Equal(t, time.UTC, ts.Location())
+
+	require.NoError(t, ts.Scan([]byte("2021-02-27 20:46:43")))
+	require.Equal(t, expected, ts.Time)
+
+	require.NoError(t, ts.Scan(nil))
+	require.True(t, ts.IsZero())
+
+	require.Error(t, ts.Scan(42))
+}
+
+func TestHeaders(t *testing.T) {
+	v, err := Headers(nil).Value()
+	require.NoError(t, err)
+	require.Nil(t, v)
+
+	h := Headers{"traceparent": "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"}
+	v, err = h.Value()
+	require.NoError(t, err)
+
+	var scanned Headers
+	require.NoError(t, scanned.Scan([]byte(v.(string))))
+	require.Equal(t, h, scanned)
+
+	require.NoError(t, scanned.Scan(nil))
+	require.Nil(t, scanned)
+}
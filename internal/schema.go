@@ -1,50 +1,241 @@
 package internal
 
 import (
+	"context"
+	"database/sql"
 	"fmt"
+	"hash/fnv"
 	"strings"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/mattbonnell/gq/internal/databases/mysql"
 	"github.com/mattbonnell/gq/internal/databases/postgres"
-	"github.com/rs/zerolog/log"
 )
 
-func GetSchema(driverName string) ([]string, error) {
+// Dialect holds the database-specific statements used to migrate the schema, and those queries which can't be written portably
+type Dialect struct {
+	// Migrations are the ordered schema migrations. Migration n is recorded as version n+1
+	Migrations [][]string
+	// VersionTable creates the table which records applied migrations
+	VersionTable string
+	// CreateSchema creates the schema which the tables are qualified with, or is empty if they are unqualified
+	CreateSchema string
+	// AcquireLock acquires the lock which serializes concurrent migrations
+	AcquireLock string
+	// ReleaseLock releases the lock which serializes concurrent migrations
+	ReleaseLock string
+	// LockKey is the argument passed to AcquireLock and ReleaseLock
+	LockKey interface{}
+	// InsertSubscription subscribes a queue to a topic, doing nothing if it is already subscribed
+	InsertSubscription string
+	// InsertGroupOffset creates a consumer group's offset for a stream partition, doing nothing if it already exists
+	InsertGroupOffset string
+	// UpsertSchedule creates or replaces a schedule, keeping its next run time unless its spec has changed
+	UpsertSchedule string
+	// UpsertDeadStreamMessage dead-letters a stream message for a consumer group, replacing the failure recorded if the group has dead-lettered it before
+	UpsertDeadStreamMessage string
+	// InsertUniqueLock acquires a uniqueness key with no message, or locks it if it is already held
+	InsertUniqueLock string
+	// InsertQueuePause pauses a queue, doing nothing if it is already paused
+	InsertQueuePause string
+	// InsertRateLimit creates a cluster-wide rate limit's token bucket, doing nothing if it already exists
+	InsertRateLimit string
+	// InsertConcurrencySlot creates a slot of a limit on messages in flight, doing nothing if it already exists
+	InsertConcurrencySlot string
+	// ReturningID is appended to an INSERT into the message table to return the new message's ID, or is empty if
+	// the driver reports it as the result's last insert ID
+	ReturningID string
+	// Tables are the table names the statements have been rendered with
+	Tables Tables
+}
+
+// GetDialect returns the dialect for the given driver, with its statements rendered for the given tables
+func GetDialect(driverName string, tables Tables) (*Dialect, error) {
+	var d Dialect
+	var migrations [][]string
+	var createSchema string
 	switch driverName {
 	case "mysql":
-		return mysql.Schema, nil
+		migrations = mysql.Migrations
+		createSchema = mysql.CreateSchema
+		d = Dialect{
+			VersionTable:            mysql.VersionTable,
+			AcquireLock:             mysql.AcquireLock,
+			ReleaseLock:             mysql.ReleaseLock,
+			InsertSubscription:      mysql.InsertSubscription,
+			InsertGroupOffset:       mysql.InsertGroupOffset,
+			UpsertSchedule:          mysql.UpsertSchedule,
+			UpsertDeadStreamMessage: mysql.UpsertDeadStreamMessage,
+			InsertUniqueLock:        mysql.InsertUniqueLock,
+			InsertQueuePause:        mysql.InsertQueuePause,
+			InsertRateLimit:         mysql.InsertRateLimit,
+			InsertConcurrencySlot:   mysql.InsertConcurrencySlot,
+			// the lock is named after the version table, so that instances with distinct tables don't contend
+			LockKey: tables.SchemaVersion,
+		}
 	case "pg":
 		fallthrough
 	case "pgx":
 		fallthrough
 	case "postgres":
-		return postgres.Schema, nil
+		migrations = postgres.Migrations
+		createSchema = postgres.CreateSchema
+		d = Dialect{
+			VersionTable:            postgres.VersionTable,
+			AcquireLock:             postgres.AcquireLock,
+			ReleaseLock:             postgres.ReleaseLock,
+			InsertSubscription:      postgres.InsertSubscription,
+			InsertGroupOffset:       postgres.InsertGroupOffset,
+			UpsertSchedule:          postgres.UpsertSchedule,
+			UpsertDeadStreamMessage: postgres.UpsertDeadStreamMessage,
+			InsertUniqueLock:        postgres.InsertUniqueLock,
+			InsertQueuePause:        postgres.InsertQueuePause,
+			InsertRateLimit:         postgres.InsertRateLimit,
+			InsertConcurrencySlot:   postgres.InsertConcurrencySlot,
+			ReturningID:             postgres.ReturningID,
+			LockKey:                 advisoryLockKey(tables.SchemaVersion),
+		}
 	default:
 		return nil, fmt.Errorf("driver '%s' not supported", driverName)
 	}
+	d.Tables = tables
+	d.VersionTable = tables.Render(d.VersionTable)[0]
+	d.InsertSubscription = tables.Render(d.InsertSubscription)[0]
+	d.InsertGroupOffset = tables.Render(d.InsertGroupOffset)[0]
+	d.UpsertSchedule = tables.Render(d.UpsertSchedule)[0]
+	d.UpsertDeadStreamMessage = tables.Render(d.UpsertDeadStreamMessage)[0]
+	d.InsertUniqueLock = tables.Render(d.InsertUniqueLock)[0]
+	d.InsertQueuePause = tables.Render(d.InsertQueuePause)[0]
+	d.InsertRateLimit = tables.Render(d.InsertRateLimit)[0]
+	d.InsertConcurrencySlot = tables.Render(d.InsertConcurrencySlot)[0]
+	if tables.Schema != "" {
+		d.CreateSchema = tables.Render(createSchema)[0]
+	}
+	d.Migrations = make([][]string, len(migrations))
+	for i, migration := range migrations {
+		d.Migrations[i] = tables.Render(migration...)
+	}
+	return &d, nil
+}
+
+// LatestVersion returns the schema version which the migrations bring the database to
+func (d *Dialect) LatestVersion() int {
+	return len(d.Migrations)
+}
+
+// MigrationSQL returns every statement required to bring an empty database up to the latest schema version,
+// including the bookkeeping of the version table, so that it can be applied out-of-band
+func (d *Dialect) MigrationSQL() []string {
+	stmts := []string{}
+	if d.CreateSchema != "" {
+		stmts = append(stmts, d.CreateSchema)
+	}
+	stmts = append(stmts, d.VersionTable)
+	for i, migration := range d.Migrations {
+		stmts = append(stmts, migration...)
+		stmts = append(stmts, fmt.Sprintf("INSERT INTO %s (version) VALUES (%d);", d.Tables.SchemaVersion, i+1))
+	}
+	return stmts
 }
 
-func CreateSchema(db *sqlx.DB) error {
-	log.Debug().Msg("creating schema")
-	tx, err := db.Begin()
+// advisoryLockKey maps a lock name onto the integer key space used by Postgres advisory locks
+func advisoryLockKey(name string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	return int64(h.Sum64())
+}
+
+// DebugLogger receives debug logs
+type DebugLogger interface {
+	Debug(msg string, keyvals ...interface{})
+}
+
+// Migrate applies any pending schema migrations. Concurrent calls, including from other processes, are serialized by a database lock
+func Migrate(ctx context.Context, db *sqlx.DB, tables Tables, log DebugLogger) error {
+	d, err := GetDialect(db.DriverName(), tables)
 	if err != nil {
-		return fmt.Errorf("failed to begin tx: %s", err)
+		return fmt.Errorf("error retrieving dialect: %s", err)
 	}
-	defer tx.Rollback()
-	schema, err := GetSchema(db.DriverName())
+	// session-level locks are bound to a connection, so every statement must run on the same one
+	conn, err := db.Connx(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to acquire connection: %s", err)
+	}
+	defer conn.Close()
+	var acquired int
+	if err := conn.QueryRowxContext(ctx, db.Rebind(d.AcquireLock), d.LockKey).Scan(&acquired); err != nil {
+		return fmt.Errorf("failed to acquire migration lock: %s", err)
+	}
+	if acquired != 1 {
+		return fmt.Errorf("timed out acquiring migration lock")
+	}
+	defer conn.ExecContext(context.Background(), db.Rebind(d.ReleaseLock), d.LockKey)
+	if d.CreateSchema != "" {
+		if _, err := conn.ExecContext(ctx, d.CreateSchema); err != nil {
+			return fmt.Errorf("failed to create schema: %s", err)
+		}
+	}
+	if _, err := conn.ExecContext(ctx, d.VersionTable); err != nil {
+		return fmt.Errorf("failed to create version table: %s", err)
+	}
+	current, err := schemaVersion(ctx, conn, tables)
+	if err != nil {
+		return err
+	}
+	for i := current; i < d.LatestVersion(); i++ {
+		log.Debug("applying migration", "version", i+1)
+		if err := applyMigration(ctx, conn, tables, d.Migrations[i], i+1); err != nil {
+			return fmt.Errorf("failed to apply migration %d: %s", i+1, err)
+		}
+	}
+	log.Debug("schema is up to date", "version", d.LatestVersion())
+	return nil
+}
+
+func applyMigration(ctx context.Context, conn *sqlx.Conn, tables Tables, migration []string, version int) error {
+	tx, err := conn.BeginTxx(ctx, nil)
 	if err != nil {
-		return fmt.Errorf("error retrieving schema: %s", err)
+		return fmt.Errorf("failed to begin tx: %s", err)
 	}
-	for _, stmt := range schema {
-		_, err := tx.Exec(stmt)
-		if err != nil {
+	defer tx.Rollback()
+	for _, stmt := range migration {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
 			return fmt.Errorf("failed to exec stmt %s: %s", strings.Split(stmt, "(")[0], err)
 		}
 	}
+	if _, err := tx.ExecContext(ctx, tx.Rebind(fmt.Sprintf("INSERT INTO %s (version) VALUES (?)", tables.SchemaVersion)), version); err != nil {
+		return fmt.Errorf("failed to record version: %s", err)
+	}
 	if err := tx.Commit(); err != nil {
 		return fmt.Errorf("failed to commit tx: %s", err)
 	}
-	log.Debug().Msg("schema created")
+	return nil
+}
+
+type queryerContext interface {
+	QueryRowxContext(ctx context.Context, query string, args ...interface{}) *sqlx.Row
+}
+
+func schemaVersion(ctx context.Context, q queryerContext, tables Tables) (int, error) {
+	var version sql.NullInt64
+	if err := q.QueryRowxContext(ctx, fmt.Sprintf("SELECT MAX(version) FROM %s", tables.SchemaVersion)).Scan(&version); err != nil {
+		return 0, fmt.Errorf("failed to read schema version: %s", err)
+	}
+	return int(version.Int64), nil
+}
+
+// CheckSchemaVersion returns an error if the database schema has not been migrated to the latest version
+func CheckSchemaVersion(ctx context.Context, db *sqlx.DB, tables Tables) error {
+	d, err := GetDialect(db.DriverName(), tables)
+	if err != nil {
+		return fmt.Errorf("error retrieving dialect: %s", err)
+	}
+	version, err := schemaVersion(ctx, db, tables)
+	if err != nil {
+		return err
+	}
+	if version < d.LatestVersion() {
+		return fmt.Errorf("schema is at version %d, but version %d is required", version, d.LatestVersion())
+	}
 	return nil
 }
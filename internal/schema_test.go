@@ -1,6 +1,7 @@
 package internal
 
 import (
+	"context"
 	"fmt"
 	"testing"
 
@@ -10,17 +11,95 @@ import (
 	"github.com/stretchr/testify/require"
 )
 
-func TestCreateSchema(t *testing.T) {
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, ...interface{}) {}
+
+func expectedMigrations(t *testing.T, driverName string, tables Tables, applied int) test.Migrations {
+	d, err := GetDialect(driverName, tables)
+	require.NoError(t, err, "failed to get dialect")
+	return test.Migrations{
+		AcquireLock:      d.AcquireLock,
+		ReleaseLock:      d.ReleaseLock,
+		CreateSchema:     d.CreateSchema,
+		VersionTable:     d.VersionTable,
+		VersionTableName: tables.SchemaVersion,
+		Statements:       d.Migrations,
+		Applied:          applied,
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	for _, d := range SupportedDrivers {
+		t.Run(fmt.Sprintf("driver=%s", d), func(t *testing.T) {
+			t.Run("empty database should apply every migration", func(t *testing.T) {
+				db, mock, err := sqlmock.New()
+				require.NoError(t, err, "failed to create mock")
+				test.ExpectMigrations(t, mock, expectedMigrations(t, d, DefaultTables, 0))
+
+				err = Migrate(context.Background(), sqlx.NewDb(db, d), DefaultTables, nopLogger{})
+				require.NoError(t, err)
+				require.NoError(t, mock.ExpectationsWereMet())
+			})
+			t.Run("migrated database should apply nothing", func(t *testing.T) {
+				db, mock, err := sqlmock.New()
+				require.NoError(t, err, "failed to create mock")
+				dialect, err := GetDialect(d, DefaultTables)
+				require.NoError(t, err)
+				test.ExpectMigrations(t, mock, expectedMigrations(t, d, DefaultTables, dialect.LatestVersion()))
+
+				err = Migrate(context.Background(), sqlx.NewDb(db, d), DefaultTables, nopLogger{})
+				require.NoError(t, err)
+				require.NoError(t, mock.ExpectationsWereMet())
+			})
+			t.Run("lock timeout should fail", func(t *testing.T) {
+				db, mock, err := sqlmock.New()
+				require.NoError(t, err, "failed to create mock")
+				dialect, err := GetDialect(d, DefaultTables)
+				require.NoError(t, err)
+				mock.ExpectQuery(test.Query(dialect.AcquireLock)).WillReturnRows(sqlmock.NewRows([]string{"acquired"}).AddRow(0))
+
+				err = Migrate(context.Background(), sqlx.NewDb(db, d), DefaultTables, nopLogger{})
+				require.Error(t, err)
+				require.NoError(t, mock.ExpectationsWereMet())
+			})
+			t.Run("qualified tables should create schema", func(t *testing.T) {
+				tables, err := NewTables("gq", "gq_")
+				require.NoError(t, err)
+				db, mock, err := sqlmock.New()
+				require.NoError(t, err, "failed to create mock")
+				m := expectedMigrations(t, d, tables, 0)
+				require.Equal(t, "CREATE SCHEMA IF NOT EXISTS gq;", m.CreateSchema)
+				for _, migration := range m.Statements {
+					for _, stmt := range migration {
+						require.NotContains(t, stmt, " message ")
+					}
+				}
+				test.ExpectMigrations(t, mock, m)
+
+				err = Migrate(context.Background(), sqlx.NewDb(db, d), tables, nopLogger{})
+				require.NoError(t, err)
+				require.NoError(t, mock.ExpectationsWereMet())
+			})
+		})
+	}
+}
+
+func TestCheckSchemaVersion(t *testing.T) {
 	for _, d := range SupportedDrivers {
 		t.Run(fmt.Sprintf("driver=%s", d), func(t *testing.T) {
+			dialect, err := GetDialect(d, DefaultTables)
+			require.NoError(t, err)
+
 			db, mock, err := sqlmock.New()
 			require.NoError(t, err, "failed to create mock")
-			schema, err := GetSchema(d)
-			require.NoError(t, err, "failed to get schema")
-			test.ExpectSchema(t, mock, schema)
+			mock.ExpectQuery(test.Query("SELECT MAX(version) FROM gq_schema_version")).
+				WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow(dialect.LatestVersion() - 1))
+			require.Error(t, CheckSchemaVersion(context.Background(), sqlx.NewDb(db, d), DefaultTables))
 
-			err = CreateSchema(sqlx.NewDb(db, d))
-			require.NoError(t, err)
+			mock.ExpectQuery(test.Query("SELECT MAX(version) FROM gq_schema_version")).
+				WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow(dialect.LatestVersion()))
+			require.NoError(t, CheckSchemaVersion(context.Background(), sqlx.NewDb(db, d), DefaultTables))
 		})
 	}
 }
@@ -0,0 +1,94 @@
+package internal
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+var identifierPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Tables holds the names of gq's tables, qualified with the configured schema
+type Tables struct {
+	// Schema is the schema (or MySQL database) which the tables belong to, or empty for the connection's default
+	Schema string
+	// Prefix is prepended to the name of each table and index
+	Prefix string
+	// Message is the name of the message table
+	Message string
+	// DeadMessage is the name of the table which messages are moved to once they have exhausted their processing retries
+	DeadMessage string
+	// DeadStreamMessage is the name of the table which holds the stream messages each consumer group has dead-lettered
+	DeadStreamMessage string
+	// SchemaVersion is the name of the table which records applied migrations
+	SchemaVersion string
+	// Subscription is the name of the table which routes the messages published to each topic to the subscribed queues
+	Subscription string
+	// ConsumerGroupOffset is the name of the table which records the offset each consumer group has committed in each stream partition
+	ConsumerGroupOffset string
+	// Schedule is the name of the table which holds the schedules of recurring messages
+	Schedule string
+	// UniqueLock is the name of the table which holds the uniqueness keys of unique messages
+	UniqueLock string
+	// JobStatus is the name of the table which records the status of tracked messages, and their results
+	JobStatus string
+	// Workflow is the name of the table which records the progress of workflows
+	Workflow string
+	// WorkflowTask is the name of the table which holds the tasks of workflows' later steps, until they are pushed
+	WorkflowTask string
+	// QueuePause is the name of the table which lists the paused queues
+	QueuePause string
+	// RateLimit is the name of the table which holds the token buckets of cluster-wide consumer rate limits
+	RateLimit string
+	// ConcurrencySlot is the name of the table which holds the slots of cluster-wide limits on messages in flight
+	ConcurrencySlot string
+}
+
+// DefaultTables are the table names used when no schema or prefix is configured
+var DefaultTables = Tables{Message: "message", DeadMessage: "dead_message", DeadStreamMessage: "dead_stream_message", SchemaVersion: "gq_schema_version", Subscription: "subscription", ConsumerGroupOffset: "consumer_group_offset", Schedule: "schedule", UniqueLock: "unique_lock", JobStatus: "job_status", Workflow: "workflow", WorkflowTask: "workflow_task", QueuePause: "queue_pause", RateLimit: "rate_limit", ConcurrencySlot: "concurrency_slot"}
+
+// NewTables returns the table names for the given schema and table prefix, either of which may be empty
+func NewTables(schema string, prefix string) (Tables, error) {
+	if schema != "" && !identifierPattern.MatchString(schema) {
+		return Tables{}, fmt.Errorf("invalid schema name '%s'", schema)
+	}
+	if prefix != "" && !identifierPattern.MatchString(prefix) {
+		return Tables{}, fmt.Errorf("invalid table prefix '%s'", prefix)
+	}
+	qualify := func(name string) string {
+		if schema == "" {
+			return prefix + name
+		}
+		return schema + "." + prefix + name
+	}
+	return Tables{
+		Schema:              schema,
+		Prefix:              prefix,
+		Message:             qualify(DefaultTables.Message),
+		DeadMessage:         qualify(DefaultTables.DeadMessage),
+		DeadStreamMessage:   qualify(DefaultTables.DeadStreamMessage),
+		SchemaVersion:       qualify(DefaultTables.SchemaVersion),
+		Subscription:        qualify(DefaultTables.Subscription),
+		ConsumerGroupOffset: qualify(DefaultTables.ConsumerGroupOffset),
+		Schedule:            qualify(DefaultTables.Schedule),
+		UniqueLock:          qualify(DefaultTables.UniqueLock),
+		JobStatus:           qualify(DefaultTables.JobStatus),
+		Workflow:            qualify(DefaultTables.Workflow),
+		WorkflowTask:        qualify(DefaultTables.WorkflowTask),
+		QueuePause:          qualify(DefaultTables.QueuePause),
+		RateLimit:           qualify(DefaultTables.RateLimit),
+		ConcurrencySlot:     qualify(DefaultTables.ConcurrencySlot),
+	}, nil
+}
+
+// Render executes each statement template with the table names
+func (t Tables) Render(stmts ...string) []string {
+	rendered := make([]string, len(stmts))
+	for i, stmt := range stmts {
+		b := strings.Builder{}
+		template.Must(template.New("").Parse(stmt)).Execute(&b, t)
+		rendered[i] = b.String()
+	}
+	return rendered
+}
@@ -0,0 +1,36 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewTables(t *testing.T) {
+	tables, err := NewTables("", "")
+	require.NoError(t, err)
+	require.Equal(t, DefaultTables, tables)
+
+	tables, err = NewTables("gq", "app_")
+	require.NoError(t, err)
+	require.Equal(t, "gq.app_message", tables.Message)
+	require.Equal(t, "gq.app_dead_message", tables.DeadMessage)
+	require.Equal(t, "gq.app_gq_schema_version", tables.SchemaVersion)
+	require.Equal(t, "gq.app_subscription", tables.Subscription)
+	require.Equal(t, "gq.app_consumer_group_offset", tables.ConsumerGroupOffset)
+	require.Equal(t, "gq.app_schedule", tables.Schedule)
+	require.Equal(t, "gq.app_unique_lock", tables.UniqueLock)
+	require.Equal(t, "gq.app_job_status", tables.JobStatus)
+	require.Equal(t, "gq.app_workflow", tables.Workflow)
+	require.Equal(t, "gq.app_workflow_task", tables.WorkflowTask)
+	require.Equal(t, "gq.app_queue_pause", tables.QueuePause)
+	require.Equal(t, "gq.app_rate_limit", tables.RateLimit)
+	require.Equal(t, "gq.app_concurrency_slot", tables.ConcurrencySlot)
+	require.Equal(t, "gq.app_dead_stream_message", tables.DeadStreamMessage)
+	require.Equal(t, []string{"CREATE INDEX app_message_idx ON gq.app_message"}, tables.Render("CREATE INDEX {{.Prefix}}message_idx ON {{.Message}}"))
+
+	_, err = NewTables("gq; DROP TABLE message", "")
+	require.Error(t, err)
+	_, err = NewTables("", "1prefix")
+	require.Error(t, err)
+}
@@ -0,0 +1,391 @@
+package gq
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/mattbonnell/gq/internal"
+)
+
+// Delivery is a message leased to the caller of Consumer.Receive
+type Delivery struct {
+	Message
+	// LeaseToken identifies the lease, and must be passed to Ack, Nack and Extend
+	LeaseToken string
+	// LeaseExpiresAt is the time after which the message is delivered again, unless it has been acked, nacked or its lease extended
+	LeaseExpiresAt time.Time
+}
+
+// errLeaseExpired is the error recorded for a leased message which is dead-lettered because its last lease expired
+var errLeaseExpired = errors.New("lease expired")
+
+// newToken returns a random 128-bit token, hex-encoded
+func newToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Receive claims up to n messages which are ready on the consumer's queue, leasing them to the caller for the lease duration,
+// which must be positive. It returns immediately, with no deliveries if none are ready. A message whose lease expires before
+// it is acked or nacked counts as a failed attempt: it is delivered again, or dead-lettered if it has exhausted its retries.
+// It returns no deliveries while the queue is paused, and no more than the consumer's rate limit allows
+func (c *Consumer) Receive(ctx context.Context, n int, lease time.Duration) ([]*Delivery, error) {
+	if lease <= 0 {
+		return nil, errors.New("the lease must be positive")
+	}
+	paused, err := c.paused(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if paused {
+		return nil, nil
+	}
+	token, err := newToken()
+	if err != nil {
+		return nil, fmt.Errorf("error generating lease token: %s", err)
+	}
+	now := c.now()
+	if c.limiter != nil {
+		if n, err = c.limiter.take(ctx, n, now); err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			return nil, nil
+		}
+	}
+	taken, claimed := n, 0
+	defer func() { c.refundTokens(ctx, taken-claimed) }()
+	expiresAt := now.Add(lease)
+	tx, err := c.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error beginning receive transaction: %s", err)
+	}
+	defer tx.Rollback()
+	var slots []int
+	if c.slots != nil {
+		if slots, err = c.slots.lock(ctx, tx, n, now); err != nil {
+			return nil, err
+		}
+		if len(slots) == 0 {
+			return nil, nil
+		}
+		n = len(slots)
+	}
+	query := tx.Rebind(fmt.Sprintf("SELECT id, payload, headers, retries, created_at, unique_key, tracked, lease_token FROM %s WHERE queue = ? AND ready_at <= ? ORDER BY priority DESC, ready_at ASC LIMIT ? FOR UPDATE SKIP LOCKED", c.tables.Message))
+	rows, err := tx.QueryxContext(ctx, query, c.opts.Queue, now, n)
+	if err != nil {
+		return nil, fmt.Errorf("error selecting messages: %s", err)
+	}
+	defer rows.Close()
+	deliveries := make([]*Delivery, 0, n)
+	ids := make([]int64, 0, n)
+	var tracked []int64
+	// exhausted are the messages whose expired lease was their last attempt, which are dead-lettered rather than delivered
+	var exhausted []internal.Message
+	for rows.Next() {
+		var m internal.Message
+		var payload []byte
+		var leaseToken sql.NullString
+		if err := rows.Scan(&m.ID, &payload, &m.Headers, &m.Retries, &m.CreatedAt, &m.UniqueKey, &m.Tracked, &leaseToken); err != nil {
+			return nil, fmt.Errorf("error scanning messages: %s", err)
+		}
+		if leaseToken.Valid {
+			// the message's lease expired before it was acked or nacked
+			if int(m.Retries) >= c.opts.MaxProcessingRetries {
+				m.Payload = payload
+				exhausted = append(exhausted, m)
+				continue
+			}
+			m.Retries++
+		}
+		deliveries = append(deliveries, &Delivery{
+			Message: Message{
+				ID:        m.ID,
+				Queue:     c.opts.Queue,
+				Payload:   payload,
+				Headers:   m.Headers,
+				Attempt:   int(m.Retries) + 1,
+				CreatedAt: m.CreatedAt.Time,
+			},
+			LeaseToken:     token,
+			LeaseExpiresAt: expiresAt,
+		})
+		ids = append(ids, m.ID)
+		if m.Tracked {
+			tracked = append(tracked, m.ID)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error selecting messages: %s", err)
+	}
+	rows.Close()
+	if len(ids) == 0 && len(exhausted) == 0 {
+		return nil, nil
+	}
+	if len(ids) > 0 {
+		// retries is set first, since MySQL assigns the columns in order, and a message which was leased before has failed an attempt
+		query, args, err := sqlx.In(fmt.Sprintf("UPDATE %s SET retries = CASE WHEN lease_token IS NULL THEN retries ELSE retries + 1 END, ready_at = ?, lease_token = ? WHERE id IN (?)", c.tables.Message), expiresAt, token, ids)
+		if err != nil {
+			return nil, fmt.Errorf("error formulating lease query: %s", err)
+		}
+		if _, err := tx.ExecContext(ctx, tx.Rebind(query), args...); err != nil {
+			return nil, fmt.Errorf("error leasing messages: %s", err)
+		}
+	}
+	if len(tracked) > 0 {
+		if err := startJob(ctx, tx, c.tables, tracked, now); err != nil {
+			return nil, err
+		}
+	}
+	if c.slots != nil {
+		if err := c.slots.assign(ctx, tx, slots, ids, expiresAt); err != nil {
+			return nil, err
+		}
+	}
+	workflows := newWorkflowUpdates(ctx, c.tracer)
+	if err := c.deadLetterExpired(ctx, tx, exhausted, workflows, now); err != nil {
+		workflows.report(c.metrics, err)
+		return nil, err
+	}
+	err = tx.Commit()
+	workflows.report(c.metrics, err)
+	if err != nil {
+		return nil, fmt.Errorf("error committing receive transaction: %s", err)
+	}
+	claimed = len(deliveries)
+	c.metrics.MessagesPulled(c.opts.Queue, len(deliveries))
+	for _, m := range exhausted {
+		c.metrics.MessageProcessed(c.opts.Queue, OutcomeDeadLettered, unknownDuration, now.Sub(m.CreatedAt.Time))
+	}
+	return deliveries, nil
+}
+
+// deadLetterExpired moves the messages whose expired lease was their last attempt to the dead-letter table, as Nack would have
+func (c *Consumer) deadLetterExpired(ctx context.Context, tx *sqlx.Tx, messages []internal.Message, workflows *workflowUpdates, now time.Time) error {
+	if len(messages) == 0 {
+		return nil
+	}
+	ids := make([]int64, len(messages))
+	var unique []int64
+	for i, m := range messages {
+		c.log.Error("lease expired on message's last attempt, dead-lettering", "queue", c.opts.Queue, "id", m.ID)
+		if err := c.deadLetter(tx, m, errLeaseExpired); err != nil {
+			return err
+		}
+		ids[i] = m.ID
+		if m.UniqueKey.Valid {
+			unique = append(unique, m.ID)
+		}
+	}
+	query, args, err := sqlx.In(fmt.Sprintf("DELETE FROM %s WHERE id IN (?)", c.tables.Message), ids)
+	if err != nil {
+		return fmt.Errorf("error formulating delete query: %s", err)
+	}
+	if _, err := tx.ExecContext(ctx, tx.Rebind(query), args...); err != nil {
+		return fmt.Errorf("error deleting messages: %s", err)
+	}
+	if len(unique) > 0 {
+		if err := releaseUnique(ctx, tx, c.dialect, c.tables, unique, now); err != nil {
+			return err
+		}
+	}
+	for _, m := range messages {
+		if m.Tracked {
+			if err := finishJob(ctx, tx, c.tables, workflows, m.ID, OutcomeDeadLettered, errLeaseExpired, nil, now); err != nil {
+				return err
+			}
+		}
+	}
+	return workflows.advance(ctx, tx, c.dialect, c.tables, now)
+}
+
+// Ack removes a leased message from the queue once it has been processed successfully.
+// It returns ErrLeaseLost if the lease has expired and the message has since been delivered again, or removed
+func (c *Consumer) Ack(ctx context.Context, id int64, leaseToken string) error {
+	return c.AckWithResult(ctx, id, leaseToken, nil)
+}
+
+// AckWithResult acks a leased message like Ack, recording result in its status if it was pushed with Producer.PushTracked
+func (c *Consumer) AckWithResult(ctx context.Context, id int64, leaseToken string, result []byte) error {
+	m, err := c.leased(ctx, c.db, id, leaseToken)
+	if err != nil {
+		return err
+	}
+	if m.UniqueKey.Valid || m.Tracked {
+		err = c.ackInTx(ctx, m, leaseToken, result)
+	} else {
+		err = c.deleteLeased(ctx, c.db, id, leaseToken)
+	}
+	if err != nil {
+		return err
+	}
+	c.releaseSlot(ctx, id)
+	c.metrics.MessageProcessed(c.opts.Queue, OutcomeAcked, unknownDuration, c.now().Sub(m.CreatedAt.Time))
+	return nil
+}
+
+// ackInTx deletes a leased message in a transaction which pushes any rerun of a unique message requested while it was
+// processing, and records the outcome of a tracked one
+func (c *Consumer) ackInTx(ctx context.Context, m *internal.Message, leaseToken string, result []byte) error {
+	tx, err := c.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error beginning ack transaction: %s", err)
+	}
+	defer tx.Rollback()
+	if err := c.deleteLeased(ctx, tx, m.ID, leaseToken); err != nil {
+		return err
+	}
+	if m.UniqueKey.Valid {
+		if err := releaseUnique(ctx, tx, c.dialect, c.tables, []int64{m.ID}, c.now()); err != nil {
+			return err
+		}
+	}
+	workflows := newWorkflowUpdates(ctx, c.tracer)
+	if m.Tracked {
+		if err := finishJob(ctx, tx, c.tables, workflows, m.ID, OutcomeAcked, nil, result, c.now()); err != nil {
+			return err
+		}
+	}
+	if err := workflows.advance(ctx, tx, c.dialect, c.tables, c.now()); err != nil {
+		workflows.report(c.metrics, err)
+		return err
+	}
+	err = tx.Commit()
+	workflows.report(c.metrics, err)
+	if err != nil {
+		return fmt.Errorf("error committing ack transaction: %s", err)
+	}
+	return nil
+}
+
+func (c *Consumer) deleteLeased(ctx context.Context, ex sqlx.ExecerContext, id int64, leaseToken string) error {
+	query := c.db.Rebind(fmt.Sprintf("DELETE FROM %s WHERE id = ? AND lease_token = ?", c.tables.Message))
+	res, err := ex.ExecContext(ctx, query, id, leaseToken)
+	if err != nil {
+		return fmt.Errorf("error deleting message: %s", err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("error deleting message: %s", err)
+	} else if n == 0 {
+		return ErrLeaseLost
+	}
+	return nil
+}
+
+// Nack rejects a leased message which failed processing with reason. Like a message whose handler returns an error,
+// it is retried after a backoff, or moved to the dead-letter table once it has exhausted its retries.
+// It returns ErrLeaseLost if the lease has expired and the message has since been delivered again, or removed
+func (c *Consumer) Nack(ctx context.Context, id int64, leaseToken string, reason error) error {
+	if reason == nil {
+		reason = errors.New("nacked")
+	}
+	tx, err := c.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error beginning nack transaction: %s", err)
+	}
+	defer tx.Rollback()
+	m, err := c.leased(ctx, tx, id, leaseToken)
+	if err != nil {
+		return err
+	}
+	outcome := OutcomeRetried
+	if int(m.Retries) >= c.opts.MaxProcessingRetries {
+		outcome = OutcomeDeadLettered
+		if err := c.deadLetter(tx, *m, reason); err != nil {
+			return err
+		}
+		query := tx.Rebind(fmt.Sprintf("DELETE FROM %s WHERE id = ?", c.tables.Message))
+		if _, err := tx.ExecContext(ctx, query, id); err != nil {
+			return fmt.Errorf("error deleting message: %s", err)
+		}
+		if m.UniqueKey.Valid {
+			if err := releaseUnique(ctx, tx, c.dialect, c.tables, []int64{id}, c.now()); err != nil {
+				return err
+			}
+		}
+	} else if err := c.retry(tx, *m); err != nil {
+		return err
+	}
+	workflows := newWorkflowUpdates(ctx, c.tracer)
+	if m.Tracked {
+		if err := finishJob(ctx, tx, c.tables, workflows, id, outcome, reason, nil, c.now()); err != nil {
+			return err
+		}
+	}
+	if err := workflows.advance(ctx, tx, c.dialect, c.tables, c.now()); err != nil {
+		workflows.report(c.metrics, err)
+		return err
+	}
+	err = tx.Commit()
+	workflows.report(c.metrics, err)
+	if err != nil {
+		return fmt.Errorf("error committing nack transaction: %s", err)
+	}
+	c.releaseSlot(ctx, id)
+	c.metrics.MessageProcessed(c.opts.Queue, outcome, unknownDuration, c.now().Sub(m.CreatedAt.Time))
+	return nil
+}
+
+// Extend extends the lease on a message, so that it expires after lease from now.
+// It returns ErrLeaseLost if the lease has expired and the message has since been delivered again, or removed
+func (c *Consumer) Extend(ctx context.Context, id int64, leaseToken string, lease time.Duration) (time.Time, error) {
+	if lease <= 0 {
+		return time.Time{}, errors.New("the lease must be positive")
+	}
+	expiresAt := c.now().Add(lease)
+	query := c.db.Rebind(fmt.Sprintf("UPDATE %s SET ready_at = ? WHERE id = ? AND lease_token = ?", c.tables.Message))
+	res, err := c.db.ExecContext(ctx, query, expiresAt, id, leaseToken)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("error extending lease: %s", err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return time.Time{}, fmt.Errorf("error extending lease: %s", err)
+	} else if n == 0 {
+		return time.Time{}, ErrLeaseLost
+	}
+	if c.slots != nil {
+		if err := c.slots.extend(ctx, id, expiresAt); err != nil {
+			c.log.Error("error extending concurrency slot", "id", id, "error", err)
+		}
+	}
+	return expiresAt, nil
+}
+
+// releaseSlot frees the concurrency slot assigned to a settled message. A slot which can't be released is freed once the
+// message's lease expires
+func (c *Consumer) releaseSlot(ctx context.Context, id int64) {
+	if c.slots == nil {
+		return
+	}
+	if err := c.slots.release(ctx, id); err != nil {
+		c.log.Error("error releasing concurrency slot", "id", id, "error", err)
+	}
+}
+
+// leased reads a message which is leased with leaseToken, locking it if q is a transaction
+func (c *Consumer) leased(ctx context.Context, q sqlx.QueryerContext, id int64, leaseToken string) (*internal.Message, error) {
+	query := fmt.Sprintf("SELECT id, payload, headers, retries, created_at, unique_key, tracked FROM %s WHERE id = ? AND lease_token = ?", c.tables.Message)
+	if _, ok := q.(*sqlx.Tx); ok {
+		query += " FOR UPDATE"
+	}
+	m := internal.Message{}
+	var payload []byte
+	err := q.QueryRowxContext(ctx, c.db.Rebind(query), id, leaseToken).Scan(&m.ID, &payload, &m.Headers, &m.Retries, &m.CreatedAt, &m.UniqueKey, &m.Tracked)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrLeaseLost
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading leased message: %s", err)
+	}
+	m.Payload = payload
+	return &m, nil
+}
@@ -0,0 +1,151 @@
+package gq
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/require"
+)
+
+func newLeaseTestConsumer(t *testing.T) (*Consumer, sqlmock.Sqlmock, time.Time) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err, "failed to open stub database connection")
+	t.Cleanup(func() { db.Close() })
+	now := time.Now().UTC()
+	cl := newTestClient(db)
+	cl.opts.Clock = func() time.Time { return now }
+	c, err := cl.NewLeaseConsumer(context.Background(), ConsumerOptions{Queue: "emails", MaxProcessingRetries: 1})
+	require.NoError(t, err)
+	return c, mock, now
+}
+
+func TestReceive(t *testing.T) {
+	c, mock, now := newLeaseTestConsumer(t)
+	lease := 30 * time.Second
+
+	expectPauseCheck(mock, "emails", false)
+	mock.ExpectBegin()
+	// message 2's lease expired, which counts as a failed attempt, and message 3's expired on its last attempt
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT id, payload, headers, retries, created_at, unique_key, tracked, lease_token FROM message WHERE queue = ? AND ready_at <= ? ORDER BY priority DESC, ready_at ASC LIMIT ? FOR UPDATE SKIP LOCKED")).
+		WithArgs("emails", now, 10).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "payload", "headers", "retries", "created_at", "unique_key", "tracked", "lease_token"}).
+			AddRow(1, []byte("a"), nil, 0, now, nil, false, nil).
+			AddRow(2, []byte("b"), `{"k":"v"}`, 0, now, nil, false, "expired").
+			AddRow(3, []byte("c"), nil, 1, now, nil, false, "expired"))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE message SET retries = CASE WHEN lease_token IS NULL THEN retries ELSE retries + 1 END, ready_at = ?, lease_token = ? WHERE id IN (?, ?)")).
+		WithArgs(now.Add(lease), sqlmock.AnyArg(), 1, 2).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO dead_message")).
+		WithArgs(3, "emails", []byte("c"), nil, now, now, 1, errLeaseExpired.Error()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM message WHERE id IN (?)")).
+		WithArgs(3).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	deliveries, err := c.Receive(context.Background(), 10, lease)
+	require.NoError(t, err)
+	require.Len(t, deliveries, 2)
+	require.Equal(t, Message{ID: 2, Queue: "emails", Payload: []byte("b"), Headers: map[string]string{"k": "v"}, Attempt: 2, CreatedAt: now}, deliveries[1].Message)
+	require.Len(t, deliveries[0].LeaseToken, 32)
+	require.Equal(t, now.Add(lease), deliveries[0].LeaseExpiresAt)
+	require.NoError(t, mock.ExpectationsWereMet())
+
+	_, err = c.Receive(context.Background(), 10, 0)
+	require.Error(t, err)
+}
+
+func TestReceive_NoneReady(t *testing.T) {
+	c, mock, now := newLeaseTestConsumer(t)
+
+	expectPauseCheck(mock, "emails", false)
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT id, payload").
+		WithArgs("emails", now, 10).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "payload", "headers", "retries", "created_at", "unique_key", "tracked", "lease_token"}))
+	mock.ExpectRollback()
+
+	deliveries, err := c.Receive(context.Background(), 10, time.Second)
+	require.NoError(t, err)
+	require.Empty(t, deliveries)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func leasedRows(retries int, createdAt time.Time) *sqlmock.Rows {
+	return sqlmock.NewRows([]string{"id", "payload", "headers", "retries", "created_at", "unique_key", "tracked"}).AddRow(7, []byte("a"), nil, retries, createdAt, nil, false)
+}
+
+func TestAck(t *testing.T) {
+	c, mock, now := newLeaseTestConsumer(t)
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT id, payload, headers, retries, created_at, unique_key, tracked FROM message WHERE id = ? AND lease_token = ?")).
+		WithArgs(7, "token").
+		WillReturnRows(leasedRows(0, now))
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM message WHERE id = ? AND lease_token = ?")).
+		WithArgs(7, "token").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	require.NoError(t, c.Ack(context.Background(), 7, "token"))
+
+	mock.ExpectQuery(regexp.QuoteMeta("FROM message WHERE id = ? AND lease_token = ?")).
+		WithArgs(7, "stale").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "payload", "headers", "retries", "created_at", "unique_key", "tracked"}))
+	require.ErrorIs(t, c.Ack(context.Background(), 7, "stale"), ErrLeaseLost)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestNack(t *testing.T) {
+	t.Run("retried", func(t *testing.T) {
+		c, mock, now := newLeaseTestConsumer(t)
+		mock.ExpectBegin()
+		mock.ExpectQuery(regexp.QuoteMeta("FROM message WHERE id = ? AND lease_token = ? FOR UPDATE")).
+			WithArgs(7, "token").
+			WillReturnRows(leasedRows(0, now))
+		mock.ExpectExec(regexp.QuoteMeta("UPDATE message SET retries = ?, ready_at = ?, lease_token = NULL WHERE id = ?")).
+			WithArgs(1, now.Add(retryInitialBackoffPeriodSeconds*time.Second), 7).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		require.NoError(t, c.Nack(context.Background(), 7, "token", errors.New("boom")))
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+	t.Run("dead-lettered", func(t *testing.T) {
+		c, mock, now := newLeaseTestConsumer(t)
+		mock.ExpectBegin()
+		mock.ExpectQuery(regexp.QuoteMeta("FROM message WHERE id = ? AND lease_token = ? FOR UPDATE")).
+			WithArgs(7, "token").
+			WillReturnRows(leasedRows(1, now))
+		mock.ExpectExec(regexp.QuoteMeta("INSERT INTO dead_message")).
+			WithArgs(7, "emails", []byte("a"), nil, now, now, 1, "boom").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(regexp.QuoteMeta("DELETE FROM message WHERE id = ?")).
+			WithArgs(7).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		require.NoError(t, c.Nack(context.Background(), 7, "token", errors.New("boom")))
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func TestExtend(t *testing.T) {
+	c, mock, now := newLeaseTestConsumer(t)
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE message SET ready_at = ? WHERE id = ? AND lease_token = ?")).
+		WithArgs(now.Add(time.Minute), 7, "token").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE message SET ready_at = ? WHERE id = ? AND lease_token = ?")).
+		WithArgs(now.Add(time.Minute), 7, "stale").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	expiresAt, err := c.Extend(context.Background(), 7, "token", time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, now.Add(time.Minute), expiresAt)
+	_, err = c.Extend(context.Background(), 7, "stale", time.Minute)
+	require.ErrorIs(t, err, ErrLeaseLost)
+	_, err = c.Extend(context.Background(), 7, "token", 0)
+	require.Error(t, err)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,82 @@
+package gq
+
+import (
+	"fmt"
+	"log/slog"
+
+	"github.com/rs/zerolog"
+)
+
+// Logger is the interface through which gq reports what it is doing. Each method takes a message followed by alternating
+// keys and values, in the style of log/slog; a *slog.Logger satisfies it directly.
+// gq logs per-message activity at debug level, and failures such as a discarded push batch at error level
+type Logger interface {
+	Debug(msg string, keyvals ...interface{})
+	Info(msg string, keyvals ...interface{})
+	Warn(msg string, keyvals ...interface{})
+	Error(msg string, keyvals ...interface{})
+}
+
+// NewSlogLogger returns a Logger which writes to l, or to slog.Default() if l is nil
+func NewSlogLogger(l *slog.Logger) Logger {
+	if l == nil {
+		return slog.Default()
+	}
+	return l
+}
+
+type zerologLogger struct {
+	l zerolog.Logger
+}
+
+// NewZerologLogger returns a Logger which writes to l
+func NewZerologLogger(l zerolog.Logger) Logger {
+	return zerologLogger{l: l}
+}
+
+func (z zerologLogger) Debug(msg string, keyvals ...interface{}) {
+	z.log(z.l.Debug(), msg, keyvals)
+}
+
+func (z zerologLogger) Info(msg string, keyvals ...interface{}) {
+	z.log(z.l.Info(), msg, keyvals)
+}
+
+func (z zerologLogger) Warn(msg string, keyvals ...interface{}) {
+	z.log(z.l.Warn(), msg, keyvals)
+}
+
+func (z zerologLogger) Error(msg string, keyvals ...interface{}) {
+	z.log(z.l.Error(), msg, keyvals)
+}
+
+func (z zerologLogger) log(e *zerolog.Event, msg string, keyvals []interface{}) {
+	if e == nil {
+		return // level disabled
+	}
+	for i := 0; i < len(keyvals); i += 2 {
+		key := fmt.Sprint(keyvals[i])
+		if i+1 == len(keyvals) {
+			e = e.Interface("!BADKEY", keyvals[i])
+			break
+		}
+		if err, ok := keyvals[i+1].(error); ok {
+			e = e.AnErr(key, err)
+		} else {
+			e = e.Interface(key, keyvals[i+1])
+		}
+	}
+	e.Msg(msg)
+}
+
+type nopLogger struct{}
+
+// NewNopLogger returns a Logger which discards everything
+func NewNopLogger() Logger {
+	return nopLogger{}
+}
+
+func (nopLogger) Debug(string, ...interface{}) {}
+func (nopLogger) Info(string, ...interface{})  {}
+func (nopLogger) Warn(string, ...interface{})  {}
+func (nopLogger) Error(string, ...interface{}) {}
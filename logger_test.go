@@ -0,0 +1,35 @@
+package gq
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestZerologLogger(t *testing.T) {
+	buf := bytes.Buffer{}
+	l := NewZerologLogger(zerolog.New(&buf).Level(zerolog.InfoLevel))
+
+	l.Debug("filtered", "id", 1)
+	require.Empty(t, buf.String())
+
+	l.Error("error pushing messages", "count", 3, "error", errors.New("boom"))
+	require.JSONEq(t, `{"level":"error","count":3,"error":"boom","message":"error pushing messages"}`, buf.String())
+}
+
+func TestSlogLogger(t *testing.T) {
+	buf := bytes.Buffer{}
+	l := NewSlogLogger(slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelWarn})))
+
+	l.Info("filtered")
+	require.Empty(t, buf.String())
+
+	l.Warn("discarding message", "id", 1)
+	require.Contains(t, buf.String(), "level=WARN msg=\"discarding message\" id=1")
+
+	require.Equal(t, slog.Default(), NewSlogLogger(nil))
+}
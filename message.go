@@ -0,0 +1,41 @@
+package gq
+
+import (
+	"context"
+	"time"
+)
+
+// Message is a message pulled from a queue, as passed to a HandlerFunc
+type Message struct {
+	// ID uniquely identifies the message within gq's tables
+	ID int64
+	// Queue is the name of the queue the message was pushed onto
+	Queue string
+	// Payload is the message pushed by the producer
+	Payload []byte
+	// Headers are the headers the message was pushed with, if any
+	Headers map[string]string
+	// Attempt is the number of times processing the message has been attempted, including this one
+	Attempt int
+	// CreatedAt is the time the message was pushed
+	CreatedAt time.Time
+
+	result []byte
+}
+
+// SetResult sets the result recorded in the status of a message pushed with Producer.PushTracked, if it is processed successfully.
+// It is ignored for other messages. The result must not be modified once set
+func (m *Message) SetResult(result []byte) {
+	m.result = result
+}
+
+// HandlerFunc represents a function which processes a message. It is passed a context carrying any trace context propagated
+// with the message. The message's payload is only valid until the function returns
+type HandlerFunc func(ctx context.Context, m *Message) error
+
+// handlerFunc adapts a ProcessFunc to a HandlerFunc
+func (p ProcessFunc) handlerFunc() HandlerFunc {
+	return func(ctx context.Context, m *Message) error {
+		return p(m.Payload)
+	}
+}
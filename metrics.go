@@ -0,0 +1,94 @@
+package gq
+
+import "time"
+
+// Outcome labels the result of pushing or processing messages in Metrics
+type Outcome string
+
+const (
+	// OutcomeSuccess means a batch of messages was pushed onto the queue
+	OutcomeSuccess Outcome = "success"
+	// OutcomeError means a batch of messages could not be pushed onto the queue
+	OutcomeError Outcome = "error"
+	// OutcomeAcked means a message was processed successfully and removed from the queue
+	OutcomeAcked Outcome = "acked"
+	// OutcomeRetried means a message failed processing and was requeued to be retried
+	OutcomeRetried Outcome = "retried"
+	// OutcomeDeadLettered means a message failed processing after exhausting its retries, and was moved to the dead-letter table
+	OutcomeDeadLettered Outcome = "dead_lettered"
+)
+
+// Metrics receives measurements of gq's activity. Implementations must be safe for concurrent use.
+// See the gqprom package for a Prometheus implementation
+type Metrics interface {
+	// MessagesPushed is called after each attempt to push a batch of count messages onto queue,
+	// with OutcomeSuccess or OutcomeError and the time the attempt took
+	MessagesPushed(queue string, count int, outcome Outcome, duration time.Duration)
+	// MessagesPulled is called after count messages are pulled from queue for processing
+	MessagesPulled(queue string, count int)
+	// MessageProcessed is called once the result of processing a message has been committed, with OutcomeAcked, OutcomeRetried
+	// or OutcomeDeadLettered, the time the process function took, and the time since the message was created. The handler
+	// duration is negative if it isn't known, as for messages received with Consumer.Receive, which are processed by the caller
+	MessageProcessed(queue string, outcome Outcome, handlerDuration time.Duration, endToEndLatency time.Duration)
+	// BufferedMessages is called with the change in the number of messages buffered by a producer for queue
+	// whenever it changes, so that the sum of the deltas across producers is the number buffered for the queue
+	BufferedMessages(queue string, delta int)
+}
+
+// ScalingMetrics is implemented by Metrics which also receive the scaling decisions of autoscaling consumers.
+// Consumers report them to the client's Metrics if it implements this interface
+type ScalingMetrics interface {
+	// ConsumerScaled is called with the change in the number of goroutines an autoscaling consumer of queue pulls messages
+	// from whenever it changes, and why, so that the sum of the deltas across consumers is the number pulling from the queue
+	ConsumerScaled(queue string, delta int, reason ScaleReason)
+}
+
+// unknownDuration is reported as the handler duration of a message processed outside of gq
+const unknownDuration time.Duration = -1
+
+type nopMetrics struct{}
+
+func (nopMetrics) MessagesPushed(string, int, Outcome, time.Duration)             {}
+func (nopMetrics) MessagesPulled(string, int)                                     {}
+func (nopMetrics) MessageProcessed(string, Outcome, time.Duration, time.Duration) {}
+func (nopMetrics) BufferedMessages(string, int)                                   {}
+
+// MultiMetrics returns Metrics which reports every measurement to each of metrics, such as to both Prometheus and a dashboard
+func MultiMetrics(metrics ...Metrics) Metrics {
+	return multiMetrics(metrics)
+}
+
+type multiMetrics []Metrics
+
+func (m multiMetrics) MessagesPushed(queue string, count int, outcome Outcome, duration time.Duration) {
+	for _, metrics := range m {
+		metrics.MessagesPushed(queue, count, outcome, duration)
+	}
+}
+
+func (m multiMetrics) MessagesPulled(queue string, count int) {
+	for _, metrics := range m {
+		metrics.MessagesPulled(queue, count)
+	}
+}
+
+func (m multiMetrics) MessageProcessed(queue string, outcome Outcome, handlerDuration time.Duration, endToEndLatency time.Duration) {
+	for _, metrics := range m {
+		metrics.MessageProcessed(queue, outcome, handlerDuration, endToEndLatency)
+	}
+}
+
+func (m multiMetrics) BufferedMessages(queue string, delta int) {
+	for _, metrics := range m {
+		metrics.BufferedMessages(queue, delta)
+	}
+}
+
+// ConsumerScaled implements ScalingMetrics, reporting to each of m which implements it
+func (m multiMetrics) ConsumerScaled(queue string, delta int, reason ScaleReason) {
+	for _, metrics := range m {
+		if s, ok := metrics.(ScalingMetrics); ok {
+			s.ConsumerScaled(queue, delta, reason)
+		}
+	}
+}
@@ -0,0 +1,25 @@
+package gq
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMultiMetrics(t *testing.T) {
+	a, b := newRecordingMetrics(), newRecordingMetrics()
+	s := &scalingMetrics{}
+	m := MultiMetrics(a, b, s)
+	m.MessagesPushed(DefaultQueue, 2, OutcomeSuccess, time.Millisecond)
+	m.MessagesPulled(DefaultQueue, 3)
+	m.MessageProcessed(DefaultQueue, OutcomeAcked, time.Millisecond, time.Second)
+	m.BufferedMessages(DefaultQueue, 1)
+	m.(ScalingMetrics).ConsumerScaled(DefaultQueue, 1, ScaleStarted)
+	for _, r := range []*recordingMetrics{a, b} {
+		require.Equal(t, 2, r.pushed[OutcomeSuccess])
+		require.Equal(t, 3, r.pulled)
+		require.Equal(t, []Outcome{OutcomeAcked}, r.outcomes)
+	}
+	require.Equal(t, 1, s.goroutines, "scaling decisions are reported to the metrics which implement ScalingMetrics")
+}
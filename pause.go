@@ -0,0 +1,64 @@
+package gq
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// pauseCheckPeriod is how long a consumer caches whether its queue is paused
+const pauseCheckPeriod = time.Second
+
+// Pause stops Consumers from claiming messages from queue until it is resumed, which they notice within a second. Messages which
+// have already been claimed are processed as usual, and Producers keep pushing messages onto the queue
+func (c *Client) Pause(ctx context.Context, queue string) error {
+	if _, err := c.exec(ctx, c.dialect.InsertQueuePause, queueOrDefault(queue), c.now()); err != nil {
+		return fmt.Errorf("error pausing queue: %s", err)
+	}
+	return nil
+}
+
+// Resume lets Consumers claim messages from a paused queue again
+func (c *Client) Resume(ctx context.Context, queue string) error {
+	if _, err := c.exec(ctx, fmt.Sprintf("DELETE FROM %s WHERE queue = ?", c.tables.QueuePause), queueOrDefault(queue)); err != nil {
+		return fmt.Errorf("error resuming queue: %s", err)
+	}
+	return nil
+}
+
+// PausedQueues returns the names of the paused queues
+func (c *Client) PausedQueues(ctx context.Context) ([]string, error) {
+	queues := []string{}
+	if err := c.db.SelectContext(ctx, &queues, fmt.Sprintf("SELECT queue FROM %s ORDER BY queue", c.tables.QueuePause)); err != nil {
+		return nil, fmt.Errorf("error selecting paused queues: %s", err)
+	}
+	return queues, nil
+}
+
+// pauseCache caches whether a consumer's queue is paused, so that the pause table is read at most once per pauseCheckPeriod
+type pauseCache struct {
+	mu        sync.Mutex
+	checkedAt time.Time
+	paused    bool
+}
+
+// paused returns whether the consumer's queue is paused
+func (c *Consumer) paused(ctx context.Context) (bool, error) {
+	c.pause.mu.Lock()
+	defer c.pause.mu.Unlock()
+	now := c.now()
+	if !c.pause.checkedAt.IsZero() && now.Sub(c.pause.checkedAt) < pauseCheckPeriod {
+		return c.pause.paused, nil
+	}
+	var count int
+	query := c.db.Rebind(fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE queue = ?", c.tables.QueuePause))
+	if err := c.db.GetContext(ctx, &count, query, c.opts.Queue); err != nil {
+		return c.pause.paused, fmt.Errorf("error checking whether queue is paused: %s", err)
+	}
+	if paused := count > 0; paused != c.pause.paused {
+		c.log.Info("queue pause changed", "queue", c.opts.Queue, "paused", paused)
+	}
+	c.pause.checkedAt, c.pause.paused = now, count > 0
+	return c.pause.paused, nil
+}
@@ -0,0 +1,69 @@
+package gq
+
+import (
+	"context"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/require"
+)
+
+func expectPauseCheck(mock sqlmock.Sqlmock, queue string, paused bool) {
+	count := 0
+	if paused {
+		count = 1
+	}
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(*) FROM queue_pause WHERE queue = ?")).
+		WithArgs(queue).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(count))
+}
+
+func TestPauseAndResume(t *testing.T) {
+	c, mock, now := newAdminTestClient(t)
+	mock.ExpectExec(regexp.QuoteMeta("INSERT IGNORE INTO queue_pause (queue, paused_at) VALUES (?, ?)")).
+		WithArgs("emails", now).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	require.NoError(t, c.Pause(context.Background(), "emails"))
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT queue FROM queue_pause ORDER BY queue")).
+		WillReturnRows(sqlmock.NewRows([]string{"queue"}).AddRow("emails"))
+	queues, err := c.PausedQueues(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, []string{"emails"}, queues)
+
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM queue_pause WHERE queue = ?")).
+		WithArgs("emails").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	require.NoError(t, c.Resume(context.Background(), "emails"))
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestReceive_Paused(t *testing.T) {
+	c, mock, _ := newLeaseTestConsumer(t)
+	expectPauseCheck(mock, "emails", true)
+
+	// the pause is cached, so the second receive doesn't read it again
+	for i := 0; i < 2; i++ {
+		deliveries, err := c.Receive(context.Background(), 10, time.Second)
+		require.NoError(t, err)
+		require.Empty(t, deliveries)
+	}
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestPaused_Expires(t *testing.T) {
+	c, mock, now := newLeaseTestConsumer(t)
+	expectPauseCheck(mock, "emails", true)
+	paused, err := c.paused(context.Background())
+	require.NoError(t, err)
+	require.True(t, paused)
+
+	c.now = func() time.Time { return now.Add(pauseCheckPeriod) }
+	expectPauseCheck(mock, "emails", false)
+	paused, err = c.paused(context.Background())
+	require.NoError(t, err)
+	require.False(t, paused)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
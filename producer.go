@@ -2,21 +2,42 @@ package gq
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/cenkalti/backoff"
 	"github.com/jmoiron/sqlx"
-	"github.com/rs/zerolog/log"
+	"github.com/mattbonnell/gq/internal"
 )
 
 const (
 	messageBufferSize      = 100
-	pushBatchSize          = 1
 	defaultPushPeriod      = time.Millisecond * 50
 	defaultMaxRetryPeriods = 3
 	maxBatchQuerySize      = (1 << 16) - 1
+	// pushColumns is the number of placeholders each pushed message occupies in the INSERT query
+	pushColumns = 5
+	// maxPushBatchSize is the largest batch of messages which fits in one INSERT query
+	maxPushBatchSize  = maxBatchQuerySize / pushColumns
+	defaultBufferSize = 10000
+	// pushTimeout bounds each attempt to push a batch, so that a database which hangs can't stall a pusher, or the replay of
+	// the spool, indefinitely
+	pushTimeout = 30 * time.Second
+)
+
+// OverflowPolicy decides what pushing a message does while a producer's buffer is full
+type OverflowPolicy int
+
+const (
+	// OverflowBlock makes the push wait for room in the buffer, until its context is done or, if set, BufferTimeout passes
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDropNewest discards the message being pushed, logging a warning
+	OverflowDropNewest
+	// OverflowError makes the push fail with ErrBufferFull
+	OverflowError
 )
 
 // ProducerOptions represents the options which can be used to tailor producer behaviour
@@ -28,6 +49,23 @@ type ProducerOptions struct {
 	MaxRetryPeriods int
 	// Concurrency is the number of concurrent goroutines to push messages from (default: 1)
 	Concurrency int
+	// Queue is the name of the queue to push messages onto (default: "default")
+	Queue string
+	// Topic is the name of a topic to publish messages to, instead of pushing them onto a queue. Each message is delivered to every
+	// queue subscribed to the topic with Client.Subscribe when it is published, and is discarded if there are none
+	Topic string
+	// BufferSize is the most messages the producer holds which have not yet been pushed, including those being pushed (default: 10000)
+	BufferSize int
+	// Overflow decides what pushing a message does while the buffer is full, such as while the database is slow (default: OverflowBlock)
+	Overflow OverflowPolicy
+	// BufferTimeout, if set, is the longest a push waits for room in the buffer under OverflowBlock, before failing with ErrBufferFull
+	BufferTimeout time.Duration
+	// SpoolDir, if set, is a directory in which batches which fail to be pushed are spooled, instead of being discarded, to be pushed
+	// in order once the database recovers. Spooled messages left by a producer which crashed are pushed when a producer is next
+	// created with the same directory. Each producer should have its own directory
+	SpoolDir string
+	// SpoolSync decides when spooled batches are flushed to disk (default: SpoolSyncAlways)
+	SpoolSync SpoolSync
 }
 
 func defaultProducerOpts() ProducerOptions {
@@ -35,46 +73,334 @@ func defaultProducerOpts() ProducerOptions {
 		PushPeriod:      defaultPushPeriod,
 		MaxRetryPeriods: defaultMaxRetryPeriods,
 		Concurrency:     1,
+		Queue:           DefaultQueue,
+		BufferSize:      defaultBufferSize,
 	}
 }
 
 // Producer represents a message queue producer
 type Producer struct {
 	db      *sqlx.DB
-	msgChan chan []byte
-	opts    ProducerOptions
+	tables  internal.Tables
+	dialect *internal.Dialect
+	log     Logger
+	metrics Metrics
+	now     func() time.Time
+	tracer  Tracer
+	msgChan chan outgoingMessage
+	// space holds a token for each message buffered, bounding the buffer to its capacity
+	space chan struct{}
+	opts  ProducerOptions
+	spool *spool
+
+	stop      chan struct{}
+	stopOnce  sync.Once
+	closeOnce sync.Once
+	// closeMu orders buffering messages before closing, so that pushers flush every message buffered
+	closeMu  sync.RWMutex
+	closed   bool
+	wg       sync.WaitGroup
+	errMu    sync.Mutex
+	flushErr error
 }
 
-func newProducer(ctx context.Context, db *sqlx.DB, opts *ProducerOptions) (*Producer, error) {
-	p := &Producer{db: db, msgChan: make(chan []byte)}
+func newProducer(ctx context.Context, cl *Client, opts *ProducerOptions) (*Producer, error) {
+	p := &Producer{db: cl.db, tables: cl.tables, dialect: cl.dialect, log: cl.opts.Logger, metrics: cl.opts.Metrics, tracer: cl.opts.Tracer, now: cl.now, stop: make(chan struct{})}
 	if opts != nil {
+		if opts.Topic != "" && opts.Queue != "" {
+			return nil, fmt.Errorf("a producer can't push onto both queue '%s' and topic '%s'", opts.Queue, opts.Topic)
+		}
 		p.opts = *opts
+		if p.opts.Topic == "" {
+			p.opts.Queue = queueOrDefault(p.opts.Queue)
+		}
 	} else {
 		p.opts = defaultProducerOpts()
 	}
+	if p.opts.BufferSize <= 0 {
+		p.opts.BufferSize = defaultBufferSize
+	}
+	p.space = make(chan struct{}, p.opts.BufferSize)
+	// a message is only sent once it holds space, so sending never blocks
+	p.msgChan = make(chan outgoingMessage, p.opts.BufferSize)
+	if p.opts.SpoolDir != "" {
+		s, err := openSpool(p.opts.SpoolDir, p.opts.SpoolSync, p.log)
+		if err != nil {
+			return nil, err
+		}
+		p.spool = s
+		p.wg.Add(1)
+		go p.startReplaying(ctx)
+	}
+	p.wg.Add(p.opts.Concurrency)
 	for i := 0; i < p.opts.Concurrency; i++ {
 		go p.startPushingMessages(ctx)
 	}
 	return p, nil
 }
 
-// Push pushes a message onto the queue
-func (p *Producer) Push(message []byte) {
-	p.msgChan <- message
+// outgoingMessage is a message waiting to be pushed
+type outgoingMessage struct {
+	payload []byte
+	headers map[string]string
+	// done, if set, receives the result of pushing the message
+	done chan error
+}
+
+// Push buffers a message to be pushed onto the queue, returning once it is buffered. While the buffer is full, the producer's
+// overflow policy decides whether Push waits or discards the message. It returns ErrProducerClosed once the producer has been
+// closed, and ErrBufferFull if the message can't be buffered
+func (p *Producer) Push(message []byte) error {
+	return p.push(context.Background(), outgoingMessage{payload: message})
+}
+
+// PushContext pushes a message onto the queue like Push, propagating the trace context carried by ctx to the consumer which
+// processes it. Under OverflowBlock, it returns ctx's error if ctx is done before the message is buffered
+func (p *Producer) PushContext(ctx context.Context, message []byte) error {
+	return p.PushWithHeaders(ctx, message, nil)
+}
+
+// PushWithHeaders pushes a message with the supplied headers onto the queue like PushContext
+func (p *Producer) PushWithHeaders(ctx context.Context, message []byte, headers map[string]string) error {
+	h := make(map[string]string, len(headers))
+	for k, v := range headers {
+		h[k] = v
+	}
+	p.tracer.Inject(ctx, h)
+	return p.push(ctx, outgoingMessage{payload: message, headers: h})
+}
+
+// PushSync pushes a message with the supplied headers onto the queue like PushWithHeaders, but waits until the batch containing
+// it has been inserted, or spooled if SpoolDir is set, returning the error if it could not be. If ctx is done first, PushSync returns ctx's error,
+// but the message may still be pushed
+func (p *Producer) PushSync(ctx context.Context, message []byte, headers map[string]string) error {
+	h := make(map[string]string, len(headers))
+	for k, v := range headers {
+		h[k] = v
+	}
+	p.tracer.Inject(ctx, h)
+	done := make(chan error, 1)
+	if err := p.push(ctx, outgoingMessage{payload: message, headers: h, done: done}); err != nil {
+		return err
+	}
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// OutgoingMessage is a message to push with PushBatch
+type OutgoingMessage struct {
+	Payload []byte
+	Headers map[string]string
 }
 
-func (p Producer) startPushingMessages(ctx context.Context) {
-	buf := make([][]byte, 0, messageBufferSize)
+// PushBatch pushes messages onto the queue immediately, propagating the trace context carried by ctx, in a single transaction,
+// so that either every message is pushed or none are. The messages aren't buffered, so they aren't subject to the overflow
+// policy, nor spooled if they can't be pushed
+func (p *Producer) PushBatch(ctx context.Context, messages []OutgoingMessage) error {
+	select {
+	case <-p.stop:
+		return ErrProducerClosed
+	default:
+	}
+	batch := make([]outgoingMessage, len(messages))
+	headers := make([]map[string]string, len(messages))
+	for i := range messages {
+		h := make(map[string]string, len(messages[i].Headers))
+		for k, v := range messages[i].Headers {
+			h[k] = v
+		}
+		p.tracer.Inject(ctx, h)
+		batch[i] = outgoingMessage{payload: messages[i].Payload, headers: h}
+		headers[i] = h
+	}
+	end := p.tracer.StartPush(ctx, p.destination(), headers)
+	err := p.pushMessages(ctx, batch)
+	end(err)
+	return err
+}
+
+// pushNow pushes a single message immediately with push, within a span started by the tracer, and records it as pushed
+// if push reports that it was
+func (p *Producer) pushNow(ctx context.Context, headers map[string]string, push func(headers internal.Headers) (bool, error)) (bool, error) {
+	select {
+	case <-p.stop:
+		return false, ErrProducerClosed
+	default:
+	}
+	h := internal.Headers{}
+	for k, v := range headers {
+		h[k] = v
+	}
+	p.tracer.Inject(ctx, h)
+	end := p.tracer.StartPush(ctx, p.opts.Queue, []map[string]string{h})
+	start := time.Now()
+	pushed, err := push(h)
+	end(err)
+	if err != nil {
+		p.metrics.MessagesPushed(p.opts.Queue, 1, OutcomeError, time.Since(start))
+		return false, err
+	}
+	if pushed {
+		p.metrics.MessagesPushed(p.opts.Queue, 1, OutcomeSuccess, time.Since(start))
+	}
+	return pushed, nil
+}
+
+// push buffers m to be pushed by one of the pushing goroutines, applying the overflow policy while the buffer is full
+func (p *Producer) push(ctx context.Context, m outgoingMessage) error {
+	if err := p.reserve(ctx); err != nil {
+		if err == errDropped {
+			p.log.Warn("discarding message pushed while the producer's buffer is full", "destination", p.destination())
+			if m.done != nil {
+				m.done <- ErrBufferFull
+			}
+			return nil
+		}
+		return err
+	}
+	p.closeMu.RLock()
+	defer p.closeMu.RUnlock()
+	if p.closed {
+		<-p.space
+		return ErrProducerClosed
+	}
+	// counted before it is sent, so that the pusher's release of it can't be counted first
+	p.metrics.BufferedMessages(p.destination(), 1)
+	p.msgChan <- m
+	return nil
+}
+
+// errDropped is returned by reserve when the message should be discarded under OverflowDropNewest
+var errDropped = errors.New("message dropped")
+
+// reserve takes space in the buffer for a message, applying the overflow policy if there is none
+func (p *Producer) reserve(ctx context.Context) error {
+	select {
+	case <-p.stop:
+		return ErrProducerClosed
+	default:
+	}
+	select {
+	case p.space <- struct{}{}:
+		return nil
+	default:
+	}
+	switch p.opts.Overflow {
+	case OverflowDropNewest:
+		return errDropped
+	case OverflowError:
+		return ErrBufferFull
+	}
+	var timeout <-chan time.Time
+	if p.opts.BufferTimeout > 0 {
+		timer := time.NewTimer(p.opts.BufferTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case p.space <- struct{}{}:
+		return nil
+	case <-p.stop:
+		return ErrProducerClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timeout:
+		return ErrBufferFull
+	}
+}
+
+// release frees the space in the buffer held by n messages which have been pushed or discarded
+func (p *Producer) release(n int) {
+	for i := 0; i < n; i++ {
+		<-p.space
+	}
+	p.metrics.BufferedMessages(p.destination(), -n)
+}
+
+// markClosed stops the producer accepting messages, waking any pushes waiting for room in the buffer
+func (p *Producer) markClosed() {
+	p.stopOnce.Do(func() {
+		p.closeMu.Lock()
+		p.closed = true
+		close(p.stop)
+		p.closeMu.Unlock()
+	})
+}
+
+// Close stops the producer, pushing any messages it has buffered before returning.
+// It returns the error encountered while pushing the buffered messages, if any
+func (p *Producer) Close() error {
+	p.closeOnce.Do(func() {
+		p.markClosed()
+		p.wg.Wait()
+		if p.spool != nil {
+			p.spool.close()
+		}
+	})
+	p.errMu.Lock()
+	defer p.errMu.Unlock()
+	return p.flushErr
+}
+
+// destination is the name of the queue or topic the producer pushes onto, which labels its logs, metrics and traces
+func (p *Producer) destination() string {
+	if p.opts.Topic != "" {
+		return p.opts.Topic
+	}
+	return p.opts.Queue
+}
+
+func (p *Producer) startPushingMessages(ctx context.Context) {
+	defer p.wg.Done()
+	buf := make([]outgoingMessage, 0, messageBufferSize)
 	ticker := time.NewTicker(p.opts.PushPeriod)
+	defer ticker.Stop()
 	retryTimeout := p.opts.PushPeriod * time.Duration(p.opts.MaxRetryPeriods)
 	for {
 		select {
 		case <-ctx.Done():
-			log.Debug().Msgf("stopping message pushing: %s", ctx.Err())
+			// the producer can't push any more messages, so stop it accepting them, and discard those it has buffered
+			p.markClosed()
+			buf = p.drain(buf)
+			err := ctx.Err()
+			if len(buf) > 0 && p.spool != nil {
+				// the spool is replayed by the next producer created with it
+				if err = p.spoolMessages(buf); err == nil {
+					p.log.Warn("spooled buffered messages after the producer's context was done", "destination", p.destination(), "count", len(buf))
+				}
+			}
+			if err != nil && len(buf) > 0 {
+				p.log.Error("discarding buffered messages after the producer's context was done", "destination", p.destination(), "count", len(buf), "reason", err)
+			}
+			for i := range buf {
+				if buf[i].done != nil {
+					buf[i].done <- err
+				}
+			}
+			p.release(len(buf))
+			return
+		case <-p.stop:
+			// no more messages are buffered once the producer is closed, so take any this goroutine hasn't received yet
+			buf = p.drain(buf)
+			p.log.Debug("producer closed, flushing buffered messages", "count", len(buf))
+			if len(buf) > 0 {
+				// the producer's context may outlive Close, so flush under a fresh one bounded by the retry timeout
+				if err := p.pushMessagesWithRetryTimeout(context.Background(), buf, retryTimeout); err != nil {
+					p.errMu.Lock()
+					if p.flushErr == nil {
+						p.flushErr = err
+					}
+					p.errMu.Unlock()
+				}
+			}
 			return
 		case m := <-p.msgChan:
 			buf = append(buf, m)
-			if len(buf) == maxBatchQuerySize {
+			if len(buf) == maxPushBatchSize {
 				p.pushMessagesWithRetryTimeout(ctx, buf, retryTimeout)
 				buf = clear(buf)
 			}
@@ -88,40 +414,190 @@ func (p Producer) startPushingMessages(ctx context.Context) {
 	}
 }
 
-func clear(buffer [][]byte) [][]byte {
+// drain appends the messages waiting in the producer's channel to buf
+func (p *Producer) drain(buf []outgoingMessage) []outgoingMessage {
+	for {
+		select {
+		case m := <-p.msgChan:
+			buf = append(buf, m)
+		default:
+			return buf
+		}
+	}
+}
+
+func clear(buffer []outgoingMessage) []outgoingMessage {
 	for i := range buffer {
-		buffer[i] = []byte{} // allow elements to be garbage-collected
+		buffer[i] = outgoingMessage{} // allow elements to be garbage-collected
 	}
 	return buffer[:0]
 }
 
-func (p Producer) pushMessagesWithRetryTimeout(ctx context.Context, messages [][]byte, retryTimeout time.Duration) {
-	ctx, cancel := context.WithTimeout(ctx, retryTimeout)
-	if err := backoff.Retry(func() error { return p.pushMessages(messages) }, backoff.WithContext(backoff.NewExponentialBackOff(), ctx)); err != nil {
-		log.Err(err).Msg("error pushing messages")
+func (p *Producer) pushMessagesWithRetryTimeout(ctx context.Context, messages []outgoingMessage, retryTimeout time.Duration) error {
+	headers := make([]map[string]string, len(messages))
+	for i := range messages {
+		headers[i] = messages[i].headers
+	}
+	end := p.tracer.StartPush(ctx, p.destination(), headers)
+	var err error
+	if p.spool != nil && !p.spool.empty() {
+		// the messages are pushed after those spooled before them, once the spool is replayed
+		err = p.spoolMessages(messages)
+	} else {
+		retryCtx, cancel := context.WithTimeout(ctx, retryTimeout)
+		err = backoff.Retry(func() error { return p.pushMessages(ctx, messages) }, backoff.WithContext(backoff.NewExponentialBackOff(), retryCtx))
+		cancel() // release ctx resources if timeout hasn't expired
+		if err != nil && p.spool != nil {
+			p.log.Warn("spooling messages after failing to push them", "destination", p.destination(), "count", len(messages), "error", err)
+			err = p.spoolMessages(messages)
+		}
 	}
-	cancel() // release ctx resources if timeout hasn't expired
+	end(err)
+	if err != nil {
+		p.log.Error("discarding messages after failing to push them", "destination", p.destination(), "count", len(messages), "error", err)
+	}
+	p.release(len(messages))
+	for i := range messages {
+		if messages[i].done != nil {
+			messages[i].done <- err
+		}
+	}
+	return err
+}
 
+// spoolMessages appends messages to the spool, to be pushed when it is replayed
+func (p *Producer) spoolMessages(messages []outgoingMessage) error {
+	if err := p.spool.append(messages); err != nil {
+		return err
+	}
+	p.log.Debug("spooled messages", "destination", p.destination(), "count", len(messages))
+	return nil
 }
 
-func (p Producer) pushMessages(messages [][]byte) error {
-	log.Debug().Msgf("pushing %d messages onto queue", len(messages))
-	valuesListBuilder := strings.Builder{}
-	valuesListBuilder.Grow(len(messages) * len([]byte("(?), ")))
-	args := make([]interface{}, len(messages))
-	for i := range messages {
-		if i == 0 {
-			valuesListBuilder.WriteString("(?)")
-		} else {
-			valuesListBuilder.WriteString(", (?)")
+// startReplaying pushes the spooled messages every spoolReplayPeriod, starting immediately so that messages spooled by a
+// previous producer are recovered
+func (p *Producer) startReplaying(ctx context.Context) {
+	defer p.wg.Done()
+	ticker := time.NewTicker(spoolReplayPeriod)
+	defer ticker.Stop()
+	for {
+		p.replay(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-p.stop:
+			return
+		case <-ticker.C:
 		}
-		args[i] = messages[i]
 	}
-	query := fmt.Sprintf("INSERT INTO message (payload) VALUES %s", valuesListBuilder.String())
-	query = p.db.Rebind(query)
-	if _, err := p.db.Exec(query, args...); err != nil {
-		return fmt.Errorf("error INSERTING messages: %s", err)
+}
+
+func (p *Producer) replay(ctx context.Context) {
+	if p.spool.empty() {
+		return
+	}
+	n, err := p.spool.replay(func(messages []outgoingMessage) error { return p.pushMessages(ctx, messages) })
+	if n > 0 {
+		p.log.Info("pushed spooled messages", "destination", p.destination(), "count", n)
+	}
+	if err != nil {
+		p.log.Error("error replaying spooled messages", "destination", p.destination(), "error", err)
+	}
+}
+
+func (p *Producer) pushMessages(ctx context.Context, messages []outgoingMessage) error {
+	p.log.Debug("pushing messages", "destination", p.destination(), "count", len(messages))
+	ctx, cancel := context.WithTimeout(ctx, pushTimeout)
+	defer cancel()
+	start := time.Now()
+	var err error
+	if p.opts.Topic != "" {
+		err = p.publishMessages(ctx, messages)
+	} else {
+		err = p.insertQueued(ctx, messages)
+	}
+	if err != nil {
+		p.metrics.MessagesPushed(p.destination(), len(messages), OutcomeError, time.Since(start))
+		return err
+	}
+	p.metrics.MessagesPushed(p.destination(), len(messages), OutcomeSuccess, time.Since(start))
+	p.log.Debug("successfully pushed messages", "destination", p.destination())
+	return nil
+}
+
+// publishMessages inserts a copy of each message onto every queue subscribed to the producer's topic, atomically
+func (p *Producer) publishMessages(ctx context.Context, messages []outgoingMessage) error {
+	tx, err := p.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error beginning publish transaction: %s", err)
+	}
+	defer tx.Rollback()
+	queues := []string{}
+	query := tx.Rebind(fmt.Sprintf("SELECT queue FROM %s WHERE topic = ? ORDER BY queue", p.tables.Subscription))
+	if err := tx.SelectContext(ctx, &queues, query, p.opts.Topic); err != nil {
+		return fmt.Errorf("error selecting subscriptions: %s", err)
+	}
+	if len(queues) == 0 {
+		p.log.Debug("discarding messages published to topic without subscriptions", "topic", p.opts.Topic, "count", len(messages))
+		return nil
+	}
+	for _, queue := range queues {
+		if err := p.insertMessages(ctx, tx, queue, messages); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing publish transaction: %s", err)
+	}
+	return nil
+}
+
+// insertQueued inserts messages onto the producer's queue, within a transaction if they don't fit in one query, so that either
+// every message is inserted or none are
+func (p *Producer) insertQueued(ctx context.Context, messages []outgoingMessage) error {
+	if len(messages) <= maxPushBatchSize {
+		return p.insertMessages(ctx, p.db, p.opts.Queue, messages)
+	}
+	tx, err := p.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error beginning push transaction: %s", err)
+	}
+	defer tx.Rollback()
+	if err := p.insertMessages(ctx, tx, p.opts.Queue, messages); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing push transaction: %s", err)
+	}
+	return nil
+}
+
+// insertMessages inserts messages onto queue, in as few queries as the placeholder limit allows
+func (p *Producer) insertMessages(ctx context.Context, ex sqlx.ExecerContext, queue string, messages []outgoingMessage) error {
+	// timestamps come from the client's clock, the same one consumers compare ready_at against
+	now := p.now()
+	for len(messages) > 0 {
+		batch := messages
+		if len(batch) > maxPushBatchSize {
+			batch = batch[:maxPushBatchSize]
+		}
+		messages = messages[len(batch):]
+		valuesListBuilder := strings.Builder{}
+		valuesListBuilder.Grow(len(batch) * len([]byte("(?, ?, ?, ?, ?), ")))
+		args := make([]interface{}, 0, len(batch)*pushColumns)
+		for i := range batch {
+			if i == 0 {
+				valuesListBuilder.WriteString("(?, ?, ?, ?, ?)")
+			} else {
+				valuesListBuilder.WriteString(", (?, ?, ?, ?, ?)")
+			}
+			args = append(args, queue, batch[i].payload, internal.Headers(batch[i].headers), now, now)
+		}
+		query := fmt.Sprintf("INSERT INTO %s (queue, payload, headers, created_at, ready_at) VALUES %s", p.tables.Message, valuesListBuilder.String())
+		query = p.db.Rebind(query)
+		if _, err := ex.ExecContext(ctx, query, args...); err != nil {
+			return fmt.Errorf("error INSERTING messages: %s", err)
+		}
 	}
-	log.Debug().Msg("successfully pushed messages onto queue")
 	return nil
 }
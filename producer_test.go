@@ -8,7 +8,6 @@ import (
 	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
-	"github.com/jmoiron/sqlx"
 	"github.com/mattbonnell/gq/internal"
 	"github.com/stretchr/testify/require"
 )
@@ -19,22 +18,32 @@ func TestPushMessageShouldSucceed_OneMessage(t *testing.T) {
 
 	m := internal.Message{Payload: []byte("random payload")}
 
+	now := time.Now().UTC()
 	mock.
 		ExpectExec(
-			regexp.QuoteMeta(`INSERT INTO message (payload) VALUES (?)`),
+			regexp.QuoteMeta(`INSERT INTO message (queue, payload, headers, created_at, ready_at) VALUES (?, ?, ?, ?, ?)`),
 		).
-		WithArgs(m.Payload).
+		WithArgs(DefaultQueue, m.Payload, nil, now, now).
 		WillReturnResult(sqlmock.NewResult(1, 1))
 
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
 	defer cancel()
 
-	p, err := newProducer(ctx, sqlx.NewDb(db, arbitraryDriverName), &ProducerOptions{PushPeriod: 500 * time.Nanosecond, MaxRetryPeriods: 0, Concurrency: 1})
+	cl := newTestClient(db)
+	cl.opts.Clock = func() time.Time { return now }
+	metrics := newRecordingMetrics()
+	cl.opts.Metrics = metrics
+	p, err := newProducer(ctx, cl, &ProducerOptions{PushPeriod: 500 * time.Nanosecond, MaxRetryPeriods: 0, Concurrency: 1})
 	require.NoError(t, err)
 
 	p.Push(m.Payload)
 	time.Sleep(time.Millisecond)
 	require.NoError(t, mock.ExpectationsWereMet())
+	require.Eventually(t, func() bool {
+		metrics.mu.Lock()
+		defer metrics.mu.Unlock()
+		return metrics.pushed[OutcomeSuccess] == 1
+	}, time.Second, time.Millisecond)
 }
 
 // TODO: fix this test
@@ -48,17 +57,20 @@ func TestPushMessageShouldSucceed_ThreeMessages(t *testing.T) {
 		messages[i] = []byte("payload" + strconv.Itoa(i))
 	}
 
+	now := time.Now().UTC()
 	mock.
 		ExpectExec(
-			regexp.QuoteMeta(`INSERT INTO message (payload) VALUES (?), (?), (?)`),
+			regexp.QuoteMeta(`INSERT INTO message (queue, payload, headers, created_at, ready_at) VALUES (?, ?, ?, ?, ?), (?, ?, ?, ?, ?), (?, ?, ?, ?, ?)`),
 		).
-		WithArgs(messages[0], messages[1], messages[2]).
+		WithArgs(DefaultQueue, messages[0], nil, now, now, DefaultQueue, messages[1], nil, now, now, DefaultQueue, messages[2], nil, now, now).
 		WillReturnResult(sqlmock.NewResult(3, 3))
 
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
 	defer cancel()
 
-	p, err := newProducer(ctx, sqlx.NewDb(db, arbitraryDriverName), &ProducerOptions{PushPeriod: time.Millisecond, MaxRetryPeriods: 0, Concurrency: 2})
+	cl := newTestClient(db)
+	cl.opts.Clock = func() time.Time { return now }
+	p, err := newProducer(ctx, cl, &ProducerOptions{PushPeriod: time.Millisecond, MaxRetryPeriods: 0, Concurrency: 2})
 	require.NoError(t, err)
 
 	for _, m := range messages {
@@ -67,3 +79,163 @@ func TestPushMessageShouldSucceed_ThreeMessages(t *testing.T) {
 	time.Sleep(time.Millisecond * 5)
 	require.NoError(t, mock.ExpectationsWereMet())
 }
+
+func TestPushSync(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+
+	now := time.Now().UTC()
+	mock.
+		ExpectExec(
+			regexp.QuoteMeta(`INSERT INTO message (queue, payload, headers, created_at, ready_at) VALUES (?, ?, ?, ?, ?)`),
+		).
+		WithArgs(DefaultQueue, []byte("payload"), `{"k":"v"}`, now, now).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+	defer cancel()
+
+	cl := newTestClient(db)
+	cl.opts.Clock = func() time.Time { return now }
+	p, err := newProducer(ctx, cl, &ProducerOptions{PushPeriod: time.Millisecond, MaxRetryPeriods: 1, Concurrency: 1})
+	require.NoError(t, err)
+
+	require.NoError(t, p.PushSync(ctx, []byte("payload"), map[string]string{"k": "v"}))
+	require.NoError(t, mock.ExpectationsWereMet())
+
+	require.NoError(t, p.Close())
+	require.ErrorIs(t, p.PushSync(ctx, []byte("payload"), nil), ErrProducerClosed)
+}
+
+func TestPublish(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+
+	now := time.Now().UTC()
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT queue FROM subscription WHERE topic = ? ORDER BY queue")).
+		WithArgs("orders").
+		WillReturnRows(sqlmock.NewRows([]string{"queue"}).AddRow("analytics").AddRow("billing"))
+	for _, queue := range []string{"analytics", "billing"} {
+		mock.
+			ExpectExec(
+				regexp.QuoteMeta(`INSERT INTO message (queue, payload, headers, created_at, ready_at) VALUES (?, ?, ?, ?, ?)`),
+			).
+			WithArgs(queue, []byte("payload"), nil, now, now).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+	}
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT queue FROM subscription WHERE topic = ? ORDER BY queue")).
+		WithArgs("orders").
+		WillReturnRows(sqlmock.NewRows([]string{"queue"}))
+	mock.ExpectRollback()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+	defer cancel()
+
+	cl := newTestClient(db)
+	cl.opts.Clock = func() time.Time { return now }
+	metrics := newRecordingMetrics()
+	cl.opts.Metrics = metrics
+	p, err := newProducer(ctx, cl, &ProducerOptions{PushPeriod: time.Millisecond, MaxRetryPeriods: 1, Concurrency: 1, Topic: "orders"})
+	require.NoError(t, err)
+
+	require.NoError(t, p.PushSync(ctx, []byte("payload"), nil))
+	// without subscriptions, the message is discarded
+	require.NoError(t, p.PushSync(ctx, []byte("payload"), nil))
+	require.NoError(t, mock.ExpectationsWereMet())
+	require.Equal(t, 2, metrics.pushed[OutcomeSuccess])
+
+	_, err = newProducer(ctx, cl, &ProducerOptions{PushPeriod: time.Millisecond, Concurrency: 1, Queue: "billing", Topic: "orders"})
+	require.Error(t, err)
+}
+
+func TestPushOverflow(t *testing.T) {
+	full := func(t *testing.T, opts ProducerOptions) (*Producer, sqlmock.Sqlmock) {
+		db, mock, err := sqlmock.New()
+		require.NoError(t, err)
+		cl := newTestClient(db)
+		opts.PushPeriod = time.Hour
+		opts.MaxRetryPeriods = 1
+		opts.Concurrency = 1
+		opts.BufferSize = 2
+		p, err := newProducer(context.Background(), cl, &opts)
+		require.NoError(t, err)
+		require.NoError(t, p.Push([]byte("a")))
+		require.NoError(t, p.Push([]byte("b")))
+		// closing flushes only the buffered messages
+		mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO message (queue, payload, headers, created_at, ready_at) VALUES (?, ?, ?, ?, ?), (?, ?, ?, ?, ?)`)).
+			WillReturnResult(sqlmock.NewResult(2, 2))
+		return p, mock
+	}
+
+	t.Run("error", func(t *testing.T) {
+		p, mock := full(t, ProducerOptions{Overflow: OverflowError})
+		require.ErrorIs(t, p.Push([]byte("c")), ErrBufferFull)
+		require.ErrorIs(t, p.PushSync(context.Background(), []byte("c"), nil), ErrBufferFull)
+		require.NoError(t, p.Close())
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("drop newest", func(t *testing.T) {
+		p, mock := full(t, ProducerOptions{Overflow: OverflowDropNewest})
+		require.NoError(t, p.Push([]byte("c")))
+		require.ErrorIs(t, p.PushSync(context.Background(), []byte("c"), nil), ErrBufferFull)
+		require.NoError(t, p.Close())
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("block", func(t *testing.T) {
+		p, mock := full(t, ProducerOptions{Overflow: OverflowBlock, BufferTimeout: 10 * time.Millisecond})
+		require.ErrorIs(t, p.Push([]byte("c")), ErrBufferFull)
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		require.ErrorIs(t, p.PushContext(ctx, []byte("c")), context.Canceled)
+		require.NoError(t, p.Close())
+		require.NoError(t, mock.ExpectationsWereMet())
+		require.ErrorIs(t, p.Push([]byte("c")), ErrProducerClosed)
+	})
+}
+
+func TestProducer_ContextDone(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	p, err := newProducer(ctx, newTestClient(db), &ProducerOptions{PushPeriod: time.Hour, MaxRetryPeriods: 1, Concurrency: 1, BufferSize: 1})
+	require.NoError(t, err)
+
+	done := make(chan error)
+	go func() { done <- p.PushSync(context.Background(), []byte("a"), nil) }()
+	require.Eventually(t, func() bool { return len(p.space) == 1 }, time.Second, time.Millisecond)
+	blocked := make(chan error)
+	go func() { blocked <- p.Push([]byte("b")) }()
+
+	// buffered messages are failed, and pushes waiting for room, or made later, are refused
+	cancel()
+	require.ErrorIs(t, <-done, context.Canceled)
+	require.ErrorIs(t, <-blocked, ErrProducerClosed)
+	require.ErrorIs(t, p.Push([]byte("c")), ErrProducerClosed)
+	require.NoError(t, p.Close())
+	require.Len(t, p.space, 0)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestPushBatch(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	now := time.Now().UTC()
+	cl := newTestClient(db)
+	cl.opts.Clock = func() time.Time { return now }
+	p, err := newProducer(context.Background(), cl, &ProducerOptions{PushPeriod: time.Hour, MaxRetryPeriods: 1, Concurrency: 1})
+	require.NoError(t, err)
+
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO message (queue, payload, headers, created_at, ready_at) VALUES (?, ?, ?, ?, ?), (?, ?, ?, ?, ?)`)).
+		WithArgs(DefaultQueue, []byte("a"), `{"k":"v"}`, now, now, DefaultQueue, []byte("b"), nil, now, now).
+		WillReturnResult(sqlmock.NewResult(2, 2))
+	require.NoError(t, p.PushBatch(context.Background(), []OutgoingMessage{{Payload: []byte("a"), Headers: map[string]string{"k": "v"}}, {Payload: []byte("b")}}))
+	require.NoError(t, mock.ExpectationsWereMet())
+
+	require.NoError(t, p.Close())
+	require.ErrorIs(t, p.PushBatch(context.Background(), []OutgoingMessage{{Payload: []byte("c")}}), ErrProducerClosed)
+}
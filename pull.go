@@ -0,0 +1,73 @@
+package gq
+
+import (
+	"math/rand"
+	"time"
+)
+
+const (
+	defaultMaxIdlePullPeriod = time.Second
+	// pullJitter is the fraction by which the wait between pulls is randomly lengthened or shortened, so that the pulls of
+	// many consumers don't synchronise
+	pullJitter = 0.2
+)
+
+// pullOutcome summarises a pull, to schedule the next one
+type pullOutcome int
+
+const (
+	// pullEmpty means no messages were claimed, or the pull failed
+	pullEmpty pullOutcome = iota
+	// pullPartial means fewer messages were claimed than were asked for, so the queue has been drained
+	pullPartial
+	// pullFull means as many messages were claimed as were asked for, so more are likely to be waiting
+	pullFull
+	// pullThrottled means no messages were claimed because the queue is paused, or the consumer's limits were reached
+	pullThrottled
+)
+
+// pullScheduler decides how long a consumer waits between pulls. It pulls again immediately while batches come back full,
+// and backs off exponentially from the pull period up to the maximum idle period while the queue is empty
+type pullScheduler struct {
+	period  time.Duration
+	maxIdle time.Duration
+	idle    time.Duration
+}
+
+func newPullScheduler(period time.Duration, maxIdle time.Duration) *pullScheduler {
+	if period <= 0 {
+		period = defaultPullPeriod
+	}
+	if maxIdle <= 0 {
+		maxIdle = defaultMaxIdlePullPeriod
+	}
+	if maxIdle < period {
+		maxIdle = period
+	}
+	return &pullScheduler{period: period, maxIdle: maxIdle}
+}
+
+// next returns how long to wait before the pull after one with the given outcome
+func (s *pullScheduler) next(outcome pullOutcome) time.Duration {
+	switch outcome {
+	case pullFull:
+		s.idle = 0
+		return 0
+	case pullEmpty:
+		s.idle *= 2
+		if s.idle == 0 {
+			s.idle = s.period
+		}
+		if s.idle > s.maxIdle {
+			s.idle = s.maxIdle
+		}
+		return jitter(s.idle)
+	}
+	s.idle = 0
+	return jitter(s.period)
+}
+
+// jitter returns d randomly lengthened or shortened by up to pullJitter of itself
+func jitter(d time.Duration) time.Duration {
+	return time.Duration(float64(d) * (1 + pullJitter*(2*rand.Float64()-1)))
+}
@@ -0,0 +1,52 @@
+package gq
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/require"
+)
+
+func requireJittered(t *testing.T, expected time.Duration, actual time.Duration) {
+	t.Helper()
+	require.GreaterOrEqual(t, actual, time.Duration(float64(expected)*(1-pullJitter)))
+	require.LessOrEqual(t, actual, time.Duration(float64(expected)*(1+pullJitter)))
+}
+
+func TestPullScheduler(t *testing.T) {
+	s := newPullScheduler(50*time.Millisecond, 300*time.Millisecond)
+	require.Equal(t, time.Duration(0), s.next(pullFull), "full batches are pulled again immediately")
+
+	for _, expected := range []time.Duration{50, 100, 200, 300, 300} {
+		requireJittered(t, expected*time.Millisecond, s.next(pullEmpty))
+	}
+	requireJittered(t, 50*time.Millisecond, s.next(pullPartial))
+	requireJittered(t, 50*time.Millisecond, s.next(pullEmpty))
+	requireJittered(t, 50*time.Millisecond, s.next(pullThrottled))
+	require.Equal(t, time.Duration(0), s.next(pullFull))
+}
+
+func TestPullScheduler_Defaults(t *testing.T) {
+	s := newPullScheduler(0, 0)
+	require.Equal(t, defaultPullPeriod, s.period)
+	require.Equal(t, defaultMaxIdlePullPeriod, s.maxIdle)
+
+	s = newPullScheduler(5*time.Second, time.Second)
+	require.Equal(t, 5*time.Second, s.maxIdle, "the queue isn't polled more often when idle")
+}
+
+func TestPullMessages_UnsetBatchSize(t *testing.T) {
+	c, mock, now := newAdminTestClient(t)
+	// options passed explicitly aren't defaulted, so the batch size is left unset
+	consumer, err := newConsumer(context.Background(), c, func(ctx context.Context, m *Message) error { return nil }, &ConsumerOptions{PullPeriod: time.Hour})
+	require.NoError(t, err)
+	defer consumer.Close()
+	require.Equal(t, defaultMaxBatchSize, consumer.opts.MaxBatchSize)
+
+	expectPull(mock, now, sqlmock.NewRows([]string{"id", "payload", "headers", "retries", "created_at", "unique_key", "tracked"}))
+	mock.ExpectCommit()
+	require.Equal(t, pullEmpty, consumer.pullMessages(context.Background(), now), "an empty pull isn't a full batch")
+	require.NoError(t, mock.ExpectationsWereMet())
+}
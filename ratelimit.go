@@ -0,0 +1,154 @@
+package gq
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/mattbonnell/gq/internal"
+)
+
+// RateLimit limits the rate at which a Consumer claims messages
+type RateLimit struct {
+	// Rate is the number of messages per second which may be claimed. A zero rate is unlimited
+	Rate float64
+	// Burst is the largest number of messages which may be claimed at once, after the consumer has been idle (default: Rate, rounded up)
+	Burst int
+	// Cluster, if true, applies the limit to every consumer of the queue together, rather than to each one, by keeping the
+	// token bucket in the database. Every consumer of the queue should use the same limit
+	Cluster bool
+}
+
+// burst returns the capacity of the limit's token bucket
+func (l RateLimit) burst() float64 {
+	if l.Burst > 0 {
+		return float64(l.Burst)
+	}
+	return math.Max(1, math.Ceil(l.Rate))
+}
+
+// rateLimiter grants the tokens which claiming messages consumes, one per message
+type rateLimiter interface {
+	// take takes up to n tokens, returning the number taken
+	take(ctx context.Context, n int, now time.Time) (int, error)
+	// refund returns tokens which were taken but not used
+	refund(ctx context.Context, n int) error
+}
+
+// newRateLimiter returns the limiter for a consumer of queue, or nil if its rate is unlimited
+func newRateLimiter(db *sqlx.DB, d *internal.Dialect, tables internal.Tables, queue string, limit RateLimit) rateLimiter {
+	if limit.Rate <= 0 {
+		return nil
+	}
+	if limit.Cluster {
+		return &clusterLimiter{db: db, dialect: d, tables: tables, name: queue, rate: limit.Rate, burst: limit.burst()}
+	}
+	return &localLimiter{rate: limit.Rate, burst: limit.burst(), tokens: limit.burst()}
+}
+
+// refill returns the tokens in a bucket which held tokens at updatedAt, once it has been refilled at rate until now
+func refill(tokens float64, updatedAt time.Time, rate float64, burst float64, now time.Time) float64 {
+	if elapsed := now.Sub(updatedAt).Seconds(); elapsed > 0 {
+		tokens += elapsed * rate
+	}
+	return math.Min(tokens, burst)
+}
+
+// localLimiter is a token bucket shared by a consumer's goroutines
+type localLimiter struct {
+	mu        sync.Mutex
+	rate      float64
+	burst     float64
+	tokens    float64
+	updatedAt time.Time
+}
+
+func (l *localLimiter) take(_ context.Context, n int, now time.Time) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.updatedAt.IsZero() {
+		l.tokens = refill(l.tokens, l.updatedAt, l.rate, l.burst, now)
+	}
+	l.updatedAt = now
+	taken := int(math.Min(float64(n), math.Floor(l.tokens)))
+	l.tokens -= float64(taken)
+	return taken, nil
+}
+
+func (l *localLimiter) refund(_ context.Context, n int) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.tokens = math.Min(l.tokens+float64(n), l.burst)
+	return nil
+}
+
+// clusterLimiter is a token bucket in the rate limit table, shared by every consumer of a queue
+type clusterLimiter struct {
+	db      *sqlx.DB
+	dialect *internal.Dialect
+	tables  internal.Tables
+	name    string
+	rate    float64
+	burst   float64
+
+	mu      sync.Mutex
+	created bool
+}
+
+func (l *clusterLimiter) take(ctx context.Context, n int, now time.Time) (int, error) {
+	if err := l.create(ctx, now); err != nil {
+		return 0, err
+	}
+	tx, err := l.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("error beginning rate limit transaction: %s", err)
+	}
+	defer tx.Rollback()
+	bucket := struct {
+		Tokens    float64       `db:"tokens"`
+		UpdatedAt internal.Time `db:"updated_at"`
+	}{}
+	query := tx.Rebind(fmt.Sprintf("SELECT tokens, updated_at FROM %s WHERE name = ? FOR UPDATE", l.tables.RateLimit))
+	if err := tx.GetContext(ctx, &bucket, query, l.name); err != nil {
+		return 0, fmt.Errorf("error selecting rate limit: %s", err)
+	}
+	tokens := refill(bucket.Tokens, bucket.UpdatedAt.Time, l.rate, l.burst, now)
+	// a replica whose clock lags mustn't wind the bucket's clock back, and refill it twice
+	if now.Before(bucket.UpdatedAt.Time) {
+		now = bucket.UpdatedAt.Time
+	}
+	taken := int(math.Min(float64(n), math.Floor(tokens)))
+	query = tx.Rebind(fmt.Sprintf("UPDATE %s SET tokens = ?, updated_at = ? WHERE name = ?", l.tables.RateLimit))
+	if _, err := tx.ExecContext(ctx, query, tokens-float64(taken), now, l.name); err != nil {
+		return 0, fmt.Errorf("error updating rate limit: %s", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("error committing rate limit transaction: %s", err)
+	}
+	return taken, nil
+}
+
+// create creates the bucket, full, the first time the limiter is used
+func (l *clusterLimiter) create(ctx context.Context, now time.Time) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.created {
+		return nil
+	}
+	if _, err := l.db.ExecContext(ctx, l.db.Rebind(l.dialect.InsertRateLimit), l.name, l.burst, now); err != nil {
+		return fmt.Errorf("error creating rate limit: %s", err)
+	}
+	l.created = true
+	return nil
+}
+
+func (l *clusterLimiter) refund(ctx context.Context, n int) error {
+	query := l.db.Rebind(fmt.Sprintf("UPDATE %s SET tokens = tokens + ? WHERE name = ?", l.tables.RateLimit))
+	if _, err := l.db.ExecContext(ctx, query, n, l.name); err != nil {
+		return fmt.Errorf("error refunding rate limit tokens: %s", err)
+	}
+	return nil
+}
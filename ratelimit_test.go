@@ -0,0 +1,102 @@
+package gq
+
+import (
+	"context"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/mattbonnell/gq/internal"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLocalLimiter(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+	l := newRateLimiter(nil, nil, internal.DefaultTables, "emails", RateLimit{Rate: 100})
+
+	taken, err := l.take(ctx, 400, now)
+	require.NoError(t, err)
+	require.Equal(t, 100, taken, "a full bucket grants its burst")
+	taken, _ = l.take(ctx, 400, now)
+	require.Equal(t, 0, taken)
+
+	taken, _ = l.take(ctx, 400, now.Add(50*time.Millisecond))
+	require.Equal(t, 5, taken, "the bucket refills at the rate")
+	require.NoError(t, l.refund(ctx, 3))
+	taken, _ = l.take(ctx, 400, now.Add(50*time.Millisecond))
+	require.Equal(t, 3, taken)
+
+	taken, _ = l.take(ctx, 400, now.Add(time.Hour))
+	require.Equal(t, 100, taken, "the bucket holds no more than its burst")
+}
+
+func TestRateLimit_Burst(t *testing.T) {
+	require.Equal(t, float64(1), RateLimit{Rate: 0.5}.burst())
+	require.Equal(t, float64(3), RateLimit{Rate: 2.5}.burst())
+	require.Equal(t, float64(10), RateLimit{Rate: 100, Burst: 10}.burst())
+}
+
+func TestClusterLimiter(t *testing.T) {
+	c, mock, now := newAdminTestClient(t)
+	l := newRateLimiter(c.db, c.dialect, c.tables, "emails", RateLimit{Rate: 100, Cluster: true})
+	selectBucket := regexp.QuoteMeta("SELECT tokens, updated_at FROM rate_limit WHERE name = ? FOR UPDATE")
+	updateBucket := regexp.QuoteMeta("UPDATE rate_limit SET tokens = ?, updated_at = ? WHERE name = ?")
+
+	mock.ExpectExec(regexp.QuoteMeta("INSERT IGNORE INTO rate_limit (name, tokens, updated_at) VALUES (?, ?, ?)")).
+		WithArgs("emails", float64(100), now).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectBegin()
+	mock.ExpectQuery(selectBucket).WithArgs("emails").
+		WillReturnRows(sqlmock.NewRows([]string{"tokens", "updated_at"}).AddRow(2.5, now.Add(-100*time.Millisecond)))
+	mock.ExpectExec(updateBucket).WithArgs(0.5, now, "emails").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	taken, err := l.take(context.Background(), 12, now)
+	require.NoError(t, err)
+	require.Equal(t, 12, taken)
+
+	// the bucket isn't created again, and a lagging clock doesn't wind it back
+	mock.ExpectBegin()
+	mock.ExpectQuery(selectBucket).WithArgs("emails").
+		WillReturnRows(sqlmock.NewRows([]string{"tokens", "updated_at"}).AddRow(0.5, now.Add(time.Second)))
+	mock.ExpectExec(updateBucket).WithArgs(0.5, now.Add(time.Second), "emails").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	taken, err = l.take(context.Background(), 12, now)
+	require.NoError(t, err)
+	require.Equal(t, 0, taken)
+
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE rate_limit SET tokens = tokens + ? WHERE name = ?")).
+		WithArgs(4, "emails").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	require.NoError(t, l.refund(context.Background(), 4))
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestPullMessages_RateLimited(t *testing.T) {
+	c, mock, now := newAdminTestClient(t)
+	opts := idleConsumerOpts()
+	opts.RateLimit = RateLimit{Rate: 10}
+	consumer, err := newConsumer(context.Background(), c, func(ctx context.Context, m *Message) error { return nil }, opts)
+	require.NoError(t, err)
+	defer consumer.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("FROM message WHERE queue = ? AND ready_at <= ? ORDER BY priority DESC, ready_at ASC LIMIT ? FOR UPDATE SKIP LOCKED")).
+		WithArgs(DefaultQueue, now, 10).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "payload", "headers", "retries", "created_at", "unique_key", "tracked"}).
+			AddRow(1, []byte("a"), nil, 0, now, nil, false))
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM message WHERE id in (?)")).WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	require.Equal(t, pullPartial, consumer.pullMessages(context.Background(), now))
+	require.NoError(t, mock.ExpectationsWereMet())
+
+	// the 9 tokens left unused are refunded, so the next pull may claim them
+	taken, err := consumer.limiter.take(context.Background(), 400, now)
+	require.NoError(t, err)
+	require.Equal(t, 9, taken)
+
+	// with no tokens left, nothing is claimed
+	require.Equal(t, pullThrottled, consumer.pullMessages(context.Background(), now))
+	require.NoError(t, mock.ExpectationsWereMet())
+}
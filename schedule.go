@@ -0,0 +1,289 @@
+package gq
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/mattbonnell/gq/internal"
+	"github.com/mattbonnell/gq/internal/cron"
+)
+
+const (
+	defaultSchedulerPollPeriod = time.Second
+	defaultSchedulerBatchSize  = 100
+	// misfireThreshold is how late a tick may be before it counts as missed, rather than merely delayed by polling
+	misfireThreshold = time.Minute
+	// maxCatchUpTicks bounds the messages pushed for one schedule in one poll under CatchUpAll. Any further missed ticks are pushed by later polls
+	maxCatchUpTicks = 1000
+	// ScheduleHeader is the header which carries the name of the schedule a recurring message was pushed by
+	ScheduleHeader = "gq-schedule"
+	// ScheduleTickHeader is the header which carries the time, in RFC 3339 format, of the tick a recurring message was pushed for
+	ScheduleTickHeader = "gq-schedule-tick"
+)
+
+// CatchUp is the policy which decides what happens to the ticks of a schedule which were missed, because no Scheduler was running
+type CatchUp int
+
+const (
+	// CatchUpOnce pushes a single message for any number of missed ticks
+	CatchUpOnce CatchUp = iota
+	// CatchUpAll pushes a message for every missed tick
+	CatchUpAll
+	// CatchUpSkip discards missed ticks
+	CatchUpSkip
+)
+
+// Schedule is a recurring message, which is pushed onto a queue each time its spec is due
+type Schedule struct {
+	// Name identifies the schedule. Registering a schedule with the same name replaces it
+	Name string `json:"name"`
+	// Spec is a five-field cron expression such as "*/5 * * * *", a descriptor such as "@daily", or an interval such as "@every 90s".
+	// Cron expressions are evaluated in UTC
+	Spec string `json:"spec"`
+	// Queue is the name of the queue to push the message onto (default: "default")
+	Queue string `json:"queue"`
+	// Payload is the message's payload
+	Payload []byte `json:"payload"`
+	// Headers are the message's headers, to which the schedule's name and the time of the tick are added
+	Headers map[string]string `json:"headers,omitempty"`
+	// CatchUp is the policy for ticks missed while no Scheduler was running (default: CatchUpOnce)
+	CatchUp CatchUp `json:"catch_up"`
+	// NextRunAt is the time of the schedule's next tick, or the zero time if it will never be due again. It is ignored when registering a schedule
+	NextRunAt time.Time `json:"next_run_at"`
+	// LastRunAt is the time the schedule last pushed a message. It is ignored when registering a schedule
+	LastRunAt time.Time `json:"last_run_at"`
+}
+
+// scheduleRow is a schedule as selected from the database
+type scheduleRow struct {
+	Name      string           `db:"name"`
+	Spec      string           `db:"spec"`
+	Queue     string           `db:"queue"`
+	Payload   []byte           `db:"payload"`
+	Headers   internal.Headers `db:"headers"`
+	CatchUp   CatchUp          `db:"catch_up"`
+	NextRunAt sql.NullTime     `db:"next_run_at"`
+	LastRunAt sql.NullTime     `db:"last_run_at"`
+}
+
+// Schedule registers a recurring message, replacing any schedule with the same name. Messages are pushed by the Schedulers started
+// with NewScheduler, of which exactly one pushes each tick however many are running. Re-registering a schedule with an unchanged
+// spec, as every replica of a service may do when it starts, keeps its next tick
+func (c *Client) Schedule(ctx context.Context, s Schedule) error {
+	if s.Name == "" {
+		return errors.New("a schedule name is required")
+	}
+	spec, err := cron.Parse(s.Spec)
+	if err != nil {
+		return err
+	}
+	if s.Payload == nil {
+		s.Payload = []byte{}
+	}
+	next := spec.Next(c.now())
+	if _, err := c.db.ExecContext(ctx, c.db.Rebind(c.dialect.UpsertSchedule), s.Name, s.Spec, queueOrDefault(s.Queue), s.Payload, internal.Headers(s.Headers), s.CatchUp, nullTime(next)); err != nil {
+		return fmt.Errorf("error registering schedule '%s': %s", s.Name, err)
+	}
+	return nil
+}
+
+// Unschedule deletes a schedule, or returns ErrNotFound if there is none with that name. Messages it has already pushed are kept
+func (c *Client) Unschedule(ctx context.Context, name string) error {
+	n, err := c.exec(ctx, fmt.Sprintf("DELETE FROM %s WHERE name = ?", c.tables.Schedule), name)
+	if err != nil {
+		return fmt.Errorf("error deleting schedule '%s': %s", name, err)
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Schedules returns every registered schedule, ordered by name
+func (c *Client) Schedules(ctx context.Context) ([]Schedule, error) {
+	rows := []scheduleRow{}
+	query := fmt.Sprintf("SELECT name, spec, queue, payload, headers, catch_up, next_run_at, last_run_at FROM %s ORDER BY name", c.tables.Schedule)
+	if err := c.db.SelectContext(ctx, &rows, query); err != nil {
+		return nil, fmt.Errorf("error selecting schedules: %s", err)
+	}
+	schedules := make([]Schedule, len(rows))
+	for i, r := range rows {
+		schedules[i] = Schedule{Name: r.Name, Spec: r.Spec, Queue: r.Queue, Payload: r.Payload, Headers: r.Headers, CatchUp: r.CatchUp, NextRunAt: r.NextRunAt.Time, LastRunAt: r.LastRunAt.Time}
+	}
+	return schedules, nil
+}
+
+// SchedulerOptions represents the options which can be used to tailor scheduler behaviour
+type SchedulerOptions struct {
+	// PollPeriod is the period due schedules are polled at (default: 1s). Ticks are pushed up to this late
+	PollPeriod time.Duration
+	// MaxBatchSize is the maximum number of due schedules to be claimed in one poll (default: 100)
+	MaxBatchSize int
+}
+
+// Scheduler pushes the messages of due schedules. Any number of Schedulers may run, in any number of processes: each claims due
+// schedules with a row lock, and pushes their messages and advances them in the same transaction, so every tick is pushed exactly once
+type Scheduler struct {
+	db      *sqlx.DB
+	tables  internal.Tables
+	now     func() time.Time
+	log     Logger
+	metrics Metrics
+	opts    SchedulerOptions
+
+	stop      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+// NewScheduler creates a Scheduler, which begins pushing the messages of due schedules immediately
+func (c *Client) NewScheduler(ctx context.Context, opts SchedulerOptions) (*Scheduler, error) {
+	if opts.PollPeriod <= 0 {
+		opts.PollPeriod = defaultSchedulerPollPeriod
+	}
+	if opts.MaxBatchSize <= 0 {
+		opts.MaxBatchSize = defaultSchedulerBatchSize
+	}
+	s := &Scheduler{db: c.db, tables: c.tables, now: c.now, log: c.opts.Logger, metrics: c.opts.Metrics, opts: opts, stop: make(chan struct{})}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil, ErrClientClosed
+	}
+	c.schedulers = append(c.schedulers, s)
+	s.wg.Add(1)
+	go s.startPolling(ctx)
+	return s, nil
+}
+
+// Close stops the scheduler, waiting for any poll in progress to complete
+func (s *Scheduler) Close() {
+	s.closeOnce.Do(func() {
+		close(s.stop)
+		s.wg.Wait()
+	})
+}
+
+func (s *Scheduler) startPolling(ctx context.Context) {
+	defer s.wg.Done()
+	ticker := time.NewTicker(s.opts.PollPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			s.log.Debug("stopping schedule polling", "reason", ctx.Err())
+			return
+		case <-s.stop:
+			s.log.Debug("scheduler closed, stopping schedule polling")
+			return
+		case <-ticker.C:
+			if err := s.poll(ctx, s.now()); err != nil {
+				s.log.Error("error polling schedules", "error", err)
+			}
+		}
+	}
+}
+
+// poll claims the schedules which are due, pushes a message for each of their due ticks according to their catch-up policy,
+// and advances them to their next tick
+func (s *Scheduler) poll(ctx context.Context, now time.Time) error {
+	start := time.Now()
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error beginning schedule transaction: %s", err)
+	}
+	defer tx.Rollback()
+	due := []scheduleRow{}
+	query := tx.Rebind(fmt.Sprintf("SELECT name, spec, queue, payload, headers, catch_up, next_run_at, last_run_at FROM %s WHERE next_run_at <= ? ORDER BY next_run_at ASC LIMIT ? FOR UPDATE SKIP LOCKED", s.tables.Schedule))
+	if err := tx.SelectContext(ctx, &due, query, now, s.opts.MaxBatchSize); err != nil {
+		return fmt.Errorf("error selecting due schedules: %s", err)
+	}
+	if len(due) == 0 {
+		return nil
+	}
+	pushed := map[string]int{}
+	for _, r := range due {
+		spec, err := cron.Parse(r.Spec)
+		if err != nil {
+			// only valid specs are registered, so this schedule was written by a newer version of gq
+			s.log.Error("skipping schedule with invalid spec", "schedule", r.Name, "error", err)
+			continue
+		}
+		ticks, next := dueTicks(spec, r.NextRunAt.Time, now, r.CatchUp)
+		insert := tx.Rebind(fmt.Sprintf("INSERT INTO %s (queue, payload, headers, created_at, ready_at) VALUES (?, ?, ?, ?, ?)", s.tables.Message))
+		for _, tick := range ticks {
+			headers := internal.Headers{}
+			for k, v := range r.Headers {
+				headers[k] = v
+			}
+			headers[ScheduleHeader] = r.Name
+			headers[ScheduleTickHeader] = tick.Format(time.RFC3339)
+			if _, err := tx.ExecContext(ctx, insert, r.Queue, r.Payload, headers, now, now); err != nil {
+				return fmt.Errorf("error pushing message for schedule '%s': %s", r.Name, err)
+			}
+		}
+		lastRunAt := r.LastRunAt
+		if len(ticks) > 0 {
+			lastRunAt = sql.NullTime{Time: now, Valid: true}
+		}
+		update := tx.Rebind(fmt.Sprintf("UPDATE %s SET next_run_at = ?, last_run_at = ? WHERE name = ?", s.tables.Schedule))
+		if _, err := tx.ExecContext(ctx, update, nullTime(next), lastRunAt, r.Name); err != nil {
+			return fmt.Errorf("error advancing schedule '%s': %s", r.Name, err)
+		}
+		pushed[r.Queue] += len(ticks)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing schedule transaction: %s", err)
+	}
+	duration := time.Since(start)
+	for queue, n := range pushed {
+		if n > 0 {
+			s.metrics.MessagesPushed(queue, n, OutcomeSuccess, duration)
+		}
+	}
+	return nil
+}
+
+// dueTicks returns the ticks of a schedule due by now, starting from first, which should be pushed under the catch-up policy,
+// and the time of the tick after the last one considered
+func dueTicks(spec cron.Schedule, first time.Time, now time.Time, catchUp CatchUp) ([]time.Time, time.Time) {
+	if first.IsZero() || first.After(now) {
+		return nil, first
+	}
+	var ticks []time.Time
+	last := first
+	if every, ok := spec.(cron.Every); ok && catchUp != CatchUpAll {
+		// skip straight to the last due tick, rather than stepping through every tick missed at a short interval
+		last = first.Add(now.Sub(first) / time.Duration(every) * time.Duration(every))
+	} else {
+		for t := first; !t.IsZero() && !t.After(now); t = spec.Next(t) {
+			if catchUp == CatchUpAll {
+				if len(ticks) == maxCatchUpTicks {
+					return ticks, t
+				}
+				ticks = append(ticks, t)
+			}
+			last = t
+		}
+	}
+	next := spec.Next(last)
+	switch catchUp {
+	case CatchUpAll:
+		return ticks, next
+	case CatchUpSkip:
+		if now.Sub(last) > misfireThreshold {
+			return nil, next
+		}
+	}
+	return []time.Time{last}, next
+}
+
+// nullTime maps the zero time to NULL
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t, Valid: !t.IsZero()}
+}
@@ -0,0 +1,100 @@
+package gq
+
+import (
+	"context"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/mattbonnell/gq/internal/cron"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDueTicks(t *testing.T) {
+	minutely, err := cron.Parse("* * * * *")
+	require.NoError(t, err)
+	first := time.Date(2021, 3, 4, 5, 0, 0, 0, time.UTC)
+	at := func(minute int) time.Time { return first.Add(time.Duration(minute) * time.Minute) }
+	for _, tc := range []struct {
+		name    string
+		spec    cron.Schedule
+		now     time.Time
+		catchUp CatchUp
+		ticks   []time.Time
+		next    time.Time
+	}{
+		{"not due", minutely, first.Add(-time.Second), CatchUpOnce, nil, first},
+		{"on time", minutely, first.Add(time.Second), CatchUpOnce, []time.Time{first}, at(1)},
+		{"once", minutely, at(3).Add(time.Second), CatchUpOnce, []time.Time{at(3)}, at(4)},
+		{"all", minutely, at(3).Add(time.Second), CatchUpAll, []time.Time{at(0), at(1), at(2), at(3)}, at(4)},
+		{"skip recent", minutely, at(3).Add(time.Second), CatchUpSkip, []time.Time{at(3)}, at(4)},
+		{"skip missed", cron.Every(time.Hour), first.Add(90 * time.Minute), CatchUpSkip, nil, first.Add(2 * time.Hour)},
+		{"every once", cron.Every(time.Minute), at(10000).Add(time.Second), CatchUpOnce, []time.Time{at(10000)}, at(10001)},
+		{"all bounded", cron.Every(time.Second), first.Add(time.Hour), CatchUpAll, nil, first.Add(maxCatchUpTicks * time.Second)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ticks, next := dueTicks(tc.spec, first, tc.now, tc.catchUp)
+			if tc.name == "all bounded" {
+				require.Len(t, ticks, maxCatchUpTicks)
+			} else {
+				require.Equal(t, tc.ticks, ticks)
+			}
+			require.Equal(t, tc.next, next)
+		})
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	c, mock, _ := newAdminTestClient(t)
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO schedule (name, spec, queue, payload, headers, catch_up, next_run_at) VALUES (?, ?, ?, ?, ?, ?, ?) ON DUPLICATE KEY UPDATE")).
+		WithArgs("report", "@hourly", "reports", []byte("go"), nil, CatchUpAll, time.Date(2021, 3, 4, 6, 0, 0, 0, time.UTC)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	require.NoError(t, c.Schedule(context.Background(), Schedule{Name: "report", Spec: "@hourly", Queue: "reports", Payload: []byte("go"), CatchUp: CatchUpAll}))
+	require.Error(t, c.Schedule(context.Background(), Schedule{Name: "report", Spec: "every hour"}))
+	require.Error(t, c.Schedule(context.Background(), Schedule{Spec: "@hourly"}))
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestSchedulerPoll(t *testing.T) {
+	c, mock, now := newAdminTestClient(t)
+	s := &Scheduler{db: c.db, tables: c.tables, now: c.now, log: c.opts.Logger, metrics: c.opts.Metrics, opts: SchedulerOptions{MaxBatchSize: 10}}
+	due := now.Truncate(time.Minute)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT name, spec, queue, payload, headers, catch_up, next_run_at, last_run_at FROM schedule WHERE next_run_at <= ? ORDER BY next_run_at ASC LIMIT ? FOR UPDATE SKIP LOCKED")).
+		WithArgs(now, 10).
+		WillReturnRows(sqlmock.NewRows([]string{"name", "spec", "queue", "payload", "headers", "catch_up", "next_run_at", "last_run_at"}).
+			AddRow("report", "*/5 * * * *", "reports", []byte("go"), `{"k":"v"}`, CatchUpOnce, due, nil))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO message (queue, payload, headers, created_at, ready_at) VALUES (?, ?, ?, ?, ?)")).
+		WithArgs("reports", []byte("go"), `{"gq-schedule":"report","gq-schedule-tick":"2021-03-04T05:06:00Z","k":"v"}`, now, now).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE schedule SET next_run_at = ?, last_run_at = ? WHERE name = ?")).
+		WithArgs(time.Date(2021, 3, 4, 5, 10, 0, 0, time.UTC), now, "report").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	require.NoError(t, s.poll(context.Background(), now))
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("FROM schedule").
+		WillReturnRows(sqlmock.NewRows([]string{"name", "spec", "queue", "payload", "headers", "catch_up", "next_run_at", "last_run_at"}))
+	mock.ExpectRollback()
+	require.NoError(t, s.poll(context.Background(), now))
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestUnscheduleAndSchedules(t *testing.T) {
+	c, mock, now := newAdminTestClient(t)
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT name, spec, queue, payload, headers, catch_up, next_run_at, last_run_at FROM schedule ORDER BY name")).
+		WillReturnRows(sqlmock.NewRows([]string{"name", "spec", "queue", "payload", "headers", "catch_up", "next_run_at", "last_run_at"}).
+			AddRow("report", "@hourly", "reports", []byte("go"), nil, CatchUpSkip, now, nil))
+	schedules, err := c.Schedules(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, []Schedule{{Name: "report", Spec: "@hourly", Queue: "reports", Payload: []byte("go"), CatchUp: CatchUpSkip, NextRunAt: now}}, schedules)
+
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM schedule WHERE name = ?")).WithArgs("report").WillReturnResult(sqlmock.NewResult(0, 1))
+	require.NoError(t, c.Unschedule(context.Background(), "report"))
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM schedule WHERE name = ?")).WithArgs("report").WillReturnResult(sqlmock.NewResult(0, 0))
+	require.ErrorIs(t, c.Unschedule(context.Background(), "report"), ErrNotFound)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,296 @@
+package gq
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// spoolSegmentSize is the size beyond which the spool starts a new segment file, so that replayed segments can be deleted
+	spoolSegmentSize  = 64 << 20
+	spoolReplayPeriod = time.Second
+	spoolSuffix       = ".spool"
+	// spoolHeaderSize is the size of each record's header: its length and checksum
+	spoolHeaderSize = 8
+	// spoolMaxRecordSize is the largest record which is written, so that a corrupt length isn't trusted to allocate its record
+	spoolMaxRecordSize = spoolSegmentSize
+)
+
+// SpoolSync decides when a producer's spool is flushed to disk
+type SpoolSync int
+
+const (
+	// SpoolSyncAlways flushes the spool to disk after every batch is appended, so that spooled messages survive the machine crashing
+	SpoolSyncAlways SpoolSync = iota
+	// SpoolSyncNever leaves flushing the spool to the operating system, so that spooled messages survive the process crashing,
+	// but may be lost if the machine does
+	SpoolSyncNever
+)
+
+// spooledMessage is a message as it is recorded in the spool
+type spooledMessage struct {
+	Payload []byte            `json:"payload"`
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// errCorruptRecord is returned when reading a record which was only partly written, such as by a crash
+var errCorruptRecord = errors.New("corrupt spool record")
+
+// spool is a write-ahead log of batches of messages which could not be pushed, to be replayed in order once they can.
+// It is a directory of segment files, named by their sequence number, each holding a series of records: a batch encoded as JSON,
+// preceded by its length and CRC-32 checksum, so that a record torn by a crash is detected and skipped
+type spool struct {
+	dir  string
+	sync SpoolSync
+	log  Logger
+
+	mu sync.Mutex
+	// segments holds the sequence numbers of the segment files, oldest first
+	segments []uint64
+	// w is the newest segment, open for appending, or nil if the next append starts a new one
+	w     *os.File
+	wSize int64
+	// offset is the position in the oldest segment of the next record to replay
+	offset int64
+}
+
+// openSpool opens the spool in dir, creating dir if it doesn't exist. Segments left by a previous process are replayed before
+// any appended since, but are not appended to, in case their last record is torn
+func openSpool(dir string, sync SpoolSync, log Logger) (*spool, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("error creating spool directory: %s", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("error reading spool directory: %s", err)
+	}
+	s := &spool{dir: dir, sync: sync, log: log}
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), spoolSuffix) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(e.Name(), spoolSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		s.segments = append(s.segments, seq)
+	}
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i] < s.segments[j] })
+	return s, nil
+}
+
+func (s *spool) path(seq uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", seq, spoolSuffix))
+}
+
+// empty reports whether every spooled batch has been replayed
+func (s *spool) empty() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.segments) == 0
+}
+
+// append records a batch of messages at the end of the spool
+func (s *spool) append(messages []outgoingMessage) error {
+	batch := make([]spooledMessage, len(messages))
+	for i := range messages {
+		batch[i] = spooledMessage{Payload: messages[i].payload, Headers: messages[i].headers}
+	}
+	data, err := json.Marshal(batch)
+	if err != nil {
+		return fmt.Errorf("error encoding spooled messages: %s", err)
+	}
+	if len(data) > spoolMaxRecordSize {
+		if len(messages) == 1 {
+			return fmt.Errorf("message of %d bytes is too large to spool", len(messages[0].payload))
+		}
+		// halves are appended in order, so they are replayed as the batch would have been
+		if err := s.append(messages[:len(messages)/2]); err != nil {
+			return err
+		}
+		return s.append(messages[len(messages)/2:])
+	}
+	record := make([]byte, spoolHeaderSize+len(data))
+	binary.BigEndian.PutUint32(record, uint32(len(data)))
+	binary.BigEndian.PutUint32(record[4:], crc32.ChecksumIEEE(data))
+	copy(record[spoolHeaderSize:], data)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.w == nil || s.wSize >= spoolSegmentSize {
+		if err := s.roll(); err != nil {
+			return err
+		}
+	}
+	if _, err := s.w.Write(record); err != nil {
+		// the segment may end in a partial record now, so later records go in a new one
+		s.closeWriter()
+		return fmt.Errorf("error writing to spool: %s", err)
+	}
+	s.wSize += int64(len(record))
+	if s.sync == SpoolSyncAlways {
+		if err := s.w.Sync(); err != nil {
+			s.closeWriter()
+			return fmt.Errorf("error syncing spool: %s", err)
+		}
+	}
+	return nil
+}
+
+// roll starts a new segment to append to
+func (s *spool) roll() error {
+	s.closeWriter()
+	seq := uint64(1)
+	if len(s.segments) > 0 {
+		seq = s.segments[len(s.segments)-1] + 1
+	}
+	f, err := os.OpenFile(s.path(seq), os.O_CREATE|os.O_EXCL|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("error creating spool segment: %s", err)
+	}
+	if s.sync == SpoolSyncAlways {
+		// sync the directory too, so that the new segment's entry survives a crash
+		if err := syncDir(s.dir); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	s.segments = append(s.segments, seq)
+	s.w, s.wSize = f, 0
+	return nil
+}
+
+func (s *spool) closeWriter() {
+	if s.w != nil {
+		s.w.Close()
+		s.w = nil
+	}
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("error opening spool directory: %s", err)
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("error syncing spool directory: %s", err)
+	}
+	return nil
+}
+
+// replay passes each spooled batch to push in the order they were appended, deleting each segment once every batch in it has
+// been pushed. It stops at the first batch push fails to push, to retry it at the next replay, and returns the number of
+// messages pushed. A batch is pushed again if the process crashes before its segment is deleted. The spool isn't locked while
+// batches are pushed, so that batches can still be appended while the database is slow
+func (s *spool) replay(push func(messages []outgoingMessage) error) (int, error) {
+	replayed := 0
+	for {
+		messages, next, err := s.next()
+		if err != nil || messages == nil {
+			return replayed, err
+		}
+		if err := push(messages); err != nil {
+			return replayed, err
+		}
+		s.advance(next)
+		replayed += len(messages)
+	}
+}
+
+// next returns the next batch to replay, with the offset of the record after it, deleting segments which have been replayed.
+// It returns no batch once the spool is empty
+func (s *spool) next() ([]outgoingMessage, int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.segments) > 0 {
+		seq := s.segments[0]
+		messages, size, err := s.read(seq, s.offset)
+		if err == nil {
+			return messages, s.offset + size, nil
+		}
+		if err == errCorruptRecord {
+			// a torn record is left only by a crash or a failed append, neither of which reported the batch as spooled, and
+			// nothing is appended after one, so the rest of the segment is skipped
+			s.log.Warn("skipping the rest of a spool segment after a corrupt record", "segment", s.path(seq), "offset", s.offset)
+		} else if err != io.EOF {
+			return nil, 0, err
+		}
+		if len(s.segments) == 1 {
+			s.closeWriter()
+		}
+		if err := os.Remove(s.path(seq)); err != nil {
+			return nil, 0, fmt.Errorf("error removing replayed spool segment: %s", err)
+		}
+		s.segments = s.segments[1:]
+		s.offset = 0
+	}
+	return nil, 0, nil
+}
+
+// advance moves the replay past a batch which has been pushed
+func (s *spool) advance(offset int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.offset = offset
+}
+
+// read reads the record at offset in segment seq
+func (s *spool) read(seq uint64, offset int64) ([]outgoingMessage, int64, error) {
+	f, err := os.Open(s.path(seq))
+	if err != nil {
+		return nil, 0, fmt.Errorf("error opening spool segment: %s", err)
+	}
+	defer f.Close()
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return nil, 0, fmt.Errorf("error seeking spool segment: %s", err)
+	}
+	return readSpoolRecord(bufio.NewReader(f))
+}
+
+// readSpoolRecord reads the next batch from r, returning it with the size of its record
+func readSpoolRecord(r io.Reader) ([]outgoingMessage, int64, error) {
+	header := make([]byte, spoolHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if err == io.EOF {
+			return nil, 0, io.EOF
+		}
+		return nil, 0, errCorruptRecord
+	}
+	size := binary.BigEndian.Uint32(header)
+	if size > spoolMaxRecordSize {
+		return nil, 0, errCorruptRecord
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil || crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(header[4:]) {
+		return nil, 0, errCorruptRecord
+	}
+	batch := []spooledMessage{}
+	if err := json.Unmarshal(data, &batch); err != nil {
+		return nil, 0, errCorruptRecord
+	}
+	messages := make([]outgoingMessage, len(batch))
+	for i := range batch {
+		messages[i] = outgoingMessage{payload: batch[i].Payload, headers: batch[i].Headers}
+	}
+	return messages, int64(spoolHeaderSize + len(data)), nil
+}
+
+// close closes the segment being appended to
+func (s *spool) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closeWriter()
+}
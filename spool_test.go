@@ -0,0 +1,155 @@
+package gq
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/require"
+)
+
+func spoolBatch(payloads ...string) []outgoingMessage {
+	messages := make([]outgoingMessage, len(payloads))
+	for i, p := range payloads {
+		messages[i] = outgoingMessage{payload: []byte(p), headers: map[string]string{"n": p}}
+	}
+	return messages
+}
+
+// replayed collects the payloads of the batches replayed from s, failing once failAfter batches have been pushed if it's positive
+func replayed(t *testing.T, s *spool, failAfter int) ([]string, error) {
+	payloads := []string{}
+	batches := 0
+	n, err := s.replay(func(messages []outgoingMessage) error {
+		if failAfter > 0 && batches == failAfter {
+			return errors.New("database unavailable")
+		}
+		batches++
+		for _, m := range messages {
+			if m.headers != nil {
+				require.Equal(t, string(m.payload), m.headers["n"])
+			}
+			payloads = append(payloads, string(m.payload))
+		}
+		return nil
+	})
+	require.Equal(t, len(payloads), n)
+	return payloads, err
+}
+
+func TestSpool(t *testing.T) {
+	s, err := openSpool(t.TempDir(), SpoolSyncAlways, nopLogger{})
+	require.NoError(t, err)
+	require.True(t, s.empty())
+
+	require.NoError(t, s.append(spoolBatch("a", "b")))
+	require.NoError(t, s.append(spoolBatch("c")))
+	require.NoError(t, s.append(spoolBatch("d")))
+	require.False(t, s.empty())
+
+	payloads, err := replayed(t, s, 2)
+	require.Error(t, err)
+	require.Equal(t, []string{"a", "b", "c"}, payloads)
+
+	// the batch which failed is retried, and those pushed aren't pushed again
+	require.NoError(t, s.append(spoolBatch("e")))
+	payloads, err = replayed(t, s, 0)
+	require.NoError(t, err)
+	require.Equal(t, []string{"d", "e"}, payloads)
+	require.True(t, s.empty())
+
+	// appending after the spool is emptied starts a new segment
+	require.NoError(t, s.append(spoolBatch("f")))
+	payloads, err = replayed(t, s, 0)
+	require.NoError(t, err)
+	require.Equal(t, []string{"f"}, payloads)
+	s.close()
+}
+
+func TestSpool_Recover(t *testing.T) {
+	dir := t.TempDir()
+	s, err := openSpool(dir, SpoolSyncNever, nopLogger{})
+	require.NoError(t, err)
+	require.NoError(t, s.append(spoolBatch("a")))
+	require.NoError(t, s.append(spoolBatch("b")))
+	s.close()
+
+	// simulate a crash part way through appending a record
+	f, err := os.OpenFile(s.path(1), os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{0, 0, 0, 40, 1, 2})
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	s, err = openSpool(dir, SpoolSyncNever, nopLogger{})
+	require.NoError(t, err)
+	require.False(t, s.empty())
+	require.NoError(t, s.append(spoolBatch("c")))
+	payloads, err := replayed(t, s, 0)
+	require.NoError(t, err)
+	require.Equal(t, []string{"a", "b", "c"}, payloads)
+	require.True(t, s.empty())
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+	s.close()
+}
+
+func TestProducer_Spool(t *testing.T) {
+	dir := t.TempDir()
+	insert := regexp.QuoteMeta(`INSERT INTO message (queue, payload, headers, created_at, ready_at) VALUES (?, ?, ?, ?, ?)`)
+	opts := ProducerOptions{PushPeriod: time.Hour, MaxRetryPeriods: 0, Concurrency: 1, SpoolDir: dir}
+
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	mock.ExpectExec(insert).WillReturnError(errors.New("database unavailable"))
+	p, err := newProducer(context.Background(), newTestClient(db), &opts)
+	require.NoError(t, err)
+	require.NoError(t, p.Push([]byte("order")))
+	require.NoError(t, p.Close(), "the batch which failed to be pushed is spooled")
+	require.NoError(t, mock.ExpectationsWereMet())
+
+	// a producer created with the same directory pushes the spooled messages
+	db, mock, err = sqlmock.New()
+	require.NoError(t, err)
+	mock.ExpectExec(insert).
+		WithArgs(DefaultQueue, []byte("order"), nil, sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	p, err = newProducer(context.Background(), newTestClient(db), &opts)
+	require.NoError(t, err)
+	require.Eventually(t, p.spool.empty, time.Second, time.Millisecond)
+	require.NoError(t, p.Close())
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestReadSpoolRecord_CorruptLength(t *testing.T) {
+	header := []byte{0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0}
+	_, _, err := readSpoolRecord(bytes.NewReader(header))
+	require.Equal(t, errCorruptRecord, err, "a length beyond the largest record isn't allocated")
+}
+
+func TestProducer_SpoolOnContextDone(t *testing.T) {
+	dir := t.TempDir()
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	p, err := newProducer(ctx, newTestClient(db), &ProducerOptions{PushPeriod: time.Hour, MaxRetryPeriods: 1, Concurrency: 1, SpoolDir: dir})
+	require.NoError(t, err)
+	require.NoError(t, p.Push([]byte("order")))
+	cancel()
+	require.Eventually(t, func() bool { return p.Push([]byte("late")) == ErrProducerClosed }, time.Second, time.Millisecond)
+	require.NoError(t, p.Close())
+	require.NoError(t, mock.ExpectationsWereMet())
+
+	s, err := openSpool(dir, SpoolSyncAlways, nopLogger{})
+	require.NoError(t, err)
+	payloads, err := replayed(t, s, 0)
+	require.NoError(t, err)
+	require.Equal(t, []string{"order"}, payloads, "the buffered message is spooled rather than discarded")
+	s.close()
+}
@@ -0,0 +1,254 @@
+package gq
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/mattbonnell/gq/internal"
+)
+
+const (
+	waitInitialPollPeriod = 10 * time.Millisecond
+	waitMaxPollPeriod     = time.Second
+)
+
+// JobState is the state of a tracked message
+type JobState int
+
+const (
+	// JobQueued is the state of a message waiting to be processed, including one waiting to be retried
+	JobQueued JobState = iota
+	// JobRunning is the state of a message being processed
+	JobRunning
+	// JobSucceeded is the state of a message which has been processed successfully
+	JobSucceeded
+	// JobFailed is the state of a message which exhausted its retries and was moved to the dead-letter table
+	JobFailed
+	// JobCancelled is the state of a message which was cancelled with Client.Cancel before it was processed
+	JobCancelled
+)
+
+func (s JobState) String() string {
+	switch s {
+	case JobQueued:
+		return "queued"
+	case JobRunning:
+		return "running"
+	case JobSucceeded:
+		return "succeeded"
+	case JobFailed:
+		return "failed"
+	case JobCancelled:
+		return "cancelled"
+	}
+	return fmt.Sprintf("JobState(%d)", int(s))
+}
+
+// Done is whether the state is terminal
+func (s JobState) Done() bool {
+	return s == JobSucceeded || s == JobFailed || s == JobCancelled
+}
+
+// JobStatus is the status of a message pushed with Producer.PushTracked
+type JobStatus struct {
+	// ID is the message's ID
+	ID int64 `json:"id"`
+	// Queue is the name of the queue the message was pushed onto
+	Queue string `json:"queue"`
+	// State is the message's state
+	State JobState `json:"state"`
+	// Attempts is the number of times processing the message has been attempted
+	Attempts int `json:"attempts"`
+	// LastError is the error from the last failed attempt, if any
+	LastError string `json:"last_error,omitempty"`
+	// Result is the result the message's handler set with Message.SetResult, or its lease was acked with
+	Result []byte `json:"result,omitempty"`
+	// CreatedAt is the time the message was pushed
+	CreatedAt time.Time `json:"created_at"`
+	// StartedAt is the time the last attempt began, or the zero time if there has been none
+	StartedAt time.Time `json:"started_at"`
+	// FinishedAt is the time the message succeeded or failed, or the zero time if it hasn't yet
+	FinishedAt time.Time `json:"finished_at"`
+}
+
+// jobStatusRow is a status as selected from the database
+type jobStatusRow struct {
+	ID         int64          `db:"id"`
+	Queue      string         `db:"queue"`
+	State      JobState       `db:"state"`
+	Attempts   int            `db:"attempts"`
+	LastError  sql.NullString `db:"last_error"`
+	Result     []byte         `db:"result"`
+	CreatedAt  internal.Time  `db:"created_at"`
+	StartedAt  internal.Time  `db:"started_at"`
+	FinishedAt internal.Time  `db:"finished_at"`
+}
+
+// PushTracked pushes a message with the supplied headers onto the queue immediately, rather than in the producer's next batch,
+// returning its ID. The message's status is recorded as it is processed, and can be read with Client.Status or awaited with
+// Client.Wait until it is purged with Client.PurgeStatuses
+func (p *Producer) PushTracked(ctx context.Context, message []byte, headers map[string]string) (int64, error) {
+	if p.opts.Topic != "" {
+		return 0, errors.New("tracked messages can't be published to a topic")
+	}
+	var id int64
+	_, err := p.pushNow(ctx, headers, func(h internal.Headers) (bool, error) {
+		var err error
+		id, err = pushTracked(ctx, p.db, p.dialect, p.tables, p.opts.Queue, message, h, sql.NullTime{}, p.now())
+		return err == nil, err
+	})
+	return id, err
+}
+
+// pushTracked inserts a message and its status, which may be deleted once it expires if it is never claimed by a caller
+func pushTracked(ctx context.Context, db *sqlx.DB, d *internal.Dialect, tables internal.Tables, queue string, message []byte, headers internal.Headers, expiresAt sql.NullTime, now time.Time) (int64, error) {
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("error beginning tracked push transaction: %s", err)
+	}
+	defer tx.Rollback()
+	id, err := insertTracked(ctx, tx, d, tables, queue, message, headers, expiresAt, sql.NullString{}, now)
+	if err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("error committing tracked push transaction: %s", err)
+	}
+	return id, nil
+}
+
+// insertTracked inserts a message and its status in tx, as a task of the given workflow, if any
+func insertTracked(ctx context.Context, tx *sqlx.Tx, d *internal.Dialect, tables internal.Tables, queue string, message []byte, headers internal.Headers, expiresAt sql.NullTime, workflowID sql.NullString, now time.Time) (int64, error) {
+	id, err := insertMessage(ctx, tx, d, tables, queue, message, headers, sql.NullString{}, true, now)
+	if err != nil {
+		return 0, err
+	}
+	query := tx.Rebind(fmt.Sprintf("INSERT INTO %s (id, queue, state, attempts, created_at, expires_at, workflow_id) VALUES (?, ?, ?, 0, ?, ?, ?)", tables.JobStatus))
+	if _, err := tx.ExecContext(ctx, query, id, queue, JobQueued, now, expiresAt, workflowID); err != nil {
+		return 0, fmt.Errorf("error inserting job status: %s", err)
+	}
+	return id, nil
+}
+
+// Status returns the status of a message pushed with Producer.PushTracked, or ErrNotFound if there is no status for id
+func (c *Client) Status(ctx context.Context, id int64) (*JobStatus, error) {
+	r := jobStatusRow{}
+	query := c.db.Rebind(fmt.Sprintf("SELECT id, queue, state, attempts, last_error, result, created_at, started_at, finished_at FROM %s WHERE id = ?", c.tables.JobStatus))
+	err := c.db.GetContext(ctx, &r, query, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error selecting job status: %s", err)
+	}
+	return &JobStatus{
+		ID:         r.ID,
+		Queue:      r.Queue,
+		State:      r.State,
+		Attempts:   r.Attempts,
+		LastError:  r.LastError.String,
+		Result:     r.Result,
+		CreatedAt:  r.CreatedAt.Time,
+		StartedAt:  r.StartedAt.Time,
+		FinishedAt: r.FinishedAt.Time,
+	}, nil
+}
+
+// Wait blocks until a message pushed with Producer.PushTracked has succeeded or failed, returning its final status.
+// It polls the message's status, backing off from 10ms to 1s between polls, until then or until ctx is done
+func (c *Client) Wait(ctx context.Context, id int64) (*JobStatus, error) {
+	period := waitInitialPollPeriod
+	for {
+		status, err := c.Status(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if status.State.Done() {
+			return status, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(period):
+		}
+		if period *= 2; period > waitMaxPollPeriod {
+			period = waitMaxPollPeriod
+		}
+	}
+}
+
+// PurgeStatuses deletes the statuses of the tracked messages which finished before the given time, returning the number deleted
+func (c *Client) PurgeStatuses(ctx context.Context, before time.Time) (int64, error) {
+	return c.exec(ctx, fmt.Sprintf("DELETE FROM %s WHERE finished_at < ?", c.tables.JobStatus), before.UTC())
+}
+
+// startJob records that attempts to process tracked messages have begun
+func startJob(ctx context.Context, ex sqlx.ExtContext, tables internal.Tables, ids []int64, now time.Time) error {
+	query, args, err := sqlx.In(fmt.Sprintf("UPDATE %s SET state = ?, attempts = attempts + 1, started_at = ? WHERE id IN (?)", tables.JobStatus), JobRunning, now, ids)
+	if err != nil {
+		return fmt.Errorf("error formulating job status query: %s", err)
+	}
+	if _, err := ex.ExecContext(ctx, ex.Rebind(query), args...); err != nil {
+		return fmt.Errorf("error recording job start: %s", err)
+	}
+	return nil
+}
+
+// finishJob records the outcome of an attempt to process a tracked message, adding it to the finished tasks of its workflow
+// if it succeeded or failed
+func finishJob(ctx context.Context, tx *sqlx.Tx, tables internal.Tables, u *workflowUpdates, id int64, outcome Outcome, processErr error, result []byte, now time.Time) error {
+	state := JobSucceeded
+	var finishedAt sql.NullTime
+	var lastError sql.NullString
+	switch outcome {
+	case OutcomeRetried:
+		state = JobQueued
+	case OutcomeDeadLettered:
+		state = JobFailed
+	}
+	if state.Done() {
+		finishedAt = sql.NullTime{Time: now, Valid: true}
+	}
+	if processErr != nil {
+		lastError = sql.NullString{String: processErr.Error(), Valid: true}
+	}
+	var value interface{}
+	if result != nil {
+		value = result
+	}
+	query := tx.Rebind(fmt.Sprintf("UPDATE %s SET state = ?, last_error = COALESCE(?, last_error), result = ?, finished_at = ? WHERE id = ?", tables.JobStatus))
+	if _, err := tx.ExecContext(ctx, query, state, lastError, value, finishedAt, id); err != nil {
+		return fmt.Errorf("error recording job outcome: %s", err)
+	}
+	if !state.Done() {
+		return nil
+	}
+	return finishJobWorkflow(ctx, tx, tables, u, id, state == JobSucceeded)
+}
+
+// cancelJob records that a tracked message was cancelled, failing its workflow, if any
+func cancelJob(ctx context.Context, tx *sqlx.Tx, tables internal.Tables, u *workflowUpdates, id int64, now time.Time) error {
+	query := tx.Rebind(fmt.Sprintf("UPDATE %s SET state = ?, finished_at = ? WHERE id = ?", tables.JobStatus))
+	if _, err := tx.ExecContext(ctx, query, JobCancelled, now, id); err != nil {
+		return fmt.Errorf("error recording job cancellation: %s", err)
+	}
+	return finishJobWorkflow(ctx, tx, tables, u, id, false)
+}
+
+// finishJobWorkflow adds a tracked message which has finished to the finished tasks of its workflow, if it belongs to one
+func finishJobWorkflow(ctx context.Context, tx *sqlx.Tx, tables internal.Tables, u *workflowUpdates, id int64, succeeded bool) error {
+	var workflowID sql.NullString
+	query := tx.Rebind(fmt.Sprintf("SELECT workflow_id FROM %s WHERE id = ?", tables.JobStatus))
+	if err := tx.GetContext(ctx, &workflowID, query, id); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("error selecting job workflow: %s", err)
+	}
+	if !workflowID.Valid {
+		return nil
+	}
+	u.finish(workflowID.String, succeeded)
+	return nil
+}
@@ -0,0 +1,119 @@
+package gq
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/require"
+)
+
+var statusColumns = []string{"id", "queue", "state", "attempts", "last_error", "result", "created_at", "started_at", "finished_at"}
+
+func expectNoWorkflow(mock sqlmock.Sqlmock, id int64) {
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT workflow_id FROM job_status WHERE id = ?")).
+		WithArgs(id).
+		WillReturnRows(sqlmock.NewRows([]string{"workflow_id"}).AddRow(nil))
+}
+
+func TestPushTracked(t *testing.T) {
+	c, mock, now := newAdminTestClient(t)
+	p, err := newProducer(context.Background(), c, &ProducerOptions{Queue: "jobs"})
+	require.NoError(t, err)
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO message (queue, payload, headers, unique_key, tracked, created_at, ready_at) VALUES (?, ?, ?, ?, ?, ?, ?)")).
+		WithArgs("jobs", []byte("go"), `{"k":"v"}`, nil, true, now, now).
+		WillReturnResult(sqlmock.NewResult(4, 1))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO job_status (id, queue, state, attempts, created_at, expires_at, workflow_id) VALUES (?, ?, ?, 0, ?, ?, ?)")).
+		WithArgs(4, "jobs", JobQueued, now, nil, nil).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	id, err := p.PushTracked(context.Background(), []byte("go"), map[string]string{"k": "v"})
+	require.NoError(t, err)
+	require.Equal(t, int64(4), id)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestStatusAndWait(t *testing.T) {
+	c, mock, now := newAdminTestClient(t)
+	query := regexp.QuoteMeta("SELECT id, queue, state, attempts, last_error, result, created_at, started_at, finished_at FROM job_status WHERE id = ?")
+
+	mock.ExpectQuery(query).WithArgs(5).WillReturnRows(sqlmock.NewRows(statusColumns))
+	_, err := c.Status(context.Background(), 5)
+	require.ErrorIs(t, err, ErrNotFound)
+
+	mock.ExpectQuery(query).WithArgs(4).
+		WillReturnRows(sqlmock.NewRows(statusColumns).AddRow(4, "jobs", JobRunning, 1, nil, nil, now, now, nil))
+	mock.ExpectQuery(query).WithArgs(4).
+		WillReturnRows(sqlmock.NewRows(statusColumns).AddRow(4, "jobs", JobSucceeded, 2, "boom", []byte("done"), now, now, now))
+	status, err := c.Wait(context.Background(), 4)
+	require.NoError(t, err)
+	require.Equal(t, &JobStatus{ID: 4, Queue: "jobs", State: JobSucceeded, Attempts: 2, LastError: "boom", Result: []byte("done"), CreatedAt: now, StartedAt: now, FinishedAt: now}, status)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestPurgeStatuses(t *testing.T) {
+	c, mock, now := newAdminTestClient(t)
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM job_status WHERE finished_at < ?")).
+		WithArgs(now).
+		WillReturnResult(sqlmock.NewResult(0, 3))
+	n, err := c.PurgeStatuses(context.Background(), now)
+	require.NoError(t, err)
+	require.Equal(t, int64(3), n)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestPullMessages_Tracked(t *testing.T) {
+	c, mock, now := newAdminTestClient(t)
+	processErr := errors.New("boom")
+	consumer, err := newConsumer(context.Background(), c, func(ctx context.Context, m *Message) error {
+		if m.ID == 2 {
+			return processErr
+		}
+		m.SetResult([]byte("done"))
+		return nil
+	}, idleConsumerOpts())
+	require.NoError(t, err)
+	defer consumer.Close()
+
+	expectPull(mock, now, sqlmock.NewRows([]string{"id", "payload", "headers", "retries", "created_at", "unique_key", "tracked"}).
+		AddRow(1, []byte("a"), nil, 0, now, nil, true).
+		AddRow(2, []byte("b"), nil, 0, now, nil, true))
+	startJob := regexp.QuoteMeta("UPDATE job_status SET state = ?, attempts = attempts + 1, started_at = ? WHERE id IN (?)")
+	mock.ExpectExec(startJob).WithArgs(JobRunning, now, 1).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(startJob).WithArgs(JobRunning, now, 2).WillReturnResult(sqlmock.NewResult(0, 1))
+	finishJob := regexp.QuoteMeta("UPDATE job_status SET state = ?, last_error = COALESCE(?, last_error), result = ?, finished_at = ? WHERE id = ?")
+	mock.ExpectExec(finishJob).WithArgs(JobSucceeded, nil, []byte("done"), now, 1).WillReturnResult(sqlmock.NewResult(0, 1))
+	expectNoWorkflow(mock, 1)
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE message SET retries = ?, ready_at = ?, lease_token = NULL WHERE id = ?")).
+		WithArgs(1, now.Add(retryInitialBackoffPeriodSeconds*time.Second), 2).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(finishJob).WithArgs(JobQueued, "boom", nil, nil, 2).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM message WHERE id in (?)")).WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	consumer.pullMessages(context.Background(), now)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestAckWithResult(t *testing.T) {
+	c, mock, now := newLeaseTestConsumer(t)
+	mock.ExpectQuery(regexp.QuoteMeta("FROM message WHERE id = ? AND lease_token = ?")).
+		WithArgs(7, "token").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "payload", "headers", "retries", "created_at", "unique_key", "tracked"}).AddRow(7, []byte("a"), nil, 0, now, nil, true))
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM message WHERE id = ? AND lease_token = ?")).
+		WithArgs(7, "token").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE job_status SET state = ?")).
+		WithArgs(JobSucceeded, nil, []byte("done"), now, 7).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	expectNoWorkflow(mock, 7)
+	mock.ExpectCommit()
+	require.NoError(t, c.AckWithResult(context.Background(), 7, "token", []byte("done")))
+	require.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,428 @@
+package gq
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/mattbonnell/gq/internal"
+)
+
+const (
+	defaultSettleDelay       = time.Second
+	retentionPeriod          = time.Minute
+	defaultStreamPartitions  = 1
+	streamRetryBackoffPeriod = retryInitialBackoffPeriodSeconds * time.Second
+)
+
+// NoRetries is the MaxProcessingRetries of a group consumer which dead-letters a message the first time its processing fails,
+// since leaving it unset retries it the default number of times
+const NoRetries = -1
+
+// GroupConsumerOptions represents the options which can be used to tailor group consumer behaviour
+type GroupConsumerOptions struct {
+	// Stream is the name of the queue to read as a stream (default: "default").
+	// A stream's messages are deleted by retention rather than by consumers, so it must not also be read by a Consumer
+	Stream string
+	// Group is the name of the consumer group. Each group reads every message in the stream once, and the consumers in a group
+	// split its messages between them
+	Group string
+	// Partitions is the number of partitions the group splits the stream into (default: 1). Message n belongs to partition n mod Partitions;
+	// each partition is processed in order by one consumer at a time, so this bounds the group's parallelism.
+	// It is fixed when the group is created
+	Partitions int
+	// PullPeriod is the period messages should be pulled at (default: 50ms)
+	PullPeriod time.Duration
+	// MaxBatchSize is the maximum number of messages to be pulled from a partition in one batch (default: 400)
+	MaxBatchSize int
+	// Concurrency is the number of concurrent goroutines to pull messages from, each of which claims one partition at a time (default: 1)
+	Concurrency int
+	// MaxProcessingRetries is the number of times a message is retried after processing fails before it is dead-lettered and its
+	// partition moves past it (default: 3). Set it to NoRetries to dead-letter a message without retrying it
+	MaxProcessingRetries int
+	// StartFromLatest starts a new group after the last message already in the stream, instead of at the beginning of the stream (default: false)
+	StartFromLatest bool
+	// Retention, if set, makes the consumer delete the stream's messages once they are older than Retention, checking every minute,
+	// whether or not every group has processed them. Messages are kept while no consumer of the stream with a retention is running.
+	// Every consumer of a stream should use the same retention
+	Retention time.Duration
+	// SettleDelay is how old a message must be before it is read (default: 1s). Message IDs are assigned when a message is inserted but
+	// become visible when its transaction commits, so a message may appear after one with a higher ID; the delay gives concurrent pushes
+	// time to commit so they aren't skipped. It should exceed the longest push transaction and any clock skew between producers
+	SettleDelay time.Duration
+}
+
+func (o *GroupConsumerOptions) setDefaults() {
+	o.Stream = queueOrDefault(o.Stream)
+	if o.Partitions <= 0 {
+		o.Partitions = defaultStreamPartitions
+	}
+	if o.PullPeriod <= 0 {
+		o.PullPeriod = defaultPullPeriod
+	}
+	if o.MaxBatchSize <= 0 {
+		o.MaxBatchSize = defaultMaxBatchSize
+	}
+	if o.Concurrency <= 0 {
+		o.Concurrency = 1
+	}
+	if o.MaxProcessingRetries == 0 {
+		o.MaxProcessingRetries = processingMaxRetries
+	} else if o.MaxProcessingRetries < 0 {
+		o.MaxProcessingRetries = 0
+	}
+	if o.SettleDelay <= 0 {
+		o.SettleDelay = defaultSettleDelay
+	}
+}
+
+// GroupConsumer represents a member of a consumer group, which reads a stream without deleting its messages and commits its progress
+// through the stream as an offset. A message whose processing fails stops its partition while it is retried, until it succeeds or
+// exhausts its retries and is dead-lettered for the group. A dead-lettered message is left in the stream, so it is replayed by
+// resetting the group rather than requeued
+type GroupConsumer struct {
+	db      *sqlx.DB
+	tables  internal.Tables
+	dialect *internal.Dialect
+	now     func() time.Time
+	log     Logger
+	metrics Metrics
+	tracer  Tracer
+	handle  HandlerFunc
+	opts    GroupConsumerOptions
+
+	stop      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+// PartitionOffset is the offset a consumer group has committed in one partition of a stream
+type PartitionOffset struct {
+	Partition int `json:"partition" db:"partition_id"`
+	// Offset is the ID of the last message the group has processed in the partition
+	Offset int64 `json:"offset" db:"committed_offset"`
+	// Retries is the number of times processing the partition's next message has failed
+	Retries int `json:"retries" db:"retries"`
+}
+
+// NewGroupConsumer creates a consumer in a consumer group, creating the group if it doesn't exist. It begins pulling messages immediately,
+// and passes each one to the supplied handler
+func (c *Client) NewGroupConsumer(ctx context.Context, h HandlerFunc, opts GroupConsumerOptions) (*GroupConsumer, error) {
+	if opts.Group == "" {
+		return nil, errors.New("a consumer group name is required")
+	}
+	opts.setDefaults()
+	gc := &GroupConsumer{db: c.db, tables: c.tables, dialect: c.dialect, now: c.now, log: c.opts.Logger, metrics: c.opts.Metrics, tracer: c.opts.Tracer, handle: h, opts: opts, stop: make(chan struct{})}
+	if err := c.createGroup(ctx, opts); err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil, ErrClientClosed
+	}
+	c.groupConsumers = append(c.groupConsumers, gc)
+	gc.wg.Add(opts.Concurrency)
+	for i := 0; i < opts.Concurrency; i++ {
+		go gc.startPullingMessages(ctx)
+	}
+	if opts.Retention > 0 {
+		gc.wg.Add(1)
+		go gc.startTrimming(ctx)
+	}
+	return gc, nil
+}
+
+// createGroup creates the offsets of a consumer group's partitions, unless the group already exists with the same number of partitions
+func (c *Client) createGroup(ctx context.Context, opts GroupConsumerOptions) error {
+	var partitions int
+	query := c.db.Rebind(fmt.Sprintf("SELECT partitions FROM %s WHERE stream = ? AND group_name = ? LIMIT 1", c.tables.ConsumerGroupOffset))
+	err := c.db.GetContext(ctx, &partitions, query, opts.Stream, opts.Group)
+	if err == nil {
+		if partitions != opts.Partitions {
+			return fmt.Errorf("consumer group '%s' has %d partitions, not %d", opts.Group, partitions, opts.Partitions)
+		}
+		return nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("error selecting consumer group: %s", err)
+	}
+	var offset int64
+	if opts.StartFromLatest {
+		query := c.db.Rebind(fmt.Sprintf("SELECT COALESCE(MAX(id), 0) FROM %s WHERE queue = ?", c.tables.Message))
+		if err := c.db.GetContext(ctx, &offset, query, opts.Stream); err != nil {
+			return fmt.Errorf("error selecting latest message: %s", err)
+		}
+	}
+	insert := c.db.Rebind(c.dialect.InsertGroupOffset)
+	for p := 0; p < opts.Partitions; p++ {
+		// a consumer creating the group concurrently inserts the same rows, which are ignored
+		if _, err := c.db.ExecContext(ctx, insert, opts.Stream, opts.Group, p, opts.Partitions, offset, c.now()); err != nil {
+			return fmt.Errorf("error creating consumer group: %s", err)
+		}
+	}
+	return nil
+}
+
+// Close stops the consumer from pulling messages, waiting for any messages it is processing to be completed
+func (gc *GroupConsumer) Close() {
+	gc.closeOnce.Do(func() {
+		close(gc.stop)
+		gc.wg.Wait()
+	})
+}
+
+func (gc *GroupConsumer) startPullingMessages(ctx context.Context) {
+	defer gc.wg.Done()
+	ticker := time.NewTicker(gc.opts.PullPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			gc.log.Debug("stopping message pulling", "reason", ctx.Err())
+			return
+		case <-gc.stop:
+			gc.log.Debug("group consumer closed, stopping message pulling")
+			return
+		case <-ticker.C:
+			gc.pullMessages(ctx, gc.now())
+		}
+	}
+}
+
+// pullMessages claims the partition of the group which was polled least recently and isn't claimed by another consumer,
+// processes the messages after its offset and commits the offset of the last one processed
+func (gc *GroupConsumer) pullMessages(ctx context.Context, now time.Time) {
+	tx, err := gc.db.BeginTxx(ctx, nil)
+	if err != nil {
+		gc.log.Error("error beginning message pull transaction", "error", err)
+		return
+	}
+	defer tx.Rollback()
+	var p struct {
+		PartitionOffset
+		Partitions int `db:"partitions"`
+	}
+	// a partition whose next message failed isn't polled again until its backoff has elapsed
+	query := tx.Rebind(fmt.Sprintf("SELECT partition_id, partitions, committed_offset, retries FROM %s WHERE stream = ? AND group_name = ? AND poll_after <= ? ORDER BY poll_after ASC LIMIT 1 FOR UPDATE SKIP LOCKED", gc.tables.ConsumerGroupOffset))
+	if err := tx.GetContext(ctx, &p, query, gc.opts.Stream, gc.opts.Group, now); err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			gc.log.Error("error claiming partition", "error", err)
+		}
+		return
+	}
+	gc.log.Debug("pulling new messages", "stream", gc.opts.Stream, "group", gc.opts.Group, "partition", p.Partition)
+	query = tx.Rebind(fmt.Sprintf("SELECT id, payload, headers, created_at FROM %s WHERE queue = ? AND id > ? AND MOD(id, ?) = ? AND created_at <= ? ORDER BY id ASC LIMIT ?", gc.tables.Message))
+	rows, err := tx.QueryxContext(ctx, query, gc.opts.Stream, p.Offset, p.Partitions, p.Partition, now.Add(-gc.opts.SettleDelay), gc.opts.MaxBatchSize)
+	if err != nil {
+		gc.log.Error("error pulling messages", "error", err)
+		return
+	}
+	defer rows.Close()
+	var m internal.Message
+	results := make([]result, 0, gc.opts.MaxBatchSize)
+	offset, retries := p.Offset, p.Retries
+	for rows.Next() {
+		if err := rows.Scan(&m.ID, &m.Payload, &m.Headers, &m.CreatedAt); err != nil {
+			gc.log.Error("error scanning messages", "error", err)
+			return
+		}
+		m.Retries = int32(retries)
+		start := time.Now()
+		err := gc.process(ctx, m)
+		r := result{message: m, err: err, handlerDuration: time.Since(start), outcome: OutcomeAcked}
+		if err != nil && retries >= gc.opts.MaxProcessingRetries {
+			gc.log.Error("error processing stream message, dead-lettering", "stream", gc.opts.Stream, "group", gc.opts.Group, "id", m.ID, "error", err)
+			// the payload is only valid until the next call to rows.Next, and is needed to dead-letter the message
+			r.message.Payload = append([]byte(nil), m.Payload...)
+			r.outcome = OutcomeDeadLettered
+			offset, retries = m.ID, 0
+			results = append(results, r)
+			continue
+		}
+		if err != nil {
+			gc.log.Error("error processing stream message, retrying", "stream", gc.opts.Stream, "group", gc.opts.Group, "id", m.ID, "error", err)
+			r.outcome = OutcomeRetried
+			retries++
+			results = append(results, r)
+			break
+		}
+		offset, retries = m.ID, 0
+		results = append(results, r)
+	}
+	if err := rows.Err(); err != nil {
+		gc.log.Error("error from query result", "error", err)
+		return
+	}
+	rows.Close()
+	gc.metrics.MessagesPulled(gc.opts.Stream, len(results))
+	upsertDead := tx.Rebind(gc.dialect.UpsertDeadStreamMessage)
+	for _, r := range results {
+		if r.outcome != OutcomeDeadLettered {
+			continue
+		}
+		m := r.message
+		if _, err := tx.ExecContext(ctx, upsertDead, gc.opts.Stream, gc.opts.Group, m.ID, []byte(m.Payload), m.Headers, m.CreatedAt.Time, gc.now(), m.Retries, r.err.Error()); err != nil {
+			gc.log.Error("error inserting dead message", "error", err)
+			return
+		}
+	}
+	// polling the partition last, or backing off linearly with its retries, lets the consumers take turns over the partitions
+	pollAfter := now.Add(streamRetryBackoffPeriod * time.Duration(retries))
+	query = tx.Rebind(fmt.Sprintf("UPDATE %s SET committed_offset = ?, retries = ?, poll_after = ? WHERE stream = ? AND group_name = ? AND partition_id = ?", gc.tables.ConsumerGroupOffset))
+	if _, err := tx.ExecContext(ctx, query, offset, retries, pollAfter, gc.opts.Stream, gc.opts.Group, p.Partition); err != nil {
+		gc.log.Error("error committing offset", "error", err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		gc.log.Error("error committing message pull transaction", "error", err)
+		return
+	}
+	committedAt := gc.now()
+	for _, r := range results {
+		gc.metrics.MessageProcessed(gc.opts.Stream, r.outcome, r.handlerDuration, committedAt.Sub(r.message.CreatedAt.Time))
+	}
+}
+
+// startTrimming deletes the messages in the consumer's stream which are older than its retention, and their dead letters, every retentionPeriod
+func (gc *GroupConsumer) startTrimming(ctx context.Context) {
+	defer gc.wg.Done()
+	ticker := time.NewTicker(retentionPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-gc.stop:
+			return
+		case <-ticker.C:
+			gc.trim(ctx)
+		}
+	}
+}
+
+func (gc *GroupConsumer) trim(ctx context.Context) {
+	before := gc.now().Add(-gc.opts.Retention)
+	query := gc.db.Rebind(fmt.Sprintf("DELETE FROM %s WHERE queue = ? AND created_at < ?", gc.tables.Message))
+	res, err := gc.db.ExecContext(ctx, query, gc.opts.Stream, before)
+	if err != nil {
+		gc.log.Error("error trimming stream", "stream", gc.opts.Stream, "error", err)
+		return
+	}
+	if n, err := res.RowsAffected(); err == nil && n > 0 {
+		gc.log.Debug("trimmed stream", "stream", gc.opts.Stream, "count", n)
+	}
+	query = gc.db.Rebind(fmt.Sprintf("DELETE FROM %s WHERE stream = ? AND created_at < ?", gc.tables.DeadStreamMessage))
+	if _, err := gc.db.ExecContext(ctx, query, gc.opts.Stream, before); err != nil {
+		gc.log.Error("error trimming stream dead letters", "stream", gc.opts.Stream, "error", err)
+	}
+}
+
+// process passes a pulled message to the handler, within the span started by the tracer
+func (gc *GroupConsumer) process(ctx context.Context, m internal.Message) error {
+	msg := &Message{
+		ID:        m.ID,
+		Queue:     gc.opts.Stream,
+		Payload:   []byte(m.Payload),
+		Headers:   m.Headers,
+		Attempt:   int(m.Retries) + 1,
+		CreatedAt: m.CreatedAt.Time,
+	}
+	ctx, end := gc.tracer.StartProcess(ctx, msg)
+	err := gc.handle(ctx, msg)
+	end(err)
+	return err
+}
+
+// GroupOffsets returns the offsets a consumer group has committed in each partition of stream, or ErrNotFound if the group doesn't exist
+func (c *Client) GroupOffsets(ctx context.Context, stream string, group string) ([]PartitionOffset, error) {
+	offsets := []PartitionOffset{}
+	query := c.db.Rebind(fmt.Sprintf("SELECT partition_id, committed_offset, retries FROM %s WHERE stream = ? AND group_name = ? ORDER BY partition_id", c.tables.ConsumerGroupOffset))
+	if err := c.db.SelectContext(ctx, &offsets, query, queueOrDefault(stream), group); err != nil {
+		return nil, fmt.Errorf("error selecting consumer group offsets: %s", err)
+	}
+	if len(offsets) == 0 {
+		return nil, ErrNotFound
+	}
+	return offsets, nil
+}
+
+// ResetGroup moves every partition of a consumer group to offset, so that the group next processes the messages after it.
+// Resetting to an earlier offset replays the stream's history; resetting to 0 replays every message still retained.
+// Consumers finish the batch they are processing before the reset takes effect
+func (c *Client) ResetGroup(ctx context.Context, stream string, group string, offset int64) error {
+	query := c.db.Rebind(fmt.Sprintf("UPDATE %s SET committed_offset = ?, retries = 0, poll_after = ? WHERE stream = ? AND group_name = ?", c.tables.ConsumerGroupOffset))
+	res, err := c.db.ExecContext(ctx, query, offset, c.now(), queueOrDefault(stream), group)
+	if err != nil {
+		return fmt.Errorf("error resetting consumer group: %s", err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// ResetGroupToTime moves every partition of a consumer group to just before the first message pushed at or after t,
+// or to the end of the stream if there is none
+func (c *Client) ResetGroupToTime(ctx context.Context, stream string, group string, t time.Time) error {
+	stream = queueOrDefault(stream)
+	var first sql.NullInt64
+	query := c.db.Rebind(fmt.Sprintf("SELECT MIN(id) FROM %s WHERE queue = ? AND created_at >= ?", c.tables.Message))
+	if err := c.db.GetContext(ctx, &first, query, stream, t.UTC()); err != nil {
+		return fmt.Errorf("error selecting first message: %s", err)
+	}
+	if first.Valid {
+		return c.ResetGroup(ctx, stream, group, first.Int64-1)
+	}
+	var last int64
+	query = c.db.Rebind(fmt.Sprintf("SELECT COALESCE(MAX(id), 0) FROM %s WHERE queue = ?", c.tables.Message))
+	if err := c.db.GetContext(ctx, &last, query, stream); err != nil {
+		return fmt.Errorf("error selecting latest message: %s", err)
+	}
+	return c.ResetGroup(ctx, stream, group, last)
+}
+
+// DeleteGroup deletes a consumer group's offsets and dead letters. Its consumers should be closed first, since they recreate the group
+// from the start of the stream
+func (c *Client) DeleteGroup(ctx context.Context, stream string, group string) error {
+	stream = queueOrDefault(stream)
+	for _, table := range []string{c.tables.ConsumerGroupOffset, c.tables.DeadStreamMessage} {
+		if _, err := c.exec(ctx, fmt.Sprintf("DELETE FROM %s WHERE stream = ? AND group_name = ?", table), stream, group); err != nil {
+			return fmt.Errorf("error deleting consumer group: %s", err)
+		}
+	}
+	return nil
+}
+
+// PeekDeadGroup returns up to n of the messages from stream which a consumer group has dead-lettered, most recently failed first.
+// Their IDs are those of the messages in the stream
+func (c *Client) PeekDeadGroup(ctx context.Context, stream string, group string, n int) ([]MessageInfo, error) {
+	query := c.db.Rebind(fmt.Sprintf("SELECT message_id AS id, stream AS queue, payload, headers, retries, created_at, failed_at, last_error FROM %s WHERE stream = ? AND group_name = ? ORDER BY failed_at DESC LIMIT ?", c.tables.DeadStreamMessage))
+	rows := []messageInfoRow{}
+	if err := c.db.SelectContext(ctx, &rows, query, queueOrDefault(stream), group, n); err != nil {
+		return nil, fmt.Errorf("error peeking dead stream messages: %s", err)
+	}
+	messages := make([]MessageInfo, len(rows))
+	for i, r := range rows {
+		messages[i] = r.info(true)
+	}
+	return messages, nil
+}
+
+// TrimStream deletes the messages pushed onto stream before before, and the consumer groups' dead letters of them, returning the
+// number of messages deleted. Consumer groups which haven't processed them yet skip them
+func (c *Client) TrimStream(ctx context.Context, stream string, before time.Time) (int64, error) {
+	stream = queueOrDefault(stream)
+	n, err := c.exec(ctx, fmt.Sprintf("DELETE FROM %s WHERE queue = ? AND created_at < ?", c.tables.Message), stream, before.UTC())
+	if err != nil {
+		return 0, fmt.Errorf("error trimming stream: %s", err)
+	}
+	if _, err := c.exec(ctx, fmt.Sprintf("DELETE FROM %s WHERE stream = ? AND created_at < ?", c.tables.DeadStreamMessage), stream, before.UTC()); err != nil {
+		return 0, fmt.Errorf("error trimming stream dead letters: %s", err)
+	}
+	return n, nil
+}
@@ -0,0 +1,230 @@
+package gq
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestGroupConsumer(c *Client, h HandlerFunc, opts GroupConsumerOptions) *GroupConsumer {
+	opts.setDefaults()
+	return &GroupConsumer{db: c.db, tables: c.tables, dialect: c.dialect, now: c.now, log: c.opts.Logger, metrics: c.opts.Metrics, tracer: c.opts.Tracer, handle: h, opts: opts, stop: make(chan struct{})}
+}
+
+func TestCreateGroup(t *testing.T) {
+	c, mock, now := newAdminTestClient(t)
+	selectGroup := regexp.QuoteMeta("SELECT partitions FROM consumer_group_offset WHERE stream = ? AND group_name = ? LIMIT 1")
+
+	mock.ExpectQuery(selectGroup).WithArgs("events", "billing").WillReturnError(sql.ErrNoRows)
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT COALESCE(MAX(id), 0) FROM message WHERE queue = ?")).
+		WithArgs("events").
+		WillReturnRows(sqlmock.NewRows([]string{"max"}).AddRow(41))
+	for p := 0; p < 2; p++ {
+		mock.ExpectExec(regexp.QuoteMeta("INSERT IGNORE INTO consumer_group_offset (stream, group_name, partition_id, partitions, committed_offset, retries, poll_after) VALUES (?, ?, ?, ?, ?, 0, ?)")).
+			WithArgs("events", "billing", p, 2, 41, now).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+	require.NoError(t, c.createGroup(context.Background(), GroupConsumerOptions{Stream: "events", Group: "billing", Partitions: 2, StartFromLatest: true}))
+
+	mock.ExpectQuery(selectGroup).WithArgs("events", "billing").WillReturnRows(sqlmock.NewRows([]string{"partitions"}).AddRow(2))
+	require.NoError(t, c.createGroup(context.Background(), GroupConsumerOptions{Stream: "events", Group: "billing", Partitions: 2}))
+	mock.ExpectQuery(selectGroup).WithArgs("events", "billing").WillReturnRows(sqlmock.NewRows([]string{"partitions"}).AddRow(2))
+	require.Error(t, c.createGroup(context.Background(), GroupConsumerOptions{Stream: "events", Group: "billing", Partitions: 4}))
+	require.NoError(t, mock.ExpectationsWereMet())
+
+	_, err := c.NewGroupConsumer(context.Background(), nil, GroupConsumerOptions{Stream: "events"})
+	require.Error(t, err)
+}
+
+func TestGroupConsumerPullMessages(t *testing.T) {
+	c, mock, now := newAdminTestClient(t)
+	var processed []int64
+	gc := newTestGroupConsumer(c, func(ctx context.Context, m *Message) error {
+		processed = append(processed, m.ID)
+		if m.ID == 6 {
+			return errors.New("boom")
+		}
+		return nil
+	}, GroupConsumerOptions{Stream: "events", Group: "billing", Partitions: 2, MaxBatchSize: 10})
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT partition_id, partitions, committed_offset, retries FROM consumer_group_offset WHERE stream = ? AND group_name = ? AND poll_after <= ? ORDER BY poll_after ASC LIMIT 1 FOR UPDATE SKIP LOCKED")).
+		WithArgs("events", "billing", now).
+		WillReturnRows(sqlmock.NewRows([]string{"partition_id", "partitions", "committed_offset", "retries"}).AddRow(0, 2, 0, 0))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT id, payload, headers, created_at FROM message WHERE queue = ? AND id > ? AND MOD(id, ?) = ? AND created_at <= ? ORDER BY id ASC LIMIT ?")).
+		WithArgs("events", 0, 2, 0, now.Add(-defaultSettleDelay), 10).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "payload", "headers", "created_at"}).
+			AddRow(2, []byte("a"), nil, now).
+			AddRow(4, []byte("b"), nil, now).
+			AddRow(6, []byte("c"), nil, now).
+			AddRow(8, []byte("d"), nil, now))
+	// message 6 failed, so the offset stops at 4 and the partition backs off
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE consumer_group_offset SET committed_offset = ?, retries = ?, poll_after = ? WHERE stream = ? AND group_name = ? AND partition_id = ?")).
+		WithArgs(4, 1, now.Add(streamRetryBackoffPeriod), "events", "billing", 0).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	gc.pullMessages(context.Background(), now)
+	require.NoError(t, mock.ExpectationsWereMet())
+	require.Equal(t, []int64{2, 4, 6}, processed)
+}
+
+func TestGroupConsumerPullMessages_NoPartitionAvailable(t *testing.T) {
+	c, mock, _ := newAdminTestClient(t)
+	gc := newTestGroupConsumer(c, func(ctx context.Context, m *Message) error { return nil }, GroupConsumerOptions{Group: "billing"})
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("FROM consumer_group_offset").
+		WillReturnRows(sqlmock.NewRows([]string{"partition_id", "partitions", "committed_offset", "retries"}))
+	mock.ExpectRollback()
+
+	gc.pullMessages(context.Background(), c.now())
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestResetGroup(t *testing.T) {
+	c, mock, now := newAdminTestClient(t)
+	reset := regexp.QuoteMeta("UPDATE consumer_group_offset SET committed_offset = ?, retries = 0, poll_after = ? WHERE stream = ? AND group_name = ?")
+
+	mock.ExpectExec(reset).WithArgs(10, now, "events", "billing").WillReturnResult(sqlmock.NewResult(0, 2))
+	require.NoError(t, c.ResetGroup(context.Background(), "events", "billing", 10))
+
+	mock.ExpectExec(reset).WithArgs(10, now, "events", "missing").WillReturnResult(sqlmock.NewResult(0, 0))
+	require.ErrorIs(t, c.ResetGroup(context.Background(), "events", "missing", 10), ErrNotFound)
+
+	since := now.Add(-time.Hour)
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT MIN(id) FROM message WHERE queue = ? AND created_at >= ?")).
+		WithArgs("events", since).
+		WillReturnRows(sqlmock.NewRows([]string{"min"}).AddRow(21))
+	mock.ExpectExec(reset).WithArgs(20, now, "events", "billing").WillReturnResult(sqlmock.NewResult(0, 2))
+	require.NoError(t, c.ResetGroupToTime(context.Background(), "events", "billing", since))
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT MIN(id) FROM message WHERE queue = ? AND created_at >= ?")).
+		WithArgs("events", now).
+		WillReturnRows(sqlmock.NewRows([]string{"min"}).AddRow(nil))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT COALESCE(MAX(id), 0) FROM message WHERE queue = ?")).
+		WithArgs("events").
+		WillReturnRows(sqlmock.NewRows([]string{"max"}).AddRow(30))
+	mock.ExpectExec(reset).WithArgs(30, now, "events", "billing").WillReturnResult(sqlmock.NewResult(0, 2))
+	require.NoError(t, c.ResetGroupToTime(context.Background(), "events", "billing", now))
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestGroupOffsets(t *testing.T) {
+	c, mock, _ := newAdminTestClient(t)
+	query := regexp.QuoteMeta("SELECT partition_id, committed_offset, retries FROM consumer_group_offset WHERE stream = ? AND group_name = ? ORDER BY partition_id")
+	mock.ExpectQuery(query).
+		WithArgs("events", "billing").
+		WillReturnRows(sqlmock.NewRows([]string{"partition_id", "committed_offset", "retries"}).AddRow(0, 12, 0).AddRow(1, 9, 2))
+	offsets, err := c.GroupOffsets(context.Background(), "events", "billing")
+	require.NoError(t, err)
+	require.Equal(t, []PartitionOffset{{Partition: 0, Offset: 12}, {Partition: 1, Offset: 9, Retries: 2}}, offsets)
+
+	mock.ExpectQuery(query).WithArgs("events", "missing").WillReturnRows(sqlmock.NewRows([]string{"partition_id", "committed_offset", "retries"}))
+	_, err = c.GroupOffsets(context.Background(), "events", "missing")
+	require.ErrorIs(t, err, ErrNotFound)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestTrimStream(t *testing.T) {
+	c, mock, _ := newAdminTestClient(t)
+	before := c.now().Add(-24 * time.Hour)
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM message WHERE queue = ? AND created_at < ?")).
+		WithArgs("events", before).
+		WillReturnResult(sqlmock.NewResult(0, 5))
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM dead_stream_message WHERE stream = ? AND created_at < ?")).
+		WithArgs("events", before).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	n, err := c.TrimStream(context.Background(), "events", before)
+	require.NoError(t, err)
+	require.Equal(t, int64(5), n)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestGroupConsumerTrim(t *testing.T) {
+	c, mock, now := newAdminTestClient(t)
+	gc := newTestGroupConsumer(c, func(ctx context.Context, m *Message) error { return nil }, GroupConsumerOptions{Stream: "events", Group: "billing", Retention: time.Hour})
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM message WHERE queue = ? AND created_at < ?")).
+		WithArgs("events", now.Add(-time.Hour)).
+		WillReturnResult(sqlmock.NewResult(0, 5))
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM dead_stream_message WHERE stream = ? AND created_at < ?")).
+		WithArgs("events", now.Add(-time.Hour)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	gc.trim(context.Background())
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestGroupConsumerPullMessages_DeadLetter(t *testing.T) {
+	c, mock, now := newAdminTestClient(t)
+	processErr := errors.New("boom")
+	var processed []int64
+	gc := newTestGroupConsumer(c, func(ctx context.Context, m *Message) error {
+		processed = append(processed, m.ID)
+		if m.ID == 2 {
+			return processErr
+		}
+		return nil
+	}, GroupConsumerOptions{Stream: "events", Group: "billing", MaxBatchSize: 10})
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT partition_id, partitions, committed_offset, retries FROM consumer_group_offset WHERE stream = ? AND group_name = ? AND poll_after <= ? ORDER BY poll_after ASC LIMIT 1 FOR UPDATE SKIP LOCKED")).
+		WithArgs("events", "billing", now).
+		WillReturnRows(sqlmock.NewRows([]string{"partition_id", "partitions", "committed_offset", "retries"}).AddRow(0, 1, 1, processingMaxRetries))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT id, payload, headers, created_at FROM message WHERE queue = ? AND id > ? AND MOD(id, ?) = ? AND created_at <= ? ORDER BY id ASC LIMIT ?")).
+		WithArgs("events", 1, 1, 0, now.Add(-defaultSettleDelay), 10).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "payload", "headers", "created_at"}).
+			AddRow(2, []byte("a"), nil, now).
+			AddRow(3, []byte("b"), nil, now))
+	// message 2 has exhausted its retries, so it is dead-lettered for the group and the partition moves on to message 3
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO dead_stream_message (stream, group_name, message_id, payload, headers, created_at, failed_at, retries, last_error) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?) ON DUPLICATE KEY UPDATE")).
+		WithArgs("events", "billing", 2, []byte("a"), nil, now, now, processingMaxRetries, processErr.Error()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE consumer_group_offset SET committed_offset = ?, retries = ?, poll_after = ? WHERE stream = ? AND group_name = ? AND partition_id = ?")).
+		WithArgs(3, 0, now, "events", "billing", 0).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	gc.pullMessages(context.Background(), now)
+	require.NoError(t, mock.ExpectationsWereMet())
+	require.Equal(t, []int64{2, 3}, processed)
+}
+
+func TestGroupConsumerOptionsMaxProcessingRetries(t *testing.T) {
+	opts := GroupConsumerOptions{}
+	opts.setDefaults()
+	require.Equal(t, processingMaxRetries, opts.MaxProcessingRetries)
+
+	opts = GroupConsumerOptions{MaxProcessingRetries: NoRetries}
+	opts.setDefaults()
+	require.Equal(t, 0, opts.MaxProcessingRetries)
+}
+
+func TestPeekDeadGroup(t *testing.T) {
+	c, mock, now := newAdminTestClient(t)
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT message_id AS id, stream AS queue, payload, headers, retries, created_at, failed_at, last_error FROM dead_stream_message WHERE stream = ? AND group_name = ? ORDER BY failed_at DESC LIMIT ?")).
+		WithArgs("events", "billing", 10).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "queue", "payload", "headers", "retries", "created_at", "failed_at", "last_error"}).
+			AddRow(2, "events", []byte("a"), nil, 3, now, now, "boom"))
+	messages, err := c.PeekDeadGroup(context.Background(), "events", "billing", 10)
+	require.NoError(t, err)
+	require.Equal(t, []MessageInfo{{ID: 2, Queue: "events", Payload: []byte("a"), Retries: 3, CreatedAt: now, Dead: true, FailedAt: now, LastError: "boom"}}, messages)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestDeleteGroup(t *testing.T) {
+	c, mock, _ := newAdminTestClient(t)
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM consumer_group_offset WHERE stream = ? AND group_name = ?")).
+		WithArgs("events", "billing").
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM dead_stream_message WHERE stream = ? AND group_name = ?")).
+		WithArgs("events", "billing").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	require.NoError(t, c.DeleteGroup(context.Background(), "events", "billing"))
+	require.NoError(t, mock.ExpectationsWereMet())
+}
@@ -1,16 +1,60 @@
 package test
 
 import (
+	"fmt"
 	"regexp"
+	"strings"
 	"testing"
 
 	"github.com/DATA-DOG/go-sqlmock"
 )
 
-func ExpectSchema(t *testing.T, mock sqlmock.Sqlmock, schema []string) {
-	mock.ExpectBegin()
-	for _, stmt := range schema {
-		mock.ExpectExec(regexp.QuoteMeta(stmt)).WillReturnResult(sqlmock.NewResult(0, 0))
+// Migrations describes the statements a migration run is expected to execute
+type Migrations struct {
+	AcquireLock string
+	ReleaseLock string
+	// CreateSchema is the schema creation statement, if the tables are schema-qualified
+	CreateSchema string
+	VersionTable string
+	// VersionTableName is the qualified name of the version table
+	VersionTableName string
+	// Statements are the ordered migrations, as returned by the dialect
+	Statements [][]string
+	// Applied is the schema version the database is at before the run
+	Applied int
+}
+
+// Query returns a pattern matching q literally, with its placeholders in either the ? or $n bind style
+func Query(q string) string {
+	return strings.ReplaceAll(regexp.QuoteMeta(q), `\?`, `(?:\?|\$\d+)`)
+}
+
+func ExpectMigrations(t *testing.T, mock sqlmock.Sqlmock, m Migrations) {
+	mock.ExpectQuery(Query(m.AcquireLock)).WillReturnRows(sqlmock.NewRows([]string{"acquired"}).AddRow(1))
+	if m.CreateSchema != "" {
+		mock.ExpectExec(Query(m.CreateSchema)).WillReturnResult(sqlmock.NewResult(0, 0))
 	}
-	mock.ExpectCommit()
+	mock.ExpectExec(Query(m.VersionTable)).WillReturnResult(sqlmock.NewResult(0, 0))
+	applied := sqlmock.NewRows([]string{"version"})
+	if m.Applied > 0 {
+		applied.AddRow(m.Applied)
+	} else {
+		applied.AddRow(nil)
+	}
+	mock.ExpectQuery(Query("SELECT MAX(version) FROM " + m.VersionTableName)).WillReturnRows(applied)
+	for i := m.Applied; i < len(m.Statements); i++ {
+		mock.ExpectBegin()
+		for _, stmt := range m.Statements[i] {
+			mock.ExpectExec(Query(stmt)).WillReturnResult(sqlmock.NewResult(0, 0))
+		}
+		mock.ExpectExec(Query("INSERT INTO " + m.VersionTableName + " (version) VALUES (?)")).WithArgs(i + 1).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+	}
+	mock.ExpectExec(Query(m.ReleaseLock)).WillReturnResult(sqlmock.NewResult(0, 0))
+}
+
+// ExpectSchemaVersion expects a client created with migrations disabled to check that the schema is at version
+func ExpectSchemaVersion(mock sqlmock.Sqlmock, versionTableName string, version int) {
+	mock.ExpectQuery(Query(fmt.Sprintf("SELECT MAX(version) FROM %s", versionTableName))).
+		WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow(version))
 }
@@ -0,0 +1,37 @@
+package gq
+
+import (
+	"context"
+	"fmt"
+)
+
+// Subscribe subscribes queue to topic, so that every message subsequently published to the topic is also pushed onto the queue.
+// Each subscribed queue is consumed, retried and dead-lettered independently. Subscribing a queue which is already subscribed does nothing
+func (c *Client) Subscribe(ctx context.Context, topic string, queue string) error {
+	if topic == "" || queue == "" {
+		return fmt.Errorf("a topic and queue are required")
+	}
+	if _, err := c.db.ExecContext(ctx, c.db.Rebind(c.dialect.InsertSubscription), topic, queue); err != nil {
+		return fmt.Errorf("error subscribing queue '%s' to topic '%s': %s", queue, topic, err)
+	}
+	return nil
+}
+
+// Unsubscribe unsubscribes queue from topic. Messages already pushed onto the queue are kept
+func (c *Client) Unsubscribe(ctx context.Context, topic string, queue string) error {
+	query := c.db.Rebind(fmt.Sprintf("DELETE FROM %s WHERE topic = ? AND queue = ?", c.tables.Subscription))
+	if _, err := c.db.ExecContext(ctx, query, topic, queue); err != nil {
+		return fmt.Errorf("error unsubscribing queue '%s' from topic '%s': %s", queue, topic, err)
+	}
+	return nil
+}
+
+// Subscriptions returns the names of the queues subscribed to topic
+func (c *Client) Subscriptions(ctx context.Context, topic string) ([]string, error) {
+	queues := []string{}
+	query := c.db.Rebind(fmt.Sprintf("SELECT queue FROM %s WHERE topic = ? ORDER BY queue", c.tables.Subscription))
+	if err := c.db.SelectContext(ctx, &queues, query, topic); err != nil {
+		return nil, fmt.Errorf("error selecting subscriptions: %s", err)
+	}
+	return queues, nil
+}
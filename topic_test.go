@@ -0,0 +1,54 @@
+package gq
+
+import (
+	"context"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jmoiron/sqlx"
+	"github.com/mattbonnell/gq/internal"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSubscribe(t *testing.T) {
+	for driver, query := range map[string]string{
+		"mysql":    "INSERT IGNORE INTO subscription (topic, queue) VALUES (?, ?)",
+		"postgres": "INSERT INTO subscription (topic, queue) VALUES ($1, $2) ON CONFLICT DO NOTHING",
+	} {
+		t.Run(driver, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			require.NoError(t, err)
+			defer db.Close()
+			c := newTestClient(db)
+			c.db = sqlx.NewDb(db, driver)
+			c.dialect, err = internal.GetDialect(driver, internal.DefaultTables)
+			require.NoError(t, err)
+
+			mock.ExpectExec(regexp.QuoteMeta(query)).WithArgs("orders", "billing").WillReturnResult(sqlmock.NewResult(0, 1))
+			require.NoError(t, c.Subscribe(context.Background(), "orders", "billing"))
+			require.Error(t, c.Subscribe(context.Background(), "", "billing"))
+			require.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestUnsubscribeAndSubscriptions(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+	c := newTestClient(db)
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT queue FROM subscription WHERE topic = ? ORDER BY queue")).
+		WithArgs("orders").
+		WillReturnRows(sqlmock.NewRows([]string{"queue"}).AddRow("analytics").AddRow("billing"))
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM subscription WHERE topic = ? AND queue = ?")).
+		WithArgs("orders", "billing").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	queues, err := c.Subscriptions(context.Background(), "orders")
+	require.NoError(t, err)
+	require.Equal(t, []string{"analytics", "billing"}, queues)
+	require.NoError(t, c.Unsubscribe(context.Background(), "orders", "billing"))
+	require.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,28 @@
+package gq
+
+import "context"
+
+// Tracer instruments pushing and processing messages, propagating trace context from producers to consumers through message headers.
+// Implementations must be safe for concurrent use. See the gqotel package for an OpenTelemetry implementation
+type Tracer interface {
+	// Inject records the trace context carried by ctx in the headers of a message being pushed
+	Inject(ctx context.Context, headers map[string]string)
+	// StartPush is called before a batch of messages is pushed onto queue, with the headers of each message.
+	// The returned function is called with the result of the push
+	StartPush(ctx context.Context, queue string, headers []map[string]string) func(err error)
+	// StartProcess is called before a message is passed to the handler. The returned context is passed to the handler,
+	// and the returned function is called with the handler's result
+	StartProcess(ctx context.Context, m *Message) (context.Context, func(err error))
+}
+
+type nopTracer struct{}
+
+func (nopTracer) Inject(context.Context, map[string]string) {}
+
+func (nopTracer) StartPush(context.Context, string, []map[string]string) func(error) {
+	return func(error) {}
+}
+
+func (nopTracer) StartProcess(ctx context.Context, _ *Message) (context.Context, func(error)) {
+	return ctx, func(error) {}
+}
@@ -0,0 +1,256 @@
+package gq
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/mattbonnell/gq/internal"
+)
+
+// UniqueScope is how long a unique message's key is held, during which further pushes with the same key are duplicates
+type UniqueScope int
+
+const (
+	// UniqueWhileQueued holds the key until a consumer begins processing the message, so that at most one instance is waiting to run
+	UniqueWhileQueued UniqueScope = iota
+	// UniqueUntilProcessed holds the key until the message has been processed, or dead-lettered, so that at most one instance
+	// is waiting or running
+	UniqueUntilProcessed
+	// UniqueForWindow holds the key for a window of time after the message is pushed, whatever becomes of it
+	UniqueForWindow
+)
+
+// UniqueOptions represents the options which make a pushed message unique
+type UniqueOptions struct {
+	// Key identifies the job. It is unique within the producer's queue
+	Key string
+	// Scope is how long the key is held (default: UniqueWhileQueued)
+	Scope UniqueScope
+	// Window is how long the key is held with UniqueForWindow
+	Window time.Duration
+	// Replace coalesces a duplicate into the message holding the key, replacing its payload and headers, if that message
+	// hasn't begun processing (default: false, the duplicate is discarded)
+	Replace bool
+	// RerunAfter, with UniqueUntilProcessed, pushes a duplicate once the message holding the key finishes processing, if it is
+	// processing now. At most one rerun is kept, carrying the payload and headers of the latest duplicate (default: false)
+	RerunAfter bool
+}
+
+func (o UniqueOptions) validate() error {
+	if o.Key == "" {
+		return errors.New("a uniqueness key is required")
+	}
+	if o.Scope == UniqueForWindow && o.Window <= 0 {
+		return errors.New("a window is required with UniqueForWindow")
+	}
+	if o.RerunAfter && o.Scope != UniqueUntilProcessed {
+		return errors.New("RerunAfter requires UniqueUntilProcessed")
+	}
+	return nil
+}
+
+// PushUnique pushes a unique message onto the queue immediately, rather than in the producer's next batch, returning whether
+// it was pushed. It isn't pushed if another message holds its key, in which case it may be coalesced into that message or
+// kept to run after it, according to opts. Keys are held in a table whose primary key enforces their uniqueness
+func (p *Producer) PushUnique(ctx context.Context, message []byte, headers map[string]string, opts UniqueOptions) (bool, error) {
+	if p.opts.Topic != "" {
+		return false, errors.New("unique messages can't be published to a topic")
+	}
+	if err := opts.validate(); err != nil {
+		return false, err
+	}
+	return p.pushNow(ctx, headers, func(h internal.Headers) (bool, error) {
+		return p.pushUnique(ctx, message, h, opts)
+	})
+}
+
+// uniqueLock is the holder of a uniqueness key
+type uniqueLock struct {
+	MessageID int64        `db:"message_id"`
+	Scope     UniqueScope  `db:"scope"`
+	ExpiresAt sql.NullTime `db:"expires_at"`
+}
+
+func (p *Producer) pushUnique(ctx context.Context, message []byte, headers internal.Headers, opts UniqueOptions) (bool, error) {
+	now := p.now()
+	var expiresAt sql.NullTime
+	if opts.Scope == UniqueForWindow {
+		expiresAt = sql.NullTime{Time: now.Add(opts.Window), Valid: true}
+	}
+	tx, err := p.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return false, fmt.Errorf("error beginning unique push transaction: %s", err)
+	}
+	defer tx.Rollback()
+	// acquire the key by inserting it before the message, so that concurrent pushes wait on its primary key rather than deadlocking
+	if _, err := tx.ExecContext(ctx, tx.Rebind(p.dialect.InsertUniqueLock), p.opts.Queue, opts.Key, 0, opts.Scope, expiresAt); err != nil {
+		return false, fmt.Errorf("error acquiring uniqueness key: %s", err)
+	}
+	var lock uniqueLock
+	query := tx.Rebind(fmt.Sprintf("SELECT message_id, scope, expires_at FROM %s WHERE queue = ? AND unique_key = ? FOR UPDATE", p.tables.UniqueLock))
+	if err := tx.GetContext(ctx, &lock, query, p.opts.Queue, opts.Key); err != nil {
+		return false, fmt.Errorf("error selecting uniqueness key: %s", err)
+	}
+	if lock.MessageID == 0 {
+		// a key is only without a message until the transaction which inserted it commits, so this one did. Rows affected
+		// can't tell, as MySQL counts a duplicate's no-op update as a row found if the DSN sets clientFoundRows
+		return p.takeUniqueKey(ctx, tx, message, headers, opts, expiresAt, now)
+	}
+	state, err := p.messageState(ctx, tx, lock.MessageID, now)
+	if err != nil {
+		return false, err
+	}
+	held := false
+	switch lock.Scope {
+	case UniqueWhileQueued:
+		held = state == messageQueued
+	case UniqueUntilProcessed:
+		held = state != messageGone
+	case UniqueForWindow:
+		held = lock.ExpiresAt.Valid && now.Before(lock.ExpiresAt.Time)
+	}
+	if held {
+		switch {
+		case opts.Replace && state == messageQueued:
+			query := tx.Rebind(fmt.Sprintf("UPDATE %s SET payload = ?, headers = ? WHERE id = ?", p.tables.Message))
+			if _, err := tx.ExecContext(ctx, query, message, headers, lock.MessageID); err != nil {
+				return false, fmt.Errorf("error coalescing duplicate message: %s", err)
+			}
+		case opts.RerunAfter && state == messageRunning:
+			query := tx.Rebind(fmt.Sprintf("UPDATE %s SET rerun_payload = ?, rerun_headers = ? WHERE queue = ? AND unique_key = ?", p.tables.UniqueLock))
+			if _, err := tx.ExecContext(ctx, query, message, headers, p.opts.Queue, opts.Key); err != nil {
+				return false, fmt.Errorf("error scheduling rerun: %s", err)
+			}
+		default:
+			p.log.Debug("discarding duplicate unique message", "queue", p.opts.Queue, "key", opts.Key)
+			return false, nil
+		}
+		if err := tx.Commit(); err != nil {
+			return false, fmt.Errorf("error committing unique push transaction: %s", err)
+		}
+		return false, nil
+	}
+	// the key's holder has released it, so this message takes it over
+	return p.takeUniqueKey(ctx, tx, message, headers, opts, expiresAt, now)
+}
+
+// takeUniqueKey inserts a unique message and makes it the holder of its key, which tx has locked
+func (p *Producer) takeUniqueKey(ctx context.Context, tx *sqlx.Tx, message []byte, headers internal.Headers, opts UniqueOptions, expiresAt sql.NullTime, now time.Time) (bool, error) {
+	id, err := insertMessage(ctx, tx, p.dialect, p.tables, p.opts.Queue, message, headers, sql.NullString{String: opts.Key, Valid: true}, false, now)
+	if err != nil {
+		return false, err
+	}
+	query := tx.Rebind(fmt.Sprintf("UPDATE %s SET message_id = ?, scope = ?, expires_at = ?, rerun_payload = NULL, rerun_headers = NULL WHERE queue = ? AND unique_key = ?", p.tables.UniqueLock))
+	if _, err := tx.ExecContext(ctx, query, id, opts.Scope, expiresAt, p.opts.Queue, opts.Key); err != nil {
+		return false, fmt.Errorf("error acquiring uniqueness key: %s", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("error committing unique push transaction: %s", err)
+	}
+	return true, nil
+}
+
+type messageState int
+
+const (
+	messageQueued messageState = iota
+	messageRunning
+	messageGone
+)
+
+// messageState determines whether a message is waiting to be processed, being processed or gone. A message being processed by a
+// Consumer is locked by its transaction, and one being processed by a lease consumer carries an unexpired lease. A queued message
+// is locked by tx, so that it can be coalesced into
+func (p *Producer) messageState(ctx context.Context, tx *sqlx.Tx, id int64, now time.Time) (messageState, error) {
+	var found int64
+	query := tx.Rebind(fmt.Sprintf("SELECT id FROM %s WHERE id = ? AND (lease_token IS NULL OR ready_at <= ?) FOR UPDATE SKIP LOCKED", p.tables.Message))
+	err := tx.GetContext(ctx, &found, query, id, now)
+	if err == nil {
+		return messageQueued, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return 0, fmt.Errorf("error selecting unique message: %s", err)
+	}
+	var count int
+	query = tx.Rebind(fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE id = ?", p.tables.Message))
+	if err := tx.GetContext(ctx, &count, query, id); err != nil {
+		return 0, fmt.Errorf("error selecting unique message: %s", err)
+	}
+	if count > 0 {
+		return messageRunning, nil
+	}
+	return messageGone, nil
+}
+
+// insertMessage inserts a single message, returning its ID
+func insertMessage(ctx context.Context, tx *sqlx.Tx, d *internal.Dialect, tables internal.Tables, queue string, payload []byte, headers internal.Headers, uniqueKey sql.NullString, tracked bool, now time.Time) (int64, error) {
+	query := tx.Rebind(fmt.Sprintf("INSERT INTO %s (queue, payload, headers, unique_key, tracked, created_at, ready_at) VALUES (?, ?, ?, ?, ?, ?, ?)", tables.Message) + d.ReturningID)
+	if d.ReturningID != "" {
+		var id int64
+		if err := tx.QueryRowxContext(ctx, query, queue, payload, headers, uniqueKey, tracked, now, now).Scan(&id); err != nil {
+			return 0, fmt.Errorf("error INSERTING message: %s", err)
+		}
+		return id, nil
+	}
+	res, err := tx.ExecContext(ctx, query, queue, payload, headers, uniqueKey, tracked, now, now)
+	if err != nil {
+		return 0, fmt.Errorf("error INSERTING message: %s", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("error reading inserted message ID: %s", err)
+	}
+	return id, nil
+}
+
+// releaseUnique is called as unique messages with the given IDs are deleted once processed or dead-lettered. It pushes the reruns
+// requested while they were processing, which take over their keys, and deletes the other keys, unless their window is still open
+func releaseUnique(ctx context.Context, tx *sqlx.Tx, d *internal.Dialect, tables internal.Tables, ids []int64, now time.Time) error {
+	query, args, err := sqlx.In(fmt.Sprintf("SELECT queue, unique_key, rerun_payload, rerun_headers FROM %s WHERE message_id IN (?) AND rerun_payload IS NOT NULL FOR UPDATE", tables.UniqueLock), ids)
+	if err != nil {
+		return fmt.Errorf("error formulating rerun query: %s", err)
+	}
+	reruns := []struct {
+		Queue   string           `db:"queue"`
+		Key     string           `db:"unique_key"`
+		Payload []byte           `db:"rerun_payload"`
+		Headers internal.Headers `db:"rerun_headers"`
+	}{}
+	if err := tx.SelectContext(ctx, &reruns, tx.Rebind(query), args...); err != nil {
+		return fmt.Errorf("error selecting reruns: %s", err)
+	}
+	for _, r := range reruns {
+		id, err := insertMessage(ctx, tx, d, tables, r.Queue, r.Payload, r.Headers, sql.NullString{String: r.Key, Valid: true}, false, now)
+		if err != nil {
+			return err
+		}
+		query := tx.Rebind(fmt.Sprintf("UPDATE %s SET message_id = ?, rerun_payload = NULL, rerun_headers = NULL WHERE queue = ? AND unique_key = ?", tables.UniqueLock))
+		if _, err := tx.ExecContext(ctx, query, id, r.Queue, r.Key); err != nil {
+			return fmt.Errorf("error pushing rerun: %s", err)
+		}
+	}
+	// a rerun requested since the reruns were selected keeps its key, to be pushed by the next push with the key
+	query, args, err = sqlx.In(fmt.Sprintf("DELETE FROM %s WHERE message_id IN (?) AND rerun_payload IS NULL AND (expires_at IS NULL OR expires_at <= ?)", tables.UniqueLock), ids, now)
+	if err != nil {
+		return fmt.Errorf("error formulating unique key release query: %s", err)
+	}
+	if _, err := tx.ExecContext(ctx, tx.Rebind(query), args...); err != nil {
+		return fmt.Errorf("error releasing unique keys: %s", err)
+	}
+	return nil
+}
+
+// PurgeUniqueKeys deletes the uniqueness keys whose window has closed, and those left behind by messages deleted without being
+// processed, as by Purge, returning the number deleted. Keys are otherwise deleted as their messages are processed, so this only
+// needs to be run occasionally, like PurgeStatuses
+func (c *Client) PurgeUniqueKeys(ctx context.Context) (int64, error) {
+	n, err := c.exec(ctx, fmt.Sprintf("DELETE FROM %s WHERE expires_at <= ? OR (expires_at IS NULL AND message_id NOT IN (SELECT id FROM %s))", c.tables.UniqueLock, c.tables.Message), c.now())
+	if err != nil {
+		return 0, fmt.Errorf("error purging unique keys: %s", err)
+	}
+	return n, nil
+}
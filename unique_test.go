@@ -0,0 +1,193 @@
+package gq
+
+import (
+	"context"
+	"database/sql"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/require"
+)
+
+func newUniqueTestProducer(t *testing.T) (*Producer, sqlmock.Sqlmock, time.Time) {
+	c, mock, now := newAdminTestClient(t)
+	p, err := newProducer(context.Background(), c, &ProducerOptions{Queue: "jobs"})
+	require.NoError(t, err)
+	return p, mock, now
+}
+
+func expectUniqueLock(mock sqlmock.Sqlmock, acquired bool, lockRows *sqlmock.Rows) {
+	mock.ExpectBegin()
+	var affected int64
+	if acquired {
+		affected = 1
+		lockRows = sqlmock.NewRows([]string{"message_id", "scope", "expires_at"}).AddRow(0, UniqueWhileQueued, nil)
+	}
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO unique_lock (queue, unique_key, message_id, scope, expires_at) VALUES (?, ?, ?, ?, ?) ON DUPLICATE KEY UPDATE unique_key = unique_key")).
+		WillReturnResult(sqlmock.NewResult(0, affected))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT message_id, scope, expires_at FROM unique_lock WHERE queue = ? AND unique_key = ? FOR UPDATE")).
+		WithArgs("jobs", "report").
+		WillReturnRows(lockRows)
+}
+
+func expectMessageState(mock sqlmock.Sqlmock, now time.Time, queued bool, count int) {
+	probe := mock.ExpectQuery(regexp.QuoteMeta("SELECT id FROM message WHERE id = ? AND (lease_token IS NULL OR ready_at <= ?) FOR UPDATE SKIP LOCKED")).
+		WithArgs(3, now)
+	if queued {
+		probe.WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(3))
+		return
+	}
+	probe.WillReturnError(sql.ErrNoRows)
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(*) FROM message WHERE id = ?")).
+		WithArgs(3).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(count))
+}
+
+func expectTakeUniqueKey(mock sqlmock.Sqlmock, now time.Time, scope UniqueScope, expiresAt interface{}) {
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO message (queue, payload, headers, unique_key, tracked, created_at, ready_at) VALUES (?, ?, ?, ?, ?, ?, ?)")).
+		WithArgs("jobs", []byte("go"), nil, "report", false, now, now).
+		WillReturnResult(sqlmock.NewResult(4, 1))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE unique_lock SET message_id = ?, scope = ?, expires_at = ?, rerun_payload = NULL, rerun_headers = NULL WHERE queue = ? AND unique_key = ?")).
+		WithArgs(4, scope, expiresAt, "jobs", "report").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+}
+
+func lockRows(scope UniqueScope, expiresAt interface{}) *sqlmock.Rows {
+	return sqlmock.NewRows([]string{"message_id", "scope", "expires_at"}).AddRow(3, scope, expiresAt)
+}
+
+func TestPushUnique(t *testing.T) {
+	ctx := context.Background()
+	t.Run("acquired", func(t *testing.T) {
+		p, mock, now := newUniqueTestProducer(t)
+		expectUniqueLock(mock, true, nil)
+		expectTakeUniqueKey(mock, now, UniqueWhileQueued, nil)
+		pushed, err := p.PushUnique(ctx, []byte("go"), nil, UniqueOptions{Key: "report"})
+		require.NoError(t, err)
+		require.True(t, pushed)
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+	t.Run("duplicate discarded", func(t *testing.T) {
+		p, mock, now := newUniqueTestProducer(t)
+		expectUniqueLock(mock, false, lockRows(UniqueWhileQueued, nil))
+		expectMessageState(mock, now, true, 0)
+		mock.ExpectRollback()
+		pushed, err := p.PushUnique(ctx, []byte("go"), nil, UniqueOptions{Key: "report"})
+		require.NoError(t, err)
+		require.False(t, pushed)
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+	t.Run("duplicate found by the lock's update", func(t *testing.T) {
+		// MySQL reports the held key's exclusive lock as a row affected if the DSN sets clientFoundRows
+		p, mock, now := newUniqueTestProducer(t)
+		mock.ExpectBegin()
+		mock.ExpectExec(regexp.QuoteMeta("INSERT INTO unique_lock (queue, unique_key, message_id, scope, expires_at) VALUES (?, ?, ?, ?, ?) ON DUPLICATE KEY UPDATE unique_key = unique_key")).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT message_id, scope, expires_at FROM unique_lock WHERE queue = ? AND unique_key = ? FOR UPDATE")).
+			WithArgs("jobs", "report").
+			WillReturnRows(lockRows(UniqueWhileQueued, nil))
+		expectMessageState(mock, now, true, 0)
+		mock.ExpectRollback()
+		pushed, err := p.PushUnique(ctx, []byte("go"), nil, UniqueOptions{Key: "report"})
+		require.NoError(t, err)
+		require.False(t, pushed)
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+	t.Run("duplicate coalesced", func(t *testing.T) {
+		p, mock, now := newUniqueTestProducer(t)
+		expectUniqueLock(mock, false, lockRows(UniqueUntilProcessed, nil))
+		expectMessageState(mock, now, true, 0)
+		mock.ExpectExec(regexp.QuoteMeta("UPDATE message SET payload = ?, headers = ? WHERE id = ?")).
+			WithArgs([]byte("go"), `{"k":"v"}`, 3).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+		pushed, err := p.PushUnique(ctx, []byte("go"), map[string]string{"k": "v"}, UniqueOptions{Key: "report", Scope: UniqueUntilProcessed, Replace: true})
+		require.NoError(t, err)
+		require.False(t, pushed)
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+	t.Run("rerun after running", func(t *testing.T) {
+		p, mock, now := newUniqueTestProducer(t)
+		expectUniqueLock(mock, false, lockRows(UniqueUntilProcessed, nil))
+		expectMessageState(mock, now, false, 1)
+		mock.ExpectExec(regexp.QuoteMeta("UPDATE unique_lock SET rerun_payload = ?, rerun_headers = ? WHERE queue = ? AND unique_key = ?")).
+			WithArgs([]byte("go"), nil, "jobs", "report").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+		pushed, err := p.PushUnique(ctx, []byte("go"), nil, UniqueOptions{Key: "report", Scope: UniqueUntilProcessed, RerunAfter: true})
+		require.NoError(t, err)
+		require.False(t, pushed)
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+	t.Run("released by running message", func(t *testing.T) {
+		p, mock, now := newUniqueTestProducer(t)
+		expectUniqueLock(mock, false, lockRows(UniqueWhileQueued, nil))
+		expectMessageState(mock, now, false, 1)
+		expectTakeUniqueKey(mock, now, UniqueWhileQueued, nil)
+		pushed, err := p.PushUnique(ctx, []byte("go"), nil, UniqueOptions{Key: "report"})
+		require.NoError(t, err)
+		require.True(t, pushed)
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+	t.Run("window expired", func(t *testing.T) {
+		p, mock, now := newUniqueTestProducer(t)
+		expectUniqueLock(mock, false, lockRows(UniqueForWindow, now.Add(-time.Second)))
+		expectMessageState(mock, now, false, 0)
+		expectTakeUniqueKey(mock, now, UniqueForWindow, now.Add(time.Hour))
+		pushed, err := p.PushUnique(ctx, []byte("go"), nil, UniqueOptions{Key: "report", Scope: UniqueForWindow, Window: time.Hour})
+		require.NoError(t, err)
+		require.True(t, pushed)
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func TestPushUnique_Invalid(t *testing.T) {
+	p, _, _ := newUniqueTestProducer(t)
+	for _, opts := range []UniqueOptions{
+		{},
+		{Key: "report", Scope: UniqueForWindow},
+		{Key: "report", RerunAfter: true},
+	} {
+		_, err := p.PushUnique(context.Background(), []byte("go"), nil, opts)
+		require.Error(t, err)
+	}
+}
+
+func TestReleaseUnique(t *testing.T) {
+	c, mock, now := newAdminTestClient(t)
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT queue, unique_key, rerun_payload, rerun_headers FROM unique_lock WHERE message_id IN (?, ?) AND rerun_payload IS NOT NULL FOR UPDATE")).
+		WithArgs(3, 5).
+		WillReturnRows(sqlmock.NewRows([]string{"queue", "unique_key", "rerun_payload", "rerun_headers"}).AddRow("jobs", "report", []byte("go"), nil))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO message (queue, payload, headers, unique_key, tracked, created_at, ready_at) VALUES (?, ?, ?, ?, ?, ?, ?)")).
+		WithArgs("jobs", []byte("go"), nil, "report", false, now, now).
+		WillReturnResult(sqlmock.NewResult(4, 1))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE unique_lock SET message_id = ?, rerun_payload = NULL, rerun_headers = NULL WHERE queue = ? AND unique_key = ?")).
+		WithArgs(4, "jobs", "report").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	// message 5's key has no rerun, so it is deleted
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM unique_lock WHERE message_id IN (?, ?) AND rerun_payload IS NULL AND (expires_at IS NULL OR expires_at <= ?)")).
+		WithArgs(3, 5, now).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	tx, err := c.db.BeginTxx(context.Background(), nil)
+	require.NoError(t, err)
+	require.NoError(t, releaseUnique(context.Background(), tx, c.dialect, c.tables, []int64{3, 5}, now))
+	require.NoError(t, tx.Commit())
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestPurgeUniqueKeys(t *testing.T) {
+	c, mock, now := newAdminTestClient(t)
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM unique_lock WHERE expires_at <= ? OR (expires_at IS NULL AND message_id NOT IN (SELECT id FROM message))")).
+		WithArgs(now).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	n, err := c.PurgeUniqueKeys(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, int64(2), n)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
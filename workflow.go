@@ -0,0 +1,360 @@
+package gq
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/mattbonnell/gq/internal"
+)
+
+const (
+	// WorkflowHeader is the header which carries the ID of the workflow a task or completion callback belongs to
+	WorkflowHeader = "gq-workflow"
+	// WorkflowStateHeader is the header which carries the final state of a workflow, "succeeded" or "failed", to its completion callback
+	WorkflowStateHeader = "gq-workflow-state"
+	// onCompleteStep is the step a workflow's completion callback is stored under
+	onCompleteStep = -1
+)
+
+// Task is a message to be pushed as part of a workflow
+type Task struct {
+	// Queue is the name of the queue to push the task onto (default: "default")
+	Queue string
+	// Payload is the task's payload
+	Payload []byte
+	// Headers are the task's headers, to which the workflow's ID is added
+	Headers map[string]string
+}
+
+// Workflow is a pipeline of tasks, run in steps. The tasks of each step are pushed together, and may run in parallel; those of
+// the next step are pushed once all of them have succeeded. If any task fails, having exhausted its retries, the workflow fails
+// once the rest of its step has finished, and its later steps are never pushed
+type Workflow struct {
+	// Steps are the workflow's steps, each of which must have at least one task
+	Steps [][]Task
+	// OnComplete, if set, is pushed once the workflow has succeeded or failed. Its WorkflowStateHeader says which
+	OnComplete *Task
+}
+
+// Chain returns a workflow which runs tasks one after another, each once the one before has succeeded
+func Chain(tasks ...Task) Workflow {
+	steps := make([][]Task, len(tasks))
+	for i, t := range tasks {
+		steps[i] = []Task{t}
+	}
+	return Workflow{Steps: steps}
+}
+
+// Group returns a workflow which runs tasks in parallel. Set its OnComplete to push a task once they have all finished
+func Group(tasks ...Task) Workflow {
+	return Workflow{Steps: [][]Task{tasks}}
+}
+
+// Then returns a workflow which runs the steps of next once those of w have succeeded. Its OnComplete is next's, if set
+func (w Workflow) Then(next Workflow) Workflow {
+	steps := make([][]Task, 0, len(w.Steps)+len(next.Steps))
+	w.Steps = append(append(steps, w.Steps...), next.Steps...)
+	if next.OnComplete != nil {
+		w.OnComplete = next.OnComplete
+	}
+	return w
+}
+
+// WorkflowStatus is the progress of a workflow
+type WorkflowStatus struct {
+	// ID is the workflow's ID
+	ID string `json:"id"`
+	// State is JobRunning until the workflow has succeeded or failed
+	State JobState `json:"state"`
+	// Step is the index of the step being run, or the last one run once the workflow has finished
+	Step int `json:"step"`
+	// Steps is the number of steps in the workflow
+	Steps int `json:"steps"`
+	// Total is the number of tasks in the workflow, not counting its completion callback
+	Total int `json:"total"`
+	// Pending is the number of tasks of the current step which have yet to succeed or fail
+	Pending int `json:"pending"`
+	// Succeeded is the number of tasks which have succeeded
+	Succeeded int `json:"succeeded"`
+	// Failed is the number of tasks which have failed
+	Failed int `json:"failed"`
+	// CreatedAt is the time the workflow was started
+	CreatedAt time.Time `json:"created_at"`
+	// FinishedAt is the time the workflow succeeded or failed, or the zero time if it hasn't yet
+	FinishedAt time.Time `json:"finished_at"`
+}
+
+// workflowRow is a workflow as selected from the database
+type workflowRow struct {
+	ID         string        `db:"id"`
+	State      JobState      `db:"state"`
+	Step       int           `db:"step"`
+	Steps      int           `db:"steps"`
+	Total      int           `db:"total"`
+	Pending    int           `db:"pending"`
+	Succeeded  int           `db:"succeeded"`
+	Failed     int           `db:"failed"`
+	CreatedAt  internal.Time `db:"created_at"`
+	FinishedAt internal.Time `db:"finished_at"`
+}
+
+const workflowColumns = "id, state, step, steps, total, pending, succeeded, failed, created_at, finished_at"
+
+// StartWorkflow pushes the tasks of a workflow's first step, and persists the rest of the workflow so that it is advanced by
+// whichever consumers process its tasks, returning the workflow's ID. Tasks are tracked, so their statuses can be read with
+// Client.Status and are kept until purged with Client.PurgeStatuses
+func (c *Client) StartWorkflow(ctx context.Context, w Workflow) (string, error) {
+	if len(w.Steps) == 0 {
+		return "", errors.New("a workflow requires at least one step")
+	}
+	total := 0
+	for i, step := range w.Steps {
+		if len(step) == 0 {
+			return "", fmt.Errorf("step %d of the workflow has no tasks", i)
+		}
+		total += len(step)
+	}
+	id, err := newToken()
+	if err != nil {
+		return "", fmt.Errorf("error generating workflow ID: %s", err)
+	}
+	now := c.now()
+	updates := newWorkflowUpdates(ctx, c.opts.Tracer)
+	tx, err := c.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return "", fmt.Errorf("error beginning workflow transaction: %s", err)
+	}
+	defer tx.Rollback()
+	query := tx.Rebind(fmt.Sprintf("INSERT INTO %s (id, state, step, steps, total, pending, succeeded, failed, created_at) VALUES (?, ?, 0, ?, ?, ?, 0, 0, ?)", c.tables.Workflow))
+	if _, err := tx.ExecContext(ctx, query, id, JobRunning, len(w.Steps), total, len(w.Steps[0]), now); err != nil {
+		return "", fmt.Errorf("error inserting workflow: %s", err)
+	}
+	query = tx.Rebind(fmt.Sprintf("INSERT INTO %s (workflow_id, step, position, queue, payload, headers) VALUES (?, ?, ?, ?, ?, ?)", c.tables.WorkflowTask))
+	store := func(step int, position int, t Task) error {
+		h := internal.Headers{}
+		for k, v := range t.Headers {
+			h[k] = v
+		}
+		c.opts.Tracer.Inject(ctx, h)
+		if t.Payload == nil {
+			t.Payload = []byte{}
+		}
+		if _, err := tx.ExecContext(ctx, query, id, step, position, queueOrDefault(t.Queue), t.Payload, h); err != nil {
+			return fmt.Errorf("error inserting workflow task: %s", err)
+		}
+		return nil
+	}
+	for i, step := range w.Steps {
+		for j, t := range step {
+			if err := store(i, j, t); err != nil {
+				return "", err
+			}
+		}
+	}
+	if w.OnComplete != nil {
+		if err := store(onCompleteStep, 0, *w.OnComplete); err != nil {
+			return "", err
+		}
+	}
+	if _, err := pushStep(ctx, tx, c.dialect, c.tables, updates, id, 0, nil, now); err != nil {
+		updates.report(c.opts.Metrics, err)
+		return "", err
+	}
+	err = tx.Commit()
+	updates.report(c.opts.Metrics, err)
+	if err != nil {
+		return "", fmt.Errorf("error committing workflow transaction: %s", err)
+	}
+	return id, nil
+}
+
+// Workflow returns the progress of a workflow, or ErrNotFound if there is no workflow with that ID
+func (c *Client) Workflow(ctx context.Context, id string) (*WorkflowStatus, error) {
+	r := workflowRow{}
+	query := c.db.Rebind(fmt.Sprintf("SELECT %s FROM %s WHERE id = ?", workflowColumns, c.tables.Workflow))
+	err := c.db.GetContext(ctx, &r, query, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error selecting workflow: %s", err)
+	}
+	return &WorkflowStatus{
+		ID:         r.ID,
+		State:      r.State,
+		Step:       r.Step,
+		Steps:      r.Steps,
+		Total:      r.Total,
+		Pending:    r.Pending,
+		Succeeded:  r.Succeeded,
+		Failed:     r.Failed,
+		CreatedAt:  r.CreatedAt.Time,
+		FinishedAt: r.FinishedAt.Time,
+	}, nil
+}
+
+// PurgeWorkflows deletes the workflows which finished before the given time, returning the number deleted.
+// The statuses of their tasks are purged by Client.PurgeStatuses
+func (c *Client) PurgeWorkflows(ctx context.Context, before time.Time) (int64, error) {
+	return c.exec(ctx, fmt.Sprintf("DELETE FROM %s WHERE finished_at < ?", c.tables.Workflow), before.UTC())
+}
+
+// workflowUpdates collects the workflow tasks which finish within a transaction, and the tasks pushed as their workflows advance.
+// The workflows are advanced once the transaction's other work is done, in ID order, so that transactions finishing tasks of the
+// same workflows lock them in the same order rather than deadlocking. The tasks pushed are reported to the tracer and metrics
+// with the result of the transaction, as the producer's pushes are
+type workflowUpdates struct {
+	ctx      context.Context
+	tracer   Tracer
+	start    time.Time
+	finished []finishedTask
+	pushed   map[string]int
+	ends     []func(error)
+}
+
+// finishedTask is a workflow task which has succeeded or failed
+type finishedTask struct {
+	workflowID string
+	succeeded  bool
+}
+
+func newWorkflowUpdates(ctx context.Context, tracer Tracer) *workflowUpdates {
+	return &workflowUpdates{ctx: ctx, tracer: tracer, start: time.Now(), pushed: map[string]int{}}
+}
+
+// finish records that a task of the workflow with the given ID has succeeded or failed
+func (u *workflowUpdates) finish(id string, succeeded bool) {
+	u.finished = append(u.finished, finishedTask{workflowID: id, succeeded: succeeded})
+}
+
+// advance advances the workflows of the finished tasks, in ID order
+func (u *workflowUpdates) advance(ctx context.Context, tx *sqlx.Tx, d *internal.Dialect, tables internal.Tables, now time.Time) error {
+	sort.SliceStable(u.finished, func(i, j int) bool { return u.finished[i].workflowID < u.finished[j].workflowID })
+	for _, t := range u.finished {
+		if err := advanceWorkflow(ctx, tx, d, tables, u, t.workflowID, t.succeeded, now); err != nil {
+			return err
+		}
+	}
+	u.finished = nil
+	return nil
+}
+
+// pushing is called before a task is pushed onto queue, with its headers
+func (u *workflowUpdates) pushing(queue string, headers map[string]string) {
+	u.ends = append(u.ends, u.tracer.StartPush(u.ctx, queue, []map[string]string{headers}))
+	u.pushed[queue]++
+}
+
+// report ends the spans of the tasks pushed with the result of their transaction, and records them as pushed
+func (u *workflowUpdates) report(metrics Metrics, err error) {
+	for _, end := range u.ends {
+		end(err)
+	}
+	outcome := OutcomeSuccess
+	if err != nil {
+		outcome = OutcomeError
+	}
+	duration := time.Since(u.start)
+	for queue, n := range u.pushed {
+		metrics.MessagesPushed(queue, n, outcome, duration)
+	}
+	u.ends, u.pushed = nil, map[string]int{}
+}
+
+// pushStep pushes the stored tasks of a workflow's step, adding the workflow's ID and extra to their headers, and deletes them
+// from the task table. Tasks are tracked, but the completion callback isn't. It returns the number of tasks pushed
+func pushStep(ctx context.Context, tx *sqlx.Tx, d *internal.Dialect, tables internal.Tables, u *workflowUpdates, id string, step int, extra map[string]string, now time.Time) (int, error) {
+	tasks := []struct {
+		Queue   string           `db:"queue"`
+		Payload []byte           `db:"payload"`
+		Headers internal.Headers `db:"headers"`
+	}{}
+	query := tx.Rebind(fmt.Sprintf("SELECT queue, payload, headers FROM %s WHERE workflow_id = ? AND step = ? ORDER BY position", tables.WorkflowTask))
+	if err := tx.SelectContext(ctx, &tasks, query, id, step); err != nil {
+		return 0, fmt.Errorf("error selecting workflow tasks: %s", err)
+	}
+	for _, t := range tasks {
+		if t.Headers == nil {
+			t.Headers = internal.Headers{}
+		}
+		for k, v := range extra {
+			t.Headers[k] = v
+		}
+		t.Headers[WorkflowHeader] = id
+		u.pushing(t.Queue, t.Headers)
+		if step == onCompleteStep {
+			_, err := insertMessage(ctx, tx, d, tables, t.Queue, t.Payload, t.Headers, sql.NullString{}, false, now)
+			if err != nil {
+				return 0, err
+			}
+		} else if _, err := insertTracked(ctx, tx, d, tables, t.Queue, t.Payload, t.Headers, sql.NullTime{}, sql.NullString{String: id, Valid: true}, now); err != nil {
+			return 0, err
+		}
+	}
+	query = tx.Rebind(fmt.Sprintf("DELETE FROM %s WHERE workflow_id = ? AND step = ?", tables.WorkflowTask))
+	if _, err := tx.ExecContext(ctx, query, id, step); err != nil {
+		return 0, fmt.Errorf("error deleting pushed workflow tasks: %s", err)
+	}
+	return len(tasks), nil
+}
+
+// advanceWorkflow records that one of a workflow's tasks has succeeded or failed, in the transaction which completed the task.
+// Once every task of the current step has finished, it pushes the next step, or finishes the workflow and pushes its
+// completion callback. The workflow is locked until tx commits, so that concurrent completions are counted exactly once
+func advanceWorkflow(ctx context.Context, tx *sqlx.Tx, d *internal.Dialect, tables internal.Tables, u *workflowUpdates, id string, succeeded bool, now time.Time) error {
+	w := workflowRow{}
+	query := tx.Rebind(fmt.Sprintf("SELECT %s FROM %s WHERE id = ? FOR UPDATE", workflowColumns, tables.Workflow))
+	err := tx.GetContext(ctx, &w, query, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		// the workflow has been purged
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error selecting workflow: %s", err)
+	}
+	if w.State != JobRunning {
+		return nil
+	}
+	w.Pending--
+	if succeeded {
+		w.Succeeded++
+	} else {
+		w.Failed++
+	}
+	var finishedAt sql.NullTime
+	if w.Pending <= 0 {
+		switch {
+		case w.Failed > 0:
+			w.State = JobFailed
+		case w.Step+1 < w.Steps:
+			w.Step++
+			pushed, err := pushStep(ctx, tx, d, tables, u, id, w.Step, nil, now)
+			if err != nil {
+				return err
+			}
+			w.Pending = pushed
+		default:
+			w.State = JobSucceeded
+		}
+	}
+	if w.State.Done() {
+		finishedAt = sql.NullTime{Time: now, Valid: true}
+		if _, err := pushStep(ctx, tx, d, tables, u, id, onCompleteStep, map[string]string{WorkflowStateHeader: w.State.String()}, now); err != nil {
+			return err
+		}
+		query := tx.Rebind(fmt.Sprintf("DELETE FROM %s WHERE workflow_id = ?", tables.WorkflowTask))
+		if _, err := tx.ExecContext(ctx, query, id); err != nil {
+			return fmt.Errorf("error deleting workflow tasks: %s", err)
+		}
+	}
+	query = tx.Rebind(fmt.Sprintf("UPDATE %s SET state = ?, step = ?, pending = ?, succeeded = ?, failed = ?, finished_at = ? WHERE id = ?", tables.Workflow))
+	if _, err := tx.ExecContext(ctx, query, w.State, w.Step, w.Pending, w.Succeeded, w.Failed, finishedAt, id); err != nil {
+		return fmt.Errorf("error advancing workflow: %s", err)
+	}
+	return nil
+}
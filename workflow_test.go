@@ -0,0 +1,204 @@
+package gq
+
+import (
+	"context"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/require"
+)
+
+var workflowRowColumns = []string{"id", "state", "step", "steps", "total", "pending", "succeeded", "failed", "created_at", "finished_at"}
+
+func TestWorkflowBuilders(t *testing.T) {
+	a, b, c := Task{Queue: "a"}, Task{Queue: "b"}, Task{Queue: "c"}
+	require.Equal(t, Workflow{Steps: [][]Task{{a}, {b}}}, Chain(a, b))
+	require.Equal(t, Workflow{Steps: [][]Task{{a, b}}}, Group(a, b))
+	w := Group(a, b)
+	w.OnComplete = &c
+	require.Equal(t, Workflow{Steps: [][]Task{{a}, {a, b}}, OnComplete: &c}, Chain(a).Then(w))
+}
+
+func expectPushStep(mock sqlmock.Sqlmock, now time.Time, step int, queues ...string) {
+	rows := sqlmock.NewRows([]string{"queue", "payload", "headers"})
+	for _, q := range queues {
+		rows.AddRow(q, []byte(q), nil)
+	}
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT queue, payload, headers FROM workflow_task WHERE workflow_id = ? AND step = ? ORDER BY position")).
+		WithArgs("wf", step).
+		WillReturnRows(rows)
+	for i, q := range queues {
+		headers := `{"gq-workflow":"wf"}`
+		if step == onCompleteStep {
+			headers = `{"gq-workflow":"wf","gq-workflow-state":"succeeded"}`
+			mock.ExpectExec(regexp.QuoteMeta("INSERT INTO message (queue, payload, headers, unique_key, tracked, created_at, ready_at)")).
+				WithArgs(q, []byte(q), headers, nil, false, now, now).
+				WillReturnResult(sqlmock.NewResult(int64(10+i), 1))
+			continue
+		}
+		mock.ExpectExec(regexp.QuoteMeta("INSERT INTO message (queue, payload, headers, unique_key, tracked, created_at, ready_at)")).
+			WithArgs(q, []byte(q), headers, nil, true, now, now).
+			WillReturnResult(sqlmock.NewResult(int64(10+i), 1))
+		mock.ExpectExec(regexp.QuoteMeta("INSERT INTO job_status")).
+			WithArgs(10+i, q, JobQueued, now, nil, "wf").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM workflow_task WHERE workflow_id = ? AND step = ?")).
+		WithArgs("wf", step).
+		WillReturnResult(sqlmock.NewResult(0, int64(len(queues))))
+}
+
+func TestStartWorkflow(t *testing.T) {
+	c, mock, now := newAdminTestClient(t)
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO workflow (id, state, step, steps, total, pending, succeeded, failed, created_at) VALUES (?, ?, 0, ?, ?, ?, 0, 0, ?)")).
+		WithArgs(sqlmock.AnyArg(), JobRunning, 2, 3, 2, now).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	insertTask := regexp.QuoteMeta("INSERT INTO workflow_task (workflow_id, step, position, queue, payload, headers) VALUES (?, ?, ?, ?, ?, ?)")
+	mock.ExpectExec(insertTask).WithArgs(sqlmock.AnyArg(), 0, 0, "shards", []byte("1"), nil).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(insertTask).WithArgs(sqlmock.AnyArg(), 0, 1, "shards", []byte("2"), nil).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(insertTask).WithArgs(sqlmock.AnyArg(), 1, 0, "merge", []byte{}, nil).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(insertTask).WithArgs(sqlmock.AnyArg(), onCompleteStep, 0, "notify", []byte{}, nil).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT queue, payload, headers FROM workflow_task WHERE workflow_id = ? AND step = ?")).
+		WithArgs(sqlmock.AnyArg(), 0).
+		WillReturnRows(sqlmock.NewRows([]string{"queue", "payload", "headers"}).AddRow("shards", []byte("1"), nil).AddRow("shards", []byte("2"), nil))
+	for i := 0; i < 2; i++ {
+		mock.ExpectExec(regexp.QuoteMeta("INSERT INTO message")).WillReturnResult(sqlmock.NewResult(int64(i+1), 1))
+		mock.ExpectExec(regexp.QuoteMeta("INSERT INTO job_status")).WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM workflow_task WHERE workflow_id = ? AND step = ?")).WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectCommit()
+
+	w := Group(Task{Queue: "shards", Payload: []byte("1")}, Task{Queue: "shards", Payload: []byte("2")}).Then(Chain(Task{Queue: "merge"}))
+	w.OnComplete = &Task{Queue: "notify"}
+	id, err := c.StartWorkflow(context.Background(), w)
+	require.NoError(t, err)
+	require.Len(t, id, 32)
+	require.NoError(t, mock.ExpectationsWereMet())
+
+	_, err = c.StartWorkflow(context.Background(), Workflow{})
+	require.Error(t, err)
+	_, err = c.StartWorkflow(context.Background(), Workflow{Steps: [][]Task{{}}})
+	require.Error(t, err)
+}
+
+func TestAdvanceWorkflow(t *testing.T) {
+	selectWorkflow := regexp.QuoteMeta("SELECT id, state, step, steps, total, pending, succeeded, failed, created_at, finished_at FROM workflow WHERE id = ? FOR UPDATE")
+	updateWorkflow := regexp.QuoteMeta("UPDATE workflow SET state = ?, step = ?, pending = ?, succeeded = ?, failed = ?, finished_at = ? WHERE id = ?")
+	advance := func(t *testing.T, c *Client, now time.Time, succeeded bool) {
+		tx, err := c.db.BeginTxx(context.Background(), nil)
+		require.NoError(t, err)
+		require.NoError(t, advanceWorkflow(context.Background(), tx, c.dialect, c.tables, newWorkflowUpdates(context.Background(), nopTracer{}), "wf", succeeded, now))
+		require.NoError(t, tx.Commit())
+	}
+
+	t.Run("step pending", func(t *testing.T) {
+		c, mock, now := newAdminTestClient(t)
+		mock.ExpectBegin()
+		mock.ExpectQuery(selectWorkflow).WithArgs("wf").
+			WillReturnRows(sqlmock.NewRows(workflowRowColumns).AddRow("wf", JobRunning, 0, 2, 3, 2, 0, 0, now, nil))
+		mock.ExpectExec(updateWorkflow).WithArgs(JobRunning, 0, 1, 1, 0, nil, "wf").WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+		advance(t, c, now, true)
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+	t.Run("next step", func(t *testing.T) {
+		c, mock, now := newAdminTestClient(t)
+		mock.ExpectBegin()
+		mock.ExpectQuery(selectWorkflow).WithArgs("wf").
+			WillReturnRows(sqlmock.NewRows(workflowRowColumns).AddRow("wf", JobRunning, 0, 2, 3, 1, 1, 0, now, nil))
+		expectPushStep(mock, now, 1, "merge")
+		mock.ExpectExec(updateWorkflow).WithArgs(JobRunning, 1, 1, 2, 0, nil, "wf").WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+		advance(t, c, now, true)
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+	t.Run("succeeded", func(t *testing.T) {
+		c, mock, now := newAdminTestClient(t)
+		mock.ExpectBegin()
+		mock.ExpectQuery(selectWorkflow).WithArgs("wf").
+			WillReturnRows(sqlmock.NewRows(workflowRowColumns).AddRow("wf", JobRunning, 1, 2, 3, 1, 2, 0, now, nil))
+		expectPushStep(mock, now, onCompleteStep, "notify")
+		mock.ExpectExec(regexp.QuoteMeta("DELETE FROM workflow_task WHERE workflow_id = ?")).WithArgs("wf").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec(updateWorkflow).WithArgs(JobSucceeded, 1, 0, 3, 0, now, "wf").WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+		advance(t, c, now, true)
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+	t.Run("failed", func(t *testing.T) {
+		c, mock, now := newAdminTestClient(t)
+		mock.ExpectBegin()
+		mock.ExpectQuery(selectWorkflow).WithArgs("wf").
+			WillReturnRows(sqlmock.NewRows(workflowRowColumns).AddRow("wf", JobRunning, 0, 2, 3, 1, 1, 0, now, nil))
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT queue, payload, headers FROM workflow_task WHERE workflow_id = ? AND step = ?")).
+			WithArgs("wf", onCompleteStep).
+			WillReturnRows(sqlmock.NewRows([]string{"queue", "payload", "headers"}))
+		mock.ExpectExec(regexp.QuoteMeta("DELETE FROM workflow_task WHERE workflow_id = ? AND step = ?")).WithArgs("wf", onCompleteStep).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec(regexp.QuoteMeta("DELETE FROM workflow_task WHERE workflow_id = ?")).WithArgs("wf").WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(updateWorkflow).WithArgs(JobFailed, 0, 0, 1, 1, now, "wf").WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+		advance(t, c, now, false)
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func TestWorkflowStatus(t *testing.T) {
+	c, mock, now := newAdminTestClient(t)
+	query := regexp.QuoteMeta("SELECT id, state, step, steps, total, pending, succeeded, failed, created_at, finished_at FROM workflow WHERE id = ?")
+	mock.ExpectQuery(query).WithArgs("wf").
+		WillReturnRows(sqlmock.NewRows(workflowRowColumns).AddRow("wf", JobRunning, 0, 2, 501, 499, 1, 0, now, nil))
+	status, err := c.Workflow(context.Background(), "wf")
+	require.NoError(t, err)
+	require.Equal(t, &WorkflowStatus{ID: "wf", State: JobRunning, Steps: 2, Total: 501, Pending: 499, Succeeded: 1, CreatedAt: now}, status)
+
+	mock.ExpectQuery(query).WithArgs("none").WillReturnRows(sqlmock.NewRows(workflowRowColumns))
+	_, err = c.Workflow(context.Background(), "none")
+	require.ErrorIs(t, err, ErrNotFound)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+// recordingTracer records the queues of the messages whose pushes it traces, and the results of the pushes
+type recordingTracer struct {
+	nopTracer
+	pushed  []string
+	results []error
+}
+
+func (r *recordingTracer) StartPush(ctx context.Context, queue string, headers []map[string]string) func(error) {
+	r.pushed = append(r.pushed, queue)
+	return func(err error) { r.results = append(r.results, err) }
+}
+
+func TestWorkflowUpdates(t *testing.T) {
+	c, mock, now := newAdminTestClient(t)
+	selectWorkflow := regexp.QuoteMeta("SELECT id, state, step, steps, total, pending, succeeded, failed, created_at, finished_at FROM workflow WHERE id = ? FOR UPDATE")
+	updateWorkflow := regexp.QuoteMeta("UPDATE workflow SET state = ?, step = ?, pending = ?, succeeded = ?, failed = ?, finished_at = ? WHERE id = ?")
+	tracer, metrics := &recordingTracer{}, newRecordingMetrics()
+	updates := newWorkflowUpdates(context.Background(), tracer)
+	updates.finish("wf2", true)
+	updates.finish("wf", true)
+
+	// the workflows are locked in ID order, whatever order their tasks finished in
+	mock.ExpectBegin()
+	mock.ExpectQuery(selectWorkflow).WithArgs("wf").
+		WillReturnRows(sqlmock.NewRows(workflowRowColumns).AddRow("wf", JobRunning, 0, 2, 2, 1, 0, 0, now, nil))
+	expectPushStep(mock, now, 1, "merge")
+	mock.ExpectExec(updateWorkflow).WithArgs(JobRunning, 1, 1, 1, 0, nil, "wf").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(selectWorkflow).WithArgs("wf2").
+		WillReturnRows(sqlmock.NewRows(workflowRowColumns).AddRow("wf2", JobRunning, 0, 1, 2, 2, 0, 0, now, nil))
+	mock.ExpectExec(updateWorkflow).WithArgs(JobRunning, 0, 1, 1, 0, nil, "wf2").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	tx, err := c.db.BeginTxx(context.Background(), nil)
+	require.NoError(t, err)
+	require.NoError(t, updates.advance(context.Background(), tx, c.dialect, c.tables, now))
+	err = tx.Commit()
+	require.NoError(t, err)
+	updates.report(metrics, err)
+	require.NoError(t, mock.ExpectationsWereMet())
+	require.Equal(t, []string{"merge"}, tracer.pushed)
+	require.Equal(t, []error{nil}, tracer.results)
+	require.Equal(t, map[Outcome]int{OutcomeSuccess: 1}, metrics.pushed)
+}